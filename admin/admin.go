@@ -0,0 +1,379 @@
+// Package admin is an HTTP handler to operate an outbox from within a running service.
+//
+// The handler can be mounted on any path, for example:
+//
+//	http.Handle("/outbox/", http.StripPrefix("/outbox", admin.New(o)))
+//
+// It serves the following endpoints, all of them answering with JSON:
+//
+//	GET  /status                  dispatcher state and message counts
+//	GET  /messages                paged messages, filtered by ?state=pending|dispatched|failed|dead&after=<id>&limit=<n>
+//	GET  /messages/<id>           a single message
+//	POST /messages/<id>/requeue   sets a dispatched or dead message back to pending
+//	POST /replay                  sets the dispatched messages that match a filter back to pending
+//	POST /pause                   pauses the dispatcher
+//	POST /resume                  resumes the dispatcher
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/italolelis/outboxer"
+)
+
+const (
+	defaultLimit = 50
+	maxLimit     = 1000
+)
+
+// ErrInspectNotSupported is used when the data store doesn't implement outboxer.Inspector.
+var ErrInspectNotSupported = errors.New("the data store doesn't support inspecting messages")
+
+// Handler serves the admin endpoints of an outbox.
+type Handler struct {
+	o *outboxer.Outboxer
+}
+
+// New creates a new instance of Handler.
+func New(o *outboxer.Outboxer) *Handler {
+	return &Handler{o: o}
+}
+
+// Status is the response of the status endpoint.
+type Status struct {
+	LastDispatchedAt *time.Time `json:"last_dispatched_at,omitempty"`
+	OldestPendingID  *int64     `json:"oldest_pending_id,omitempty"`
+	Pending          int64      `json:"pending"`
+	Dispatched       int64      `json:"dispatched"`
+	Failed           int64      `json:"failed"`
+	Dead             int64      `json:"dead"`
+	Paused           bool       `json:"paused"`
+}
+
+// Message is the JSON representation of an outbox message.
+type Message struct {
+	CreatedAt    time.Time              `json:"created_at"`
+	DispatchedAt *time.Time             `json:"dispatched_at,omitempty"`
+	Options      outboxer.DynamicValues `json:"options"`
+	Headers      outboxer.DynamicValues `json:"headers"`
+	LastError    string                 `json:"last_error,omitempty"`
+	// Payload is base64 encoded.
+	Payload    []byte `json:"payload"`
+	ID         int64  `json:"id"`
+	Attempts   int32  `json:"attempts"`
+	Dispatched bool   `json:"dispatched"`
+	Dead       bool   `json:"dead"`
+}
+
+// MessageList is the response of the messages endpoint.
+// NextAfter is the value of the after parameter for the next page, zero when there are no more messages.
+type MessageList struct {
+	Messages  []*Message `json:"messages"`
+	NextAfter int64      `json:"next_after,omitempty"`
+}
+
+// ReplayRequest is the body of the replay endpoint. Zero values are ignored, a request without
+// any filter is rejected unless All is set, so that an empty body doesn't replay the whole table.
+type ReplayRequest struct {
+	DispatchedAfter  time.Time              `json:"dispatched_after"`
+	DispatchedBefore time.Time              `json:"dispatched_before"`
+	Destination      outboxer.DynamicValues `json:"destination"`
+	Options          outboxer.DynamicValues `json:"options"`
+	FromID           int64                  `json:"from_id"`
+	ToID             int64                  `json:"to_id"`
+	DryRun           bool                   `json:"dry_run"`
+	All              bool                   `json:"all"`
+}
+
+// ReplayResponse is the response of the replay and requeue endpoints.
+type ReplayResponse struct {
+	Count  int64 `json:"count"`
+	DryRun bool  `json:"dry_run,omitempty"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// ServeHTTP implements http.Handler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+
+	switch {
+	case len(parts) == 1 && parts[0] == "status":
+		h.allow(w, r, http.MethodGet, h.status)
+	case len(parts) == 1 && parts[0] == "messages":
+		h.allow(w, r, http.MethodGet, h.listMessages)
+	case len(parts) == 2 && parts[0] == "messages":
+		h.allow(w, r, http.MethodGet, h.withID(parts[1], h.getMessage))
+	case len(parts) == 3 && parts[0] == "messages" && parts[2] == "requeue":
+		h.allow(w, r, http.MethodPost, h.withID(parts[1], h.requeue))
+	case len(parts) == 1 && parts[0] == "replay":
+		h.allow(w, r, http.MethodPost, h.replay)
+	case len(parts) == 1 && parts[0] == "pause":
+		h.allow(w, r, http.MethodPost, h.pause)
+	case len(parts) == 1 && parts[0] == "resume":
+		h.allow(w, r, http.MethodPost, h.resume)
+	default:
+		writeError(w, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+func (h *Handler) allow(w http.ResponseWriter, r *http.Request, method string, fn http.HandlerFunc) {
+	if r.Method != method {
+		w.Header().Set("Allow", method)
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+
+		return
+	}
+
+	fn(w, r)
+}
+
+func (h *Handler) withID(param string, fn func(http.ResponseWriter, *http.Request, int64)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.ParseInt(param, 10, 64)
+		if err != nil || id <= 0 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid message id"))
+			return
+		}
+
+		fn(w, r, id)
+	}
+}
+
+func (h *Handler) inspector(w http.ResponseWriter) (outboxer.Inspector, bool) {
+	i, ok := h.o.DataStore().(outboxer.Inspector)
+	if !ok {
+		writeError(w, http.StatusNotImplemented, ErrInspectNotSupported)
+	}
+
+	return i, ok
+}
+
+func (h *Handler) status(w http.ResponseWriter, r *http.Request) {
+	i, ok := h.inspector(w)
+	if !ok {
+		return
+	}
+
+	stats, err := i.Stats(r.Context())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	s := Status{
+		Pending:    stats.Pending,
+		Dispatched: stats.Dispatched,
+		Failed:     stats.Failed,
+		Dead:       stats.Dead,
+		Paused:     h.o.Paused(),
+	}
+
+	if stats.LastDispatchedAt.Valid {
+		s.LastDispatchedAt = &stats.LastDispatchedAt.Time
+	}
+
+	if stats.OldestPendingID.Valid {
+		s.OldestPendingID = &stats.OldestPendingID.Int64
+	}
+
+	writeJSON(w, http.StatusOK, s)
+}
+
+func (h *Handler) listMessages(w http.ResponseWriter, r *http.Request) {
+	i, ok := h.inspector(w)
+	if !ok {
+		return
+	}
+
+	q := r.URL.Query()
+	f := outboxer.ListFilter{Limit: defaultLimit}
+
+	switch q.Get("state") {
+	case "":
+	case "pending":
+		f.State = outboxer.PendingState
+	case "dispatched":
+		f.State = outboxer.DispatchedState
+	case "failed":
+		f.State = outboxer.FailedState
+	case "dead":
+		f.State = outboxer.DeadState
+	default:
+		writeError(w, http.StatusBadRequest, errors.New("invalid state"))
+		return
+	}
+
+	if v := q.Get("after"); v != "" {
+		after, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errors.New("invalid after"))
+			return
+		}
+
+		f.AfterID = after
+	}
+
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit <= 0 || limit > maxLimit {
+			writeError(w, http.StatusBadRequest, errors.New("invalid limit"))
+			return
+		}
+
+		f.Limit = int32(limit)
+	}
+
+	msgs, err := i.ListEvents(r.Context(), f)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	list := MessageList{Messages: make([]*Message, 0, len(msgs))}
+	for _, m := range msgs {
+		list.Messages = append(list.Messages, newMessage(m))
+	}
+
+	if len(msgs) == int(f.Limit) {
+		list.NextAfter = msgs[len(msgs)-1].ID
+	}
+
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (h *Handler) getMessage(w http.ResponseWriter, r *http.Request, id int64) {
+	i, ok := h.inspector(w)
+	if !ok {
+		return
+	}
+
+	m, err := i.GetEvent(r.Context(), id)
+	if errors.Is(err, outboxer.ErrMessageNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, newMessage(m))
+}
+
+func (h *Handler) requeue(w http.ResponseWriter, r *http.Request, id int64) {
+	// a message is either dead or dispatched, dead messages are requeued with their attempts cleared.
+	n, err := h.o.Requeue(r.Context(), id)
+	if err != nil && !errors.Is(err, outboxer.ErrFailureTrackingNotSupported) {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if n > 0 {
+		writeJSON(w, http.StatusOK, ReplayResponse{Count: n})
+		return
+	}
+
+	h.doReplay(w, r, outboxer.ReplayFilter{FromID: id, ToID: id}, false)
+}
+
+func (h *Handler) replay(w http.ResponseWriter, r *http.Request) {
+	var req ReplayRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid replay request"))
+		return
+	}
+
+	f := outboxer.ReplayFilter{
+		DispatchedAfter:  req.DispatchedAfter,
+		DispatchedBefore: req.DispatchedBefore,
+		Destination:      req.Destination,
+		FromID:           req.FromID,
+		ToID:             req.ToID,
+	}
+	if !req.All && f.DispatchedAfter.IsZero() && f.DispatchedBefore.IsZero() &&
+		len(f.Destination) == 0 && f.FromID == 0 && f.ToID == 0 {
+		writeError(w, http.StatusBadRequest, errors.New("a replay needs a filter, set all to replay every message"))
+		return
+	}
+
+	var opts []outboxer.ReplayOption
+	if req.DryRun {
+		opts = append(opts, outboxer.ReplayDryRun())
+	}
+
+	if len(req.Options) > 0 {
+		opts = append(opts, outboxer.ReplayWithOptions(req.Options))
+	}
+
+	h.doReplay(w, r, f, req.DryRun, opts...)
+}
+
+func (h *Handler) doReplay(
+	w http.ResponseWriter,
+	r *http.Request,
+	f outboxer.ReplayFilter,
+	dryRun bool,
+	opts ...outboxer.ReplayOption,
+) {
+	n, err := h.o.Replay(r.Context(), f, opts...)
+	if errors.Is(err, outboxer.ErrReplayNotSupported) {
+		writeError(w, http.StatusNotImplemented, err)
+		return
+	}
+
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ReplayResponse{Count: n, DryRun: dryRun})
+}
+
+func (h *Handler) pause(w http.ResponseWriter, _ *http.Request) {
+	h.o.Pause()
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": true})
+}
+
+func (h *Handler) resume(w http.ResponseWriter, _ *http.Request) {
+	h.o.Resume()
+	writeJSON(w, http.StatusOK, map[string]bool{"paused": false})
+}
+
+func newMessage(m *outboxer.OutboxMessage) *Message {
+	msg := Message{
+		CreatedAt:  m.CreatedAt,
+		ID:         m.ID,
+		Attempts:   m.Attempts,
+		LastError:  m.LastError,
+		Dispatched: m.Dispatched,
+		Dead:       m.Dead,
+		Payload:    m.Payload,
+		Options:    m.Options,
+		Headers:    m.Headers,
+	}
+
+	if m.DispatchedAt.Valid {
+		msg.DispatchedAt = &m.DispatchedAt.Time
+	}
+
+	return &msg
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, errorResponse{Error: err.Error()})
+}
@@ -0,0 +1,371 @@
+package admin_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/admin"
+	"github.com/italolelis/outboxer/outboxertest"
+)
+
+type inMemDS struct {
+	data []*outboxer.OutboxMessage
+}
+
+func (s *inMemDS) GetEvents(context.Context, int32) ([]*outboxer.OutboxMessage, error) {
+	return nil, nil
+}
+
+func (s *inMemDS) Add(_ context.Context, m *outboxer.OutboxMessage) error {
+	m.ID = int64(len(s.data) + 1)
+	s.data = append(s.data, m)
+
+	return nil
+}
+
+func (s *inMemDS) AddWithinTx(ctx context.Context, m *outboxer.OutboxMessage, _ func(outboxer.ExecerContext) error) error {
+	return s.Add(ctx, m)
+}
+
+func (s *inMemDS) SetAsDispatched(_ context.Context, id int64) error {
+	s.data[id-1].Dispatched = true
+	s.data[id-1].DispatchedAt = sql.NullTime{Time: time.Now(), Valid: true}
+
+	return nil
+}
+
+func (s *inMemDS) Remove(context.Context, time.Time, int32) error {
+	return nil
+}
+
+func (s *inMemDS) Stats(context.Context) (*outboxer.Stats, error) {
+	var stats outboxer.Stats
+
+	for _, m := range s.data {
+		if m.Dispatched {
+			stats.Dispatched++
+		} else {
+			stats.Pending++
+		}
+	}
+
+	return &stats, nil
+}
+
+func (s *inMemDS) GetEvent(_ context.Context, id int64) (*outboxer.OutboxMessage, error) {
+	if id > int64(len(s.data)) {
+		return nil, outboxer.ErrMessageNotFound
+	}
+
+	return s.data[id-1], nil
+}
+
+func (s *inMemDS) ListEvents(_ context.Context, f outboxer.ListFilter) ([]*outboxer.OutboxMessage, error) {
+	var msgs []*outboxer.OutboxMessage
+
+	for _, m := range s.data {
+		if m.ID <= f.AfterID || len(msgs) == int(f.Limit) ||
+			(f.State == outboxer.PendingState && m.Dispatched) ||
+			(f.State == outboxer.DispatchedState && !m.Dispatched) {
+			continue
+		}
+
+		msgs = append(msgs, m)
+	}
+
+	return msgs, nil
+}
+
+func (s *inMemDS) matches(m *outboxer.OutboxMessage, f outboxer.ReplayFilter) bool {
+	return m.Dispatched && m.ID >= f.FromID && (f.ToID == 0 || m.ID <= f.ToID)
+}
+
+func (s *inMemDS) CountDispatched(_ context.Context, f outboxer.ReplayFilter) (int64, error) {
+	var n int64
+
+	for _, m := range s.data {
+		if s.matches(m, f) {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (s *inMemDS) GetDispatched(context.Context, outboxer.ReplayFilter, int64, int32) ([]*outboxer.OutboxMessage, error) {
+	return nil, nil
+}
+
+func (s *inMemDS) Replay(_ context.Context, f outboxer.ReplayFilter, _ outboxer.DynamicValues) (int64, error) {
+	var n int64
+
+	for _, m := range s.data {
+		if s.matches(m, f) {
+			m.Dispatched = false
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+type inMemES struct{}
+
+func (inMemES) Send(context.Context, *outboxer.OutboxMessage) error {
+	return nil
+}
+
+func newHandler(t *testing.T) (*admin.Handler, *outboxer.Outboxer, *inMemDS) {
+	t.Helper()
+
+	ds := &inMemDS{}
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if err := ds.Add(ctx, &outboxer.OutboxMessage{Payload: []byte("test payload")}); err != nil {
+			t.Fatalf("failed to add message: %s", err)
+		}
+	}
+
+	if err := ds.SetAsDispatched(ctx, 2); err != nil {
+		t.Fatalf("failed to dispatch message: %s", err)
+	}
+
+	o, err := outboxer.New(outboxer.WithDataStore(ds), outboxer.WithEventStream(inMemES{}))
+	if err != nil {
+		t.Fatalf("could not create an outboxer instance: %s", err)
+	}
+
+	return admin.New(o), o, ds
+}
+
+func serve(t *testing.T, h http.Handler, method, target, body string, v interface{}) int {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+
+	if v != nil {
+		if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+			t.Fatalf("failed to decode response %q: %s", rec.Body.String(), err)
+		}
+	}
+
+	return rec.Code
+}
+
+func TestHandler(t *testing.T) {
+	t.Run("status", func(t *testing.T) {
+		h, o, _ := newHandler(t)
+
+		var s admin.Status
+		if code := serve(t, h, http.MethodGet, "/status", "", &s); code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		if s.Pending != 2 || s.Dispatched != 1 || s.Paused {
+			t.Fatalf("unexpected status %+v", s)
+		}
+
+		if code := serve(t, h, http.MethodPost, "/pause", "", nil); code != http.StatusOK || !o.Paused() {
+			t.Fatalf("expected the dispatcher to be paused, got %d", code)
+		}
+
+		if code := serve(t, h, http.MethodPost, "/resume", "", nil); code != http.StatusOK || o.Paused() {
+			t.Fatalf("expected the dispatcher to be resumed, got %d", code)
+		}
+	})
+
+	t.Run("list messages", func(t *testing.T) {
+		h, _, _ := newHandler(t)
+
+		var list admin.MessageList
+		if code := serve(t, h, http.MethodGet, "/messages?state=pending&limit=1", "", &list); code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		if len(list.Messages) != 1 || list.Messages[0].ID != 1 || list.NextAfter != 1 {
+			t.Fatalf("unexpected first page %+v", list)
+		}
+
+		if code := serve(t, h, http.MethodGet, "/messages?state=pending&limit=1&after=1", "", &list); code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		if len(list.Messages) != 1 || list.Messages[0].ID != 3 {
+			t.Fatalf("unexpected second page %+v", list)
+		}
+
+		if code := serve(t, h, http.MethodGet, "/messages?state=bogus", "", nil); code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d", code)
+		}
+
+		if code := serve(t, h, http.MethodGet, "/messages?limit=nope", "", nil); code != http.StatusBadRequest {
+			t.Fatalf("expected status 400, got %d", code)
+		}
+	})
+
+	t.Run("get message", func(t *testing.T) {
+		h, _, _ := newHandler(t)
+
+		var m admin.Message
+		if code := serve(t, h, http.MethodGet, "/messages/2", "", &m); code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		if !m.Dispatched || m.DispatchedAt == nil || string(m.Payload) != "test payload" {
+			t.Fatalf("unexpected message %+v", m)
+		}
+
+		if code := serve(t, h, http.MethodGet, "/messages/10", "", nil); code != http.StatusNotFound {
+			t.Fatalf("expected status 404, got %d", code)
+		}
+	})
+
+	t.Run("requeue and replay", func(t *testing.T) {
+		h, _, ds := newHandler(t)
+
+		var resp admin.ReplayResponse
+		if code := serve(t, h, http.MethodPost, "/replay", `{}`, nil); code != http.StatusBadRequest {
+			t.Fatalf("expected status 400 for an empty filter, got %d", code)
+		}
+
+		if code := serve(t, h, http.MethodPost, "/replay", `{"dry_run": true}`, nil); code != http.StatusBadRequest {
+			t.Fatalf("expected status 400 for a dry run without a filter, got %d", code)
+		}
+
+		if code := serve(t, h, http.MethodPost, "/replay", `{"dry_run": true, "from_id": 3}`, &resp); code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		if resp.Count != 0 || !resp.DryRun {
+			t.Fatalf("unexpected filtered dry run %+v", resp)
+		}
+
+		if code := serve(t, h, http.MethodPost, "/replay", `{"dry_run": true, "all": true}`, &resp); code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		if resp.Count != 1 || !resp.DryRun || !ds.data[1].Dispatched {
+			t.Fatalf("unexpected dry run %+v", resp)
+		}
+
+		if code := serve(t, h, http.MethodGet, "/messages/2/requeue", "", nil); code != http.StatusMethodNotAllowed {
+			t.Fatalf("expected status 405, got %d", code)
+		}
+
+		if code := serve(t, h, http.MethodPost, "/messages/2/requeue", "", &resp); code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		if resp.Count != 1 || ds.data[1].Dispatched {
+			t.Fatalf("expected the message to be requeued, got %+v", resp)
+		}
+	})
+}
+
+// newFakeHandler serves the same messages as newHandler from the outboxertest fakes,
+// which also keep track of failed sends.
+func newFakeHandler(t *testing.T) (*admin.Handler, *outboxer.Outboxer, *outboxertest.DataStore) {
+	t.Helper()
+
+	ds := outboxertest.NewDataStore()
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if err := ds.Add(ctx, &outboxer.OutboxMessage{Payload: []byte("test payload")}); err != nil {
+			t.Fatalf("failed to add message: %s", err)
+		}
+	}
+
+	if err := ds.SetAsDispatched(ctx, 2); err != nil {
+		t.Fatalf("failed to dispatch message: %s", err)
+	}
+
+	o, err := outboxer.New(outboxer.WithDataStore(ds), outboxer.WithEventStream(outboxertest.NewEventStream()))
+	if err != nil {
+		t.Fatalf("could not create an outboxer instance: %s", err)
+	}
+
+	return admin.New(o), o, ds
+}
+
+func TestHandler_OutboxerTest(t *testing.T) {
+	t.Run("requeue", func(t *testing.T) {
+		h, _, ds := newFakeHandler(t)
+
+		var resp admin.ReplayResponse
+		if code := serve(t, h, http.MethodPost, "/messages/2/requeue", "", &resp); code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		m, err := ds.GetEvent(context.Background(), 2)
+		if err != nil {
+			t.Fatalf("failed to get message: %s", err)
+		}
+
+		if resp.Count != 1 || m.Dispatched {
+			t.Fatalf("expected the message to be requeued, got %+v", resp)
+		}
+	})
+
+	t.Run("failed and dead messages", func(t *testing.T) {
+		h, _, ds := newFakeHandler(t)
+		ctx := context.Background()
+
+		if err := ds.SetAsFailed(ctx, 1, "broker unavailable", 1); err != nil {
+			t.Fatalf("failed to set message as failed: %s", err)
+		}
+
+		if err := ds.SetAsFailed(ctx, 3, "broker unavailable", 2); err != nil {
+			t.Fatalf("failed to set message as failed: %s", err)
+		}
+
+		var s admin.Status
+		if code := serve(t, h, http.MethodGet, "/status", "", &s); code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		if s.Pending != 1 || s.Failed != 1 || s.Dead != 1 {
+			t.Fatalf("unexpected status %+v", s)
+		}
+
+		var list admin.MessageList
+		if code := serve(t, h, http.MethodGet, "/messages?state=failed", "", &list); code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		if len(list.Messages) != 1 || list.Messages[0].ID != 3 || list.Messages[0].Attempts != 1 {
+			t.Fatalf("unexpected failed messages %+v", list)
+		}
+
+		if code := serve(t, h, http.MethodGet, "/messages?state=dead", "", &list); code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		if len(list.Messages) != 1 || !list.Messages[0].Dead || list.Messages[0].LastError != "broker unavailable" {
+			t.Fatalf("unexpected dead messages %+v", list)
+		}
+
+		var resp admin.ReplayResponse
+		if code := serve(t, h, http.MethodPost, "/messages/1/requeue", "", &resp); code != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", code)
+		}
+
+		m, err := ds.GetEvent(ctx, 1)
+		if err != nil {
+			t.Fatalf("failed to get message: %s", err)
+		}
+
+		if resp.Count != 1 || m.Dead || m.Attempts != 0 {
+			t.Fatalf("expected the dead message to be requeued, got %+v and %+v", resp, m)
+		}
+	})
+}
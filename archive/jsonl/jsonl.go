@@ -0,0 +1,322 @@
+// Package jsonl is the JSON Lines implementation of an archiver.
+// Messages are written to gzip compressed files in a local directory, one JSON object per line.
+package jsonl
+
+import (
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/italolelis/outboxer"
+)
+
+const (
+	// DefaultFilePrefix is the default prefix of the archive files.
+	DefaultFilePrefix = "outbox"
+
+	// DefaultMaxFileSize is the default amount of uncompressed bytes written to a file before it is rotated.
+	DefaultMaxFileSize = 64 << 20
+
+	// FileExtension is the extension of finished archive files.
+	FileExtension = ".jsonl.gz"
+
+	// TempFileExtension is appended to the name of the file that is still being written.
+	TempFileExtension = ".tmp"
+)
+
+// ErrClosed is used when archiving after the archiver was closed.
+var ErrClosed = errors.New("archiver is closed")
+
+// Record is a single line of an archive file.
+type Record struct {
+	DispatchedAt *time.Time             `json:"dispatched_at"`
+	Options      outboxer.DynamicValues `json:"options"`
+	Headers      outboxer.DynamicValues `json:"headers"`
+	CreatedAt    time.Time              `json:"created_at"`
+	ArchivedAt   time.Time              `json:"archived_at"`
+	// Payload is base64 encoded in the file.
+	Payload []byte `json:"payload"`
+	ID      int64  `json:"id"`
+}
+
+// NewRecord creates the archive record of a message.
+func NewRecord(m *outboxer.OutboxMessage, archivedAt time.Time) *Record {
+	r := Record{
+		ID:         m.ID,
+		Payload:    m.Payload,
+		Options:    m.Options,
+		Headers:    m.Headers,
+		CreatedAt:  m.CreatedAt.UTC(),
+		ArchivedAt: archivedAt.UTC(),
+	}
+
+	if m.DispatchedAt.Valid {
+		t := m.DispatchedAt.Time.UTC()
+		r.DispatchedAt = &t
+	}
+
+	return &r
+}
+
+// Message converts the record back into an outbox message.
+func (r *Record) Message() *outboxer.OutboxMessage {
+	m := outboxer.OutboxMessage{
+		ID:        r.ID,
+		Payload:   r.Payload,
+		Options:   r.Options,
+		Headers:   r.Headers,
+		CreatedAt: r.CreatedAt,
+	}
+
+	if r.DispatchedAt != nil {
+		m.Dispatched = true
+		m.DispatchedAt = sql.NullTime{Time: *r.DispatchedAt, Valid: true}
+	}
+
+	return &m
+}
+
+// Reader reads records from a JSON Lines stream.
+type Reader struct {
+	dec *json.Decoder
+}
+
+// NewReader creates a new instance of Reader. Compressed streams must be decompressed by the caller.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{dec: json.NewDecoder(r)}
+}
+
+// Read returns the next record, or io.EOF when there are no more records.
+func (r *Reader) Read() (*Record, error) {
+	var rec Record
+	if err := r.dec.Decode(&rec); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.EOF
+		}
+
+		return nil, fmt.Errorf("failed to decode record: %w", err)
+	}
+
+	return &rec, nil
+}
+
+// Archiver writes messages to rotating gzip compressed JSON Lines files.
+// The file that is being written carries the TempFileExtension suffix, which is removed once the file
+// is rotated or the archiver is closed, so only finished files end with FileExtension.
+type Archiver struct {
+	openedAt    time.Time
+	now         func() time.Time
+	file        *os.File
+	gz          *gzip.Writer
+	enc         *json.Encoder
+	dir         string
+	prefix      string
+	path        string
+	maxFileSize int64
+	maxFileAge  time.Duration
+	written     int64
+	maxRecords  int
+	records     int
+	seq         int
+	mu          sync.Mutex
+	closed      bool
+}
+
+// Option represents the archiver options.
+type Option func(*Archiver)
+
+// WithFilePrefix sets the prefix of the archive file names.
+func WithFilePrefix(prefix string) Option {
+	return func(a *Archiver) {
+		a.prefix = prefix
+	}
+}
+
+// WithMaxFileSize sets how many uncompressed bytes are written to a file before it is rotated.
+func WithMaxFileSize(size int64) Option {
+	return func(a *Archiver) {
+		a.maxFileSize = size
+	}
+}
+
+// WithMaxRecords sets how many records are written to a file before it is rotated.
+func WithMaxRecords(n int) Option {
+	return func(a *Archiver) {
+		a.maxRecords = n
+	}
+}
+
+// WithMaxFileAge sets how long a file is kept open before it is rotated.
+// The age is checked whenever messages are archived.
+func WithMaxFileAge(d time.Duration) Option {
+	return func(a *Archiver) {
+		a.maxFileAge = d
+	}
+}
+
+// New creates a new instance of Archiver that writes its files to the given directory.
+func New(dir string, opts ...Option) (*Archiver, error) {
+	a := Archiver{
+		dir:         dir,
+		prefix:      DefaultFilePrefix,
+		maxFileSize: DefaultMaxFileSize,
+		now:         time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(&a)
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory: %w", err)
+	}
+
+	return &a, nil
+}
+
+// Archive writes the messages to the current file and flushes them to disk.
+func (a *Archiver) Archive(ctx context.Context, msgs []*outboxer.OutboxMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return ErrClosed
+	}
+
+	now := a.now()
+
+	if a.file != nil && a.maxFileAge > 0 && now.Sub(a.openedAt) >= a.maxFileAge {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range msgs {
+		if a.file == nil {
+			if err := a.open(now); err != nil {
+				return err
+			}
+		}
+
+		if err := a.enc.Encode(NewRecord(m, now)); err != nil {
+			return fmt.Errorf("failed to encode message %d: %w", m.ID, err)
+		}
+
+		a.records++
+
+		if a.full() {
+			if err := a.rotate(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if a.file == nil {
+		return nil
+	}
+
+	if err := a.gz.Flush(); err != nil {
+		return fmt.Errorf("failed to flush archive file: %w", err)
+	}
+
+	if err := a.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync archive file: %w", err)
+	}
+
+	return nil
+}
+
+// Close finishes the current file.
+func (a *Archiver) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.closed {
+		return nil
+	}
+
+	a.closed = true
+
+	return a.rotate()
+}
+
+func (a *Archiver) full() bool {
+	if a.maxRecords > 0 && a.records >= a.maxRecords {
+		return true
+	}
+
+	return a.maxFileSize > 0 && a.written >= a.maxFileSize
+}
+
+func (a *Archiver) open(now time.Time) error {
+	a.seq++
+	name := fmt.Sprintf("%s-%s-%06d%s", a.prefix, now.UTC().Format("20060102T150405.000000000Z"), a.seq, FileExtension)
+	a.path = filepath.Join(a.dir, name)
+
+	f, err := os.OpenFile(a.path+TempFileExtension, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to create archive file: %w", err)
+	}
+
+	a.file = f
+	a.gz = gzip.NewWriter(f)
+	a.enc = json.NewEncoder(&countingWriter{w: a.gz, n: &a.written})
+	a.openedAt = now
+	a.written = 0
+	a.records = 0
+
+	return nil
+}
+
+func (a *Archiver) rotate() error {
+	if a.file == nil {
+		return nil
+	}
+
+	f := a.file
+	a.file = nil
+
+	if err := a.gz.Close(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to finish archive file: %w", err)
+	}
+
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync archive file: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close archive file: %w", err)
+	}
+
+	if err := os.Rename(a.path+TempFileExtension, a.path); err != nil {
+		return fmt.Errorf("failed to rename archive file: %w", err)
+	}
+
+	return nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	*c.n += int64(n)
+
+	return n, err
+}
@@ -0,0 +1,248 @@
+package jsonl
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/italolelis/outboxer"
+)
+
+func TestArchiver_RotatesByRecords(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	a, err := New(dir, WithMaxRecords(2), WithFilePrefix("events"))
+	if err != nil {
+		t.Fatalf("failed to create archiver: %s", err)
+	}
+
+	dispatchedAt := time.Date(2023, time.May, 1, 10, 0, 0, 0, time.UTC)
+
+	if err := a.Archive(ctx, []*outboxer.OutboxMessage{
+		{
+			ID:           1,
+			Payload:      []byte("first"),
+			Options:      outboxer.DynamicValues{"topic_name": "orders"},
+			Headers:      outboxer.DynamicValues{"trace_id": "abc"},
+			Dispatched:   true,
+			DispatchedAt: sql.NullTime{Time: dispatchedAt, Valid: true},
+		},
+		{ID: 2, Payload: []byte("second")},
+		{ID: 3, Payload: []byte("third")},
+	}); err != nil {
+		t.Fatalf("failed to archive messages: %s", err)
+	}
+
+	if files := archiveFiles(t, dir, FileExtension); len(files) != 1 {
+		t.Fatalf("was expecting 1 finished file but got %d", len(files))
+	}
+
+	if files := archiveFiles(t, dir, TempFileExtension); len(files) != 1 {
+		t.Fatalf("was expecting 1 file in progress but got %d", len(files))
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatalf("failed to close archiver: %s", err)
+	}
+
+	files := archiveFiles(t, dir, FileExtension)
+	if len(files) != 2 {
+		t.Fatalf("was expecting 2 finished files but got %d", len(files))
+	}
+
+	for _, f := range files {
+		if !strings.HasPrefix(filepath.Base(f), "events-") {
+			t.Errorf("was expecting file %s to start with the prefix", f)
+		}
+	}
+
+	lines := readLines(t, files[0])
+	if len(lines) != 2 {
+		t.Fatalf("was expecting 2 records in the first file but got %d", len(lines))
+	}
+
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(lines[0]), &raw); err != nil {
+		t.Fatalf("failed to decode record: %s", err)
+	}
+
+	if raw["payload"] != "Zmlyc3Q=" {
+		t.Errorf("was expecting a base64 encoded payload but got %v", raw["payload"])
+	}
+
+	var r Record
+	if err := json.Unmarshal([]byte(lines[0]), &r); err != nil {
+		t.Fatalf("failed to decode record: %s", err)
+	}
+
+	if r.ID != 1 || string(r.Payload) != "first" {
+		t.Errorf("unexpected record %+v", r)
+	}
+
+	if r.Options["topic_name"] != "orders" || r.Headers["trace_id"] != "abc" {
+		t.Errorf("was expecting options and headers to be kept but got %v and %v", r.Options, r.Headers)
+	}
+
+	if r.DispatchedAt == nil || !r.DispatchedAt.Equal(dispatchedAt) {
+		t.Errorf("was expecting dispatched at %s but got %v", dispatchedAt, r.DispatchedAt)
+	}
+
+	if r.ArchivedAt.IsZero() {
+		t.Error("was expecting the archived at timestamp to be set")
+	}
+
+	if lines := readLines(t, files[1]); len(lines) != 1 {
+		t.Fatalf("was expecting 1 record in the second file but got %d", len(lines))
+	}
+
+	if err := a.Archive(ctx, []*outboxer.OutboxMessage{{ID: 4}}); err != ErrClosed {
+		t.Fatalf("was expecting ErrClosed but got %v", err)
+	}
+}
+
+func TestReader_Read(t *testing.T) {
+	dispatchedAt := time.Date(2023, time.May, 1, 10, 0, 0, 0, time.UTC)
+	createdAt := time.Date(2023, time.May, 1, 9, 0, 0, 0, time.UTC)
+	input := `{"id":1,"payload":"Zmlyc3Q=","options":{"topic_name":"orders"},"headers":null,"created_at":"2023-05-01T09:00:00Z","dispatched_at":"2023-05-01T10:00:00Z","archived_at":"2023-06-01T10:00:00Z"}
+{"id":2,"payload":"c2Vjb25k","options":null,"headers":{"trace_id":"abc"},"dispatched_at":null,"archived_at":"2023-06-01T10:00:00Z"}
+`
+
+	r := NewReader(strings.NewReader(input))
+
+	rec, err := r.Read()
+	if err != nil {
+		t.Fatalf("failed to read record: %s", err)
+	}
+
+	m := rec.Message()
+	if m.ID != 1 || string(m.Payload) != "first" || m.Options["topic_name"] != "orders" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+
+	if !m.Dispatched || !m.DispatchedAt.Time.Equal(dispatchedAt) {
+		t.Fatalf("was expecting the message to be dispatched at %s but got %+v", dispatchedAt, m.DispatchedAt)
+	}
+
+	if !m.CreatedAt.Equal(createdAt) {
+		t.Fatalf("was expecting the message to be created at %s but got %s", createdAt, m.CreatedAt)
+	}
+
+	rec, err = r.Read()
+	if err != nil {
+		t.Fatalf("failed to read record: %s", err)
+	}
+
+	if m := rec.Message(); m.Dispatched || m.Headers["trace_id"] != "abc" {
+		t.Fatalf("unexpected message %+v", m)
+	}
+
+	if _, err := r.Read(); !errors.Is(err, io.EOF) {
+		t.Fatalf("was expecting io.EOF but got %v", err)
+	}
+
+	if _, err := NewReader(strings.NewReader("{not json")).Read(); err == nil || errors.Is(err, io.EOF) {
+		t.Fatalf("was expecting a decoding error but got %v", err)
+	}
+}
+
+func TestArchiver_RotatesByAge(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	a, err := New(dir, WithMaxFileAge(time.Minute))
+	if err != nil {
+		t.Fatalf("failed to create archiver: %s", err)
+	}
+
+	now := time.Date(2023, time.May, 1, 10, 0, 0, 0, time.UTC)
+	a.now = func() time.Time { return now }
+
+	if err := a.Archive(ctx, []*outboxer.OutboxMessage{{ID: 1, Payload: []byte("a")}}); err != nil {
+		t.Fatalf("failed to archive messages: %s", err)
+	}
+
+	now = now.Add(2 * time.Minute)
+
+	if err := a.Archive(ctx, []*outboxer.OutboxMessage{{ID: 2, Payload: []byte("b")}}); err != nil {
+		t.Fatalf("failed to archive messages: %s", err)
+	}
+
+	if files := archiveFiles(t, dir, FileExtension); len(files) != 1 {
+		t.Fatalf("was expecting 1 finished file but got %d", len(files))
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatalf("failed to close archiver: %s", err)
+	}
+
+	if files := archiveFiles(t, dir, FileExtension); len(files) != 2 {
+		t.Fatalf("was expecting 2 finished files but got %d", len(files))
+	}
+}
+
+func TestArchiver_CanceledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	a, err := New(t.TempDir())
+	if err != nil {
+		t.Fatalf("failed to create archiver: %s", err)
+	}
+
+	if err := a.Archive(ctx, []*outboxer.OutboxMessage{{ID: 1}}); err == nil {
+		t.Fatal("an error was expected when the context is canceled")
+	}
+}
+
+func archiveFiles(t *testing.T, dir, ext string) []string {
+	t.Helper()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+	if err != nil {
+		t.Fatalf("failed to list archive files: %s", err)
+	}
+
+	sort.Strings(files)
+
+	return files
+}
+
+func readLines(t *testing.T, path string) []string {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("failed to open archive file: %s", err)
+	}
+
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("failed to read archive file: %s", err)
+	}
+
+	var lines []string
+
+	s := bufio.NewScanner(gz)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+
+	if err := s.Err(); err != nil {
+		t.Fatalf("failed to read archive file: %s", err)
+	}
+
+	return lines
+}
@@ -0,0 +1,79 @@
+package outboxer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// BatchSender is implemented by event streams that can send many messages at once.
+// When some of the messages fail, SendBatch returns a *BatchError and the messages it doesn't list were sent.
+// Any other error means that none of the messages were sent.
+type BatchSender interface {
+	SendBatch(ctx context.Context, msgs []*OutboxMessage) error
+}
+
+// BatchError reports the messages of a batch that failed to be sent.
+type BatchError struct {
+	// Errors holds the error of each failed message, by its index in the batch.
+	Errors map[int]error
+}
+
+func (e *BatchError) Error() string {
+	errs := e.Unwrap()
+	if len(errs) == 0 {
+		return "failed to send the batch"
+	}
+
+	return fmt.Sprintf("failed to send %d messages of the batch: %s", len(errs), errs[0])
+}
+
+// Unwrap returns the errors of the failed messages, ordered by their index in the batch.
+func (e *BatchError) Unwrap() []error {
+	idx := make([]int, 0, len(e.Errors))
+	for i := range e.Errors {
+		idx = append(idx, i)
+	}
+
+	sort.Ints(idx)
+
+	errs := make([]error, len(idx))
+	for j, i := range idx {
+		errs[j] = e.Errors[i]
+	}
+
+	return errs
+}
+
+// dispatchBatch sends the messages with a single batch and sets the ones that were sent as dispatched.
+func (o *Outboxer) dispatchBatch(ctx context.Context, b BatchSender, evts []*OutboxMessage) {
+	var failed map[int]error
+
+	if err := b.SendBatch(ctx, evts); err != nil {
+		var batchErr *BatchError
+		if !errors.As(err, &batchErr) {
+			// none of them were sent, so each one counts a failed attempt
+			for _, e := range evts {
+				o.fail(ctx, e, err)
+			}
+
+			return
+		}
+
+		failed = batchErr.Errors
+	}
+
+	for i, e := range evts {
+		if err, ok := failed[i]; ok {
+			o.fail(ctx, e, err)
+			continue
+		}
+
+		if err := o.ds.SetAsDispatched(ctx, e.ID); err != nil {
+			o.errChan <- err
+		} else {
+			o.okChan <- struct{}{}
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package outboxer
+
+import "time"
+
+// Clock tells the time and creates the tickers and timers of the outboxer, so tests can drive them
+// without sleeping. See outboxertest.Clock for a clock that is advanced by hand.
+type Clock interface {
+	Now() time.Time
+	NewTicker(d time.Duration) Ticker
+	NewTimer(d time.Duration) Timer
+}
+
+// Ticker delivers ticks on its channel at intervals, like a time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// Timer delivers a single tick on its channel once it expires, like a time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	// Stop prevents the timer from firing, it returns false if the timer already expired or was stopped.
+	Stop() bool
+}
+
+// SystemClock returns the clock of the system, which is used when no clock is set.
+func SystemClock() Clock {
+	return systemClock{}
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) NewTicker(d time.Duration) Ticker {
+	return systemTicker{t: time.NewTicker(d)}
+}
+
+func (systemClock) NewTimer(d time.Duration) Timer {
+	return systemTimer{t: time.NewTimer(d)}
+}
+
+type systemTicker struct {
+	t *time.Ticker
+}
+
+func (t systemTicker) C() <-chan time.Time { return t.t.C }
+
+func (t systemTicker) Stop() { t.t.Stop() }
+
+type systemTimer struct {
+	t *time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time { return t.t.C }
+
+func (t systemTimer) Stop() bool { return t.t.Stop() }
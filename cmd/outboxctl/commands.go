@@ -0,0 +1,641 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/archive/jsonl"
+)
+
+const (
+	defaultListLimit = 50
+	exportBatchSize  = 500
+)
+
+type env struct {
+	ds     store
+	stdin  io.Reader
+	stdout io.Writer
+}
+
+type command struct {
+	run  func(ctx context.Context, e *env, args []string) error
+	help string
+	// ddl lets the command change the schema, the data store is opened with WithoutDDL otherwise.
+	ddl bool
+}
+
+var commandNames = []string{"stats", "list", "show", "requeue", "replay", "purge", "migrate", "export", "import"}
+
+var commands = map[string]command{
+	"stats":   {run: statsCmd, help: "show how many messages are pending, dispatched, failed and dead"},
+	"list":    {run: listCmd, help: "list messages, use -pending, -dispatched, -failed or -dead to filter them"},
+	"show":    {run: showCmd, help: "show a single message: show <id>"},
+	"requeue": {run: requeueCmd, help: "set dispatched or dead messages back to pending: requeue <id>..."},
+	"replay":  {run: replayCmd, help: "set dispatched messages that match a filter back to pending"},
+	"purge":   {run: purgeCmd, help: "remove messages dispatched before a given time"},
+	"migrate": {run: migrateCmd, help: "apply the schema migrations of the outbox table", ddl: true},
+	"export":  {run: exportCmd, help: "export messages as JSON Lines, gzip compressed when the file ends with .gz"},
+	"import":  {run: importCmd, help: "import messages from JSON Lines as pending messages"},
+}
+
+func statsCmd(ctx context.Context, e *env, args []string) error {
+	if err := newFlagSet("stats", e).Parse(args); err != nil {
+		return err
+	}
+
+	stats, err := e.ds.Stats(ctx)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(e.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "pending\t%d\n", stats.Pending)
+	fmt.Fprintf(w, "dispatched\t%d\n", stats.Dispatched)
+	fmt.Fprintf(w, "failed\t%d\n", stats.Failed)
+	fmt.Fprintf(w, "dead\t%d\n", stats.Dead)
+
+	if stats.OldestPendingID.Valid {
+		fmt.Fprintf(w, "oldest pending id\t%d\n", stats.OldestPendingID.Int64)
+	}
+
+	if stats.LastDispatchedAt.Valid {
+		fmt.Fprintf(w, "last dispatched at\t%s\n", stats.LastDispatchedAt.Time.Format(time.RFC3339))
+	}
+
+	return w.Flush()
+}
+
+func listCmd(ctx context.Context, e *env, args []string) error {
+	fs := newFlagSet("list", e)
+	pending := fs.Bool("pending", false, "only list pending messages")
+	dispatched := fs.Bool("dispatched", false, "only list dispatched messages")
+	failed := fs.Bool("failed", false, "only list pending messages that failed to be sent")
+	dead := fs.Bool("dead", false, "only list dead messages")
+	after := fs.Int64("after", 0, "only list messages with an id greater than the given one")
+	limit := fs.Int("limit", defaultListLimit, "maximum number of messages")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if err := checkSize("-limit", *limit); err != nil {
+		return err
+	}
+
+	f := outboxer.ListFilter{AfterID: *after, Limit: int32(*limit)}
+
+	var states int
+
+	for state, set := range map[outboxer.MessageState]bool{
+		outboxer.PendingState:    *pending,
+		outboxer.DispatchedState: *dispatched,
+		outboxer.FailedState:     *failed,
+		outboxer.DeadState:       *dead,
+	} {
+		if set {
+			f.State = state
+			states++
+		}
+	}
+
+	if states > 1 {
+		return errors.New("only one of -pending, -dispatched, -failed and -dead can be used")
+	}
+
+	msgs, err := e.ds.ListEvents(ctx, f)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(e.stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tATTEMPTS\tDISPATCHED AT\tSIZE\tOPTIONS\tLAST ERROR")
+
+	for _, m := range msgs {
+		state, dispatchedAt := "pending", "-"
+
+		switch {
+		case m.Dispatched:
+			state = "dispatched"
+		case m.Dead:
+			state = "dead"
+		case m.Attempts > 0:
+			state = "failed"
+		}
+
+		if m.DispatchedAt.Valid {
+			dispatchedAt = m.DispatchedAt.Time.Format(time.RFC3339)
+		}
+
+		options, err := json.Marshal(m.Options)
+		if err != nil {
+			return err
+		}
+
+		lastError := m.LastError
+		if lastError == "" {
+			lastError = "-"
+		}
+
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%d\t%s\t%s\n",
+			m.ID, state, m.Attempts, dispatchedAt, len(m.Payload), options, lastError)
+	}
+
+	return w.Flush()
+}
+
+func showCmd(ctx context.Context, e *env, args []string) error {
+	fs := newFlagSet("show", e)
+	raw := fs.Bool("raw", false, "only print the payload")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		return errors.New("show needs exactly one message id")
+	}
+
+	id, err := strconv.ParseInt(fs.Arg(0), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid message id %q", fs.Arg(0))
+	}
+
+	m, err := e.ds.GetEvent(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	if *raw {
+		_, err := e.stdout.Write(m.Payload)
+		return err
+	}
+
+	enc := json.NewEncoder(e.stdout)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(struct {
+		*jsonl.Record
+		ArchivedAt *time.Time `json:"archived_at,omitempty"`
+		LastError  string     `json:"last_error,omitempty"`
+		Attempts   int32      `json:"attempts"`
+		Dispatched bool       `json:"dispatched"`
+		Dead       bool       `json:"dead"`
+	}{
+		Record:     jsonl.NewRecord(m, time.Time{}),
+		LastError:  m.LastError,
+		Attempts:   m.Attempts,
+		Dispatched: m.Dispatched,
+		Dead:       m.Dead,
+	})
+}
+
+func requeueCmd(ctx context.Context, e *env, args []string) error {
+	fs := newFlagSet("requeue", e)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 {
+		return errors.New("requeue needs at least one message id")
+	}
+
+	for _, arg := range fs.Args() {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid message id %q", arg)
+		}
+
+		// a message is either dead or dispatched, dead messages are requeued with their attempts cleared.
+		n, err := e.ds.Requeue(ctx, id)
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			n, err = e.ds.Replay(ctx, outboxer.ReplayFilter{FromID: id, ToID: id}, nil)
+			if err != nil {
+				return err
+			}
+		}
+
+		if n == 0 {
+			fmt.Fprintf(e.stdout, "message %d is neither dispatched nor dead, skipping\n", id)
+			continue
+		}
+
+		fmt.Fprintf(e.stdout, "message %d requeued\n", id)
+	}
+
+	return nil
+}
+
+func replayCmd(ctx context.Context, e *env, args []string) error {
+	var (
+		f        outboxer.ReplayFilter
+		override = valuesFlag{}
+		dest     = valuesFlag{}
+		after    timeFlag
+		before   timeFlag
+	)
+
+	fs := newFlagSet("replay", e)
+	fs.Int64Var(&f.FromID, "from-id", 0, "first message id")
+	fs.Int64Var(&f.ToID, "to-id", 0, "last message id")
+	fs.Var(&after, "after", "messages dispatched at or after the given RFC3339 time or duration ago")
+	fs.Var(&before, "before", "messages dispatched before the given RFC3339 time or duration ago")
+	fs.Var(dest, "dest", "only replay messages with the given option, as key=value with a JSON value; can be repeated")
+	fs.Var(override, "set", "override an option of the replayed messages, as key=value with a JSON value; can be repeated")
+	dryRun := fs.Bool("dry-run", false, "only count the messages that would be replayed")
+	all := fs.Bool("all", false, "replay every dispatched message, required when no filter is given")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	f.DispatchedAfter = after.Time
+	f.DispatchedBefore = before.Time
+	f.Destination = outboxer.DynamicValues(dest)
+
+	if !*all && f.DispatchedAfter.IsZero() && f.DispatchedBefore.IsZero() &&
+		len(f.Destination) == 0 && f.FromID == 0 && f.ToID == 0 {
+		return errors.New("replay needs a filter, use -all to replay every message")
+	}
+
+	if *dryRun {
+		n, err := e.ds.CountDispatched(ctx, f)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(e.stdout, "%d messages would be replayed\n", n)
+
+		return nil
+	}
+
+	n, err := e.ds.Replay(ctx, f, outboxer.DynamicValues(override))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(e.stdout, "%d messages replayed\n", n)
+
+	return nil
+}
+
+func purgeCmd(ctx context.Context, e *env, args []string) error {
+	var before timeFlag
+
+	fs := newFlagSet("purge", e)
+	fs.Var(&before, "before", "remove messages dispatched before the given RFC3339 time or duration ago (required)")
+	batchSize := fs.Int("batch", 100, "how many messages are removed at a time")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if before.IsZero() {
+		return errors.New("purge needs -before")
+	}
+
+	if err := checkSize("-batch", *batchSize); err != nil {
+		return err
+	}
+
+	f := outboxer.ReplayFilter{DispatchedBefore: before.Time}
+
+	var purged int64
+
+	for {
+		n, err := e.ds.CountDispatched(ctx, f)
+		if err != nil {
+			return err
+		}
+
+		if n == 0 {
+			break
+		}
+
+		if err := e.ds.Remove(ctx, before.Time, int32(*batchSize)); err != nil {
+			return err
+		}
+
+		left, err := e.ds.CountDispatched(ctx, f)
+		if err != nil {
+			return err
+		}
+
+		if left >= n {
+			return fmt.Errorf("no progress while purging, %d messages left", left)
+		}
+
+		purged += n - left
+	}
+
+	fmt.Fprintf(e.stdout, "%d messages purged\n", purged)
+
+	return nil
+}
+
+func migrateCmd(ctx context.Context, e *env, args []string) error {
+	if err := newFlagSet("migrate", e).Parse(args); err != nil {
+		return err
+	}
+
+	if err := e.ds.Migrate(ctx); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(e.stdout, "outbox table is up to date")
+
+	return nil
+}
+
+func exportCmd(ctx context.Context, e *env, args []string) error {
+	fs := newFlagSet("export", e)
+	output := fs.String("o", "-", "output file, - for stdout")
+	pending := fs.Bool("pending", false, "only export pending messages")
+	dispatched := fs.Bool("dispatched", false, "only export dispatched messages")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	f := outboxer.ListFilter{Limit: exportBatchSize}
+
+	switch {
+	case *pending && *dispatched:
+		return errors.New("-pending and -dispatched can't be used together")
+	case *pending:
+		f.State = outboxer.PendingState
+	case *dispatched:
+		f.State = outboxer.DispatchedState
+	}
+
+	w, err := createOutput(*output, e.stdout)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	now := time.Now()
+
+	var exported int
+
+	for {
+		msgs, err := e.ds.ListEvents(ctx, f)
+		if err != nil {
+			w.Close()
+			return err
+		}
+
+		if len(msgs) == 0 {
+			break
+		}
+
+		for _, m := range msgs {
+			if err := enc.Encode(jsonl.NewRecord(m, now)); err != nil {
+				w.Close()
+				return err
+			}
+		}
+
+		exported += len(msgs)
+		f.AfterID = msgs[len(msgs)-1].ID
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	if *output != "-" {
+		fmt.Fprintf(e.stdout, "%d messages exported\n", exported)
+	}
+
+	return nil
+}
+
+func importCmd(ctx context.Context, e *env, args []string) error {
+	fs := newFlagSet("import", e)
+	input := fs.String("i", "-", "input file, - for stdin")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	r, err := openInput(*input, e.stdin)
+	if err != nil {
+		return err
+	}
+
+	defer r.Close()
+
+	records := jsonl.NewReader(r)
+
+	var imported int
+
+	for {
+		rec, err := records.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+
+		if err != nil {
+			return err
+		}
+
+		m := rec.Message()
+		if err := e.ds.Add(ctx, &outboxer.OutboxMessage{
+			Payload:   m.Payload,
+			Options:   m.Options,
+			Headers:   m.Headers,
+			CreatedAt: m.CreatedAt,
+		}); err != nil {
+			return fmt.Errorf("failed to import message %d: %w", rec.ID, err)
+		}
+
+		imported++
+	}
+
+	fmt.Fprintf(e.stdout, "%d messages imported\n", imported)
+
+	return nil
+}
+
+// checkSize checks that a number of messages given with a flag fits the int32 the data stores take.
+func checkSize(name string, n int) error {
+	if n < 1 || n > math.MaxInt32 {
+		return fmt.Errorf("%s must be between 1 and %d, got %d", name, math.MaxInt32, n)
+	}
+
+	return nil
+}
+
+func newFlagSet(name string, e *env) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(e.stdout)
+
+	return fs
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// createOutput opens the export output, compressing it when the file name ends with .gz.
+func createOutput(path string, stdout io.Writer) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopWriteCloser{stdout}, nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	bw := bufio.NewWriter(f)
+
+	if !strings.HasSuffix(path, ".gz") {
+		return &fileWriter{Writer: bw, buf: bw, f: f}, nil
+	}
+
+	gz := gzip.NewWriter(bw)
+
+	return &fileWriter{Writer: gz, gz: gz, buf: bw, f: f}, nil
+}
+
+type fileWriter struct {
+	io.Writer
+	gz  *gzip.Writer
+	buf *bufio.Writer
+	f   *os.File
+}
+
+func (w *fileWriter) Close() error {
+	if w.gz != nil {
+		if err := w.gz.Close(); err != nil {
+			w.f.Close()
+			return err
+		}
+	}
+
+	if err := w.buf.Flush(); err != nil {
+		w.f.Close()
+		return err
+	}
+
+	return w.f.Close()
+}
+
+// openInput opens the import input, decompressing it when the file name ends with .gz.
+func openInput(path string, stdin io.Reader) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(stdin), nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasSuffix(path, ".gz") {
+		return f, nil
+	}
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return &gzipReader{Reader: gz, f: f}, nil
+}
+
+type gzipReader struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (r *gzipReader) Close() error {
+	if err := r.Reader.Close(); err != nil {
+		r.f.Close()
+		return err
+	}
+
+	return r.f.Close()
+}
+
+// valuesFlag collects repeated key=value flags. Values are parsed as JSON, so numbers and booleans keep
+// their type, anything that is not valid JSON is taken as a plain string.
+type valuesFlag outboxer.DynamicValues
+
+func (v valuesFlag) String() string {
+	pairs := make([]string, 0, len(v))
+	for k, val := range v {
+		pairs = append(pairs, fmt.Sprintf("%s=%v", k, val))
+	}
+
+	return strings.Join(pairs, ",")
+}
+
+func (v valuesFlag) Set(s string) error {
+	k, val, ok := strings.Cut(s, "=")
+	if !ok || k == "" {
+		return fmt.Errorf("%q is not a key=value pair", s)
+	}
+
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(val), &parsed); err != nil {
+		parsed = val
+	}
+
+	v[k] = parsed
+
+	return nil
+}
+
+// timeFlag accepts an RFC3339 time or a duration, which is subtracted from the current time.
+type timeFlag struct {
+	time.Time
+}
+
+func (t *timeFlag) String() string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format(time.RFC3339)
+}
+
+func (t *timeFlag) Set(s string) error {
+	if d, err := time.ParseDuration(s); err == nil {
+		t.Time = time.Now().Add(-d)
+		return nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return fmt.Errorf("%q is neither an RFC3339 time nor a duration", s)
+	}
+
+	t.Time = parsed
+
+	return nil
+}
@@ -0,0 +1,186 @@
+// Command outboxctl operates an outbox table through the outboxer data stores.
+//
+// Usage:
+//
+//	outboxctl [-driver postgres|mysql|sqlserver] [-dsn dsn] [-table name] <command> [arguments]
+//
+// The data source name can also be set with the OUTBOX_DSN environment variable.
+// Only the migrate command changes the schema, the others expect the outbox table to be migrated already.
+// Run "outboxctl help" to list the commands.
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	_ "github.com/microsoft/go-mssqldb"
+
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/storage/mysql"
+	"github.com/italolelis/outboxer/storage/postgres"
+	"github.com/italolelis/outboxer/storage/sqlserver"
+)
+
+// ErrUnknownDriver is used when the driver is not one of the supported data stores.
+var ErrUnknownDriver = errors.New("unknown driver")
+
+// store is what outboxctl needs from a data store.
+type store interface {
+	outboxer.DataStore
+	outboxer.Inspector
+	outboxer.Replayer
+	outboxer.FailureTracker
+	Migrate(ctx context.Context) error
+	Close() error
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+type config struct {
+	driver string
+	dsn    string
+	table  string
+	// ddl lets the data store create and migrate the outbox table when it is opened.
+	ddl bool
+}
+
+// openStore connects to the outbox table. It is a variable so tests can replace it.
+var openStore = func(ctx context.Context, cfg config) (store, io.Closer, error) {
+	db, err := sql.Open(cfg.driver, cfg.dsn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to the database: %w", err)
+	}
+
+	ds, err := newStore(ctx, db, cfg)
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+
+	return ds, closerFunc(func() error {
+		if err := ds.Close(); err != nil {
+			db.Close()
+			return err
+		}
+
+		return db.Close()
+	}), nil
+}
+
+// newStore opens the data store with WithoutDDL unless cfg.ddl is set, so the commands that only
+// read and write messages never change the schema.
+func newStore(ctx context.Context, db *sql.DB, cfg config) (store, error) {
+	switch cfg.driver {
+	case "postgres":
+		var opts []postgres.Option
+		if cfg.table != "" {
+			opts = append(opts, postgres.WithEventStoreTable(cfg.table))
+		}
+
+		if !cfg.ddl {
+			opts = append(opts, postgres.WithoutDDL())
+		}
+
+		return postgres.WithInstance(ctx, db, opts...)
+	case "mysql":
+		var opts []mysql.Option
+		if cfg.table != "" {
+			opts = append(opts, mysql.WithEventStoreTable(cfg.table))
+		}
+
+		if !cfg.ddl {
+			opts = append(opts, mysql.WithoutDDL())
+		}
+
+		return mysql.WithInstance(ctx, db, opts...)
+	case "sqlserver":
+		var opts []sqlserver.Option
+		if cfg.table != "" {
+			opts = append(opts, sqlserver.WithEventStoreTable(cfg.table))
+		}
+
+		if !cfg.ddl {
+			opts = append(opts, sqlserver.WithoutDDL())
+		}
+
+		return sqlserver.WithInstance(ctx, db, opts...)
+	default:
+		return nil, fmt.Errorf("%w %q", ErrUnknownDriver, cfg.driver)
+	}
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := run(ctx, os.Args[1:], os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "outboxctl: %s\n", err)
+		stop()
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer) error {
+	var cfg config
+
+	fs := flag.NewFlagSet("outboxctl", flag.ContinueOnError)
+	fs.SetOutput(stdout)
+	fs.StringVar(&cfg.driver, "driver", "postgres", "database driver: postgres, mysql or sqlserver")
+	fs.StringVar(&cfg.dsn, "dsn", os.Getenv("OUTBOX_DSN"), "data source name, defaults to $OUTBOX_DSN")
+	fs.StringVar(&cfg.table, "table", "", "outbox table name")
+	fs.Usage = func() { usage(fs) }
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() == 0 || fs.Arg(0) == "help" {
+		usage(fs)
+		return nil
+	}
+
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		usage(fs)
+		return fmt.Errorf("unknown command %q", fs.Arg(0))
+	}
+
+	cfg.ddl = cmd.ddl
+
+	ds, closer, err := openStore(ctx, cfg)
+	if err != nil {
+		return err
+	}
+
+	defer closer.Close()
+
+	return cmd.run(ctx, &env{ds: ds, stdin: stdin, stdout: stdout}, fs.Args()[1:])
+}
+
+func usage(fs *flag.FlagSet) {
+	out := fs.Output()
+
+	fmt.Fprintln(out, "Usage: outboxctl [flags] <command> [arguments]")
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Commands:")
+
+	for _, name := range commandNames {
+		fmt.Fprintf(out, "  %-10s %s\n", name, commands[name].help)
+	}
+
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Flags:")
+	fs.PrintDefaults()
+}
@@ -0,0 +1,609 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/italolelis/outboxer"
+)
+
+type fakeStore struct {
+	msgs   []*outboxer.OutboxMessage
+	mu     sync.Mutex
+	nextID int64
+}
+
+func (s *fakeStore) GetEvents(_ context.Context, batchSize int32) ([]*outboxer.OutboxMessage, error) {
+	return s.ListEvents(context.Background(), outboxer.ListFilter{State: outboxer.PendingState, Limit: batchSize})
+}
+
+func (s *fakeStore) Add(_ context.Context, m *outboxer.OutboxMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.nextID++
+	m.ID = s.nextID
+	s.msgs = append(s.msgs, m)
+
+	return nil
+}
+
+func (s *fakeStore) AddWithinTx(ctx context.Context, m *outboxer.OutboxMessage, _ func(outboxer.ExecerContext) error) error {
+	return s.Add(ctx, m)
+}
+
+func (s *fakeStore) SetAsDispatched(_ context.Context, id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.msgs {
+		if m.ID == id {
+			m.Dispatched = true
+			m.DispatchedAt = sql.NullTime{Time: time.Now(), Valid: true}
+		}
+	}
+
+	return nil
+}
+
+func (s *fakeStore) Remove(_ context.Context, since time.Time, batchSize int32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var (
+		kept    []*outboxer.OutboxMessage
+		removed int32
+	)
+
+	for _, m := range s.msgs {
+		if removed < batchSize && m.Dispatched && m.DispatchedAt.Time.Before(since) {
+			removed++
+			continue
+		}
+
+		kept = append(kept, m)
+	}
+
+	s.msgs = kept
+
+	return nil
+}
+
+func (s *fakeStore) Stats(context.Context) (*outboxer.Stats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stats outboxer.Stats
+
+	for _, m := range s.msgs {
+		if m.Dead {
+			stats.Dead++
+			continue
+		}
+
+		if !m.Dispatched {
+			stats.Pending++
+
+			if m.Attempts > 0 {
+				stats.Failed++
+			}
+
+			if !stats.OldestPendingID.Valid {
+				stats.OldestPendingID = sql.NullInt64{Int64: m.ID, Valid: true}
+			}
+
+			continue
+		}
+
+		stats.Dispatched++
+
+		if m.DispatchedAt.Time.After(stats.LastDispatchedAt.Time) {
+			stats.LastDispatchedAt = m.DispatchedAt
+		}
+	}
+
+	return &stats, nil
+}
+
+func (s *fakeStore) GetEvent(_ context.Context, id int64) (*outboxer.OutboxMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.msgs {
+		if m.ID == id {
+			return m, nil
+		}
+	}
+
+	return nil, outboxer.ErrMessageNotFound
+}
+
+func (s *fakeStore) ListEvents(_ context.Context, f outboxer.ListFilter) ([]*outboxer.OutboxMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var msgs []*outboxer.OutboxMessage
+
+	for _, m := range s.msgs {
+		if int32(len(msgs)) == f.Limit {
+			break
+		}
+
+		if m.ID <= f.AfterID ||
+			(f.State == outboxer.PendingState && (m.Dispatched || m.Dead)) ||
+			(f.State == outboxer.DispatchedState && !m.Dispatched) ||
+			(f.State == outboxer.FailedState && (m.Dispatched || m.Dead || m.Attempts == 0)) ||
+			(f.State == outboxer.DeadState && !m.Dead) {
+			continue
+		}
+
+		msgs = append(msgs, m)
+	}
+
+	return msgs, nil
+}
+
+func (s *fakeStore) matches(m *outboxer.OutboxMessage, f outboxer.ReplayFilter) bool {
+	if !m.Dispatched {
+		return false
+	}
+
+	if (f.FromID > 0 && m.ID < f.FromID) || (f.ToID > 0 && m.ID > f.ToID) {
+		return false
+	}
+
+	if !f.DispatchedAfter.IsZero() && m.DispatchedAt.Time.Before(f.DispatchedAfter) {
+		return false
+	}
+
+	if !f.DispatchedBefore.IsZero() && !m.DispatchedAt.Time.Before(f.DispatchedBefore) {
+		return false
+	}
+
+	for k, v := range f.Destination {
+		if m.Options[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (s *fakeStore) CountDispatched(_ context.Context, f outboxer.ReplayFilter) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+
+	for _, m := range s.msgs {
+		if s.matches(m, f) {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (s *fakeStore) GetDispatched(_ context.Context, f outboxer.ReplayFilter, afterID int64, batchSize int32) ([]*outboxer.OutboxMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var msgs []*outboxer.OutboxMessage
+
+	for _, m := range s.msgs {
+		if m.ID > afterID && s.matches(m, f) && int32(len(msgs)) < batchSize {
+			msgs = append(msgs, m)
+		}
+	}
+
+	return msgs, nil
+}
+
+func (s *fakeStore) Replay(_ context.Context, f outboxer.ReplayFilter, override outboxer.DynamicValues) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+
+	for _, m := range s.msgs {
+		if !s.matches(m, f) {
+			continue
+		}
+
+		m.Dispatched = false
+		m.DispatchedAt = sql.NullTime{}
+
+		for k, v := range override {
+			if m.Options == nil {
+				m.Options = outboxer.DynamicValues{}
+			}
+
+			m.Options[k] = v
+		}
+
+		n++
+	}
+
+	return n, nil
+}
+
+func (s *fakeStore) SetAsFailed(_ context.Context, id int64, reason string, maxAttempts int32) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, m := range s.msgs {
+		if m.ID == id {
+			m.Attempts++
+			m.LastError = reason
+			m.Dead = maxAttempts > 0 && m.Attempts >= maxAttempts
+		}
+	}
+
+	return nil
+}
+
+func (s *fakeStore) Requeue(_ context.Context, ids ...int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+
+	for _, m := range s.msgs {
+		for _, id := range ids {
+			if m.ID == id && m.Dead {
+				m.Dead = false
+				m.Attempts = 0
+				m.LastError = ""
+				n++
+			}
+		}
+	}
+
+	return n, nil
+}
+
+func (s *fakeStore) Migrate(context.Context) error {
+	return nil
+}
+
+func (s *fakeStore) Close() error {
+	return nil
+}
+
+func newFakeStore(t *testing.T) *fakeStore {
+	t.Helper()
+
+	ds := &fakeStore{}
+	ctx := context.Background()
+
+	for _, exchange := range []string{"orders", "orders", "payments"} {
+		if err := ds.Add(ctx, &outboxer.OutboxMessage{
+			Payload: []byte("test payload"),
+			Options: outboxer.DynamicValues{"exchange.name": exchange},
+		}); err != nil {
+			t.Fatalf("failed to add message: %s", err)
+		}
+	}
+
+	if err := ds.SetAsDispatched(ctx, 1); err != nil {
+		t.Fatalf("failed to dispatch message: %s", err)
+	}
+
+	if err := ds.SetAsDispatched(ctx, 3); err != nil {
+		t.Fatalf("failed to dispatch message: %s", err)
+	}
+
+	prev := openStore
+	openStore = func(context.Context, config) (store, io.Closer, error) {
+		return ds, ds, nil
+	}
+
+	t.Cleanup(func() { openStore = prev })
+
+	return ds
+}
+
+func runCmd(t *testing.T, stdin io.Reader, args ...string) (string, error) {
+	t.Helper()
+
+	var out bytes.Buffer
+	err := run(context.Background(), args, stdin, &out)
+
+	return out.String(), err
+}
+
+func TestRun(t *testing.T) {
+	t.Run("stats", func(t *testing.T) {
+		newFakeStore(t)
+
+		out, err := runCmd(t, nil, "stats")
+		if err != nil {
+			t.Fatalf("failed to run stats: %s", err)
+		}
+
+		if !strings.Contains(out, "pending             1") || !strings.Contains(out, "oldest pending id   2") {
+			t.Fatalf("unexpected stats output:\n%s", out)
+		}
+
+		if !strings.Contains(out, "failed              0") || !strings.Contains(out, "dead                0") {
+			t.Fatalf("unexpected stats output:\n%s", out)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		newFakeStore(t)
+
+		out, err := runCmd(t, nil, "list", "-dispatched")
+		if err != nil {
+			t.Fatalf("failed to run list: %s", err)
+		}
+
+		if lines := strings.Split(strings.TrimSpace(out), "\n"); len(lines) != 3 {
+			t.Fatalf("expected a header and 2 messages, got:\n%s", out)
+		}
+
+		if _, err := runCmd(t, nil, "list", "-pending", "-dead"); err == nil {
+			t.Fatal("expected the states to be exclusive")
+		}
+
+		for _, limit := range []string{"-1", "0", "2147483648"} {
+			if _, err := runCmd(t, nil, "list", "-limit", limit); err == nil {
+				t.Fatalf("expected -limit %s to be rejected", limit)
+			}
+		}
+	})
+
+	t.Run("list dead", func(t *testing.T) {
+		ds := newFakeStore(t)
+
+		if err := ds.SetAsFailed(context.Background(), 2, "broker unavailable", 1); err != nil {
+			t.Fatalf("failed to set message as failed: %s", err)
+		}
+
+		out, err := runCmd(t, nil, "list", "-dead")
+		if err != nil {
+			t.Fatalf("failed to run list: %s", err)
+		}
+
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		if len(lines) != 2 || !strings.HasPrefix(lines[1], "2   dead") || !strings.HasSuffix(lines[1], "broker unavailable") {
+			t.Fatalf("expected a header and the dead message, got:\n%s", out)
+		}
+	})
+
+	t.Run("show", func(t *testing.T) {
+		newFakeStore(t)
+
+		out, err := runCmd(t, nil, "show", "-raw", "2")
+		if err != nil {
+			t.Fatalf("failed to run show: %s", err)
+		}
+
+		if out != "test payload" {
+			t.Fatalf("unexpected payload %q", out)
+		}
+
+		if _, err := runCmd(t, nil, "show", "10"); !errors.Is(err, outboxer.ErrMessageNotFound) {
+			t.Fatalf("expected message not to be found, got %v", err)
+		}
+	})
+
+	t.Run("requeue", func(t *testing.T) {
+		ds := newFakeStore(t)
+
+		if _, err := runCmd(t, nil, "requeue", "1", "2"); err != nil {
+			t.Fatalf("failed to run requeue: %s", err)
+		}
+
+		stats, _ := ds.Stats(context.Background())
+		if stats.Pending != 2 {
+			t.Fatalf("expected 2 pending messages, got %d", stats.Pending)
+		}
+
+		if err := ds.SetAsFailed(context.Background(), 2, "broker unavailable", 1); err != nil {
+			t.Fatalf("failed to set message as failed: %s", err)
+		}
+
+		out, err := runCmd(t, nil, "requeue", "2")
+		if err != nil {
+			t.Fatalf("failed to run requeue: %s", err)
+		}
+
+		m, _ := ds.GetEvent(context.Background(), 2)
+		if out != "message 2 requeued\n" || m.Dead || m.Attempts != 0 {
+			t.Fatalf("expected the dead message to be requeued, got %q and %+v", out, m)
+		}
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		ds := newFakeStore(t)
+
+		out, err := runCmd(t, nil, "replay", "-dest", "exchange.name=payments", "-dry-run")
+		if err != nil {
+			t.Fatalf("failed to run replay: %s", err)
+		}
+
+		if out != "1 messages would be replayed\n" {
+			t.Fatalf("unexpected replay output %q", out)
+		}
+
+		if _, err := runCmd(t, nil, "replay", "-dest", "exchange.name=payments", "-set", "exchange.name=refunds"); err != nil {
+			t.Fatalf("failed to run replay: %s", err)
+		}
+
+		m, _ := ds.GetEvent(context.Background(), 3)
+		if m.Dispatched || m.Options["exchange.name"] != "refunds" {
+			t.Fatalf("expected message to be replayed with the new options, got %+v", m)
+		}
+	})
+
+	t.Run("replay without filter", func(t *testing.T) {
+		ds := newFakeStore(t)
+
+		if _, err := runCmd(t, nil, "replay"); err == nil {
+			t.Fatal("expected replay to require a filter")
+		}
+
+		if _, err := runCmd(t, nil, "replay", "-dry-run"); err == nil {
+			t.Fatal("expected a dry run to require a filter")
+		}
+
+		out, err := runCmd(t, nil, "replay", "-all", "-set", "priority=5", "-set", "urgent=true", "-set", `code="5"`)
+		if err != nil {
+			t.Fatalf("failed to run replay: %s", err)
+		}
+
+		if out != "2 messages replayed\n" {
+			t.Fatalf("unexpected replay output %q", out)
+		}
+
+		m, _ := ds.GetEvent(context.Background(), 1)
+		if m.Dispatched || m.Options["priority"] != float64(5) || m.Options["urgent"] != true || m.Options["code"] != "5" {
+			t.Fatalf("expected message to be replayed with JSON options, got %+v", m)
+		}
+	})
+
+	t.Run("purge", func(t *testing.T) {
+		ds := newFakeStore(t)
+
+		if _, err := runCmd(t, nil, "purge"); err == nil {
+			t.Fatal("expected purge to require -before")
+		}
+
+		out, err := runCmd(t, nil, "purge", "-before", "-1m", "-batch", "1")
+		if err != nil {
+			t.Fatalf("failed to run purge: %s", err)
+		}
+
+		if out != "2 messages purged\n" || len(ds.msgs) != 1 {
+			t.Fatalf("unexpected purge result %q with %d messages left", out, len(ds.msgs))
+		}
+	})
+
+	t.Run("export and import", func(t *testing.T) {
+		createdAt := time.Date(2023, time.May, 1, 10, 0, 0, 0, time.UTC)
+		for _, m := range newFakeStore(t).msgs {
+			m.CreatedAt = createdAt
+		}
+
+		file := filepath.Join(t.TempDir(), "outbox.jsonl.gz")
+
+		if _, err := runCmd(t, nil, "export", "-o", file); err != nil {
+			t.Fatalf("failed to run export: %s", err)
+		}
+
+		ds := newFakeStore(t)
+
+		out, err := runCmd(t, nil, "import", "-i", file)
+		if err != nil {
+			t.Fatalf("failed to run import: %s", err)
+		}
+
+		if out != "3 messages imported\n" || len(ds.msgs) != 6 || ds.msgs[5].Dispatched {
+			t.Fatalf("unexpected import result %q with %d messages", out, len(ds.msgs))
+		}
+
+		if !ds.msgs[5].CreatedAt.Equal(createdAt) {
+			t.Fatalf("expected the imported message to keep its creation time, got %s", ds.msgs[5].CreatedAt)
+		}
+	})
+
+	t.Run("unknown command", func(t *testing.T) {
+		if _, err := runCmd(t, nil, "nope"); err == nil {
+			t.Fatal("expected an error for an unknown command")
+		}
+	})
+}
+
+func TestRun_DDL(t *testing.T) {
+	for _, name := range commandNames {
+		name := name
+
+		t.Run(name, func(t *testing.T) {
+			ds := newFakeStore(t)
+
+			var ddl bool
+			openStore = func(_ context.Context, cfg config) (store, io.Closer, error) {
+				ddl = cfg.ddl
+				return ds, ds, nil
+			}
+
+			// the commands may fail on missing arguments, only the way the store is opened matters
+			_, _ = runCmd(t, strings.NewReader(""), name)
+
+			if ddl != (name == "migrate") {
+				t.Fatalf("expected only migrate to open the data store with DDL, %s got %t", name, ddl)
+			}
+		})
+	}
+}
+
+func TestNewStore_WithoutDDL(t *testing.T) {
+	cases := []struct {
+		driver string
+		expect func(mock sqlmock.Sqlmock)
+	}{
+		{
+			driver: "postgres",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT CURRENT_DATABASE()`).
+					WillReturnRows(sqlmock.NewRows([]string{"current_database"}).AddRow("test"))
+				mock.ExpectQuery(`SELECT CURRENT_SCHEMA()`).
+					WillReturnRows(sqlmock.NewRows([]string{"current_schema"}).AddRow("public"))
+				mock.ExpectQuery(`SELECT (.+) FROM event_store WHERE 1 = 0`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			},
+		},
+		{
+			driver: "mysql",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT DATABASE()`).
+					WillReturnRows(sqlmock.NewRows([]string{"database"}).AddRow("test"))
+				mock.ExpectQuery(`SELECT (.+) FROM event_store WHERE 1 = 0`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			},
+		},
+		{
+			driver: "sqlserver",
+			expect: func(mock sqlmock.Sqlmock) {
+				mock.ExpectQuery(`SELECT DB_NAME()`).
+					WillReturnRows(sqlmock.NewRows([]string{"db_name"}).AddRow("test"))
+				mock.ExpectQuery(`SELECT SCHEMA_NAME()`).
+					WillReturnRows(sqlmock.NewRows([]string{"schema_name"}).AddRow("dbo"))
+				mock.ExpectQuery(`SELECT (.+) FROM \[dbo\]\.\[event_store\] WHERE 1 = 0`).
+					WillReturnRows(sqlmock.NewRows([]string{"id"}))
+			},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.driver, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+
+			defer db.Close()
+
+			// any other statement, such as a CREATE TABLE, fails the test
+			c.expect(mock)
+
+			if _, err := newStore(context.Background(), db, config{driver: c.driver}); err != nil {
+				t.Fatalf("failed to open the data store: %s", err)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
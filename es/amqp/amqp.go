@@ -56,6 +56,20 @@ func NewAMQP(conn *amqp.Connection) *AMQP {
 
 // Send sends the message to the event stream.
 func (r *AMQP) Send(ctx context.Context, evt *outboxer.OutboxMessage) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("exchange publish: %w", err)
+	}
+
+	opts, err := r.parseOptions(evt.Options)
+	if err != nil {
+		return err
+	}
+
+	headers := amqp.Table(evt.Headers)
+	if err := headers.Validate(); err != nil {
+		return fmt.Errorf("%w: %s", outboxer.ErrInvalidOption, err)
+	}
+
 	ch, err := r.conn.Channel()
 	if err != nil {
 		return err
@@ -63,7 +77,6 @@ func (r *AMQP) Send(ctx context.Context, evt *outboxer.OutboxMessage) error {
 
 	defer ch.Close()
 
-	opts := r.parseOptions(evt.Options)
 	if err := ch.ExchangeDeclare(
 		opts.exchange,     // name
 		opts.exchangeType, // type
@@ -86,7 +99,7 @@ func (r *AMQP) Send(ctx context.Context, evt *outboxer.OutboxMessage) error {
 			Body:         evt.Payload,
 			DeliveryMode: amqp.Transient, // 1=non-persistent, 2=persistent
 			Priority:     0,              // 0-9
-			Headers:      amqp.Table(evt.Headers),
+			Headers:      headers,
 		},
 	); err != nil {
 		return fmt.Errorf("exchange publish: %w", err)
@@ -95,36 +108,33 @@ func (r *AMQP) Send(ctx context.Context, evt *outboxer.OutboxMessage) error {
 	return nil
 }
 
-func (r *AMQP) parseOptions(opts outboxer.DynamicValues) *options {
+func (r *AMQP) parseOptions(opts outboxer.DynamicValues) (*options, error) {
 	opt := options{exchangeType: defaultExchangeType, durable: true}
 
-	if data, ok := opts[ExchangeNameOption]; ok {
-		opt.exchange = data.(string)
-	}
-
-	if data, ok := opts[ExchangeTypeOption]; ok {
-		opt.exchangeType = data.(string)
-	}
-
-	if data, ok := opts[ExchangeDurable]; ok {
-		opt.durable = data.(bool)
-	}
-
-	if data, ok := opts[ExchangeAutoDelete]; ok {
-		opt.autoDelete = data.(bool)
-	}
-
-	if data, ok := opts[ExchangeInternal]; ok {
-		opt.internal = data.(bool)
-	}
-
-	if data, ok := opts[ExchangeNoWait]; ok {
-		opt.noWait = data.(bool)
+	for key, dst := range map[string]*string{
+		ExchangeNameOption: &opt.exchange,
+		ExchangeTypeOption: &opt.exchangeType,
+		RoutingKeyOption:   &opt.routingKey,
+	} {
+		if v, ok, err := opts.GetString(key); err != nil {
+			return nil, err
+		} else if ok {
+			*dst = v
+		}
 	}
 
-	if data, ok := opts[RoutingKeyOption]; ok {
-		opt.routingKey = data.(string)
+	for key, dst := range map[string]*bool{
+		ExchangeDurable:    &opt.durable,
+		ExchangeAutoDelete: &opt.autoDelete,
+		ExchangeInternal:   &opt.internal,
+		ExchangeNoWait:     &opt.noWait,
+	} {
+		if v, ok, err := opts.GetBool(key); err != nil {
+			return nil, err
+		} else if ok {
+			*dst = v
+		}
 	}
 
-	return &opt
+	return &opt, nil
 }
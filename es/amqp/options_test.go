@@ -0,0 +1,41 @@
+package amqp_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/es/amqp"
+)
+
+func TestAMQP_InvalidOptions(t *testing.T) {
+	cases := []struct {
+		name    string
+		options outboxer.DynamicValues
+		headers outboxer.DynamicValues
+	}{
+		{name: "exchange name", options: outboxer.DynamicValues{amqp.ExchangeNameOption: 42}},
+		{name: "durable", options: outboxer.DynamicValues{amqp.ExchangeDurable: "true"}},
+		{name: "routing key", options: outboxer.DynamicValues{amqp.RoutingKeyOption: []byte("key")}},
+		{name: "headers", headers: outboxer.DynamicValues{"invalid": struct{}{}}},
+	}
+
+	// The options are checked before a channel is opened, so no connection is needed.
+	es := amqp.NewAMQP(nil)
+
+	for _, c := range cases {
+		c := c
+
+		t.Run(c.name, func(t *testing.T) {
+			err := es.Send(context.Background(), &outboxer.OutboxMessage{
+				Payload: []byte("test payload"),
+				Options: c.options,
+				Headers: c.headers,
+			})
+			if !errors.Is(err, outboxer.ErrInvalidOption) {
+				t.Fatalf("expected outboxer.ErrInvalidOption, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,304 @@
+// Package estest is a conformance suite for event streams, with in-process fakes of the brokers
+// used by the built-in event streams. It checks that an event stream parses its options, keeps the headers,
+// reports wrong option types as errors instead of panicking, honours the context and, when it is an
+// outboxer.BatchSender, reports the messages of a batch that failed.
+//
+//	func TestMyStream(t *testing.T) {
+//		estest.RunEventStreamTests(t, estest.Suite{
+//			New: func(t *testing.T) estest.Stream {
+//				broker := newFakeBroker()
+//				return estest.Stream{EventStream: mystream.New(broker), Received: broker.Messages}
+//			},
+//			Options:        outboxer.DynamicValues{mystream.TopicOption: "orders"},
+//			InvalidOptions: []outboxer.DynamicValues{{mystream.TopicOption: 42}},
+//		})
+//	}
+package estest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/italolelis/outboxer"
+)
+
+// Stream is an event stream under test, together with the messages its broker received.
+type Stream struct {
+	EventStream outboxer.EventStream
+	// Received returns the messages the broker received, in order, with their options and headers
+	// decoded back from the broker requests.
+	Received func() []*outboxer.OutboxMessage
+}
+
+// Suite describes the event stream under test.
+type Suite struct {
+	// New creates an event stream with a new, empty broker. It is called once per test,
+	// the resources it creates should be released with t.Cleanup.
+	New func(t *testing.T) Stream
+	// Options route a message, the broker must receive them as they were sent.
+	Options outboxer.DynamicValues
+	// InvalidOptions each set an option to a value of the wrong type, sending with them
+	// must fail with outboxer.ErrInvalidOption.
+	InvalidOptions []outboxer.DynamicValues
+	// NoHeaders is set for event streams whose broker can't carry headers, they are not checked then.
+	NoHeaders bool
+}
+
+// RunEventStreamTests runs the conformance suite against the event streams created by s.New.
+// The batch tests are skipped when the event stream is not an outboxer.BatchSender.
+func RunEventStreamTests(t *testing.T, s Suite) {
+	t.Run("OptionsParsed", func(t *testing.T) { testOptionsParsed(t, s, s.Options) })
+	t.Run("OptionsFromJSON", func(t *testing.T) { testOptionsParsed(t, s, fromJSON(t, s.Options)) })
+	t.Run("HeadersPreserved", func(t *testing.T) { testHeadersPreserved(t, s) })
+	t.Run("InvalidOptions", func(t *testing.T) { testInvalidOptions(t, s) })
+	t.Run("InvalidHeaders", func(t *testing.T) { testInvalidHeaders(t, s) })
+	t.Run("ContextCanceled", func(t *testing.T) { testContextCanceled(t, s) })
+	t.Run("Batch", func(t *testing.T) { testBatch(t, s) })
+	t.Run("BatchPartialFailure", func(t *testing.T) { testBatchPartialFailure(t, s) })
+	t.Run("BatchContextCanceled", func(t *testing.T) { testBatchContextCanceled(t, s) })
+}
+
+// testOptionsParsed sends a message with the given options, which are the options of the suite
+// or their JSON round trip, and checks that the broker got the options of the suite.
+func testOptionsParsed(t *testing.T, s Suite, opts outboxer.DynamicValues) {
+	stream := s.New(t)
+
+	if err := send(t, stream.EventStream, context.Background(), message("payload", opts)); err != nil {
+		t.Fatalf("failed to send message: %s", err)
+	}
+
+	got := received(t, stream, 1)[0]
+
+	if string(got.Payload) != "payload" {
+		t.Errorf("expected payload %q, got %q", "payload", got.Payload)
+	}
+
+	for k, v := range s.Options {
+		if !reflect.DeepEqual(got.Options[k], v) {
+			t.Errorf("expected option %s to be %#v, got %#v", k, v, got.Options[k])
+		}
+	}
+}
+
+func testHeadersPreserved(t *testing.T, s Suite) {
+	if s.NoHeaders {
+		t.Skip("the event stream can't carry headers")
+	}
+
+	stream := s.New(t)
+	headers := outboxer.DynamicValues{"trace_id": "abc", "tenant": "acme"}
+
+	m := message("payload", s.Options)
+	m.Headers = headers
+
+	if err := send(t, stream.EventStream, context.Background(), m); err != nil {
+		t.Fatalf("failed to send message: %s", err)
+	}
+
+	if got := received(t, stream, 1)[0]; !reflect.DeepEqual(got.Headers, headers) {
+		t.Errorf("expected headers %v, got %v", headers, got.Headers)
+	}
+}
+
+func testInvalidOptions(t *testing.T, s Suite) {
+	if len(s.InvalidOptions) == 0 {
+		t.Skip("the suite has no invalid options")
+	}
+
+	for _, invalid := range s.InvalidOptions {
+		stream := s.New(t)
+		opts := merge(s.Options, invalid)
+
+		err := send(t, stream.EventStream, context.Background(), message("payload", opts))
+		if !errors.Is(err, outboxer.ErrInvalidOption) {
+			t.Errorf("expected outboxer.ErrInvalidOption for options %v, got %v", opts, err)
+		}
+
+		received(t, stream, 0)
+	}
+}
+
+func testInvalidHeaders(t *testing.T, s Suite) {
+	if s.NoHeaders {
+		t.Skip("the event stream can't carry headers")
+	}
+
+	stream := s.New(t)
+
+	m := message("payload", s.Options)
+	m.Headers = outboxer.DynamicValues{"invalid": struct{}{}}
+
+	if err := send(t, stream.EventStream, context.Background(), m); !errors.Is(err, outboxer.ErrInvalidOption) {
+		t.Errorf("expected outboxer.ErrInvalidOption, got %v", err)
+	}
+
+	received(t, stream, 0)
+}
+
+func testContextCanceled(t *testing.T, s Suite) {
+	stream := s.New(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := send(t, stream.EventStream, ctx, message("payload", s.Options)); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	received(t, stream, 0)
+}
+
+func testBatch(t *testing.T, s Suite) {
+	stream := s.New(t)
+	b := batchSender(t, stream)
+
+	msgs := []*outboxer.OutboxMessage{
+		message("a", s.Options),
+		message("b", s.Options),
+		message("c", s.Options),
+	}
+
+	if err := sendBatch(t, b, context.Background(), msgs); err != nil {
+		t.Fatalf("failed to send batch: %s", err)
+	}
+
+	got := received(t, stream, len(msgs))
+	for i, m := range msgs {
+		if string(got[i].Payload) != string(m.Payload) {
+			t.Errorf("expected message %d to be %q, got %q", i, m.Payload, got[i].Payload)
+		}
+	}
+}
+
+func testBatchPartialFailure(t *testing.T, s Suite) {
+	if len(s.InvalidOptions) == 0 {
+		t.Skip("the suite has no invalid options")
+	}
+
+	stream := s.New(t)
+	b := batchSender(t, stream)
+
+	msgs := []*outboxer.OutboxMessage{
+		message("a", s.Options),
+		message("invalid", merge(s.Options, s.InvalidOptions[0])),
+		message("c", s.Options),
+	}
+
+	err := sendBatch(t, b, context.Background(), msgs)
+
+	var batchErr *outboxer.BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("expected a *outboxer.BatchError, got %v", err)
+	}
+
+	if len(batchErr.Errors) != 1 || !errors.Is(batchErr.Errors[1], outboxer.ErrInvalidOption) {
+		t.Fatalf("expected only message 1 to fail with outboxer.ErrInvalidOption, got %v", batchErr.Errors)
+	}
+
+	got := received(t, stream, 2)
+	if string(got[0].Payload) != "a" || string(got[1].Payload) != "c" {
+		t.Errorf("expected messages a and c to be received, got %q and %q", got[0].Payload, got[1].Payload)
+	}
+}
+
+func testBatchContextCanceled(t *testing.T, s Suite) {
+	stream := s.New(t)
+	b := batchSender(t, stream)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	msgs := []*outboxer.OutboxMessage{message("a", s.Options), message("b", s.Options)}
+
+	if err := sendBatch(t, b, ctx, msgs); !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+
+	received(t, stream, 0)
+}
+
+func batchSender(t *testing.T, stream Stream) outboxer.BatchSender {
+	t.Helper()
+
+	b, ok := stream.EventStream.(outboxer.BatchSender)
+	if !ok {
+		t.Skip("the event stream is not an outboxer.BatchSender")
+	}
+
+	return b
+}
+
+// send sends the message and fails the test if the event stream panics.
+func send(t *testing.T, es outboxer.EventStream, ctx context.Context, m *outboxer.OutboxMessage) (err error) {
+	t.Helper()
+
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("Send panicked: %v", r)
+		}
+	}()
+
+	return es.Send(ctx, m)
+}
+
+// sendBatch sends the messages and fails the test if the event stream panics.
+func sendBatch(t *testing.T, b outboxer.BatchSender, ctx context.Context, msgs []*outboxer.OutboxMessage) (err error) {
+	t.Helper()
+
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("SendBatch panicked: %v", r)
+		}
+	}()
+
+	return b.SendBatch(ctx, msgs)
+}
+
+// received checks that the broker received n messages and returns them.
+func received(t *testing.T, stream Stream, n int) []*outboxer.OutboxMessage {
+	t.Helper()
+
+	msgs := stream.Received()
+	if len(msgs) != n {
+		t.Fatalf("expected the broker to receive %d messages, got %d", n, len(msgs))
+	}
+
+	return msgs
+}
+
+func message(payload string, opts outboxer.DynamicValues) *outboxer.OutboxMessage {
+	return &outboxer.OutboxMessage{Payload: []byte(payload), Options: merge(opts)}
+}
+
+// merge copies the values, the later ones taking precedence.
+func merge(values ...outboxer.DynamicValues) outboxer.DynamicValues {
+	merged := make(outboxer.DynamicValues)
+
+	for _, v := range values {
+		for k, val := range v {
+			merged[k] = val
+		}
+	}
+
+	return merged
+}
+
+// fromJSON round trips the options through JSON, as the data stores do, so numbers become float64.
+func fromJSON(t *testing.T, opts outboxer.DynamicValues) outboxer.DynamicValues {
+	t.Helper()
+
+	data, err := json.Marshal(opts)
+	if err != nil {
+		t.Fatalf("failed to encode options: %s", err)
+	}
+
+	var decoded outboxer.DynamicValues
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatalf("failed to decode options: %s", err)
+	}
+
+	return decoded
+}
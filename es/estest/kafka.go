@@ -0,0 +1,143 @@
+package estest
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+// Kafka is an in-process Kafka cluster, from kfake, with a client that is connected to it.
+type Kafka struct {
+	// Cluster is the fake cluster, it can be used to inject errors with Control.
+	Cluster *kfake.Cluster
+	// Client is connected to the fake cluster.
+	Client *kgo.Client
+
+	topics []string
+}
+
+// NewKafka starts a fake Kafka cluster with the given topics, each with the given number of partitions.
+// The client is created with opts. The cluster and the client are closed when the test ends.
+func NewKafka(t testing.TB, partitions int32, topics []string, opts ...kgo.Opt) *Kafka {
+	t.Helper()
+
+	c, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(partitions, topics...))
+	if err != nil {
+		t.Fatalf("failed to start the fake kafka cluster: %s", err)
+	}
+
+	t.Cleanup(c.Close)
+
+	client, err := kgo.NewClient(append([]kgo.Opt{kgo.SeedBrokers(c.ListenAddrs()...)}, opts...)...)
+	if err != nil {
+		t.Fatalf("failed to create the kafka client: %s", err)
+	}
+
+	t.Cleanup(client.Close)
+
+	return &Kafka{Cluster: c, Client: client, topics: topics}
+}
+
+// Records consumes every record of the topics, ordered by topic, partition and offset.
+func (f *Kafka) Records(t testing.TB) []*kgo.Record {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	want := f.endOffsets(ctx, t)
+	if want == 0 {
+		return nil
+	}
+
+	consumer, err := kgo.NewClient(
+		kgo.SeedBrokers(f.Cluster.ListenAddrs()...),
+		kgo.ConsumeTopics(f.topics...),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+	)
+	if err != nil {
+		t.Fatalf("failed to create the kafka consumer: %s", err)
+	}
+
+	defer consumer.Close()
+
+	var records []*kgo.Record
+
+	for int64(len(records)) < want {
+		fetches := consumer.PollFetches(ctx)
+		if err := ctx.Err(); err != nil {
+			t.Fatalf("consumed %d of %d records: %s", len(records), want, err)
+		}
+
+		records = append(records, fetches.Records()...)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		a, b := records[i], records[j]
+		if a.Topic != b.Topic {
+			return a.Topic < b.Topic
+		}
+
+		if a.Partition != b.Partition {
+			return a.Partition < b.Partition
+		}
+
+		return a.Offset < b.Offset
+	})
+
+	return records
+}
+
+// endOffsets returns the number of records in the topics, the sum of the end offsets of their partitions.
+func (f *Kafka) endOffsets(ctx context.Context, t testing.TB) int64 {
+	t.Helper()
+
+	meta := kmsg.NewPtrMetadataRequest()
+
+	for _, topic := range f.topics {
+		mt := kmsg.NewMetadataRequestTopic()
+		mt.Topic = kmsg.StringPtr(topic)
+		meta.Topics = append(meta.Topics, mt)
+	}
+
+	metaResp, err := meta.RequestWith(ctx, f.Client)
+	if err != nil {
+		t.Fatalf("failed to get the metadata of the topics: %s", err)
+	}
+
+	list := kmsg.NewPtrListOffsetsRequest()
+
+	for _, topic := range metaResp.Topics {
+		lt := kmsg.NewListOffsetsRequestTopic()
+		lt.Topic = *topic.Topic
+
+		for _, p := range topic.Partitions {
+			lp := kmsg.NewListOffsetsRequestTopicPartition()
+			lp.Partition = p.Partition
+			lp.Timestamp = -1 // the end offset
+			lt.Partitions = append(lt.Partitions, lp)
+		}
+
+		list.Topics = append(list.Topics, lt)
+	}
+
+	listResp, err := list.RequestWith(ctx, f.Client)
+	if err != nil {
+		t.Fatalf("failed to list the offsets of the topics: %s", err)
+	}
+
+	var total int64
+
+	for _, topic := range listResp.Topics {
+		for _, p := range topic.Partitions {
+			total += p.Offset
+		}
+	}
+
+	return total
+}
@@ -0,0 +1,117 @@
+package estest
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
+)
+
+const (
+	// maxKinesisBatchRecords is the limit of records in a single PutRecords call.
+	maxKinesisBatchRecords = 500
+
+	// kinesisShardID is the only shard of the fake streams.
+	kinesisShardID = "shardId-000000000000"
+)
+
+// Kinesis is an in-process fake of the Kinesis API used by es/kinesis, it is safe for concurrent use.
+// It records the records it is put, the records of a batch are recorded as single records.
+type Kinesis struct {
+	kinesisiface.KinesisAPI
+
+	// Reject fails the records whose data it returns true for, as Kinesis does when a shard is throttled.
+	// It must be set before putting records.
+	Reject func(data []byte) bool
+
+	mu      sync.Mutex
+	records []*kinesis.PutRecordInput
+}
+
+// NewKinesis creates a fake Kinesis that accepts every record.
+func NewKinesis() *Kinesis {
+	return &Kinesis{}
+}
+
+// PutRecordWithContext records the record.
+func (f *Kinesis) PutRecordWithContext(
+	ctx aws.Context,
+	in *kinesis.PutRecordInput,
+	_ ...request.Option,
+) (*kinesis.PutRecordOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, awserr.New(request.CanceledErrorCode, "request context canceled", err)
+	}
+
+	if f.Reject != nil && f.Reject(in.Data) {
+		return nil, awserr.New(kinesis.ErrCodeProvisionedThroughputExceededException, "the record was rejected", nil)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.records = append(f.records, in)
+
+	return &kinesis.PutRecordOutput{
+		SequenceNumber: aws.String(strconv.Itoa(len(f.records))),
+		ShardId:        aws.String(kinesisShardID),
+	}, nil
+}
+
+// PutRecordsWithContext records the records that are not rejected and reports the others as failed.
+func (f *Kinesis) PutRecordsWithContext(
+	ctx aws.Context,
+	in *kinesis.PutRecordsInput,
+	_ ...request.Option,
+) (*kinesis.PutRecordsOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, awserr.New(request.CanceledErrorCode, "request context canceled", err)
+	}
+
+	if len(in.Records) > maxKinesisBatchRecords {
+		return nil, awserr.New(kinesis.ErrCodeInvalidArgumentException, "too many records in the batch", nil)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	out := kinesis.PutRecordsOutput{FailedRecordCount: aws.Int64(0)}
+
+	for _, r := range in.Records {
+		if f.Reject != nil && f.Reject(r.Data) {
+			*out.FailedRecordCount++
+			out.Records = append(out.Records, &kinesis.PutRecordsResultEntry{
+				ErrorCode:    aws.String(kinesis.ErrCodeProvisionedThroughputExceededException),
+				ErrorMessage: aws.String("the record was rejected"),
+			})
+
+			continue
+		}
+
+		f.records = append(f.records, &kinesis.PutRecordInput{
+			StreamName:      in.StreamName,
+			Data:            r.Data,
+			ExplicitHashKey: r.ExplicitHashKey,
+			PartitionKey:    r.PartitionKey,
+		})
+
+		out.Records = append(out.Records, &kinesis.PutRecordsResultEntry{
+			SequenceNumber: aws.String(strconv.Itoa(len(f.records))),
+			ShardId:        aws.String(kinesisShardID),
+		})
+	}
+
+	return &out, nil
+}
+
+// Records returns the records that were put, in order.
+func (f *Kinesis) Records() []*kinesis.PutRecordInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]*kinesis.PutRecordInput(nil), f.records...)
+}
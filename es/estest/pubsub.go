@@ -0,0 +1,104 @@
+package estest
+
+import (
+	"context"
+	"path"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"cloud.google.com/go/pubsub/pstest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// PubsubProject is the project of the fake Pub/Sub client.
+const PubsubProject = "project"
+
+// Pubsub is an in-process Pub/Sub server, from pstest, with a client that is connected to it.
+// It records the messages published through the client, with the topic they were published to.
+type Pubsub struct {
+	// Server is the fake server, it can be used to inject publish errors.
+	Server *pstest.Server
+	// Client is connected to the fake server.
+	Client *pubsub.Client
+
+	mu        sync.Mutex
+	published []*PubsubMessage
+}
+
+// PubsubMessage is a message published to a topic.
+type PubsubMessage struct {
+	*pubsubpb.PubsubMessage
+	// Topic is the id of the topic, without the project.
+	Topic string
+}
+
+// NewPubsub starts a fake Pub/Sub server with the given topics. The server and the client
+// are closed when the test ends.
+func NewPubsub(t testing.TB, topics ...string) *Pubsub {
+	t.Helper()
+
+	ctx := context.Background()
+	f := Pubsub{Server: pstest.NewServer()}
+
+	t.Cleanup(func() { f.Server.Close() })
+
+	conn, err := grpc.Dial(
+		f.Server.Addr,
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		grpc.WithUnaryInterceptor(f.record),
+	)
+	if err != nil {
+		t.Fatalf("failed to connect to the fake pubsub server: %s", err)
+	}
+
+	f.Client, err = pubsub.NewClient(ctx, PubsubProject, option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatalf("failed to create the pubsub client: %s", err)
+	}
+
+	t.Cleanup(func() { f.Client.Close() })
+
+	for _, id := range topics {
+		if _, err := f.Client.CreateTopic(ctx, id); err != nil {
+			t.Fatalf("failed to create topic %s: %s", id, err)
+		}
+	}
+
+	return &f
+}
+
+// Published returns the messages that were published successfully, in order.
+func (f *Pubsub) Published() []*PubsubMessage {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]*PubsubMessage(nil), f.published...)
+}
+
+// record is a client interceptor that records the messages of the publish requests that succeed.
+func (f *Pubsub) record(
+	ctx context.Context,
+	method string,
+	req, reply interface{},
+	cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker,
+	opts ...grpc.CallOption,
+) error {
+	if err := invoker(ctx, method, req, reply, cc, opts...); err != nil {
+		return err
+	}
+
+	if r, ok := req.(*pubsubpb.PublishRequest); ok {
+		f.mu.Lock()
+		for _, m := range r.Messages {
+			f.published = append(f.published, &PubsubMessage{PubsubMessage: m, Topic: path.Base(r.Topic)})
+		}
+		f.mu.Unlock()
+	}
+
+	return nil
+}
@@ -0,0 +1,41 @@
+package estest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// Redis is an in-process Redis server, from miniredis, with a client that is connected to it.
+type Redis struct {
+	// Server is the fake server, it can be used to inject errors with SetError.
+	Server *miniredis.Miniredis
+	// Client is connected to the fake server.
+	Client *redis.Client
+}
+
+// NewRedis starts a fake Redis server. The server and the client are closed when the test ends.
+func NewRedis(t testing.TB) *Redis {
+	t.Helper()
+
+	f := Redis{Server: miniredis.RunT(t)}
+	f.Client = redis.NewClient(&redis.Options{Addr: f.Server.Addr()})
+
+	t.Cleanup(func() { f.Client.Close() })
+
+	return &f
+}
+
+// Entries returns the entries of a stream, in order.
+func (f *Redis) Entries(t testing.TB, stream string) []redis.XMessage {
+	t.Helper()
+
+	entries, err := f.Client.XRange(context.Background(), stream, "-", "+").Result()
+	if err != nil {
+		t.Fatalf("failed to read stream %s: %s", stream, err)
+	}
+
+	return entries
+}
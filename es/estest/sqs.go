@@ -0,0 +1,112 @@
+package estest
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// maxSQSBatchEntries is the limit of messages in a single SendMessageBatch call.
+const maxSQSBatchEntries = 10
+
+// SQS is an in-process fake of the SQS API used by es/sqs, it is safe for concurrent use.
+// It records the messages it is sent, the entries of a batch are recorded as single messages.
+type SQS struct {
+	sqsiface.SQSAPI
+
+	// Reject fails the messages whose body it returns true for, as SQS does with invalid messages.
+	// It must be set before sending.
+	Reject func(body string) bool
+
+	mu   sync.Mutex
+	sent []*sqs.SendMessageInput
+}
+
+// NewSQS creates a fake SQS that accepts every message.
+func NewSQS() *SQS {
+	return &SQS{}
+}
+
+// SendMessageWithContext records the message.
+func (f *SQS) SendMessageWithContext(
+	ctx aws.Context,
+	in *sqs.SendMessageInput,
+	_ ...request.Option,
+) (*sqs.SendMessageOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, awserr.New(request.CanceledErrorCode, "request context canceled", err)
+	}
+
+	if f.Reject != nil && f.Reject(aws.StringValue(in.MessageBody)) {
+		return nil, awserr.New(sqs.ErrCodeInvalidMessageContents, "the message was rejected", nil)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.sent = append(f.sent, in)
+
+	return &sqs.SendMessageOutput{MessageId: aws.String(strconv.Itoa(len(f.sent)))}, nil
+}
+
+// SendMessageBatchWithContext records the entries that are not rejected and reports the others as failed.
+func (f *SQS) SendMessageBatchWithContext(
+	ctx aws.Context,
+	in *sqs.SendMessageBatchInput,
+	_ ...request.Option,
+) (*sqs.SendMessageBatchOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, awserr.New(request.CanceledErrorCode, "request context canceled", err)
+	}
+
+	if len(in.Entries) > maxSQSBatchEntries {
+		return nil, awserr.New(sqs.ErrCodeTooManyEntriesInBatchRequest, "too many entries in the batch", nil)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var out sqs.SendMessageBatchOutput
+
+	for _, e := range in.Entries {
+		if f.Reject != nil && f.Reject(aws.StringValue(e.MessageBody)) {
+			out.Failed = append(out.Failed, &sqs.BatchResultErrorEntry{
+				Id:          e.Id,
+				Code:        aws.String(sqs.ErrCodeInvalidMessageContents),
+				Message:     aws.String("the message was rejected"),
+				SenderFault: aws.Bool(true),
+			})
+
+			continue
+		}
+
+		f.sent = append(f.sent, &sqs.SendMessageInput{
+			QueueUrl:               in.QueueUrl,
+			MessageBody:            e.MessageBody,
+			DelaySeconds:           e.DelaySeconds,
+			MessageAttributes:      e.MessageAttributes,
+			MessageGroupId:         e.MessageGroupId,
+			MessageDeduplicationId: e.MessageDeduplicationId,
+		})
+
+		out.Successful = append(out.Successful, &sqs.SendMessageBatchResultEntry{
+			Id:        e.Id,
+			MessageId: aws.String(strconv.Itoa(len(f.sent))),
+		})
+	}
+
+	return &out, nil
+}
+
+// Sent returns the messages that were sent, in order.
+func (f *SQS) Sent() []*sqs.SendMessageInput {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]*sqs.SendMessageInput(nil), f.sent...)
+}
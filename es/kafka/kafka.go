@@ -0,0 +1,239 @@
+// Package kafka is the Kafka implementation of an event stream, on top of franz-go.
+package kafka
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+
+	"github.com/italolelis/outboxer"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+const (
+	// TopicOption is the topic option. The default produce topic of the client is used when it is not set.
+	TopicOption = "topic"
+
+	// KeyOption is the record key option.
+	KeyOption = "key"
+
+	// PartitionOption is the partition option. It is only honoured when the client uses the
+	// partitioner of ProducerOpts, otherwise the records are partitioned by key.
+	PartitionOption = "partition"
+)
+
+// Kafka is the wrapper for the franz-go client.
+type Kafka struct {
+	client *kgo.Client
+}
+
+// New creates a new instance of Kafka. The client should be created with ProducerOpts.
+func New(client *kgo.Client) *Kafka {
+	return &Kafka{client: client}
+}
+
+// ProducerOpts returns the client options the event stream relies on. Writes are idempotent and acknowledged
+// by all the in-sync replicas, so a message is only set as dispatched once it can't be lost or duplicated
+// by the producer retries. Records are partitioned by PartitionOption when it is set, by key otherwise.
+func ProducerOpts() []kgo.Opt {
+	return []kgo.Opt{
+		kgo.RequiredAcks(kgo.AllISRAcks()),
+		kgo.RecordPartitioner(Partitioner(kgo.UniformBytesPartitioner(64<<10, true, true, nil))),
+	}
+}
+
+// Send produces the message and waits for the broker to acknowledge it. The headers are sent as record headers.
+func (k *Kafka) Send(ctx context.Context, evt *outboxer.OutboxMessage) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+
+	r, err := record(ctx, evt)
+	if err != nil {
+		return err
+	}
+
+	if err := k.client.ProduceSync(ctx, r).FirstErr(); err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+
+	return nil
+}
+
+// SendBatch produces all the messages before waiting for the broker to acknowledge them, so the client
+// batches them. It returns a *outboxer.BatchError with the messages that failed.
+func (k *Kafka) SendBatch(ctx context.Context, msgs []*outboxer.OutboxMessage) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("failed to publish messages: %w", err)
+	}
+
+	var (
+		mu     sync.Mutex
+		wg     sync.WaitGroup
+		failed = make(map[int]error)
+	)
+
+	for i, evt := range msgs {
+		r, err := record(ctx, evt)
+		if err != nil {
+			failed[i] = err
+			continue
+		}
+
+		i := i
+
+		wg.Add(1)
+		k.client.Produce(ctx, r, func(_ *kgo.Record, err error) {
+			defer wg.Done()
+
+			if err != nil {
+				mu.Lock()
+				failed[i] = fmt.Errorf("failed to publish message: %w", err)
+				mu.Unlock()
+			}
+		})
+	}
+
+	wg.Wait()
+
+	if len(failed) > 0 {
+		return &outboxer.BatchError{Errors: failed}
+	}
+
+	return nil
+}
+
+// partitionKey marks, in the context of a record, that its partition was set by PartitionOption.
+type partitionKey struct{}
+
+func record(ctx context.Context, evt *outboxer.OutboxMessage) (*kgo.Record, error) {
+	r := kgo.Record{Value: evt.Payload, Context: ctx}
+
+	if v, ok, err := evt.Options.GetString(TopicOption); err != nil {
+		return nil, err
+	} else if ok {
+		r.Topic = v
+	}
+
+	if v, ok, err := evt.Options.GetString(KeyOption); err != nil {
+		return nil, err
+	} else if ok {
+		r.Key = []byte(v)
+	}
+
+	if v, ok, err := evt.Options.GetInt64(PartitionOption); err != nil {
+		return nil, err
+	} else if ok {
+		if v < 0 || v > math.MaxInt32 {
+			return nil, fmt.Errorf("%w: %s must be a partition number, got %d", outboxer.ErrInvalidOption, PartitionOption, v)
+		}
+
+		r.Partition = int32(v)
+		r.Context = context.WithValue(ctx, partitionKey{}, true)
+	}
+
+	headers, err := parseHeaders(evt.Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Headers = headers
+
+	return &r, nil
+}
+
+// parseHeaders maps the headers to record headers, which are bytes. Numbers and bools are formatted.
+func parseHeaders(headers outboxer.DynamicValues) ([]kgo.RecordHeader, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+
+	hs := make([]kgo.RecordHeader, 0, len(headers))
+
+	for key, value := range headers {
+		var v []byte
+
+		switch val := value.(type) {
+		case string:
+			v = []byte(val)
+		case []byte:
+			v = val
+		case bool:
+			v = []byte(strconv.FormatBool(val))
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+			v = []byte(fmt.Sprint(val))
+		default:
+			return nil, fmt.Errorf("%w: header %s must be a string, a number, bytes or a bool, got %T", outboxer.ErrInvalidOption, key, value)
+		}
+
+		hs = append(hs, kgo.RecordHeader{Key: key, Value: v})
+	}
+
+	return hs, nil
+}
+
+// Partitioner returns a partitioner that sends the records with a PartitionOption to that partition,
+// and the others to the partition chosen by fallback. A partition that doesn't exist fails the record.
+func Partitioner(fallback kgo.Partitioner) kgo.Partitioner {
+	return partitioner{fallback: fallback}
+}
+
+type partitioner struct {
+	fallback kgo.Partitioner
+}
+
+func (p partitioner) ForTopic(topic string) kgo.TopicPartitioner {
+	tp := &topicPartitioner{fallback: p.fallback.ForTopic(topic)}
+
+	// The client changes how it buffers records when the partitioner reacts to new batches,
+	// so OnNewBatch is only there when the fallback has it.
+	if _, ok := tp.fallback.(kgo.TopicPartitionerOnNewBatch); ok {
+		return batchTopicPartitioner{tp}
+	}
+
+	return tp
+}
+
+// topicPartitioner always implements kgo.TopicBackupPartitioner, which the client then calls
+// instead of Partition, and passes the backup to the fallback when it uses it.
+type topicPartitioner struct {
+	fallback kgo.TopicPartitioner
+}
+
+func (p *topicPartitioner) RequiresConsistency(r *kgo.Record) bool {
+	return manual(r) || p.fallback.RequiresConsistency(r)
+}
+
+func (p *topicPartitioner) Partition(r *kgo.Record, n int) int {
+	if manual(r) {
+		return int(r.Partition)
+	}
+
+	return p.fallback.Partition(r, n)
+}
+
+func (p *topicPartitioner) PartitionByBackup(r *kgo.Record, n int, backup kgo.TopicBackupIter) int {
+	if manual(r) {
+		return int(r.Partition)
+	}
+
+	if b, ok := p.fallback.(kgo.TopicBackupPartitioner); ok {
+		return b.PartitionByBackup(r, n, backup)
+	}
+
+	return p.fallback.Partition(r, n)
+}
+
+type batchTopicPartitioner struct {
+	*topicPartitioner
+}
+
+func (p batchTopicPartitioner) OnNewBatch() {
+	p.fallback.(kgo.TopicPartitionerOnNewBatch).OnNewBatch()
+}
+
+func manual(r *kgo.Record) bool {
+	return r.Context != nil && r.Context.Value(partitionKey{}) != nil
+}
@@ -0,0 +1,183 @@
+package kafka_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/es/estest"
+	"github.com/italolelis/outboxer/es/kafka"
+)
+
+// decodeKafka maps the records of the fake back to outbox messages, ordered by topic, partition and offset.
+func decodeKafka(t testing.TB, f *estest.Kafka) []*outboxer.OutboxMessage {
+	records := f.Records(t)
+	msgs := make([]*outboxer.OutboxMessage, len(records))
+
+	for i, r := range records {
+		m := outboxer.OutboxMessage{
+			Payload: r.Value,
+			Options: outboxer.DynamicValues{
+				kafka.TopicOption:     r.Topic,
+				kafka.PartitionOption: int64(r.Partition),
+			},
+		}
+
+		if r.Key != nil {
+			m.Options[kafka.KeyOption] = string(r.Key)
+		}
+
+		for _, h := range r.Headers {
+			if m.Headers == nil {
+				m.Headers = outboxer.DynamicValues{}
+			}
+
+			m.Headers[h.Key] = string(h.Value)
+		}
+
+		msgs[i] = &m
+	}
+
+	return msgs
+}
+
+func TestKafka_Conformance(t *testing.T) {
+	estest.RunEventStreamTests(t, estest.Suite{
+		New: func(t *testing.T) estest.Stream {
+			fake := estest.NewKafka(t, 1, []string{"orders"}, kafka.ProducerOpts()...)
+
+			return estest.Stream{
+				EventStream: kafka.New(fake.Client),
+				Received:    func() []*outboxer.OutboxMessage { return decodeKafka(t, fake) },
+			}
+		},
+		Options: outboxer.DynamicValues{
+			kafka.TopicOption:     "orders",
+			kafka.KeyOption:       "customer-1",
+			kafka.PartitionOption: int64(0),
+		},
+		InvalidOptions: []outboxer.DynamicValues{
+			{kafka.TopicOption: 42},
+			{kafka.KeyOption: true},
+			{kafka.PartitionOption: "0"},
+			{kafka.PartitionOption: 1.5},
+			{kafka.PartitionOption: -1},
+		},
+	})
+}
+
+func TestKafka_Partition(t *testing.T) {
+	ctx := context.Background()
+	fake := estest.NewKafka(t, 3, []string{"orders"}, kafka.ProducerOpts()...)
+	es := kafka.New(fake.Client)
+
+	for i := 0; i < 6; i++ {
+		err := es.Send(ctx, &outboxer.OutboxMessage{
+			Payload: []byte(fmt.Sprint(i)),
+			Options: outboxer.DynamicValues{kafka.TopicOption: "orders", kafka.PartitionOption: i % 3},
+		})
+		if err != nil {
+			t.Fatalf("failed to send message %d: %s", i, err)
+		}
+	}
+
+	for _, m := range decodeKafka(t, fake) {
+		var i int64
+		if _, err := fmt.Sscan(string(m.Payload), &i); err != nil {
+			t.Fatalf("failed to parse payload %q: %s", m.Payload, err)
+		}
+
+		if got := m.Options[kafka.PartitionOption]; got != i%3 {
+			t.Errorf("expected message %d in partition %d, got %v", i, i%3, got)
+		}
+	}
+}
+
+func TestKafka_Key(t *testing.T) {
+	ctx := context.Background()
+	fake := estest.NewKafka(t, 3, []string{"orders"}, kafka.ProducerOpts()...)
+	es := kafka.New(fake.Client)
+
+	for i := 0; i < 5; i++ {
+		err := es.Send(ctx, &outboxer.OutboxMessage{
+			Payload: []byte(fmt.Sprint(i)),
+			Options: outboxer.DynamicValues{kafka.TopicOption: "orders", kafka.KeyOption: "customer-1"},
+		})
+		if err != nil {
+			t.Fatalf("failed to send message %d: %s", i, err)
+		}
+	}
+
+	msgs := decodeKafka(t, fake)
+	if len(msgs) != 5 {
+		t.Fatalf("expected 5 records, got %d", len(msgs))
+	}
+
+	// The records with the same key are in the same partition, in the order they were sent.
+	for i, m := range msgs {
+		if m.Options[kafka.PartitionOption] != msgs[0].Options[kafka.PartitionOption] {
+			t.Errorf("expected all the records in partition %v, got %v", msgs[0].Options[kafka.PartitionOption], m.Options[kafka.PartitionOption])
+		}
+
+		if got := string(m.Payload); got != fmt.Sprint(i) {
+			t.Errorf("expected record %d to be %d, got %s", i, i, got)
+		}
+	}
+}
+
+func TestKafka_SendBatch(t *testing.T) {
+	ctx := context.Background()
+	fake := estest.NewKafka(t, 1, []string{"orders"}, kafka.ProducerOpts()...)
+
+	var msgs []*outboxer.OutboxMessage
+
+	for i := 0; i < 5; i++ {
+		// The topic only has partition 0, the record sent to partition 5 fails in the client.
+		partition := 0
+		if i == 2 {
+			partition = 5
+		}
+
+		msgs = append(msgs, &outboxer.OutboxMessage{
+			Payload: []byte(fmt.Sprintf("message %d", i)),
+			Options: outboxer.DynamicValues{kafka.TopicOption: "orders", kafka.PartitionOption: partition},
+			Headers: outboxer.DynamicValues{"index": i},
+		})
+	}
+
+	err := kafka.New(fake.Client).SendBatch(ctx, msgs)
+
+	var batchErr *outboxer.BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("expected a batch error, got %v", err)
+	}
+
+	if len(batchErr.Errors) != 1 || batchErr.Errors[2] == nil {
+		t.Fatalf("expected message 2 to fail, got %v", batchErr.Errors)
+	}
+
+	got := decodeKafka(t, fake)
+	if len(got) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(got))
+	}
+
+	for i, want := range []string{"0", "1", "3", "4"} {
+		if index := got[i].Headers["index"]; index != want {
+			t.Errorf("expected record %d to have the index header %s, got %v", i, want, index)
+		}
+	}
+}
+
+func TestKafka_BrokerError(t *testing.T) {
+	fake := estest.NewKafka(t, 1, []string{"orders"}, kafka.ProducerOpts()...)
+
+	err := kafka.New(fake.Client).Send(context.Background(), &outboxer.OutboxMessage{
+		Payload: []byte("test payload"),
+		Options: outboxer.DynamicValues{kafka.TopicOption: "unknown"},
+	})
+	if err == nil {
+		t.Fatal("expected the send to an unknown topic to fail")
+	}
+}
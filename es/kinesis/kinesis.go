@@ -23,7 +23,10 @@ const (
 	PartitionKeyOption = "partition_key"
 
 	// SequenceNumberForOrderingOption is the sequence number for ordering option.
-	SequenceNumberForOrderingOption = "partition_key"
+	SequenceNumberForOrderingOption = "sequence_number_for_ordering"
+
+	// maxBatchRecords is the limit of records in a single PutRecords call.
+	maxBatchRecords = 500
 )
 
 // Kinesis is the wrapper for the Kinesis library.
@@ -43,11 +46,18 @@ func New(conn kinesisiface.KinesisAPI) *Kinesis {
 	return &Kinesis{conn: conn}
 }
 
-// Send sends the message to the event stream.
+// Send sends the message to the event stream. Kinesis records have no headers, so they are not sent.
 func (r *Kinesis) Send(ctx context.Context, evt *outboxer.OutboxMessage) error {
-	opts := r.parseOptions(evt.Options)
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+
+	opts, err := r.parseOptions(evt.Options)
+	if err != nil {
+		return err
+	}
 
-	_, err := r.conn.PutRecordWithContext(ctx, &kinesis.PutRecordInput{
+	_, err = r.conn.PutRecordWithContext(ctx, &kinesis.PutRecordInput{
 		Data:                      evt.Payload,
 		StreamName:                opts.streamName,
 		ExplicitHashKey:           opts.explicitHashKey,
@@ -61,24 +71,148 @@ func (r *Kinesis) Send(ctx context.Context, evt *outboxer.OutboxMessage) error {
 	return nil
 }
 
-func (r *Kinesis) parseOptions(opts outboxer.DynamicValues) *options {
+// SendBatch sends the messages with PutRecords, grouped by stream in batches of up to 500 records.
+// PutRecords doesn't take a sequence number for ordering, so when a message has one the messages are
+// sent one by one with Send, in order. It returns a *outboxer.BatchError with the messages that failed.
+func (r *Kinesis) SendBatch(ctx context.Context, msgs []*outboxer.OutboxMessage) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("failed to publish messages: %w", err)
+	}
+
+	failed := make(map[int]error)
+
+	if ordered(msgs) {
+		for i, evt := range msgs {
+			if err := r.Send(ctx, evt); err != nil {
+				failed[i] = err
+			}
+		}
+
+		if len(failed) > 0 {
+			return &outboxer.BatchError{Errors: failed}
+		}
+
+		return nil
+	}
+
+	var streams []string
+
+	batches := make(map[string][]int)
+	entries := make([]*kinesis.PutRecordsRequestEntry, len(msgs))
+
+	for i, evt := range msgs {
+		opts, err := r.parseOptions(evt.Options)
+		if err != nil {
+			failed[i] = err
+			continue
+		}
+
+		stream := aws.StringValue(opts.streamName)
+		if _, ok := batches[stream]; !ok {
+			streams = append(streams, stream)
+		}
+
+		batches[stream] = append(batches[stream], i)
+		entries[i] = &kinesis.PutRecordsRequestEntry{
+			Data:            evt.Payload,
+			ExplicitHashKey: opts.explicitHashKey,
+			PartitionKey:    opts.partitionKey,
+		}
+	}
+
+	for _, stream := range streams {
+		idx := batches[stream]
+
+		for len(idx) > 0 {
+			n := len(idx)
+			if n > maxBatchRecords {
+				n = maxBatchRecords
+			}
+
+			r.putRecords(ctx, stream, idx[:n], entries, failed)
+			idx = idx[n:]
+		}
+	}
+
+	if len(failed) > 0 {
+		return &outboxer.BatchError{Errors: failed}
+	}
+
+	return nil
+}
+
+// putRecords sends a single PutRecords call and records the failed messages by their index.
+func (r *Kinesis) putRecords(
+	ctx context.Context,
+	stream string,
+	idx []int,
+	entries []*kinesis.PutRecordsRequestEntry,
+	failed map[int]error,
+) {
+	records := make([]*kinesis.PutRecordsRequestEntry, len(idx))
+	for j, i := range idx {
+		records[j] = entries[i]
+	}
+
+	out, err := r.conn.PutRecordsWithContext(ctx, &kinesis.PutRecordsInput{
+		StreamName: aws.String(stream),
+		Records:    records,
+	})
+	if err != nil {
+		for _, i := range idx {
+			failed[i] = fmt.Errorf("failed to publish message: %w", err)
+		}
+
+		return
+	}
+
+	// The results are in the same order as the records.
+	for j, res := range out.Records {
+		if j < len(idx) && res.ErrorCode != nil {
+			failed[idx[j]] = fmt.Errorf(
+				"failed to publish message: %s: %s", aws.StringValue(res.ErrorCode), aws.StringValue(res.ErrorMessage),
+			)
+		}
+	}
+}
+
+// ordered reports if any of the messages has a sequence number for ordering.
+func ordered(msgs []*outboxer.OutboxMessage) bool {
+	for _, evt := range msgs {
+		if _, ok := evt.Options[SequenceNumberForOrderingOption]; ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *Kinesis) parseOptions(opts outboxer.DynamicValues) (*options, error) {
 	opt := options{partitionKey: aws.String(time.Now().Format(time.RFC3339Nano))}
 
-	if data, ok := opts[StreamNameOption]; ok {
-		opt.streamName = aws.String(data.(string))
+	if v, ok, err := opts.GetString(StreamNameOption); err != nil {
+		return nil, err
+	} else if ok {
+		opt.streamName = aws.String(v)
 	}
 
-	if data, ok := opts[ExplicitHashKeyOption]; ok {
-		opt.explicitHashKey = aws.String(data.(string))
+	if v, ok, err := opts.GetString(ExplicitHashKeyOption); err != nil {
+		return nil, err
+	} else if ok {
+		opt.explicitHashKey = aws.String(v)
 	}
 
-	if data, ok := opts[PartitionKeyOption]; ok {
-		opt.partitionKey = aws.String(data.(string))
+	if v, ok, err := opts.GetString(PartitionKeyOption); err != nil {
+		return nil, err
+	} else if ok {
+		opt.partitionKey = aws.String(v)
 	}
 
-	if data, ok := opts[SequenceNumberForOrderingOption]; ok {
-		opt.sequenceNumberForOrdering = aws.String(data.(string))
+	if v, ok, err := opts.GetString(SequenceNumberForOrderingOption); err != nil {
+		return nil, err
+	} else if ok {
+		opt.sequenceNumberForOrdering = aws.String(v)
 	}
 
-	return &opt
+	return &opt, nil
 }
@@ -2,6 +2,8 @@ package kinesis_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"testing"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -9,6 +11,7 @@ import (
 	kinesisraw "github.com/aws/aws-sdk-go/service/kinesis"
 	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
 	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/es/estest"
 	"github.com/italolelis/outboxer/es/kinesis"
 )
 
@@ -35,3 +38,181 @@ func TestKinesis_EventStream(t *testing.T) {
 		t.Fatalf("an error was not expected: %s", err)
 	}
 }
+
+// decodeKinesis maps the records put to the fake back to outbox messages.
+func decodeKinesis(records []*kinesisraw.PutRecordInput) []*outboxer.OutboxMessage {
+	msgs := make([]*outboxer.OutboxMessage, len(records))
+
+	for i, r := range records {
+		m := outboxer.OutboxMessage{Payload: r.Data, Options: outboxer.DynamicValues{}}
+
+		for key, v := range map[string]*string{
+			kinesis.StreamNameOption:      r.StreamName,
+			kinesis.ExplicitHashKeyOption: r.ExplicitHashKey,
+			kinesis.PartitionKeyOption:    r.PartitionKey,
+		} {
+			if v != nil {
+				m.Options[key] = *v
+			}
+		}
+
+		msgs[i] = &m
+	}
+
+	return msgs
+}
+
+func TestKinesis_Conformance(t *testing.T) {
+	estest.RunEventStreamTests(t, estest.Suite{
+		New: func(t *testing.T) estest.Stream {
+			fake := estest.NewKinesis()
+
+			return estest.Stream{
+				EventStream: kinesis.New(fake),
+				Received:    func() []*outboxer.OutboxMessage { return decodeKinesis(fake.Records()) },
+			}
+		},
+		Options: outboxer.DynamicValues{
+			kinesis.StreamNameOption:      "test",
+			kinesis.ExplicitHashKeyOption: "42",
+			kinesis.PartitionKeyOption:    "key",
+		},
+		InvalidOptions: []outboxer.DynamicValues{
+			{kinesis.StreamNameOption: 42},
+			{kinesis.ExplicitHashKeyOption: 42},
+			{kinesis.PartitionKeyOption: true},
+		},
+		NoHeaders: true,
+	})
+}
+
+func TestKinesis_SequenceNumberForOrdering(t *testing.T) {
+	fake := estest.NewKinesis()
+
+	if err := kinesis.New(fake).Send(context.Background(), &outboxer.OutboxMessage{
+		Payload: []byte("test payload"),
+		Options: map[string]interface{}{
+			kinesis.StreamNameOption:                "test",
+			kinesis.PartitionKeyOption:              "key",
+			kinesis.SequenceNumberForOrderingOption: "7",
+		},
+	}); err != nil {
+		t.Fatalf("an error was not expected: %s", err)
+	}
+
+	r := fake.Records()[0]
+	if aws.StringValue(r.PartitionKey) != "key" || aws.StringValue(r.SequenceNumberForOrdering) != "7" {
+		t.Fatalf("unexpected record %v", r)
+	}
+}
+
+func TestKinesis_SendBatchOrdered(t *testing.T) {
+	fake := estest.NewKinesis()
+	fake.Reject = func(data []byte) bool { return string(data) == "record 1" }
+
+	var msgs []*outboxer.OutboxMessage
+
+	for i := 0; i < 3; i++ {
+		msgs = append(msgs, &outboxer.OutboxMessage{
+			Payload: []byte(fmt.Sprintf("record %d", i)),
+			Options: outboxer.DynamicValues{
+				kinesis.StreamNameOption:                "test",
+				kinesis.SequenceNumberForOrderingOption: "7",
+			},
+		})
+	}
+
+	err := kinesis.New(fake).SendBatch(context.Background(), msgs)
+
+	var batchErr *outboxer.BatchError
+	if !errors.As(err, &batchErr) || len(batchErr.Errors) != 1 || batchErr.Errors[1] == nil {
+		t.Fatalf("expected record 1 to fail, got %v", err)
+	}
+
+	records := fake.Records()
+	if len(records) != 2 || string(records[0].Data) != "record 0" || string(records[1].Data) != "record 2" {
+		t.Fatalf("expected the records to be sent in order, got %v", records)
+	}
+
+	for _, r := range records {
+		if aws.StringValue(r.SequenceNumberForOrdering) != "7" {
+			t.Fatalf("expected the records to be sent one by one with their sequence number, got %v", r)
+		}
+	}
+}
+
+func TestKinesis_SendBatch(t *testing.T) {
+	fake := estest.NewKinesis()
+	fake.Reject = func(data []byte) bool { return string(data) == "record 1" }
+
+	var msgs []*outboxer.OutboxMessage
+
+	for i := 0; i < 4; i++ {
+		msgs = append(msgs, &outboxer.OutboxMessage{
+			Payload: []byte(fmt.Sprintf("record %d", i)),
+			Options: outboxer.DynamicValues{kinesis.StreamNameOption: fmt.Sprintf("stream-%d", i%2)},
+		})
+	}
+
+	err := kinesis.New(fake).SendBatch(context.Background(), msgs)
+
+	var batchErr *outboxer.BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("expected a batch error, got %v", err)
+	}
+
+	if len(batchErr.Errors) != 1 || batchErr.Errors[1] == nil {
+		t.Fatalf("expected record 1 to fail, got %v", batchErr.Errors)
+	}
+
+	records := fake.Records()
+	if len(records) != 3 || string(records[1].Data) != "record 2" || string(records[2].Data) != "record 3" {
+		t.Fatalf("expected the records to be grouped by stream, got %v", records)
+	}
+}
+
+// batchOnlyKinesis fails the test when a record is put on its own.
+type batchOnlyKinesis struct {
+	*estest.Kinesis
+	t *testing.T
+}
+
+func (k batchOnlyKinesis) PutRecordWithContext(
+	aws.Context,
+	*kinesisraw.PutRecordInput,
+	...request.Option,
+) (*kinesisraw.PutRecordOutput, error) {
+	k.t.Fatal("expected the records to be sent with PutRecords")
+	return nil, nil
+}
+
+func TestKinesis_SendBatchPartitioned(t *testing.T) {
+	fake := estest.NewKinesis()
+
+	var msgs []*outboxer.OutboxMessage
+
+	for i := 0; i < 4; i++ {
+		msgs = append(msgs, &outboxer.OutboxMessage{
+			Payload: []byte(fmt.Sprintf("record %d", i)),
+			Options: outboxer.DynamicValues{
+				kinesis.StreamNameOption:   "test",
+				kinesis.PartitionKeyOption: fmt.Sprintf("key-%d", i%2),
+			},
+		})
+	}
+
+	if err := kinesis.New(batchOnlyKinesis{Kinesis: fake, t: t}).SendBatch(context.Background(), msgs); err != nil {
+		t.Fatalf("an error was not expected: %s", err)
+	}
+
+	records := fake.Records()
+	if len(records) != 4 {
+		t.Fatalf("expected 4 records, got %d", len(records))
+	}
+
+	for i, r := range records {
+		if string(r.Data) != fmt.Sprintf("record %d", i) || aws.StringValue(r.PartitionKey) != fmt.Sprintf("key-%d", i%2) {
+			t.Fatalf("unexpected record %v", r)
+		}
+	}
+}
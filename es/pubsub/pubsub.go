@@ -4,6 +4,8 @@ package pubsub
 import (
 	"context"
 	"fmt"
+	"strconv"
+	"sync"
 
 	"cloud.google.com/go/pubsub"
 	"github.com/italolelis/outboxer"
@@ -20,6 +22,9 @@ const (
 // Pubsub is the wrapper for the Pubsub library.
 type Pubsub struct {
 	client *pubsub.Client
+
+	mu     sync.Mutex
+	topics map[string]*pubsub.Topic
 }
 
 type options struct {
@@ -29,36 +34,161 @@ type options struct {
 
 // New creates a new instance of Kinesis.
 func New(c *pubsub.Client) *Pubsub {
-	return &Pubsub{client: c}
+	return &Pubsub{client: c, topics: make(map[string]*pubsub.Topic)}
 }
 
-// Send sends the message to the event stream.
+// Send sends the message to the event stream. The headers are sent as attributes.
 func (p *Pubsub) Send(ctx context.Context, evt *outboxer.OutboxMessage) error {
-	opts := p.parseOptions(evt.Options)
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+
+	res, err := p.publish(ctx, evt)
+	if err != nil {
+		return err
+	}
+
+	return p.wait(ctx, res, evt)
+}
+
+// SendBatch publishes all the messages before waiting for the results, so the client bundles them.
+// It returns a *outboxer.BatchError with the messages that failed.
+func (p *Pubsub) SendBatch(ctx context.Context, msgs []*outboxer.OutboxMessage) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("failed to publish messages: %w", err)
+	}
+
+	failed := make(map[int]error)
+	results := make([]*pubsub.PublishResult, len(msgs))
+
+	for i, evt := range msgs {
+		res, err := p.publish(ctx, evt)
+		if err != nil {
+			failed[i] = err
+			continue
+		}
+
+		results[i] = res
+	}
+
+	for i, res := range results {
+		if res == nil {
+			continue
+		}
+
+		if err := p.wait(ctx, res, msgs[i]); err != nil {
+			failed[i] = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return &outboxer.BatchError{Errors: failed}
+	}
+
+	return nil
+}
+
+func (p *Pubsub) publish(ctx context.Context, evt *outboxer.OutboxMessage) (*pubsub.PublishResult, error) {
+	opts, err := p.parseOptions(evt.Options)
+	if err != nil {
+		return nil, err
+	}
 
-	topic := p.client.Topic(opts.topicName)
-	res := topic.Publish(ctx, &pubsub.Message{
+	attrs, err := parseHeaders(evt.Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	return p.topic(opts.topicName).Publish(ctx, &pubsub.Message{
 		Data:        evt.Payload,
+		Attributes:  attrs,
 		OrderingKey: opts.orderingKey,
-	})
+	}), nil
+}
 
+// wait waits for the result of a publish. When it failed, publishing is resumed for the ordering key,
+// which the client pauses after a failure.
+func (p *Pubsub) wait(ctx context.Context, res *pubsub.PublishResult, evt *outboxer.OutboxMessage) error {
 	if _, err := res.Get(ctx); err != nil {
-		return fmt.Errorf("error when getting generated id: %v", err)
+		if key, _, _ := evt.Options.GetString(OrderingKeyOption); key != "" {
+			name, _, _ := evt.Options.GetString(TopicNameOption)
+			p.topic(name).ResumePublish(key)
+		}
+
+		return fmt.Errorf("error when getting generated id: %w", err)
 	}
 
 	return nil
 }
 
-func (p *Pubsub) parseOptions(opts outboxer.DynamicValues) *options {
+// Close stops the topics that were published to, flushing the messages they still hold.
+// The client belongs to the caller and is not closed, the event stream can still be used afterwards.
+func (p *Pubsub) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for name, t := range p.topics {
+		t.Stop()
+		delete(p.topics, name)
+	}
+
+	return nil
+}
+
+// topic returns the topic with the given name, topics are reused so their publishers are shared
+// until Close stops them.
+func (p *Pubsub) topic(name string) *pubsub.Topic {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	t, ok := p.topics[name]
+	if !ok {
+		t = p.client.Topic(name)
+		t.EnableMessageOrdering = true
+		p.topics[name] = t
+	}
+
+	return t
+}
+
+func (p *Pubsub) parseOptions(opts outboxer.DynamicValues) (*options, error) {
 	opt := options{}
 
-	if data, ok := opts[TopicNameOption]; ok {
-		opt.topicName = data.(string)
+	if v, ok, err := opts.GetString(TopicNameOption); err != nil {
+		return nil, err
+	} else if ok {
+		opt.topicName = v
+	}
+
+	if v, ok, err := opts.GetString(OrderingKeyOption); err != nil {
+		return nil, err
+	} else if ok {
+		opt.orderingKey = v
 	}
 
-	if data, ok := opts[OrderingKeyOption]; ok {
-		opt.orderingKey = data.(string)
+	return &opt, nil
+}
+
+// parseHeaders maps the headers to attributes, which are strings. Numbers and bools are formatted.
+func parseHeaders(headers outboxer.DynamicValues) (map[string]string, error) {
+	if len(headers) == 0 {
+		return nil, nil
+	}
+
+	attrs := make(map[string]string, len(headers))
+
+	for key, value := range headers {
+		switch v := value.(type) {
+		case string:
+			attrs[key] = v
+		case bool:
+			attrs[key] = strconv.FormatBool(v)
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+			attrs[key] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("%w: header %s must be a string, a number or a bool, got %T", outboxer.ErrInvalidOption, key, value)
+		}
 	}
 
-	return &opt
+	return attrs, nil
 }
@@ -2,11 +2,13 @@ package pubsub_test
 
 import (
 	"context"
+	"errors"
 	"testing"
 
 	pubsubraw "cloud.google.com/go/pubsub"
 	"cloud.google.com/go/pubsub/pstest"
 	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/es/estest"
 	"github.com/italolelis/outboxer/es/pubsub"
 	"google.golang.org/api/option"
 	"google.golang.org/grpc"
@@ -88,3 +90,100 @@ func mustCreateTopic(ctx context.Context, t *testing.T, pc *pubsubraw.Client, id
 	}
 	return top
 }
+
+// decodePubsub maps the messages published to the fake back to outbox messages.
+func decodePubsub(published []*estest.PubsubMessage) []*outboxer.OutboxMessage {
+	msgs := make([]*outboxer.OutboxMessage, len(published))
+
+	for i, p := range published {
+		m := outboxer.OutboxMessage{Payload: p.Data, Options: outboxer.DynamicValues{pubsub.TopicNameOption: p.Topic}}
+
+		if p.OrderingKey != "" {
+			m.Options[pubsub.OrderingKeyOption] = p.OrderingKey
+		}
+
+		for k, v := range p.Attributes {
+			if m.Headers == nil {
+				m.Headers = outboxer.DynamicValues{}
+			}
+
+			m.Headers[k] = v
+		}
+
+		msgs[i] = &m
+	}
+
+	return msgs
+}
+
+func TestPubsub_Conformance(t *testing.T) {
+	estest.RunEventStreamTests(t, estest.Suite{
+		New: func(t *testing.T) estest.Stream {
+			fake := estest.NewPubsub(t, "test")
+
+			return estest.Stream{
+				EventStream: pubsub.New(fake.Client),
+				Received:    func() []*outboxer.OutboxMessage { return decodePubsub(fake.Published()) },
+			}
+		},
+		Options: outboxer.DynamicValues{
+			pubsub.TopicNameOption:   "test",
+			pubsub.OrderingKeyOption: "key",
+		},
+		InvalidOptions: []outboxer.DynamicValues{
+			{pubsub.TopicNameOption: 42},
+			{pubsub.OrderingKeyOption: false},
+		},
+	})
+}
+
+func TestPubsub_SendBatch(t *testing.T) {
+	fake := estest.NewPubsub(t, "test")
+
+	err := pubsub.New(fake.Client).SendBatch(context.Background(), []*outboxer.OutboxMessage{
+		{Payload: []byte("a"), Options: outboxer.DynamicValues{pubsub.TopicNameOption: "test"}},
+		{Payload: []byte("b"), Options: outboxer.DynamicValues{pubsub.TopicNameOption: "non-existent"}},
+		{Payload: []byte("c"), Options: outboxer.DynamicValues{pubsub.TopicNameOption: "test"}},
+	})
+
+	var batchErr *outboxer.BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("expected a batch error, got %v", err)
+	}
+
+	if len(batchErr.Errors) != 1 || batchErr.Errors[1] == nil {
+		t.Fatalf("expected message b to fail, got %v", batchErr.Errors)
+	}
+
+	if published := fake.Published(); len(published) != 2 {
+		t.Fatalf("expected 2 messages to be published, got %d", len(published))
+	}
+}
+
+func TestPubsub_Close(t *testing.T) {
+	fake := estest.NewPubsub(t, "test")
+	ctx := context.Background()
+	p := pubsub.New(fake.Client)
+
+	msg := &outboxer.OutboxMessage{Payload: []byte("a"), Options: outboxer.DynamicValues{pubsub.TopicNameOption: "test"}}
+
+	if err := p.SendBatch(ctx, []*outboxer.OutboxMessage{msg}); err != nil {
+		t.Fatalf("an error was not expected: %s", err)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatalf("an error was not expected: %s", err)
+	}
+
+	if err := p.Send(ctx, msg); err != nil {
+		t.Fatalf("expected the event stream to be usable after Close: %s", err)
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatalf("an error was not expected: %s", err)
+	}
+
+	if published := fake.Published(); len(published) != 2 {
+		t.Fatalf("expected 2 messages to be published, got %d", len(published))
+	}
+}
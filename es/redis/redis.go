@@ -0,0 +1,169 @@
+// Package redis is the Redis Streams implementation of an event stream.
+package redis
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/italolelis/outboxer"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// StreamOption is the name of the stream the messages are added to.
+	StreamOption = "stream"
+
+	// MaxLenOption trims the stream to the given number of entries when a message is added.
+	MaxLenOption = "max_len"
+
+	// MinIDOption trims the entries with an id lower than the given one when a message is added.
+	MinIDOption = "min_id"
+
+	// ApproxOption trims the stream with "~", which lets Redis trim less than asked for, but more efficiently.
+	ApproxOption = "approx"
+
+	// LimitOption caps the number of entries evicted by an approximate trim.
+	LimitOption = "limit"
+
+	// PayloadField is the field of the stream entry that holds the payload. The headers are the other fields.
+	PayloadField = "payload"
+)
+
+// Redis is the wrapper for the go-redis library.
+type Redis struct {
+	client redis.Cmdable
+}
+
+// New creates a new instance of Redis. The client can be a *redis.Client, a *redis.ClusterClient
+// or any other redis.Cmdable.
+func New(client redis.Cmdable) *Redis {
+	return &Redis{client: client}
+}
+
+// Send adds the message to its stream with XADD.
+func (r *Redis) Send(ctx context.Context, evt *outboxer.OutboxMessage) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+
+	args, err := parseArgs(evt)
+	if err != nil {
+		return err
+	}
+
+	if err := r.client.XAdd(ctx, args).Err(); err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
+	}
+
+	return nil
+}
+
+// SendBatch adds the messages in a single pipeline, so they take a single round trip.
+// It returns a *outboxer.BatchError with the messages that failed.
+func (r *Redis) SendBatch(ctx context.Context, msgs []*outboxer.OutboxMessage) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("failed to publish messages: %w", err)
+	}
+
+	failed := make(map[int]error)
+	cmds := make(map[int]*redis.StringCmd, len(msgs))
+	pipe := r.client.Pipeline()
+
+	for i, evt := range msgs {
+		args, err := parseArgs(evt)
+		if err != nil {
+			failed[i] = err
+			continue
+		}
+
+		cmds[i] = pipe.XAdd(ctx, args)
+	}
+
+	// The errors of the commands are checked one by one, Exec only returns the first one.
+	_, _ = pipe.Exec(ctx)
+
+	for i, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			failed[i] = fmt.Errorf("failed to publish message: %w", err)
+		}
+	}
+
+	if len(failed) > 0 {
+		return &outboxer.BatchError{Errors: failed}
+	}
+
+	return nil
+}
+
+func parseArgs(evt *outboxer.OutboxMessage) (*redis.XAddArgs, error) {
+	var args redis.XAddArgs
+
+	if v, ok, err := evt.Options.GetString(StreamOption); err != nil {
+		return nil, err
+	} else if ok {
+		args.Stream = v
+	}
+
+	if v, ok, err := evt.Options.GetInt64(MaxLenOption); err != nil {
+		return nil, err
+	} else if ok {
+		args.MaxLen = v
+	}
+
+	if v, ok, err := evt.Options.GetString(MinIDOption); err != nil {
+		return nil, err
+	} else if ok {
+		args.MinID = v
+	}
+
+	if v, ok, err := evt.Options.GetBool(ApproxOption); err != nil {
+		return nil, err
+	} else if ok {
+		args.Approx = v
+	}
+
+	if v, ok, err := evt.Options.GetInt64(LimitOption); err != nil {
+		return nil, err
+	} else if ok {
+		args.Limit = v
+	}
+
+	if args.Stream == "" {
+		return nil, fmt.Errorf("%w: %s is required", outboxer.ErrInvalidOption, StreamOption)
+	}
+
+	if args.MaxLen > 0 && args.MinID != "" {
+		return nil, fmt.Errorf("%w: %s and %s can't be used together", outboxer.ErrInvalidOption, MaxLenOption, MinIDOption)
+	}
+
+	values, err := parseValues(evt)
+	if err != nil {
+		return nil, err
+	}
+
+	args.Values = values
+
+	return &args, nil
+}
+
+// parseValues maps the payload and the headers to the fields of the stream entry.
+// Headers can be strings, byte slices, numbers or bools.
+func parseValues(evt *outboxer.OutboxMessage) ([]interface{}, error) {
+	values := make([]interface{}, 0, 2+2*len(evt.Headers))
+	values = append(values, PayloadField, evt.Payload)
+
+	for key, value := range evt.Headers {
+		if key == PayloadField {
+			return nil, fmt.Errorf("%w: header %s is the payload field", outboxer.ErrInvalidOption, key)
+		}
+
+		switch value.(type) {
+		case string, []byte, bool, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+			values = append(values, key, value)
+		default:
+			return nil, fmt.Errorf("%w: header %s must be a string, a number, bytes or a bool, got %T", outboxer.ErrInvalidOption, key, value)
+		}
+	}
+
+	return values, nil
+}
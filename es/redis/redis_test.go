@@ -0,0 +1,198 @@
+package redis_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/es/estest"
+	"github.com/italolelis/outboxer/es/redis"
+)
+
+// decodeRedis maps the entries of every stream of the fake back to outbox messages, ordered by entry id.
+func decodeRedis(t testing.TB, f *estest.Redis) []*outboxer.OutboxMessage {
+	type entry struct {
+		id  string
+		msg *outboxer.OutboxMessage
+	}
+
+	var entries []entry
+
+	for _, key := range f.Server.Keys() {
+		if f.Server.Type(key) != "stream" {
+			continue
+		}
+
+		for _, e := range f.Entries(t, key) {
+			m := outboxer.OutboxMessage{Options: outboxer.DynamicValues{redis.StreamOption: key}}
+
+			for field, value := range e.Values {
+				if field == redis.PayloadField {
+					m.Payload = []byte(value.(string))
+					continue
+				}
+
+				if m.Headers == nil {
+					m.Headers = outboxer.DynamicValues{}
+				}
+
+				m.Headers[field] = value
+			}
+
+			entries = append(entries, entry{id: e.ID, msg: &m})
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].id < entries[j].id })
+
+	msgs := make([]*outboxer.OutboxMessage, len(entries))
+	for i, e := range entries {
+		msgs[i] = e.msg
+	}
+
+	return msgs
+}
+
+func TestRedis_Conformance(t *testing.T) {
+	estest.RunEventStreamTests(t, estest.Suite{
+		New: func(t *testing.T) estest.Stream {
+			fake := estest.NewRedis(t)
+
+			return estest.Stream{
+				EventStream: redis.New(fake.Client),
+				Received:    func() []*outboxer.OutboxMessage { return decodeRedis(t, fake) },
+			}
+		},
+		Options: outboxer.DynamicValues{redis.StreamOption: "orders"},
+		InvalidOptions: []outboxer.DynamicValues{
+			{redis.StreamOption: 42},
+			{redis.StreamOption: ""},
+			{redis.MaxLenOption: "10"},
+			{redis.MaxLenOption: 1.5},
+			{redis.MinIDOption: 5},
+			{redis.MaxLenOption: 10, redis.MinIDOption: "0-1"},
+			{redis.ApproxOption: "yes"},
+			{redis.LimitOption: "all"},
+		},
+	})
+}
+
+func TestRedis_Trimming(t *testing.T) {
+	ctx := context.Background()
+
+	cases := []struct {
+		name string
+		opts outboxer.DynamicValues
+		want int
+	}{
+		{name: "max len", opts: outboxer.DynamicValues{redis.MaxLenOption: 3}, want: 3},
+		{name: "max len from json", opts: outboxer.DynamicValues{redis.MaxLenOption: float64(2)}, want: 2},
+		{name: "min id", opts: outboxer.DynamicValues{redis.MinIDOption: "1-2"}, want: 3},
+		{name: "approximate", opts: outboxer.DynamicValues{redis.MaxLenOption: 1, redis.ApproxOption: true}, want: 1},
+		{name: "no trimming", opts: outboxer.DynamicValues{}, want: 5},
+	}
+
+	for _, c := range cases {
+		c := c
+
+		t.Run(c.name, func(t *testing.T) {
+			fake := estest.NewRedis(t)
+			es := redis.New(fake.Client)
+
+			// The entries get the ids 1-0 to 1-4, so a minimum id is predictable.
+			fake.Server.SetTime(time.UnixMilli(1))
+
+			for i := 1; i <= 5; i++ {
+				opts := outboxer.DynamicValues{redis.StreamOption: "orders"}
+				for k, v := range c.opts {
+					opts[k] = v
+				}
+
+				if err := es.Send(ctx, &outboxer.OutboxMessage{Payload: []byte(fmt.Sprint(i)), Options: opts}); err != nil {
+					t.Fatalf("failed to send message %d: %s", i, err)
+				}
+			}
+
+			if n := len(fake.Entries(t, "orders")); n != c.want {
+				t.Fatalf("expected %d entries, got %d", c.want, n)
+			}
+		})
+	}
+}
+
+func TestRedis_SendBatch(t *testing.T) {
+	ctx := context.Background()
+	fake := estest.NewRedis(t)
+
+	// Adding to a key that holds a string fails, the other commands of the pipeline still run.
+	if err := fake.Server.Set("not-a-stream", "value"); err != nil {
+		t.Fatalf("failed to set key: %s", err)
+	}
+
+	var msgs []*outboxer.OutboxMessage
+
+	for i := 0; i < 5; i++ {
+		stream := "orders"
+		if i == 2 {
+			stream = "not-a-stream"
+		}
+
+		msgs = append(msgs, &outboxer.OutboxMessage{
+			Payload: []byte(fmt.Sprintf("message %d", i)),
+			Options: outboxer.DynamicValues{redis.StreamOption: stream},
+			Headers: outboxer.DynamicValues{"index": i},
+		})
+	}
+
+	err := redis.New(fake.Client).SendBatch(ctx, msgs)
+
+	var batchErr *outboxer.BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("expected a batch error, got %v", err)
+	}
+
+	if len(batchErr.Errors) != 1 || batchErr.Errors[2] == nil {
+		t.Fatalf("expected message 2 to fail, got %v", batchErr.Errors)
+	}
+
+	entries := fake.Entries(t, "orders")
+	if len(entries) != 4 {
+		t.Fatalf("expected 4 entries, got %d", len(entries))
+	}
+
+	for i, want := range []string{"0", "1", "3", "4"} {
+		if got := entries[i].Values["index"]; got != want {
+			t.Errorf("expected entry %d to have the index header %s, got %v", i, want, got)
+		}
+	}
+}
+
+func TestRedis_ServerError(t *testing.T) {
+	fake := estest.NewRedis(t)
+	fake.Server.SetError("LOADING Redis is loading the dataset in memory")
+
+	err := redis.New(fake.Client).Send(context.Background(), &outboxer.OutboxMessage{
+		Payload: []byte("test payload"),
+		Options: outboxer.DynamicValues{redis.StreamOption: "orders"},
+	})
+	if err == nil {
+		t.Fatal("expected the send to fail")
+	}
+}
+
+func TestRedis_PayloadHeader(t *testing.T) {
+	fake := estest.NewRedis(t)
+
+	err := redis.New(fake.Client).Send(context.Background(), &outboxer.OutboxMessage{
+		Payload: []byte("test payload"),
+		Options: outboxer.DynamicValues{redis.StreamOption: "orders"},
+		Headers: outboxer.DynamicValues{redis.PayloadField: "shadowed"},
+	})
+	if !errors.Is(err, outboxer.ErrInvalidOption) {
+		t.Fatalf("expected outboxer.ErrInvalidOption, got %v", err)
+	}
+}
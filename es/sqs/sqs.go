@@ -4,6 +4,7 @@ package sqs
 import (
 	"context"
 	"fmt"
+	"strconv"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/sqs"
@@ -23,6 +24,9 @@ const (
 
 	// MessageDedupIDOption is the deduplication id option.
 	MessageDedupIDOption = "message_dedup_id"
+
+	// maxBatchEntries is the limit of messages in a single SendMessageBatch call.
+	maxBatchEntries = 10
 )
 
 // SQS is the wrapper for the SQS library.
@@ -37,8 +41,6 @@ type options struct {
 	msgDedupID   *string
 }
 
-type sqsOption func(*options)
-
 // New creates a new instance of SQS.
 func New(conn sqsiface.SQSAPI) *SQS {
 	return &SQS{conn: conn}
@@ -46,104 +48,189 @@ func New(conn sqsiface.SQSAPI) *SQS {
 
 // Send sends the message to the event stream.
 func (r *SQS) Send(ctx context.Context, evt *outboxer.OutboxMessage) error {
-	opts := newOptions(
-		withQueueName(evt.Options),
-		withDelaySeconds(evt.Options),
-		withGroupID(evt.Options),
-		withDedupID(evt.Options),
-	)
-
-	input := &sqs.SendMessageInput{
-		QueueUrl:               opts.queueName,
-		MessageBody:            aws.String(string((evt.Payload))),
-		DelaySeconds:           opts.delaySeconds,
-		MessageGroupId:         opts.msgGroupID,
-		MessageDeduplicationId: opts.msgDedupID,
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("failed to publish message: %w", err)
 	}
 
-	msgAttributes := r.parseHeaders(evt.Headers)
-	if len(msgAttributes) > 0 {
-		input.MessageAttributes = msgAttributes
+	input, err := r.input(evt)
+	if err != nil {
+		return err
 	}
 
-	_, err := r.conn.SendMessageWithContext(ctx, input)
-	if err != nil {
+	if _, err := r.conn.SendMessageWithContext(ctx, input); err != nil {
 		return fmt.Errorf("failed to publish message: %w", err)
 	}
 
 	return nil
 }
 
-func newOptions(opts ...sqsOption) *options {
-	opt := &options{
-		delaySeconds: nil,
-		msgDedupID:   nil,
+// SendBatch sends the messages with SendMessageBatch, grouped by queue in batches of up to 10 messages.
+// It returns a *outboxer.BatchError with the messages that failed.
+func (r *SQS) SendBatch(ctx context.Context, msgs []*outboxer.OutboxMessage) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("failed to publish messages: %w", err)
 	}
 
-	for _, option := range opts {
-		if option == nil {
+	failed := make(map[int]error)
+
+	var queues []string
+
+	batches := make(map[string][]int)
+	inputs := make([]*sqs.SendMessageInput, len(msgs))
+
+	for i, evt := range msgs {
+		input, err := r.input(evt)
+		if err != nil {
+			failed[i] = err
 			continue
 		}
 
-		option(opt)
+		queue := aws.StringValue(input.QueueUrl)
+		if _, ok := batches[queue]; !ok {
+			queues = append(queues, queue)
+		}
+
+		batches[queue] = append(batches[queue], i)
+		inputs[i] = input
 	}
 
-	return opt
-}
+	for _, queue := range queues {
+		idx := batches[queue]
 
-func withQueueName(opts outboxer.DynamicValues) sqsOption {
-	if data, ok := opts[QueueNameOption]; ok {
-		return func(opt *options) {
-			opt.queueName = aws.String(data.(string))
+		for len(idx) > 0 {
+			n := len(idx)
+			if n > maxBatchEntries {
+				n = maxBatchEntries
+			}
+
+			r.sendBatch(ctx, queue, idx[:n], inputs, failed)
+			idx = idx[n:]
 		}
 	}
 
+	if len(failed) > 0 {
+		return &outboxer.BatchError{Errors: failed}
+	}
+
 	return nil
 }
 
-func withDelaySeconds(opts outboxer.DynamicValues) sqsOption {
-	if data, ok := opts[DelaySecondsOption]; ok {
-		return func(opt *options) {
-			opt.delaySeconds = aws.Int64(data.(int64))
+// sendBatch sends a single SendMessageBatch call and records the failed messages by their index.
+func (r *SQS) sendBatch(ctx context.Context, queue string, idx []int, inputs []*sqs.SendMessageInput, failed map[int]error) {
+	entries := make([]*sqs.SendMessageBatchRequestEntry, len(idx))
+
+	for j, i := range idx {
+		in := inputs[i]
+		entries[j] = &sqs.SendMessageBatchRequestEntry{
+			Id:                     aws.String(strconv.Itoa(i)),
+			MessageBody:            in.MessageBody,
+			DelaySeconds:           in.DelaySeconds,
+			MessageGroupId:         in.MessageGroupId,
+			MessageDeduplicationId: in.MessageDeduplicationId,
+			MessageAttributes:      in.MessageAttributes,
 		}
 	}
 
-	return nil
-}
+	out, err := r.conn.SendMessageBatchWithContext(ctx, &sqs.SendMessageBatchInput{
+		QueueUrl: aws.String(queue),
+		Entries:  entries,
+	})
+	if err != nil {
+		for _, i := range idx {
+			failed[i] = fmt.Errorf("failed to publish message: %w", err)
+		}
 
-func withGroupID(opts outboxer.DynamicValues) sqsOption {
-	if data, ok := opts[MessageGroupIDOption]; ok {
-		return func(opt *options) {
-			opt.msgGroupID = aws.String(data.(string))
+		return
+	}
+
+	for _, f := range out.Failed {
+		i, err := strconv.Atoi(aws.StringValue(f.Id))
+		if err != nil {
+			continue
 		}
+
+		failed[i] = fmt.Errorf("failed to publish message: %s: %s", aws.StringValue(f.Code), aws.StringValue(f.Message))
 	}
+}
 
-	return nil
+// input builds the SendMessage input of a message.
+func (r *SQS) input(evt *outboxer.OutboxMessage) (*sqs.SendMessageInput, error) {
+	opts, err := parseOptions(evt.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	input := &sqs.SendMessageInput{
+		QueueUrl:               opts.queueName,
+		MessageBody:            aws.String(string((evt.Payload))),
+		DelaySeconds:           opts.delaySeconds,
+		MessageGroupId:         opts.msgGroupID,
+		MessageDeduplicationId: opts.msgDedupID,
+	}
+
+	msgAttributes, err := parseHeaders(evt.Headers)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(msgAttributes) > 0 {
+		input.MessageAttributes = msgAttributes
+	}
+
+	return input, nil
 }
 
-func withDedupID(opts outboxer.DynamicValues) sqsOption {
-	if data, ok := opts[MessageDedupIDOption]; ok {
-		return func(opt *options) {
-			opt.msgDedupID = aws.String(data.(string))
-		}
+func parseOptions(opts outboxer.DynamicValues) (*options, error) {
+	var opt options
+
+	if v, ok, err := opts.GetString(QueueNameOption); err != nil {
+		return nil, err
+	} else if ok {
+		opt.queueName = aws.String(v)
 	}
 
-	return nil
+	if v, ok, err := opts.GetInt64(DelaySecondsOption); err != nil {
+		return nil, err
+	} else if ok {
+		opt.delaySeconds = aws.Int64(v)
+	}
+
+	if v, ok, err := opts.GetString(MessageGroupIDOption); err != nil {
+		return nil, err
+	} else if ok {
+		opt.msgGroupID = aws.String(v)
+	}
+
+	if v, ok, err := opts.GetString(MessageDedupIDOption); err != nil {
+		return nil, err
+	} else if ok {
+		opt.msgDedupID = aws.String(v)
+	}
+
+	return &opt, nil
 }
 
-func (r *SQS) parseHeaders(headers outboxer.DynamicValues) (response map[string]*sqs.MessageAttributeValue) {
+// parseHeaders maps the headers to message attributes. Strings are sent as String attributes,
+// numbers as Number attributes and byte slices as Binary attributes.
+func parseHeaders(headers outboxer.DynamicValues) (map[string]*sqs.MessageAttributeValue, error) {
 	if len(headers) == 0 {
-		return
+		return nil, nil
 	}
 
-	response = make(map[string]*sqs.MessageAttributeValue)
+	response := make(map[string]*sqs.MessageAttributeValue, len(headers))
 
 	for key, value := range headers {
-		response[key] = &sqs.MessageAttributeValue{
-			DataType:    aws.String("String"),
-			StringValue: aws.String(value.(string)),
+		switch v := value.(type) {
+		case string:
+			response[key] = &sqs.MessageAttributeValue{DataType: aws.String("String"), StringValue: aws.String(v)}
+		case []byte:
+			response[key] = &sqs.MessageAttributeValue{DataType: aws.String("Binary"), BinaryValue: v}
+		case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64:
+			response[key] = &sqs.MessageAttributeValue{DataType: aws.String("Number"), StringValue: aws.String(fmt.Sprint(v))}
+		default:
+			return nil, fmt.Errorf("%w: header %s must be a string, a number or bytes, got %T", outboxer.ErrInvalidOption, key, value)
 		}
 	}
 
-	return response
+	return response, nil
 }
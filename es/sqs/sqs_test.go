@@ -12,6 +12,7 @@ import (
 	sqsraw "github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/es/estest"
 	"github.com/italolelis/outboxer/es/sqs"
 )
 
@@ -77,3 +78,104 @@ func TestSQS_EventStream(t *testing.T) {
 		}
 	}
 }
+
+// decodeSQS maps the messages received by the fake back to outbox messages.
+func decodeSQS(inputs []*sqsraw.SendMessageInput) []*outboxer.OutboxMessage {
+	msgs := make([]*outboxer.OutboxMessage, len(inputs))
+
+	for i, in := range inputs {
+		m := outboxer.OutboxMessage{Payload: []byte(aws.StringValue(in.MessageBody)), Options: outboxer.DynamicValues{}}
+
+		if in.QueueUrl != nil {
+			m.Options[sqs.QueueNameOption] = *in.QueueUrl
+		}
+
+		if in.DelaySeconds != nil {
+			m.Options[sqs.DelaySecondsOption] = *in.DelaySeconds
+		}
+
+		if in.MessageGroupId != nil {
+			m.Options[sqs.MessageGroupIDOption] = *in.MessageGroupId
+		}
+
+		if in.MessageDeduplicationId != nil {
+			m.Options[sqs.MessageDedupIDOption] = *in.MessageDeduplicationId
+		}
+
+		for k, v := range in.MessageAttributes {
+			if m.Headers == nil {
+				m.Headers = outboxer.DynamicValues{}
+			}
+
+			if v.BinaryValue != nil {
+				m.Headers[k] = v.BinaryValue
+			} else {
+				m.Headers[k] = aws.StringValue(v.StringValue)
+			}
+		}
+
+		msgs[i] = &m
+	}
+
+	return msgs
+}
+
+func TestSQS_Conformance(t *testing.T) {
+	estest.RunEventStreamTests(t, estest.Suite{
+		New: func(t *testing.T) estest.Stream {
+			fake := estest.NewSQS()
+
+			return estest.Stream{
+				EventStream: sqs.New(fake),
+				Received:    func() []*outboxer.OutboxMessage { return decodeSQS(fake.Sent()) },
+			}
+		},
+		Options: outboxer.DynamicValues{
+			sqs.QueueNameOption:      "https://test/000000000000/test.fifo",
+			sqs.DelaySecondsOption:   int64(5),
+			sqs.MessageGroupIDOption: "group",
+			sqs.MessageDedupIDOption: "dedup",
+		},
+		InvalidOptions: []outboxer.DynamicValues{
+			{sqs.QueueNameOption: 42},
+			{sqs.DelaySecondsOption: "5"},
+			{sqs.DelaySecondsOption: 1.5},
+			{sqs.MessageGroupIDOption: true},
+			{sqs.MessageDedupIDOption: []byte("dedup")},
+		},
+	})
+}
+
+func TestSQS_SendBatch(t *testing.T) {
+	fake := estest.NewSQS()
+	fake.Reject = func(body string) bool { return body == "message 3" }
+
+	var msgs []*outboxer.OutboxMessage
+
+	for i := 0; i < 12; i++ {
+		queue := "https://test/000000000000/a"
+		if i%2 == 1 {
+			queue = "https://test/000000000000/b"
+		}
+
+		msgs = append(msgs, &outboxer.OutboxMessage{
+			Payload: []byte(fmt.Sprintf("message %d", i)),
+			Options: outboxer.DynamicValues{sqs.QueueNameOption: queue},
+		})
+	}
+
+	err := sqs.New(fake).SendBatch(context.Background(), msgs)
+
+	var batchErr *outboxer.BatchError
+	if !errors.As(err, &batchErr) {
+		t.Fatalf("expected a batch error, got %v", err)
+	}
+
+	if len(batchErr.Errors) != 1 || batchErr.Errors[3] == nil {
+		t.Fatalf("expected message 3 to fail, got %v", batchErr.Errors)
+	}
+
+	if sent := fake.Sent(); len(sent) != 11 {
+		t.Fatalf("expected 11 messages to be sent, got %d", len(sent))
+	}
+}
@@ -0,0 +1,154 @@
+// Package migrate applies versioned schema migrations and records them in a bookkeeping table.
+// The data stores run it while holding their advisory lock, so only one instance migrates at a time.
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// ErrInvalidVersion is used when the migration versions are not positive and strictly increasing.
+var ErrInvalidVersion = errors.New("migration versions must be positive and strictly increasing")
+
+// Migration is a single schema change. Once released, a migration must never be edited,
+// new changes are shipped as a new migration with a higher version.
+type Migration struct {
+	Description string
+	Up          string
+	Version     int64
+}
+
+// Dialect holds the bookkeeping queries of a database.
+type Dialect struct {
+	// CreateTable creates the bookkeeping table when it doesn't exist.
+	CreateTable string
+	// SelectVersions returns the applied versions.
+	SelectVersions string
+	// InsertVersion records an applied migration, it receives the version and the description.
+	InsertVersion string
+}
+
+// Conn is the connection the migrations run on.
+type Conn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// Run applies the migrations that were not applied yet, in version order.
+// Each migration and its bookkeeping record run in the same transaction, where the database allows
+// schema changes within transactions.
+func Run(ctx context.Context, conn Conn, d Dialect, migrations []Migration) error {
+	if _, err := conn.ExecContext(ctx, d.CreateTable); err != nil {
+		return fmt.Errorf("failed to create the migrations table: %w", err)
+	}
+
+	pending, err := Pending(ctx, conn, d, migrations)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range pending {
+		if err := apply(ctx, conn, d, m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Pending returns the migrations that were not applied yet. The bookkeeping table must exist.
+func Pending(ctx context.Context, conn Conn, d Dialect, migrations []Migration) ([]Migration, error) {
+	if err := Validate(migrations); err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, d.SelectVersions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the applied migrations: %w", err)
+	}
+
+	defer rows.Close()
+
+	var applied []int64
+
+	for rows.Next() {
+		var version int64
+		if err := rows.Scan(&version); err != nil {
+			return nil, fmt.Errorf("failed to scan migration version: %w", err)
+		}
+
+		applied = append(applied, version)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get the applied migrations: %w", err)
+	}
+
+	return Unapplied(migrations, applied), nil
+}
+
+// Validate checks that the migration versions are positive and strictly increasing.
+func Validate(migrations []Migration) error {
+	var last int64
+
+	for _, m := range migrations {
+		if m.Version <= last {
+			return fmt.Errorf("%w: %d", ErrInvalidVersion, m.Version)
+		}
+
+		last = m.Version
+	}
+
+	return nil
+}
+
+// Unapplied returns the migrations whose version is not in the applied versions, for data stores
+// that can't run migrations through Run and read the bookkeeping table on their own.
+func Unapplied(migrations []Migration, applied []int64) []Migration {
+	done := make(map[int64]struct{}, len(applied))
+	for _, v := range applied {
+		done[v] = struct{}{}
+	}
+
+	var pending []Migration
+
+	for _, m := range migrations {
+		if _, ok := done[m.Version]; !ok {
+			pending = append(pending, m)
+		}
+	}
+
+	return pending
+}
+
+func apply(ctx context.Context, conn Conn, d Dialect, m Migration) error {
+	tx, err := conn.BeginTx(ctx, &sql.TxOptions{})
+	if err != nil {
+		return fmt.Errorf("transaction start failed: %w", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, m.Up); err != nil {
+		if err := tx.Rollback(); err != nil {
+			return err
+		}
+
+		return fmt.Errorf("failed to apply migration %d (%s): %w", m.Version, m.Description, err)
+	}
+
+	if _, err := tx.ExecContext(ctx, d.InsertVersion, m.Version, m.Description); err != nil {
+		if err := tx.Rollback(); err != nil {
+			return err
+		}
+
+		return fmt.Errorf("failed to record migration %d: %w", m.Version, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit failed: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,88 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var dialect = Dialect{
+	CreateTable:    "CREATE TABLE IF NOT EXISTS migrations",
+	SelectVersions: "SELECT version FROM migrations",
+	InsertVersion:  "INSERT INTO migrations",
+}
+
+var migrations = []Migration{
+	{Version: 1, Description: "create table", Up: "CREATE TABLE outbox"},
+	{Version: 2, Description: "add column", Up: "ALTER TABLE outbox"},
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("applies the pending migrations", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("failed to open a stub database connection: %s", err)
+		}
+		defer db.Close()
+
+		mock.ExpectExec("CREATE TABLE IF NOT EXISTS migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT version FROM migrations").
+			WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(1))
+		mock.ExpectBegin()
+		mock.ExpectExec("ALTER TABLE outbox").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("INSERT INTO migrations").
+			WithArgs(2, "add column").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+
+		if err := Run(ctx, db, dialect, migrations); err != nil {
+			t.Fatalf("failed to run migrations: %s", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("rolls back a failed migration", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("failed to open a stub database connection: %s", err)
+		}
+		defer db.Close()
+
+		mock.ExpectExec("CREATE TABLE IF NOT EXISTS migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT version FROM migrations").
+			WillReturnRows(sqlmock.NewRows([]string{"version"}))
+		mock.ExpectBegin()
+		mock.ExpectExec("CREATE TABLE outbox").WillReturnError(errors.New("syntax error"))
+		mock.ExpectRollback()
+
+		if err := Run(ctx, db, dialect, migrations); err == nil {
+			t.Fatal("expected the migration to fail")
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("rejects versions out of order", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("failed to open a stub database connection: %s", err)
+		}
+		defer db.Close()
+
+		mock.ExpectExec("CREATE TABLE IF NOT EXISTS migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+
+		err = Run(ctx, db, dialect, []Migration{migrations[1], migrations[0]})
+		if !errors.Is(err, ErrInvalidVersion) {
+			t.Fatalf("expected an invalid version error, got %v", err)
+		}
+	})
+}
@@ -40,7 +40,23 @@ func WithCleanUpBefore(t time.Time) Option {
 	}
 }
 
+// WithCompactionInterval sets the frequency that outboxer will strip the options and headers of old
+// dispatched messages. Compaction only runs when the data store is a Compactor.
+func WithCompactionInterval(t time.Duration) Option {
+	return func(o *Outboxer) {
+		o.compactionInterval = t
+	}
+}
+
+// WithCompactBefore sets the date that the compaction process should start compacting from.
+func WithCompactBefore(t time.Time) Option {
+	return func(o *Outboxer) {
+		o.compactBefore = t
+	}
+}
+
 // WithCleanUpBatchSize sets the clean up process batch size.
+// The same batch size is used by the compaction process.
 func WithCleanUpBatchSize(s int32) Option {
 	return func(o *Outboxer) {
 		o.cleanUpBatchSize = s
@@ -53,3 +69,69 @@ func WithMessageBatchSize(s int32) Option {
 		o.messageBatchSize = s
 	}
 }
+
+// WithBatchSend sends each batch of messages at once when the event stream is a BatchSender.
+// Batches may not keep the order of the messages, or the per-message options that ordering relies on,
+// so by default the messages are sent one by one.
+func WithBatchSend() Option {
+	return func(o *Outboxer) {
+		o.batchSend = true
+	}
+}
+
+// WithRetryPolicy retries SendWithinTx, SendWithinTxOptions and SendAllWithinTx when they fail with a retryable error,
+// such as a serialization failure or a deadlock. The backoff waits through the clock, see RetryPolicy for how it
+// combines with the retries of the data store.
+func WithRetryPolicy(p RetryPolicy) Option {
+	return func(o *Outboxer) {
+		o.retryPolicy = &p
+	}
+}
+
+// WithMaxAttempts sets how many times a message may fail to be sent before it is set as dead, so it
+// no longer holds up the dispatcher. It only applies when the data store is a FailureTracker, and by
+// default messages are retried until they are sent. It is a budget of its own, a failed send is never
+// retried by the RetryPolicy.
+func WithMaxAttempts(n int32) Option {
+	return func(o *Outboxer) {
+		o.maxAttempts = n
+	}
+}
+
+// WithClock sets the clock that drives the dispatcher, cleanup and compaction tickers and the retry backoff.
+// The system clock is used by default.
+func WithClock(c Clock) Option {
+	return func(o *Outboxer) {
+		o.clock = c
+	}
+}
+
+// ReplayOption represents the options of a replay.
+type ReplayOption func(*replayOptions)
+
+type replayOptions struct {
+	es      EventStream
+	options DynamicValues
+	dryRun  bool
+}
+
+// ReplayDryRun only counts the messages that would be replayed.
+func ReplayDryRun() ReplayOption {
+	return func(o *replayOptions) {
+		o.dryRun = true
+	}
+}
+
+// ReplayWithOptions overrides the options of the replayed messages, for example to send them to another destination.
+func ReplayWithOptions(opts DynamicValues) ReplayOption {
+	return func(o *replayOptions) {
+		o.options = opts
+	}
+}
+
+// ReplayToStream sends the replayed messages to the given event stream instead of the outboxer one.
+func ReplayToStream(es EventStream) ReplayOption {
+	return func(o *replayOptions) {
+		o.es = es
+	}
+}
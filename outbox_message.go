@@ -6,20 +6,31 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"reflect"
+	"time"
 )
 
 // ErrFailedToDecodeType is returned when the type of the value is not supported.
 var ErrFailedToDecodeType = errors.New("failed to decode type")
 
 // OutboxMessage represents a message that will be sent.
+// CreatedAt is set by the data store when the message is added, unless it is already set, such as when
+// a message is imported with its original creation time.
+// Attempts counts the sends of the message that failed and LastError holds the error of the last one,
+// they are kept by the data stores that are a FailureTracker. A Dead message failed too many times
+// and is no longer dispatched until it is requeued.
 type OutboxMessage struct {
+	CreatedAt    time.Time
 	Options      DynamicValues
 	Headers      DynamicValues
 	DispatchedAt sql.NullTime
+	LastError    string
 	Payload      []byte
 	ID           int64
+	Attempts     int32
 	Dispatched   bool
+	Dead         bool
 }
 
 // DynamicValues is a map that can be serialized.
@@ -51,3 +62,91 @@ func (p *DynamicValues) Scan(src interface{}) error {
 
 	return fmt.Errorf("could not not decode type %T -> %T: %w", src, p, ErrFailedToDecodeType)
 }
+
+// GetString returns the string stored under key, ok is false when the key is not set.
+// It returns an error wrapping ErrInvalidOption when the value is not a string.
+func (p DynamicValues) GetString(key string) (v string, ok bool, err error) {
+	data, ok := p[key]
+	if !ok {
+		return "", false, nil
+	}
+
+	v, isString := data.(string)
+	if !isString {
+		return "", true, invalidOption(key, "a string", data)
+	}
+
+	return v, true, nil
+}
+
+// GetBool returns the bool stored under key, ok is false when the key is not set.
+// It returns an error wrapping ErrInvalidOption when the value is not a bool.
+func (p DynamicValues) GetBool(key string) (v bool, ok bool, err error) {
+	data, ok := p[key]
+	if !ok {
+		return false, false, nil
+	}
+
+	v, isBool := data.(bool)
+	if !isBool {
+		return false, true, invalidOption(key, "a bool", data)
+	}
+
+	return v, true, nil
+}
+
+// GetInt64 returns the integer stored under key, ok is false when the key is not set.
+// Any integer type is accepted, and so are whole floats and json.Number, which is how
+// numbers come back from the options stored as JSON.
+// It returns an error wrapping ErrInvalidOption when the value is not an integer.
+func (p DynamicValues) GetInt64(key string) (v int64, ok bool, err error) {
+	data, ok := p[key]
+	if !ok {
+		return 0, false, nil
+	}
+
+	switch n := data.(type) {
+	case int:
+		return int64(n), true, nil
+	case int8:
+		return int64(n), true, nil
+	case int16:
+		return int64(n), true, nil
+	case int32:
+		return int64(n), true, nil
+	case int64:
+		return n, true, nil
+	case uint8:
+		return int64(n), true, nil
+	case uint16:
+		return int64(n), true, nil
+	case uint32:
+		return int64(n), true, nil
+	case uint:
+		if uint64(n) <= math.MaxInt64 {
+			return int64(n), true, nil
+		}
+	case uint64:
+		if n <= math.MaxInt64 {
+			return int64(n), true, nil
+		}
+	case float32:
+		if f := float64(n); f == math.Trunc(f) && math.Abs(f) < math.MaxInt64 {
+			return int64(f), true, nil
+		}
+	case float64:
+		if n == math.Trunc(n) && math.Abs(n) < math.MaxInt64 {
+			return int64(n), true, nil
+		}
+	case json.Number:
+		if i, err := n.Int64(); err == nil {
+			return i, true, nil
+		}
+	}
+
+	return 0, true, invalidOption(key, "an integer", data)
+}
+
+func invalidOption(key, want string, got interface{}) error {
+	return fmt.Errorf("%w: %s must be %s, got %T", ErrInvalidOption, key, want, got)
+}
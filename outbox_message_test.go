@@ -1,6 +1,8 @@
 package outboxer_test
 
 import (
+	"encoding/json"
+	"errors"
 	"strings"
 	"testing"
 
@@ -22,6 +24,10 @@ func TestOutboxMessage(t *testing.T) {
 			testDynamicValuesValue,
 			"check if DynamicValues Value works for message",
 		},
+		{
+			testDynamicValuesGetters,
+			"check if DynamicValues getters convert and reject values",
+		},
 	}
 
 	for _, test := range tests {
@@ -123,3 +129,44 @@ func TestDynamicValues_Scan_InvalidSrc(t *testing.T) {
 		t.Errorf("expected error message to contain %q, but got %q", expectedErrMsg, err.Error())
 	}
 }
+
+func testDynamicValuesGetters(t *testing.T) {
+	dv := outboxer.DynamicValues{
+		"name":    "orders",
+		"durable": true,
+		"delay":   int32(5),
+		"decoded": float64(7),
+		"number":  json.Number("9"),
+		"half":    1.5,
+	}
+
+	if v, ok, err := dv.GetString("name"); err != nil || !ok || v != "orders" {
+		t.Fatalf("unexpected string %q, %t, %v", v, ok, err)
+	}
+
+	if v, ok, err := dv.GetBool("durable"); err != nil || !ok || !v {
+		t.Fatalf("unexpected bool %t, %t, %v", v, ok, err)
+	}
+
+	for key, want := range map[string]int64{"delay": 5, "decoded": 7, "number": 9} {
+		if v, ok, err := dv.GetInt64(key); err != nil || !ok || v != want {
+			t.Fatalf("unexpected integer for %s: %d, %t, %v", key, v, ok, err)
+		}
+	}
+
+	if _, ok, err := dv.GetString("missing"); ok || err != nil {
+		t.Fatalf("expected a missing key to be ignored, got %t, %v", ok, err)
+	}
+
+	if _, _, err := dv.GetString("durable"); !errors.Is(err, outboxer.ErrInvalidOption) {
+		t.Fatalf("expected ErrInvalidOption, got %v", err)
+	}
+
+	if _, _, err := dv.GetBool("name"); !errors.Is(err, outboxer.ErrInvalidOption) {
+		t.Fatalf("expected ErrInvalidOption, got %v", err)
+	}
+
+	if _, _, err := dv.GetInt64("half"); !errors.Is(err, outboxer.ErrInvalidOption) {
+		t.Fatalf("expected ErrInvalidOption, got %v", err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,6 +23,24 @@ var (
 
 	// ErrMissingDataStore is used when no data store is provided.
 	ErrMissingDataStore = errors.New("a data store is required for the outboxer to work")
+
+	// ErrReplayNotSupported is used when the data store can't replay messages.
+	ErrReplayNotSupported = errors.New("the data store does not support replaying messages")
+
+	// ErrMessageNotFound is used when a message is not in the data store.
+	ErrMessageNotFound = errors.New("message not found")
+
+	// ErrBatchNotSupported is used when the data store can't add many messages atomically.
+	ErrBatchNotSupported = errors.New("the data store does not support adding many messages at once")
+
+	// ErrTxNotSupported is used when the data store can't add messages within a caller-owned transaction.
+	ErrTxNotSupported = errors.New("the data store does not support adding messages within a transaction")
+
+	// ErrInvalidOption is used when an option or a header of a message has a value of the wrong type.
+	ErrInvalidOption = errors.New("invalid option")
+
+	// ErrFailureTrackingNotSupported is used when the data store doesn't track the failed sends of messages.
+	ErrFailureTrackingNotSupported = errors.New("the data store does not track failed messages")
 )
 
 // ExecerContext defines the exec context method that is used within a transaction.
@@ -29,6 +48,14 @@ type ExecerContext interface {
 	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
 }
 
+// Tx is the transaction handle given to the SendWithinTxOptions callback, *sql.Tx implements it.
+type Tx interface {
+	ExecerContext
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
 // DataStore defines the data store methods.
 type DataStore interface {
 	// Tries to find the given message in the outbox.
@@ -39,6 +66,127 @@ type DataStore interface {
 	Remove(ctx context.Context, since time.Time, batchSize int32) error
 }
 
+// TxAdder is implemented by data stores that can add messages within a transaction owned by the caller.
+// The data store never commits or rolls back the transaction.
+type TxAdder interface {
+	AddInTx(ctx context.Context, tx ExecerContext, msgs ...*OutboxMessage) error
+}
+
+// BatchAdder is implemented by data stores that can add many messages atomically, with multi-row inserts.
+// The ID and CreatedAt of each message are set by the data store.
+type BatchAdder interface {
+	AddAll(ctx context.Context, msgs ...*OutboxMessage) error
+	// AddAllWithinTx runs fn, when not nil, and adds the messages within a transaction started with the given options.
+	AddAllWithinTx(ctx context.Context, msgs []*OutboxMessage, opts *sql.TxOptions, fn func(Tx) error) error
+}
+
+// TxOptionsAdder is implemented by data stores that can add a message within a transaction
+// started with the given options, handing the full transaction to the callback.
+// When the callback fails, the transaction is rolled back and the message is not added.
+type TxOptionsAdder interface {
+	AddWithinTxOptions(ctx context.Context, m *OutboxMessage, opts *sql.TxOptions, fn func(Tx) error) error
+}
+
+// Notifier is implemented by data stores that can signal when messages are added, so the dispatcher
+// checks for them right away instead of waiting for the next check interval.
+type Notifier interface {
+	// Notify returns a channel that receives a value when messages are added. The channel is closed when
+	// the context is done or the notifications stop, the dispatcher then keeps checking on its interval.
+	// A nil channel means notifications are disabled.
+	Notify(ctx context.Context) (<-chan struct{}, error)
+}
+
+// Archiver receives the messages that are about to be removed from the data store by the cleanup process.
+// If archiving fails, the messages are kept in the data store, so an archiver may see the same message more than once.
+type Archiver interface {
+	Archive(ctx context.Context, msgs []*OutboxMessage) error
+}
+
+// Compactor is implemented by data stores that can strip the options and headers of old dispatched messages.
+type Compactor interface {
+	Compact(ctx context.Context, dispatchedBefore time.Time, batchSize int32) error
+}
+
+// ReplayFilter selects dispatched messages to be replayed. Zero values are ignored.
+type ReplayFilter struct {
+	// DispatchedAfter matches messages dispatched at or after the given time.
+	DispatchedAfter time.Time
+	// DispatchedBefore matches messages dispatched before the given time.
+	DispatchedBefore time.Time
+	// Destination matches messages whose options contain all of the given values.
+	Destination DynamicValues
+	// FromID matches messages with an id greater than or equal to the given one.
+	FromID int64
+	// ToID matches messages with an id lower than or equal to the given one.
+	ToID int64
+}
+
+// Replayer is implemented by data stores that can replay already dispatched messages.
+type Replayer interface {
+	// CountDispatched counts the dispatched messages that match the filter.
+	CountDispatched(ctx context.Context, f ReplayFilter) (int64, error)
+	// GetDispatched returns up to batchSize dispatched messages that match the filter
+	// and have an id greater than afterID, ordered by id.
+	GetDispatched(ctx context.Context, f ReplayFilter, afterID int64, batchSize int32) ([]*OutboxMessage, error)
+	// Replay sets the dispatched messages that match the filter back to pending and returns how many were reset.
+	// When override is not empty, it is merged into the options of each message.
+	Replay(ctx context.Context, f ReplayFilter, override DynamicValues) (int64, error)
+}
+
+// FailureTracker is implemented by data stores that keep track of the messages that failed to be sent.
+type FailureTracker interface {
+	// SetAsFailed records a failed send of the message and its reason. Once the message failed maxAttempts
+	// times it is set as dead, and it is no longer returned by GetEvents. A maxAttempts of zero never sets it as dead.
+	SetAsFailed(ctx context.Context, id int64, reason string, maxAttempts int32) error
+	// Requeue sets the dead messages with the given ids back to pending, clearing their attempts,
+	// and returns how many were requeued. Messages that are not dead are left as they are.
+	Requeue(ctx context.Context, ids ...int64) (int64, error)
+}
+
+// MessageState is the state of a message in the data store.
+type MessageState int
+
+const (
+	// AnyState matches every message.
+	AnyState MessageState = iota
+	// PendingState matches the messages that were not dispatched yet and are not dead.
+	PendingState
+	// DispatchedState matches the messages that were already dispatched.
+	DispatchedState
+	// FailedState matches the pending messages that failed to be sent at least once.
+	FailedState
+	// DeadState matches the messages that failed too many times and are no longer dispatched.
+	DeadState
+)
+
+// ListFilter selects the messages to be listed.
+type ListFilter struct {
+	State MessageState
+	// AfterID only lists messages with an id greater than the given one, which is used for paging.
+	AfterID int64
+	Limit   int32
+}
+
+// Stats holds the counters of the messages in a data store.
+// Failed counts the pending messages that failed at least once, so they are also counted as Pending.
+type Stats struct {
+	LastDispatchedAt sql.NullTime
+	OldestPendingID  sql.NullInt64
+	Pending          int64
+	Dispatched       int64
+	Failed           int64
+	Dead             int64
+}
+
+// Inspector is implemented by data stores that can be inspected by operators.
+type Inspector interface {
+	Stats(ctx context.Context) (*Stats, error)
+	// GetEvent returns ErrMessageNotFound when there is no message with the given id.
+	GetEvent(ctx context.Context, id int64) (*OutboxMessage, error)
+	// ListEvents returns the messages that match the filter, ordered by id.
+	ListEvents(ctx context.Context, f ListFilter) ([]*OutboxMessage, error)
+}
+
 // EventStream defines the event stream methods.
 type EventStream interface {
 	Send(context.Context, *OutboxMessage) error
@@ -46,15 +194,22 @@ type EventStream interface {
 
 // Outboxer implements the outbox pattern.
 type Outboxer struct {
-	cleanUpBefore    time.Time
-	ds               DataStore
-	es               EventStream
-	errChan          chan error
-	okChan           chan struct{}
-	checkInterval    time.Duration
-	cleanUpInterval  time.Duration
-	cleanUpBatchSize int32
-	messageBatchSize int32
+	cleanUpBefore      time.Time
+	compactBefore      time.Time
+	ds                 DataStore
+	es                 EventStream
+	errChan            chan error
+	okChan             chan struct{}
+	checkInterval      time.Duration
+	cleanUpInterval    time.Duration
+	compactionInterval time.Duration
+	cleanUpBatchSize   int32
+	messageBatchSize   int32
+	retryPolicy        *RetryPolicy
+	clock              Clock
+	maxAttempts        int32
+	batchSend          bool
+	paused             atomic.Bool
 }
 
 // New creates a new instance of Outboxer.
@@ -78,6 +233,10 @@ func New(opts ...Option) (*Outboxer, error) {
 		return nil, ErrMissingEventStream
 	}
 
+	if o.clock == nil {
+		o.clock = SystemClock()
+	}
+
 	return &o, nil
 }
 
@@ -98,56 +257,250 @@ func (o *Outboxer) Send(ctx context.Context, m *OutboxMessage) error {
 
 // SendWithinTx encapsulate any database call within a transaction.
 func (o *Outboxer) SendWithinTx(ctx context.Context, evt *OutboxMessage, fn func(ExecerContext) error) error {
-	return o.ds.AddWithinTx(ctx, evt, fn)
+	return o.withRetry(ctx, func() error {
+		return o.ds.AddWithinTx(ctx, evt, fn)
+	})
+}
+
+// SendWithinTxOptions encapsulate any database call within a transaction started with the given options,
+// such as the isolation level. The callback can query and prepare statements within the transaction.
+func (o *Outboxer) SendWithinTxOptions(ctx context.Context, evt *OutboxMessage, opts *sql.TxOptions, fn func(Tx) error) error {
+	a, ok := o.ds.(TxOptionsAdder)
+	if !ok {
+		return ErrTxNotSupported
+	}
+
+	return o.withRetry(ctx, func() error {
+		return a.AddWithinTxOptions(ctx, evt, opts, fn)
+	})
+}
+
+// SendAll adds all the messages atomically, either all of them are sent or none.
+func (o *Outboxer) SendAll(ctx context.Context, msgs ...*OutboxMessage) error {
+	a, ok := o.ds.(BatchAdder)
+	if !ok {
+		return ErrBatchNotSupported
+	}
+
+	return a.AddAll(ctx, msgs...)
+}
+
+// SendAllWithinTx encapsulate any database call within a transaction started with the given options,
+// and adds all the messages within the same transaction.
+func (o *Outboxer) SendAllWithinTx(ctx context.Context, msgs []*OutboxMessage, opts *sql.TxOptions, fn func(Tx) error) error {
+	a, ok := o.ds.(BatchAdder)
+	if !ok {
+		return ErrBatchNotSupported
+	}
+
+	return o.withRetry(ctx, func() error {
+		return a.AddAllWithinTx(ctx, msgs, opts, fn)
+	})
+}
+
+// SendInTx adds the messages within a transaction owned by the caller, such as a *sql.Tx.
+// They are dispatched once the caller commits the transaction, and dropped if it is rolled back.
+func (o *Outboxer) SendInTx(ctx context.Context, tx ExecerContext, msgs ...*OutboxMessage) error {
+	a, ok := o.ds.(TxAdder)
+	if !ok {
+		return ErrTxNotSupported
+	}
+
+	return a.AddInTx(ctx, tx, msgs...)
+}
+
+// Requeue sets the dead messages with the given ids back to pending, so the dispatcher sends them again,
+// and returns how many were requeued.
+func (o *Outboxer) Requeue(ctx context.Context, ids ...int64) (int64, error) {
+	t, ok := o.ds.(FailureTracker)
+	if !ok {
+		return 0, ErrFailureTrackingNotSupported
+	}
+
+	return t.Requeue(ctx, ids...)
+}
+
+// Replay re-dispatches the messages that match the filter and returns how many were affected.
+// By default the messages are set back to pending, so the dispatcher sends them again.
+// With ReplayToStream they are sent right away to the given event stream and stay dispatched.
+func (o *Outboxer) Replay(ctx context.Context, f ReplayFilter, opts ...ReplayOption) (int64, error) {
+	r, ok := o.ds.(Replayer)
+	if !ok {
+		return 0, ErrReplayNotSupported
+	}
+
+	var ro replayOptions
+	for _, opt := range opts {
+		opt(&ro)
+	}
+
+	if ro.dryRun {
+		return r.CountDispatched(ctx, f)
+	}
+
+	if ro.es == nil {
+		return r.Replay(ctx, f, ro.options)
+	}
+
+	var (
+		sent    int64
+		afterID int64
+	)
+
+	for {
+		msgs, err := r.GetDispatched(ctx, f, afterID, o.messageBatchSize)
+		if err != nil {
+			return sent, err
+		}
+
+		if len(msgs) == 0 {
+			return sent, nil
+		}
+
+		for _, m := range msgs {
+			evt := *m
+
+			if len(ro.options) > 0 {
+				evt.Options = make(DynamicValues, len(m.Options)+len(ro.options))
+				for k, v := range m.Options {
+					evt.Options[k] = v
+				}
+
+				for k, v := range ro.options {
+					evt.Options[k] = v
+				}
+			}
+
+			if err := ro.es.Send(ctx, &evt); err != nil {
+				return sent, err
+			}
+
+			sent++
+			afterID = m.ID
+		}
+	}
 }
 
 // Start encapsulates two go routines. Starts the dispatcher, which is responsible for getting the messages
 // from the data store and sending to the event stream.
 // Starts the cleanup process, that makes sure old messages are removed from the data store.
+// When a compaction interval is set and the data store is a Compactor, it also starts the compaction process.
 func (o *Outboxer) Start(ctx context.Context) {
 	go o.StartDispatcher(ctx)
 
 	go o.StartCleanup(ctx)
+
+	if _, ok := o.ds.(Compactor); ok && o.compactionInterval > 0 {
+		go o.StartCompaction(ctx)
+	}
 }
 
 // StartDispatcher starts the dispatcher, which is responsible for getting the messages
 // from the data store and sending to the event stream.
+// When the data store is a Notifier, it also dispatches as soon as messages are added.
+// With WithBatchSend and an event stream that is a BatchSender, each batch of messages is sent at once.
 func (o *Outboxer) StartDispatcher(ctx context.Context) {
-	ticker := time.NewTicker(o.checkInterval)
+	ticker := o.clock.NewTicker(o.checkInterval)
+	defer ticker.Stop()
+
+	var wake <-chan struct{}
+
+	if n, ok := o.ds.(Notifier); ok {
+		c, err := n.Notify(ctx)
+		if err != nil {
+			o.errChan <- err
+		}
+
+		wake = c
+	}
 
 	for {
 		select {
-		case <-ticker.C:
-			evts, err := o.ds.GetEvents(ctx, o.messageBatchSize)
-			if err != nil {
-				o.errChan <- err
+		case <-ticker.C():
+			o.dispatch(ctx)
+		case _, ok := <-wake:
+			if !ok {
+				wake = nil
 				break
 			}
 
-			for _, e := range evts {
-				if err := o.es.Send(ctx, e); err != nil {
-					o.errChan <- err
-				} else {
-					if err := o.ds.SetAsDispatched(ctx, e.ID); err != nil {
-						o.errChan <- err
-					} else {
-						o.okChan <- struct{}{}
-					}
-				}
-			}
+			o.dispatch(ctx)
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+func (o *Outboxer) dispatch(ctx context.Context) {
+	if o.paused.Load() {
+		return
+	}
+
+	evts, err := o.ds.GetEvents(ctx, o.messageBatchSize)
+	if err != nil {
+		o.errChan <- err
+		return
+	}
+
+	if b, ok := o.es.(BatchSender); ok && o.batchSend && len(evts) > 0 {
+		o.dispatchBatch(ctx, b, evts)
+		return
+	}
+
+	for _, e := range evts {
+		if err := o.es.Send(ctx, e); err != nil {
+			o.fail(ctx, e, err)
+		} else {
+			if err := o.ds.SetAsDispatched(ctx, e.ID); err != nil {
+				o.errChan <- err
+			} else {
+				o.okChan <- struct{}{}
+			}
+		}
+	}
+}
+
+// fail reports the error of a message that could not be sent. When the data store is a FailureTracker,
+// the failure is recorded before it is reported, see WithMaxAttempts.
+func (o *Outboxer) fail(ctx context.Context, e *OutboxMessage, err error) {
+	if t, ok := o.ds.(FailureTracker); ok {
+		if tErr := t.SetAsFailed(ctx, e.ID, err.Error(), o.maxAttempts); tErr != nil {
+			err = errors.Join(err, tErr)
+		}
+	}
+
+	o.errChan <- err
+}
+
+// Pause stops the dispatcher from sending messages until Resume is called.
+// Messages are still added to the data store while the dispatcher is paused.
+func (o *Outboxer) Pause() {
+	o.paused.Store(true)
+}
+
+// Resume lets a paused dispatcher send messages again.
+func (o *Outboxer) Resume() {
+	o.paused.Store(false)
+}
+
+// Paused reports whether the dispatcher is paused.
+func (o *Outboxer) Paused() bool {
+	return o.paused.Load()
+}
+
+// DataStore returns the data store used by the outboxer.
+func (o *Outboxer) DataStore() DataStore {
+	return o.ds
+}
+
 // StartCleanup starts the cleanup process, that makes sure old messages are removed from the data store.
 func (o *Outboxer) StartCleanup(ctx context.Context) {
-	ticker := time.NewTicker(o.cleanUpInterval)
+	ticker := o.clock.NewTicker(o.cleanUpInterval)
+	defer ticker.Stop()
 
 	for {
 		select {
-		case <-ticker.C:
+		case <-ticker.C():
 			if err := o.ds.Remove(ctx, o.cleanUpBefore, o.cleanUpBatchSize); err != nil {
 				o.errChan <- err
 			}
@@ -157,6 +510,29 @@ func (o *Outboxer) StartCleanup(ctx context.Context) {
 	}
 }
 
+// StartCompaction starts the compaction process, that strips the options and headers of old dispatched messages.
+// It returns right away when the data store is not a Compactor.
+func (o *Outboxer) StartCompaction(ctx context.Context) {
+	c, ok := o.ds.(Compactor)
+	if !ok {
+		return
+	}
+
+	ticker := o.clock.NewTicker(o.compactionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C():
+			if err := c.Compact(ctx, o.compactBefore, o.cleanUpBatchSize); err != nil {
+				o.errChan <- err
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 // Stop closes all channels.
 func (o *Outboxer) Stop() {
 	close(o.errChan)
@@ -2,6 +2,7 @@ package outboxer_test
 
 import (
 	"context"
+	"database/sql"
 	"errors"
 	"fmt"
 	"testing"
@@ -9,6 +10,7 @@ import (
 
 	"github.com/italolelis/outboxer"
 	amqpOut "github.com/italolelis/outboxer/es/amqp"
+	"github.com/italolelis/outboxer/outboxertest"
 )
 
 type inMemDS struct {
@@ -183,6 +185,956 @@ func TestOutboxer_SendWithinTx(t *testing.T) {
 	<-done
 }
 
+func TestOutboxer_SendWithFakes(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ds := outboxertest.NewDataStore()
+	es := outboxertest.NewEventStream()
+	clock := outboxertest.NewClock(time.Now())
+
+	o, err := outboxer.New(
+		outboxer.WithDataStore(ds),
+		outboxer.WithEventStream(es),
+		outboxer.WithClock(clock),
+		outboxer.WithCheckInterval(1*time.Second),
+		outboxer.WithMessageBatchSize(10),
+	)
+	if err != nil {
+		t.Fatalf("could not create an outboxer instance: %s", err)
+	}
+
+	go o.StartDispatcher(ctx)
+
+	go func() {
+		for {
+			select {
+			case err := <-o.ErrChan():
+				t.Errorf("could not dispatch message: %s", err)
+			case <-o.OkChan():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	if err := o.Send(ctx, &outboxer.OutboxMessage{Payload: []byte("sent")}); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+
+	if err := o.SendWithinTx(ctx, &outboxer.OutboxMessage{Payload: []byte("sent within tx")}, func(execer outboxer.ExecerContext) error {
+		_, err := execer.ExecContext(ctx, "UPDATE orders SET status = 'paid'")
+		return err
+	}); err != nil {
+		t.Fatalf("could not send message within transaction: %s", err)
+	}
+
+	if err := clock.WaitForTimers(ctx, 1); err != nil {
+		t.Fatalf("expected the dispatcher to wait on the clock: %s", err)
+	}
+
+	clock.Advance(time.Second)
+
+	sent, err := es.WaitForSent(ctx, 2)
+	if err != nil {
+		t.Fatalf("was expecting 2 messages to be sent: %s", err)
+	}
+
+	if string(sent[0].Payload) != "sent" || string(sent[1].Payload) != "sent within tx" {
+		t.Fatalf("unexpected messages sent %q and %q", sent[0].Payload, sent[1].Payload)
+	}
+
+	if stmts := ds.Statements(); len(stmts) != 1 || stmts[0].Query != "UPDATE orders SET status = 'paid'" {
+		t.Fatalf("was expecting the statement of the transaction to be kept, got %+v", stmts)
+	}
+}
+
+type compactingDS struct {
+	inMemDS
+	compacted chan time.Time
+}
+
+func (c *compactingDS) Compact(ctx context.Context, dispatchedBefore time.Time, batchSize int32) error {
+	select {
+	case c.compacted <- dispatchedBefore:
+	default:
+	}
+
+	return nil
+}
+
+func TestOutboxer_Compaction(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	compactBefore := time.Now().AddDate(0, 0, -30)
+	ds := &compactingDS{compacted: make(chan time.Time, 1)}
+	clock := outboxertest.NewClock(time.Now())
+
+	o, err := outboxer.New(
+		outboxer.WithDataStore(ds),
+		outboxer.WithEventStream(&inMemES{true}),
+		outboxer.WithClock(clock),
+		outboxer.WithCheckInterval(1*time.Hour),
+		outboxer.WithCleanupInterval(1*time.Hour),
+		outboxer.WithCompactionInterval(10*time.Minute),
+		outboxer.WithCompactBefore(compactBefore),
+	)
+	if err != nil {
+		t.Fatalf("could not create an outboxer instance: %s", err)
+	}
+
+	o.Start(ctx)
+
+	if err := clock.WaitForTimers(ctx, 3); err != nil {
+		t.Fatalf("the tickers were not created: %s", err)
+	}
+
+	// The second tick is only received once the compaction of the first one returned.
+	clock.Advance(10 * time.Minute)
+	clock.Advance(10 * time.Minute)
+
+	select {
+	case got := <-ds.compacted:
+		if !got.Equal(compactBefore) {
+			t.Errorf("was expecting to compact messages before %s but got %s", compactBefore, got)
+		}
+	default:
+		t.Fatal("compaction did not run")
+	}
+}
+
+type replayingDS struct {
+	inMemDS
+}
+
+func (r *replayingDS) matches(m *outboxer.OutboxMessage, f outboxer.ReplayFilter) bool {
+	if !m.Dispatched || m.ID < f.FromID || (f.ToID > 0 && m.ID > f.ToID) {
+		return false
+	}
+
+	for k, v := range f.Destination {
+		if m.Options[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (r *replayingDS) CountDispatched(ctx context.Context, f outboxer.ReplayFilter) (int64, error) {
+	var count int64
+
+	for _, m := range r.data {
+		if r.matches(m, f) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (r *replayingDS) GetDispatched(ctx context.Context, f outboxer.ReplayFilter, afterID int64, batchSize int32) ([]*outboxer.OutboxMessage, error) {
+	var msgs []*outboxer.OutboxMessage
+
+	for _, m := range r.data {
+		if m.ID > afterID && r.matches(m, f) && len(msgs) < int(batchSize) {
+			msgs = append(msgs, m)
+		}
+	}
+
+	return msgs, nil
+}
+
+func (r *replayingDS) Replay(ctx context.Context, f outboxer.ReplayFilter, override outboxer.DynamicValues) (int64, error) {
+	var count int64
+
+	for _, m := range r.data {
+		if r.matches(m, f) {
+			m.Dispatched = false
+
+			for k, v := range override {
+				m.Options[k] = v
+			}
+
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+type recordingES struct {
+	sent []*outboxer.OutboxMessage
+}
+
+func (r *recordingES) Send(_ context.Context, m *outboxer.OutboxMessage) error {
+	r.sent = append(r.sent, m)
+	return nil
+}
+
+func TestOutboxer_Replay(t *testing.T) {
+	ctx := context.Background()
+
+	newDS := func() *replayingDS {
+		ds := &replayingDS{}
+		for i := int64(1); i <= 5; i++ {
+			topic := "orders"
+			if i%2 == 0 {
+				topic = "payments"
+			}
+
+			ds.data = append(ds.data, &outboxer.OutboxMessage{
+				ID:         i,
+				Dispatched: true,
+				Options:    outboxer.DynamicValues{"topic_name": topic},
+			})
+		}
+
+		return ds
+	}
+
+	filter := outboxer.ReplayFilter{Destination: outboxer.DynamicValues{"topic_name": "orders"}}
+
+	t.Run("dry run only counts the messages", func(t *testing.T) {
+		ds := newDS()
+
+		o, err := outboxer.New(outboxer.WithDataStore(ds), outboxer.WithEventStream(&inMemES{true}))
+		if err != nil {
+			t.Fatalf("could not create an outboxer instance: %s", err)
+		}
+
+		count, err := o.Replay(ctx, filter, outboxer.ReplayDryRun())
+		if err != nil {
+			t.Fatalf("failed to replay messages: %s", err)
+		}
+
+		if count != 3 {
+			t.Fatalf("was expecting 3 messages but got %d", count)
+		}
+
+		for _, m := range ds.data {
+			if !m.Dispatched {
+				t.Fatalf("message %d was not supposed to be reset", m.ID)
+			}
+		}
+	})
+
+	t.Run("messages are set back to pending", func(t *testing.T) {
+		ds := newDS()
+
+		o, err := outboxer.New(outboxer.WithDataStore(ds), outboxer.WithEventStream(&inMemES{true}))
+		if err != nil {
+			t.Fatalf("could not create an outboxer instance: %s", err)
+		}
+
+		count, err := o.Replay(ctx, filter, outboxer.ReplayWithOptions(outboxer.DynamicValues{"topic_name": "orders.replay"}))
+		if err != nil {
+			t.Fatalf("failed to replay messages: %s", err)
+		}
+
+		if count != 3 {
+			t.Fatalf("was expecting 3 messages but got %d", count)
+		}
+
+		if ds.data[0].Dispatched || ds.data[0].Options["topic_name"] != "orders.replay" {
+			t.Fatalf("was expecting message 1 to be pending with the new destination but got %+v", ds.data[0])
+		}
+	})
+
+	t.Run("messages are sent to another stream", func(t *testing.T) {
+		ds := newDS()
+		es := &recordingES{}
+
+		o, err := outboxer.New(
+			outboxer.WithDataStore(ds),
+			outboxer.WithEventStream(&inMemES{true}),
+			outboxer.WithMessageBatchSize(2),
+		)
+		if err != nil {
+			t.Fatalf("could not create an outboxer instance: %s", err)
+		}
+
+		count, err := o.Replay(ctx, filter,
+			outboxer.ReplayToStream(es),
+			outboxer.ReplayWithOptions(outboxer.DynamicValues{"topic_name": "orders.replay"}),
+		)
+		if err != nil {
+			t.Fatalf("failed to replay messages: %s", err)
+		}
+
+		if count != 3 || len(es.sent) != 3 {
+			t.Fatalf("was expecting 3 messages to be sent but got %d", len(es.sent))
+		}
+
+		for _, m := range es.sent {
+			if m.Options["topic_name"] != "orders.replay" {
+				t.Errorf("was expecting message %d to be sent to the new destination", m.ID)
+			}
+		}
+
+		if ds.data[0].Options["topic_name"] != "orders" || !ds.data[0].Dispatched {
+			t.Fatal("the stored message was not supposed to change")
+		}
+	})
+
+	t.Run("data stores that can't replay", func(t *testing.T) {
+		o, err := outboxer.New(outboxer.WithDataStore(&inMemDS{}), outboxer.WithEventStream(&inMemES{true}))
+		if err != nil {
+			t.Fatalf("could not create an outboxer instance: %s", err)
+		}
+
+		if _, err := o.Replay(ctx, filter); !errors.Is(err, outboxer.ErrReplayNotSupported) {
+			t.Fatalf("was expecting ErrReplayNotSupported but got %v", err)
+		}
+	})
+}
+
+func TestOutboxer_Pause(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	es := outboxertest.NewEventStream()
+	clock := outboxertest.NewClock(time.Now())
+
+	o, err := outboxer.New(
+		outboxer.WithDataStore(outboxertest.NewDataStore()),
+		outboxer.WithEventStream(es),
+		outboxer.WithClock(clock),
+		outboxer.WithCheckInterval(time.Minute),
+	)
+	if err != nil {
+		t.Fatalf("could not create an outboxer instance: %s", err)
+	}
+
+	o.Pause()
+
+	if !o.Paused() {
+		t.Fatal("expected the dispatcher to be paused")
+	}
+
+	go o.StartDispatcher(ctx)
+
+	go func() {
+		for {
+			select {
+			case err := <-o.ErrChan():
+				t.Errorf("could not dispatch message: %s", err)
+			case <-o.OkChan():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	if err := o.Send(ctx, &outboxer.OutboxMessage{Payload: []byte("test payload")}); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+
+	if err := clock.WaitForTimers(ctx, 1); err != nil {
+		t.Fatalf("the ticker was not created: %s", err)
+	}
+
+	// Each tick is only received once the dispatch of the previous one returned.
+	clock.Advance(time.Minute)
+	clock.Advance(time.Minute)
+
+	if n := len(es.Sent()); n != 0 {
+		t.Fatalf("expected no message to be dispatched while paused, got %d", n)
+	}
+
+	o.Resume()
+	clock.Advance(time.Minute)
+
+	if _, err := es.WaitForSent(ctx, 1); err != nil {
+		t.Fatalf("expected the message to be dispatched after resuming: %s", err)
+	}
+}
+
+type txDS struct {
+	inMemDS
+	tx outboxer.ExecerContext
+}
+
+func (d *txDS) AddInTx(ctx context.Context, tx outboxer.ExecerContext, msgs ...*outboxer.OutboxMessage) error {
+	d.tx = tx
+
+	for _, m := range msgs {
+		if err := d.Add(ctx, m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestOutboxer_SendInTx(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("messages are added within the given transaction", func(t *testing.T) {
+		ds := &txDS{}
+
+		o, err := outboxer.New(outboxer.WithDataStore(ds), outboxer.WithEventStream(&inMemES{true}))
+		if err != nil {
+			t.Fatalf("could not create an outboxer instance: %s", err)
+		}
+
+		var tx outboxer.ExecerContext = &sql.Tx{}
+
+		if err := o.SendInTx(ctx, tx,
+			&outboxer.OutboxMessage{Payload: []byte("first")},
+			&outboxer.OutboxMessage{Payload: []byte("second")},
+		); err != nil {
+			t.Fatalf("could not send messages: %s", err)
+		}
+
+		if ds.tx != tx || len(ds.data) != 2 {
+			t.Fatalf("expected 2 messages within the transaction, got %d", len(ds.data))
+		}
+	})
+
+	t.Run("data store does not support transactions", func(t *testing.T) {
+		o, err := outboxer.New(outboxer.WithDataStore(&inMemDS{}), outboxer.WithEventStream(&inMemES{true}))
+		if err != nil {
+			t.Fatalf("could not create an outboxer instance: %s", err)
+		}
+
+		if err := o.SendInTx(ctx, &sql.Tx{}); !errors.Is(err, outboxer.ErrTxNotSupported) {
+			t.Fatalf("expected ErrTxNotSupported, got %v", err)
+		}
+	})
+}
+
+type txOptionsDS struct {
+	inMemDS
+	opts *sql.TxOptions
+}
+
+func (d *txOptionsDS) AddWithinTxOptions(
+	ctx context.Context,
+	m *outboxer.OutboxMessage,
+	opts *sql.TxOptions,
+	fn func(outboxer.Tx) error,
+) error {
+	d.opts = opts
+
+	if err := fn(&sql.Tx{}); err != nil {
+		return err
+	}
+
+	return d.Add(ctx, m)
+}
+
+func TestOutboxer_SendWithinTxOptions(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("message is added with the given options", func(t *testing.T) {
+		ds := &txOptionsDS{}
+
+		o, err := outboxer.New(outboxer.WithDataStore(ds), outboxer.WithEventStream(&inMemES{true}))
+		if err != nil {
+			t.Fatalf("could not create an outboxer instance: %s", err)
+		}
+
+		opts := &sql.TxOptions{Isolation: sql.LevelSerializable}
+
+		if err := o.SendWithinTxOptions(ctx, &outboxer.OutboxMessage{Payload: []byte("test")}, opts,
+			func(outboxer.Tx) error { return nil },
+		); err != nil {
+			t.Fatalf("could not send message: %s", err)
+		}
+
+		if ds.opts != opts || len(ds.data) != 1 {
+			t.Fatalf("expected 1 message added with the given options, got %d", len(ds.data))
+		}
+	})
+
+	t.Run("data store does not support transaction options", func(t *testing.T) {
+		o, err := outboxer.New(outboxer.WithDataStore(&inMemDS{}), outboxer.WithEventStream(&inMemES{true}))
+		if err != nil {
+			t.Fatalf("could not create an outboxer instance: %s", err)
+		}
+
+		err = o.SendWithinTxOptions(ctx, &outboxer.OutboxMessage{}, nil, func(outboxer.Tx) error { return nil })
+		if !errors.Is(err, outboxer.ErrTxNotSupported) {
+			t.Fatalf("expected ErrTxNotSupported, got %v", err)
+		}
+	})
+}
+
+var errConflict = errors.New("serialization failure")
+
+type flakyDS struct {
+	inMemDS
+	failures int
+	attempts int
+}
+
+func (d *flakyDS) AddWithinTx(ctx context.Context, m *outboxer.OutboxMessage, fn func(outboxer.ExecerContext) error) error {
+	d.attempts++
+
+	if err := fn(nil); err != nil {
+		return err
+	}
+
+	if d.attempts <= d.failures {
+		return errConflict
+	}
+
+	return d.Add(ctx, m)
+}
+
+func (d *flakyDS) IsRetryable(err error) bool {
+	return errors.Is(err, errConflict)
+}
+
+func TestOutboxer_RetryPolicy(t *testing.T) {
+	ctx := context.Background()
+	policy := outboxer.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond}
+
+	t.Run("retryable errors are retried", func(t *testing.T) {
+		ds := &flakyDS{failures: 2}
+
+		o, err := outboxer.New(
+			outboxer.WithDataStore(ds),
+			outboxer.WithEventStream(&inMemES{true}),
+			outboxer.WithRetryPolicy(policy),
+		)
+		if err != nil {
+			t.Fatalf("could not create an outboxer instance: %s", err)
+		}
+
+		var calls int
+
+		if err := o.SendWithinTx(ctx, &outboxer.OutboxMessage{Payload: []byte("test")}, func(outboxer.ExecerContext) error {
+			calls++
+			return nil
+		}); err != nil {
+			t.Fatalf("could not send message: %s", err)
+		}
+
+		if calls != 3 || len(ds.data) != 1 {
+			t.Fatalf("expected the callback to run 3 times and 1 message to be added, got %d and %d", calls, len(ds.data))
+		}
+	})
+
+	t.Run("attempts are limited", func(t *testing.T) {
+		ds := &flakyDS{failures: 5}
+
+		o, err := outboxer.New(
+			outboxer.WithDataStore(ds),
+			outboxer.WithEventStream(&inMemES{true}),
+			outboxer.WithRetryPolicy(policy),
+		)
+		if err != nil {
+			t.Fatalf("could not create an outboxer instance: %s", err)
+		}
+
+		err = o.SendWithinTx(ctx, &outboxer.OutboxMessage{}, func(outboxer.ExecerContext) error { return nil })
+		if !errors.Is(err, errConflict) || ds.attempts != 3 {
+			t.Fatalf("expected to give up after 3 attempts, got %d attempts and %v", ds.attempts, err)
+		}
+	})
+
+	t.Run("other errors are not retried", func(t *testing.T) {
+		ds := &flakyDS{}
+		fnErr := errors.New("business logic failed")
+
+		o, err := outboxer.New(
+			outboxer.WithDataStore(ds),
+			outboxer.WithEventStream(&inMemES{true}),
+			outboxer.WithRetryPolicy(policy),
+		)
+		if err != nil {
+			t.Fatalf("could not create an outboxer instance: %s", err)
+		}
+
+		err = o.SendWithinTx(ctx, &outboxer.OutboxMessage{}, func(outboxer.ExecerContext) error { return fnErr })
+		if !errors.Is(err, fnErr) || ds.attempts != 1 {
+			t.Fatalf("expected a single attempt, got %d attempts and %v", ds.attempts, err)
+		}
+	})
+
+	t.Run("backoff follows the clock", func(t *testing.T) {
+		ds := &flakyDS{failures: 2}
+		clock := outboxertest.NewClock(time.Now())
+
+		o, err := outboxer.New(
+			outboxer.WithDataStore(ds),
+			outboxer.WithEventStream(outboxertest.NewEventStream()),
+			outboxer.WithClock(clock),
+			outboxer.WithRetryPolicy(outboxer.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour}),
+		)
+		if err != nil {
+			t.Fatalf("could not create an outboxer instance: %s", err)
+		}
+
+		done := make(chan error, 1)
+
+		go func() {
+			done <- o.SendWithinTx(ctx, &outboxer.OutboxMessage{}, func(outboxer.ExecerContext) error { return nil })
+		}()
+
+		waitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+
+		// The first retry waits for an hour, the second one for two hours.
+		for _, backoff := range []time.Duration{time.Hour, 2 * time.Hour} {
+			if err := clock.WaitForTimers(waitCtx, 1); err != nil {
+				t.Fatalf("the backoff timer was not created: %s", err)
+			}
+
+			clock.Advance(backoff - time.Minute)
+
+			select {
+			case err := <-done:
+				t.Fatalf("expected to wait for the backoff of %s, got %v", backoff, err)
+			default:
+			}
+
+			clock.Advance(time.Minute)
+		}
+
+		if err := <-done; err != nil || ds.attempts != 3 {
+			t.Fatalf("expected to succeed after 3 attempts, got %d attempts and %v", ds.attempts, err)
+		}
+	})
+
+	t.Run("retries are disabled by default", func(t *testing.T) {
+		ds := &flakyDS{failures: 1}
+
+		o, err := outboxer.New(outboxer.WithDataStore(ds), outboxer.WithEventStream(&inMemES{true}))
+		if err != nil {
+			t.Fatalf("could not create an outboxer instance: %s", err)
+		}
+
+		err = o.SendWithinTx(ctx, &outboxer.OutboxMessage{}, func(outboxer.ExecerContext) error { return nil })
+		if !errors.Is(err, errConflict) || ds.attempts != 1 {
+			t.Fatalf("expected a single attempt, got %d attempts and %v", ds.attempts, err)
+		}
+	})
+}
+
+type batchDS struct {
+	inMemDS
+}
+
+func (d *batchDS) AddAll(ctx context.Context, msgs ...*outboxer.OutboxMessage) error {
+	return d.AddAllWithinTx(ctx, msgs, nil, nil)
+}
+
+func (d *batchDS) AddAllWithinTx(
+	ctx context.Context,
+	msgs []*outboxer.OutboxMessage,
+	_ *sql.TxOptions,
+	fn func(outboxer.Tx) error,
+) error {
+	if fn != nil {
+		if err := fn(&sql.Tx{}); err != nil {
+			return err
+		}
+	}
+
+	for _, m := range msgs {
+		m.ID = int64(len(d.data) + 1)
+
+		if err := d.Add(ctx, m); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestOutboxer_SendAll(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("messages are added at once", func(t *testing.T) {
+		ds := &batchDS{}
+
+		o, err := outboxer.New(outboxer.WithDataStore(ds), outboxer.WithEventStream(&inMemES{true}))
+		if err != nil {
+			t.Fatalf("could not create an outboxer instance: %s", err)
+		}
+
+		msgs := []*outboxer.OutboxMessage{{Payload: []byte("first")}, {Payload: []byte("second")}}
+		if err := o.SendAll(ctx, msgs...); err != nil {
+			t.Fatalf("could not send messages: %s", err)
+		}
+
+		if err := o.SendAllWithinTx(ctx, []*outboxer.OutboxMessage{{Payload: []byte("third")}}, nil,
+			func(outboxer.Tx) error { return nil },
+		); err != nil {
+			t.Fatalf("could not send messages: %s", err)
+		}
+
+		if len(ds.data) != 3 || msgs[1].ID != 2 {
+			t.Fatalf("expected 3 messages with their ids set, got %d", len(ds.data))
+		}
+	})
+
+	t.Run("data store does not support batches", func(t *testing.T) {
+		o, err := outboxer.New(outboxer.WithDataStore(&inMemDS{}), outboxer.WithEventStream(&inMemES{true}))
+		if err != nil {
+			t.Fatalf("could not create an outboxer instance: %s", err)
+		}
+
+		if err := o.SendAll(ctx, &outboxer.OutboxMessage{}); !errors.Is(err, outboxer.ErrBatchNotSupported) {
+			t.Fatalf("expected ErrBatchNotSupported, got %v", err)
+		}
+	})
+}
+
+type notifyingDS struct {
+	inMemDS
+	wake chan struct{}
+}
+
+func (d *notifyingDS) Add(ctx context.Context, m *outboxer.OutboxMessage) error {
+	if err := d.inMemDS.Add(ctx, m); err != nil {
+		return err
+	}
+
+	d.wake <- struct{}{}
+
+	return nil
+}
+
+func (d *notifyingDS) Notify(ctx context.Context) (<-chan struct{}, error) {
+	return d.wake, nil
+}
+
+func TestOutboxer_Notify(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := &notifyingDS{wake: make(chan struct{}, 1)}
+
+	o, err := outboxer.New(
+		outboxer.WithDataStore(ds),
+		outboxer.WithEventStream(&inMemES{true}),
+		outboxer.WithCheckInterval(time.Hour),
+	)
+	if err != nil {
+		t.Fatalf("could not create an outboxer instance: %s", err)
+	}
+
+	go o.StartDispatcher(ctx)
+
+	if err := o.Send(ctx, &outboxer.OutboxMessage{Payload: []byte("test payload")}); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+
+	select {
+	case <-o.OkChan():
+	case err := <-o.ErrChan():
+		t.Fatalf("could not dispatch message: %s", err)
+	case <-time.After(1 * time.Second):
+		t.Fatal("expected the message to be dispatched without waiting for the check interval")
+	}
+}
+
+func TestOutboxer_DispatchBatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := outboxertest.NewDataStore()
+	es := outboxertest.NewEventStream()
+	es.FailWhen(func(m *outboxer.OutboxMessage) error {
+		if string(m.Payload) == "b" {
+			return errors.New("broker unavailable")
+		}
+
+		return nil
+	})
+
+	if err := ds.AddAll(ctx,
+		&outboxer.OutboxMessage{Payload: []byte("a")},
+		&outboxer.OutboxMessage{Payload: []byte("b")},
+		&outboxer.OutboxMessage{Payload: []byte("c")},
+	); err != nil {
+		t.Fatalf("could not add messages: %s", err)
+	}
+
+	o, err := outboxer.New(
+		outboxer.WithDataStore(ds),
+		outboxer.WithEventStream(es),
+		outboxer.WithCheckInterval(10*time.Millisecond),
+		outboxer.WithBatchSend(),
+	)
+	if err != nil {
+		t.Fatalf("could not create an outboxer instance: %s", err)
+	}
+
+	go o.StartDispatcher(ctx)
+
+	var ok, failed int
+
+	for ok+failed < 3 {
+		select {
+		case <-o.OkChan():
+			ok++
+		case <-o.ErrChan():
+			failed++
+		case <-time.After(time.Second):
+			t.Fatal("expected the batch to be dispatched")
+		}
+	}
+
+	cancel()
+
+	if ok != 2 || failed != 1 {
+		t.Fatalf("expected 2 messages to be dispatched and 1 to fail, got %d and %d", ok, failed)
+	}
+
+	m, err := ds.GetEvent(context.Background(), 2)
+	if err != nil {
+		t.Fatalf("could not get message: %s", err)
+	}
+
+	if m.Dispatched {
+		t.Fatal("expected the failed message to stay pending")
+	}
+}
+
+// downBatchES is a broker that is down, every batch fails as a whole.
+type downBatchES struct{}
+
+func (downBatchES) Send(context.Context, *outboxer.OutboxMessage) error {
+	return errors.New("broker unavailable")
+}
+
+func (downBatchES) SendBatch(context.Context, []*outboxer.OutboxMessage) error {
+	return errors.New("broker unavailable")
+}
+
+func TestOutboxer_DispatchBatchFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds := outboxertest.NewDataStore()
+
+	if err := ds.AddAll(ctx,
+		&outboxer.OutboxMessage{Payload: []byte("a")},
+		&outboxer.OutboxMessage{Payload: []byte("b")},
+	); err != nil {
+		t.Fatalf("could not add messages: %s", err)
+	}
+
+	o, err := outboxer.New(
+		outboxer.WithDataStore(ds),
+		outboxer.WithEventStream(downBatchES{}),
+		outboxer.WithCheckInterval(10*time.Millisecond),
+		outboxer.WithBatchSend(),
+		outboxer.WithMaxAttempts(1),
+	)
+	if err != nil {
+		t.Fatalf("could not create an outboxer instance: %s", err)
+	}
+
+	go o.StartDispatcher(ctx)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-o.ErrChan():
+		case <-time.After(time.Second):
+			t.Fatal("expected every message of the batch to fail")
+		}
+	}
+
+	cancel()
+
+	for _, id := range []int64{1, 2} {
+		m, err := ds.GetEvent(context.Background(), id)
+		if err != nil {
+			t.Fatalf("could not get message: %s", err)
+		}
+
+		if !m.Dead || m.Attempts != 1 {
+			t.Fatalf("expected message %d to be dead after one failed batch, got %+v", id, m)
+		}
+	}
+}
+
+func TestOutboxer_MaxAttempts(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ds := outboxertest.NewDataStore()
+	es := outboxertest.NewEventStream()
+	clock := outboxertest.NewClock(time.Now())
+	es.FailWhen(func(*outboxer.OutboxMessage) error { return errors.New("broker unavailable") })
+
+	if err := ds.Add(ctx, &outboxer.OutboxMessage{Payload: []byte("test payload")}); err != nil {
+		t.Fatalf("could not add message: %s", err)
+	}
+
+	o, err := outboxer.New(
+		outboxer.WithDataStore(ds),
+		outboxer.WithEventStream(es),
+		outboxer.WithClock(clock),
+		outboxer.WithCheckInterval(time.Minute),
+		outboxer.WithMaxAttempts(2),
+	)
+	if err != nil {
+		t.Fatalf("could not create an outboxer instance: %s", err)
+	}
+
+	go o.StartDispatcher(ctx)
+
+	if err := clock.WaitForTimers(ctx, 1); err != nil {
+		t.Fatalf("the ticker was not created: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		clock.Advance(time.Minute)
+
+		select {
+		case <-o.ErrChan():
+		case <-ctx.Done():
+			t.Fatal("expected the send to fail")
+		}
+	}
+
+	m, err := ds.GetEvent(ctx, 1)
+	if err != nil {
+		t.Fatalf("could not get message: %s", err)
+	}
+
+	if !m.Dead || m.Attempts != 2 || m.LastError != "broker unavailable" {
+		t.Fatalf("expected the message to be dead after 2 attempts, got %+v", m)
+	}
+
+	if msgs, _ := ds.GetEvents(ctx, 10); len(msgs) != 0 {
+		t.Fatalf("expected the dead message not to be dispatched, got %d messages", len(msgs))
+	}
+
+	es.FailWhen(func(*outboxer.OutboxMessage) error { return nil })
+
+	if n, err := o.Requeue(ctx, 1); err != nil || n != 1 {
+		t.Fatalf("expected 1 message to be requeued, got %d and %v", n, err)
+	}
+
+	// The data store is a Notifier, so requeueing wakes the dispatcher up.
+
+	select {
+	case <-o.OkChan():
+	case err := <-o.ErrChan():
+		t.Fatalf("could not dispatch the requeued message: %s", err)
+	case <-ctx.Done():
+		t.Fatal("expected the requeued message to be dispatched")
+	}
+
+	o, err = outboxer.New(outboxer.WithDataStore(&inMemDS{}), outboxer.WithEventStream(es))
+	if err != nil {
+		t.Fatalf("could not create an outboxer instance: %s", err)
+	}
+
+	if _, err := o.Requeue(ctx, 1); !errors.Is(err, outboxer.ErrFailureTrackingNotSupported) {
+		t.Fatalf("was expecting ErrFailureTrackingNotSupported but got %v", err)
+	}
+}
+
 func TestOutboxer_WithWrongParams(t *testing.T) {
 	_, err := outboxer.New(
 		outboxer.WithEventStream(&inMemES{true}),
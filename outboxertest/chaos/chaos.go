@@ -0,0 +1,188 @@
+// Package chaos injects faults into data stores and event streams, to check the delivery guarantees of outboxer
+// under crashes, slow brokers, partial batch failures and database disconnects.
+//
+// The faults follow a Schedule that is seeded, so the same seed injects the same faults into the same
+// sequence of calls and a failing run can be replayed.
+//
+//	s := chaos.NewSchedule(seed)
+//	s.Set(chaos.OpSend, chaos.Fault{Rate: 0.2, After: true})   // the broker gets the message, the ack is lost
+//	s.Set(chaos.OpSetAsDispatched, chaos.Fault{Rate: 0.1})     // crash between Send and SetAsDispatched
+//
+//	report := chaos.Harness{Schedule: s}.Run(t)
+//	chaos.AssertAtLeastOnce(t, report)
+package chaos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrInjected is returned by the calls that fail because of a fault, unless the fault sets its own error.
+var ErrInjected = errors.New("chaos: injected fault")
+
+// Op is an operation that faults can be injected into.
+type Op string
+
+const (
+	// OpGetEvents is DataStore.GetEvents, a failure looks like a database disconnect.
+	OpGetEvents Op = "GetEvents"
+	// OpAdd is DataStore.Add and DataStore.AddWithinTx.
+	OpAdd Op = "Add"
+	// OpSetAsDispatched is DataStore.SetAsDispatched, a failure looks like a crash after the message was sent.
+	OpSetAsDispatched Op = "SetAsDispatched"
+	// OpRemove is DataStore.Remove.
+	OpRemove Op = "Remove"
+	// OpSend is EventStream.Send, and each message of EventStream.SendBatch, which fails the batch partially.
+	OpSend Op = "Send"
+	// OpSendBatch is EventStream.SendBatch as a whole.
+	OpSendBatch Op = "SendBatch"
+)
+
+// Fault describes how the calls of an operation fail.
+type Fault struct {
+	// Err is returned by the failing calls, ErrInjected when nil.
+	Err error
+	// Rate is the probability, between 0 and 1, that a call fails.
+	Rate float64
+	// Max caps the number of failures, zero means no cap.
+	Max int
+	// After fails the call once the wrapped call succeeded, such as a broker that got the message
+	// but whose acknowledgment is lost. Otherwise the wrapped call is not made.
+	After bool
+	// Latency delays every call, and Jitter adds a random delay up to its value, like a slow broker or database.
+	Latency time.Duration
+	Jitter  time.Duration
+}
+
+// Schedule decides which calls fail, it is safe for concurrent use.
+type Schedule struct {
+	seed int64
+
+	mu       sync.Mutex
+	rnd      *rand.Rand
+	faults   map[Op]Fault
+	calls    map[Op]int
+	injected map[Op]int
+}
+
+// NewSchedule creates a schedule without faults that draws from the given seed.
+func NewSchedule(seed int64) *Schedule {
+	return &Schedule{
+		seed: seed,
+		// nolint: gosec
+		rnd:      rand.New(rand.NewSource(seed)),
+		faults:   make(map[Op]Fault),
+		calls:    make(map[Op]int),
+		injected: make(map[Op]int),
+	}
+}
+
+// Seed returns the seed of the schedule.
+func (s *Schedule) Seed() int64 {
+	return s.seed
+}
+
+// Set sets the fault of an operation and returns the schedule.
+func (s *Schedule) Set(op Op, f Fault) *Schedule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults[op] = f
+
+	return s
+}
+
+// Injected returns how many faults were injected, by operation.
+func (s *Schedule) Injected() map[Op]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	injected := make(map[Op]int, len(s.injected))
+	for op, n := range s.injected {
+		injected[op] = n
+	}
+
+	return injected
+}
+
+// call is the outcome of a call drawn from the schedule.
+type call struct {
+	err   error
+	delay time.Duration
+	after bool
+}
+
+// draw decides the outcome of the next call of an operation. It only draws from the random source
+// for the faults that need it, so adding a fault doesn't change the outcomes of the other operations
+// unless they are interleaved with it.
+func (s *Schedule) draw(op Op) call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.calls[op]++
+
+	f, ok := s.faults[op]
+	if !ok {
+		return call{}
+	}
+
+	c := call{delay: f.Latency, after: f.After}
+
+	if f.Jitter > 0 {
+		c.delay += time.Duration(s.rnd.Int63n(int64(f.Jitter)))
+	}
+
+	if f.Rate <= 0 || (f.Max > 0 && s.injected[op] >= f.Max) {
+		return c
+	}
+
+	if s.rnd.Float64() < f.Rate {
+		s.injected[op]++
+
+		c.err = f.Err
+		if c.err == nil {
+			c.err = fmt.Errorf("%w: %s call %d", ErrInjected, op, s.calls[op])
+		}
+	}
+
+	return c
+}
+
+// run makes the call of an operation, injecting the fault drawn from the schedule.
+func (s *Schedule) run(ctx context.Context, op Op, fn func() error) error {
+	c := s.draw(op)
+
+	if err := sleep(ctx, c.delay); err != nil {
+		return err
+	}
+
+	if c.err != nil && !c.after {
+		return c.err
+	}
+
+	if err := fn(); err != nil {
+		return err
+	}
+
+	return c.err
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,207 @@
+package chaos_test
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/outboxertest"
+	"github.com/italolelis/outboxer/outboxertest/chaos"
+)
+
+// onlySend hides the BatchSender of an event stream, so the dispatcher sends the messages one by one.
+type onlySend struct {
+	outboxer.EventStream
+}
+
+func TestSchedule_Seeded(t *testing.T) {
+	failures := func(seed int64) []bool {
+		s := chaos.NewSchedule(seed).Set(chaos.OpSend, chaos.Fault{Rate: 0.5})
+		es := chaos.WrapEventStream(onlySend{outboxertest.NewEventStream()}, s)
+
+		var got []bool
+		for i := 0; i < 50; i++ {
+			got = append(got, es.Send(context.Background(), &outboxer.OutboxMessage{}) != nil)
+		}
+
+		return got
+	}
+
+	if a, b := failures(42), failures(42); !reflect.DeepEqual(a, b) {
+		t.Errorf("expected the same seed to inject the same faults, got %v and %v", a, b)
+	}
+
+	if a, b := failures(1), failures(2); reflect.DeepEqual(a, b) {
+		t.Errorf("expected different seeds to inject different faults, got %v for both", a)
+	}
+}
+
+func TestSchedule_Max(t *testing.T) {
+	s := chaos.NewSchedule(1).Set(chaos.OpAdd, chaos.Fault{Rate: 1, Max: 2})
+	ds := chaos.WrapDataStore(outboxertest.NewDataStore(), s)
+
+	for i := 0; i < 2; i++ {
+		if err := ds.Add(context.Background(), &outboxer.OutboxMessage{}); !errors.Is(err, chaos.ErrInjected) {
+			t.Fatalf("expected add %d to fail with chaos.ErrInjected, got %v", i, err)
+		}
+	}
+
+	if err := ds.Add(context.Background(), &outboxer.OutboxMessage{}); err != nil {
+		t.Fatalf("expected the add after the cap to succeed, got %s", err)
+	}
+
+	if got := s.Injected()[chaos.OpAdd]; got != 2 {
+		t.Errorf("expected 2 faults injected, got %d", got)
+	}
+}
+
+func TestDataStore_Faults(t *testing.T) {
+	ctx := context.Background()
+	errDisconnected := errors.New("connection reset")
+
+	inner := outboxertest.NewDataStore()
+	s := chaos.NewSchedule(1).
+		Set(chaos.OpAdd, chaos.Fault{Rate: 1, After: true, Max: 1}).
+		Set(chaos.OpSetAsDispatched, chaos.Fault{Rate: 1, Max: 1}).
+		Set(chaos.OpGetEvents, chaos.Fault{Rate: 1, Max: 1, Err: errDisconnected})
+	ds := chaos.WrapDataStore(inner, s)
+
+	if err := ds.Add(ctx, &outboxer.OutboxMessage{Payload: []byte("a")}); !errors.Is(err, chaos.ErrInjected) {
+		t.Fatalf("expected the add to fail, got %v", err)
+	}
+
+	if n := len(inner.Messages()); n != 1 {
+		t.Fatalf("expected a fault with After set to add the message, got %d messages", n)
+	}
+
+	if _, err := ds.GetEvents(ctx, 10); !errors.Is(err, errDisconnected) {
+		t.Fatalf("expected the fault error, got %v", err)
+	}
+
+	evts, err := ds.GetEvents(ctx, 10)
+	if err != nil || len(evts) != 1 {
+		t.Fatalf("expected 1 event, got %v and %v", evts, err)
+	}
+
+	if err := ds.SetAsDispatched(ctx, evts[0].ID); !errors.Is(err, chaos.ErrInjected) {
+		t.Fatalf("expected SetAsDispatched to fail, got %v", err)
+	}
+
+	if evts, _ := inner.GetEvents(ctx, 10); len(evts) != 1 {
+		t.Fatalf("expected the message to be left pending, got %d pending", len(evts))
+	}
+}
+
+func TestEventStream_PartialBatch(t *testing.T) {
+	inner := outboxertest.NewEventStream()
+	s := chaos.NewSchedule(7).Set(chaos.OpSend, chaos.Fault{Rate: 0.5})
+	es := chaos.WrapEventStream(inner, s)
+
+	b, ok := es.(outboxer.BatchSender)
+	if !ok {
+		t.Fatal("expected the wrapper of a BatchSender to be a BatchSender")
+	}
+
+	msgs := make([]*outboxer.OutboxMessage, 20)
+	for i := range msgs {
+		msgs[i] = &outboxer.OutboxMessage{Payload: []byte{byte(i)}}
+	}
+
+	var batchErr *outboxer.BatchError
+	if err := b.SendBatch(context.Background(), msgs); !errors.As(err, &batchErr) {
+		t.Fatalf("expected a *outboxer.BatchError, got %v", err)
+	}
+
+	if len(batchErr.Errors)+len(inner.Sent()) != len(msgs) {
+		t.Errorf("expected every message to be either sent or failed, got %d failed and %d sent",
+			len(batchErr.Errors), len(inner.Sent()))
+	}
+
+	for _, m := range inner.Sent() {
+		if batchErr.Errors[int(m.Payload[0])] != nil {
+			t.Errorf("expected message %d to be failed or sent, not both", m.Payload[0])
+		}
+	}
+}
+
+func TestEventStream_SlowBroker(t *testing.T) {
+	s := chaos.NewSchedule(1).Set(chaos.OpSend, chaos.Fault{Latency: time.Hour})
+	es := chaos.WrapEventStream(outboxertest.NewEventStream(), s)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := es.Send(ctx, &outboxer.OutboxMessage{}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the slow send to honour the context, got %v", err)
+	}
+}
+
+func TestHarness(t *testing.T) {
+	scenarios := []struct {
+		name     string
+		schedule func(seed int64) *chaos.Schedule
+		es       func() outboxer.EventStream
+		dupes    bool
+	}{
+		{
+			name: "crash between send and set as dispatched",
+			schedule: func(seed int64) *chaos.Schedule {
+				return chaos.NewSchedule(seed).Set(chaos.OpSetAsDispatched, chaos.Fault{Rate: 0.3})
+			},
+			es:    func() outboxer.EventStream { return onlySend{outboxertest.NewEventStream()} },
+			dupes: true,
+		},
+		{
+			name: "lost acknowledgments",
+			schedule: func(seed int64) *chaos.Schedule {
+				return chaos.NewSchedule(seed).Set(chaos.OpSend, chaos.Fault{Rate: 0.3, After: true})
+			},
+			dupes: true,
+		},
+		{
+			name: "partial batch failures",
+			schedule: func(seed int64) *chaos.Schedule {
+				return chaos.NewSchedule(seed).
+					Set(chaos.OpSend, chaos.Fault{Rate: 0.3}).
+					Set(chaos.OpSendBatch, chaos.Fault{Rate: 0.1})
+			},
+		},
+		{
+			name: "slow broker",
+			schedule: func(seed int64) *chaos.Schedule {
+				return chaos.NewSchedule(seed).Set(chaos.OpSend, chaos.Fault{Latency: time.Millisecond, Jitter: time.Millisecond})
+			},
+			es: func() outboxer.EventStream { return onlySend{outboxertest.NewEventStream()} },
+		},
+		{
+			name: "database disconnects",
+			schedule: func(seed int64) *chaos.Schedule {
+				return chaos.NewSchedule(seed).
+					Set(chaos.OpAdd, chaos.Fault{Rate: 0.2}).
+					Set(chaos.OpGetEvents, chaos.Fault{Rate: 0.3}).
+					Set(chaos.OpSetAsDispatched, chaos.Fault{Rate: 0.2})
+			},
+		},
+	}
+
+	for _, sc := range scenarios {
+		sc := sc
+
+		t.Run(sc.name, func(t *testing.T) {
+			h := chaos.Harness{Schedule: sc.schedule(42), Messages: 50}
+			if sc.es != nil {
+				h.EventStream = sc.es()
+			}
+
+			report := h.Run(t)
+			chaos.AssertAtLeastOnce(t, report)
+
+			if sc.dupes && len(report.Duplicates) == 0 {
+				t.Errorf("expected duplicates, got %s", report)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package chaos
+
+import (
+	"context"
+	"time"
+
+	"github.com/italolelis/outboxer"
+)
+
+// DataStore wraps a data store and injects the faults of its schedule. It only implements outboxer.DataStore,
+// the optional interfaces of the wrapped data store are hidden so every call goes through the schedule.
+type DataStore struct {
+	ds outboxer.DataStore
+	s  *Schedule
+}
+
+// WrapDataStore wraps the data store with the faults of the schedule.
+func WrapDataStore(ds outboxer.DataStore, s *Schedule) *DataStore {
+	return &DataStore{ds: ds, s: s}
+}
+
+// GetEvents gets the events of the wrapped data store. A fault with After set drops the events it read.
+func (d *DataStore) GetEvents(ctx context.Context, batchSize int32) ([]*outboxer.OutboxMessage, error) {
+	var evts []*outboxer.OutboxMessage
+
+	err := d.s.run(ctx, OpGetEvents, func() (err error) {
+		evts, err = d.ds.GetEvents(ctx, batchSize)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return evts, nil
+}
+
+// Add adds the message to the wrapped data store. A fault with After set reports a failure
+// for a message that was added, like a commit whose acknowledgment is lost.
+func (d *DataStore) Add(ctx context.Context, m *outboxer.OutboxMessage) error {
+	return d.s.run(ctx, OpAdd, func() error {
+		return d.ds.Add(ctx, m)
+	})
+}
+
+// AddWithinTx adds the message within a transaction of the wrapped data store.
+func (d *DataStore) AddWithinTx(ctx context.Context, m *outboxer.OutboxMessage, fn func(outboxer.ExecerContext) error) error {
+	return d.s.run(ctx, OpAdd, func() error {
+		return d.ds.AddWithinTx(ctx, m, fn)
+	})
+}
+
+// SetAsDispatched marks the message as dispatched in the wrapped data store. A fault without After set
+// leaves the message pending after it was sent, like a crash between Send and SetAsDispatched.
+func (d *DataStore) SetAsDispatched(ctx context.Context, id int64) error {
+	return d.s.run(ctx, OpSetAsDispatched, func() error {
+		return d.ds.SetAsDispatched(ctx, id)
+	})
+}
+
+// Remove removes the dispatched messages from the wrapped data store.
+func (d *DataStore) Remove(ctx context.Context, since time.Time, batchSize int32) error {
+	return d.s.run(ctx, OpRemove, func() error {
+		return d.ds.Remove(ctx, since, batchSize)
+	})
+}
@@ -0,0 +1,102 @@
+package chaos
+
+import (
+	"context"
+	"errors"
+
+	"github.com/italolelis/outboxer"
+)
+
+// EventStream wraps an event stream and injects the faults of its schedule.
+type EventStream struct {
+	es outboxer.EventStream
+	s  *Schedule
+}
+
+// batchEventStream is the EventStream of a wrapped outboxer.BatchSender.
+type batchEventStream struct {
+	*EventStream
+	b outboxer.BatchSender
+}
+
+// WrapEventStream wraps the event stream with the faults of the schedule. The result implements
+// outboxer.BatchSender when the wrapped event stream does, so the dispatcher takes the same path.
+func WrapEventStream(es outboxer.EventStream, s *Schedule) outboxer.EventStream {
+	w := &EventStream{es: es, s: s}
+
+	if b, ok := es.(outboxer.BatchSender); ok {
+		return &batchEventStream{EventStream: w, b: b}
+	}
+
+	return w
+}
+
+// Send sends the message to the wrapped event stream. A fault with After set reports a failure
+// for a message the broker got, so it is sent again.
+func (e *EventStream) Send(ctx context.Context, m *outboxer.OutboxMessage) error {
+	return e.s.run(ctx, OpSend, func() error {
+		return e.es.Send(ctx, m)
+	})
+}
+
+// SendBatch sends the messages to the wrapped event stream. The OpSendBatch fault fails the batch as a whole,
+// the OpSend fault is drawn for each message and fails the batch partially with a *outboxer.BatchError.
+// The messages failing without After set are left out of the batch the wrapped event stream gets.
+func (b *batchEventStream) SendBatch(ctx context.Context, msgs []*outboxer.OutboxMessage) error {
+	return b.s.run(ctx, OpSendBatch, func() error {
+		var (
+			batch  []*outboxer.OutboxMessage
+			idx    []int
+			failed = make(map[int]error)
+			after  = make(map[int]error)
+		)
+
+		for i, m := range msgs {
+			c := b.s.draw(OpSend)
+
+			if err := sleep(ctx, c.delay); err != nil {
+				return err
+			}
+
+			switch {
+			case c.err != nil && !c.after:
+				failed[i] = c.err
+				continue
+			case c.err != nil:
+				after[i] = c.err
+			}
+
+			batch = append(batch, m)
+			idx = append(idx, i)
+		}
+
+		if len(batch) > 0 {
+			err := b.b.SendBatch(ctx, batch)
+
+			var batchErr *outboxer.BatchError
+
+			switch {
+			case errors.As(err, &batchErr):
+				for j, err := range batchErr.Errors {
+					failed[idx[j]] = err
+				}
+			case err != nil:
+				for _, i := range idx {
+					failed[i] = err
+				}
+			}
+		}
+
+		for i, err := range after {
+			if _, ok := failed[i]; !ok {
+				failed[i] = err
+			}
+		}
+
+		if len(failed) > 0 {
+			return &outboxer.BatchError{Errors: failed}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,309 @@
+package chaos
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/outboxertest"
+)
+
+// Harness runs an outboxer on top of a data store and an event stream wrapped with the faults of a schedule,
+// and checks that every message enqueued is delivered at least once.
+type Harness struct {
+	// Schedule injects the faults, a schedule without faults is used when nil.
+	Schedule *Schedule
+	// DataStore is the data store under test, an outboxertest.DataStore when nil.
+	DataStore outboxer.DataStore
+	// EventStream is the event stream under test, an outboxertest.EventStream when nil.
+	// Batches are sent at once when it is an outboxer.BatchSender. The harness counts the messages
+	// it accepts, so it must not fail on its own.
+	EventStream outboxer.EventStream
+	// Messages is the number of messages enqueued, 100 by default.
+	Messages int
+	// BatchSize is the number of messages the dispatcher reads at once, 10 by default.
+	BatchSize int32
+	// Timeout bounds the run, 10 seconds by default. The messages that were not delivered
+	// by then are reported as missing.
+	Timeout time.Duration
+}
+
+// Report is the outcome of a harness run.
+type Report struct {
+	// Seed is the seed of the schedule, to replay the run.
+	Seed int64
+	// Enqueued is the number of messages enqueued.
+	Enqueued int
+	// Deliveries is the number of messages the event stream accepted, duplicates included.
+	Deliveries int
+	// Missing are the payloads that were never delivered.
+	Missing []string
+	// Duplicates are the payloads that were delivered more than once, with their number of deliveries.
+	// The run stops once every message was delivered, so later duplicates are not seen.
+	Duplicates map[string]int
+	// Injected is how many faults were injected, by operation.
+	Injected map[Op]int
+}
+
+// String describes the report.
+func (r *Report) String() string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "seed %d: %d messages enqueued, %d deliveries, %d missing, %d duplicated",
+		r.Seed, r.Enqueued, r.Deliveries, len(r.Missing), len(r.Duplicates))
+
+	ops := make([]string, 0, len(r.Injected))
+	for op, n := range r.Injected {
+		ops = append(ops, fmt.Sprintf("%s=%d", op, n))
+	}
+
+	sort.Strings(ops)
+
+	if len(ops) > 0 {
+		fmt.Fprintf(&b, ", faults injected: %s", strings.Join(ops, " "))
+	}
+
+	return b.String()
+}
+
+// Run enqueues the messages, retrying the adds that fail, and dispatches them until all of them
+// were delivered or the timeout is reached.
+func (h Harness) Run(t testing.TB) *Report {
+	t.Helper()
+
+	h.defaults()
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.Timeout)
+	defer cancel()
+
+	rec := newRecorder(h.EventStream)
+
+	o, err := outboxer.New(
+		outboxer.WithDataStore(WrapDataStore(h.DataStore, h.Schedule)),
+		outboxer.WithEventStream(WrapEventStream(rec.stream(), h.Schedule)),
+		outboxer.WithCheckInterval(time.Millisecond),
+		outboxer.WithMessageBatchSize(h.BatchSize),
+		outboxer.WithBatchSend(),
+	)
+	if err != nil {
+		t.Fatalf("could not create an outboxer instance: %s", err)
+	}
+
+	payloads := make([]string, h.Messages)
+
+	for i := range payloads {
+		payloads[i] = fmt.Sprintf("message-%d", i)
+
+		if err := enqueue(ctx, o, payloads[i]); err != nil {
+			t.Fatalf("could not enqueue message %s: %s", payloads[i], err)
+		}
+	}
+
+	// The dispatcher sends on unbuffered channels, they are drained until it returns.
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		o.StartDispatcher(ctx)
+	}()
+
+	go func() {
+		for {
+			select {
+			case <-o.ErrChan():
+			case <-o.OkChan():
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	rec.wait(ctx, payloads)
+	cancel()
+	<-done
+
+	return rec.report(h.Schedule, payloads)
+}
+
+func (h *Harness) defaults() {
+	if h.Schedule == nil {
+		h.Schedule = NewSchedule(0)
+	}
+
+	if h.DataStore == nil {
+		h.DataStore = outboxertest.NewDataStore()
+	}
+
+	if h.EventStream == nil {
+		h.EventStream = outboxertest.NewEventStream()
+	}
+
+	if h.Messages <= 0 {
+		h.Messages = 100
+	}
+
+	if h.BatchSize <= 0 {
+		h.BatchSize = 10
+	}
+
+	if h.Timeout <= 0 {
+		h.Timeout = 10 * time.Second
+	}
+}
+
+// enqueue adds the message, retrying while the adds fail because of the injected faults.
+// A fault with After set adds the message anyway, so it may be enqueued twice.
+func enqueue(ctx context.Context, o *outboxer.Outboxer, payload string) error {
+	for {
+		err := o.Send(ctx, &outboxer.OutboxMessage{Payload: []byte(payload)})
+		if err == nil || !errors.Is(err, ErrInjected) {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+}
+
+// AssertAtLeastOnce fails the test when a message was not delivered. The duplicates are logged,
+// they are expected under faults.
+func AssertAtLeastOnce(t testing.TB, r *Report) {
+	t.Helper()
+
+	if len(r.Missing) > 0 {
+		t.Errorf("%s\nmissing: %s", r, strings.Join(r.Missing, ", "))
+		return
+	}
+
+	t.Log(r)
+}
+
+// recorder sits between the chaos wrapper and the event stream under test, and records the messages
+// the event stream accepted. A fault with After set fails a send the recorder saw succeed.
+type recorder struct {
+	es outboxer.EventStream
+
+	mu         sync.Mutex
+	deliveries map[string]int
+	total      int
+	changed    chan struct{}
+}
+
+type batchRecorder struct {
+	*recorder
+	b outboxer.BatchSender
+}
+
+func newRecorder(es outboxer.EventStream) *recorder {
+	return &recorder{es: es, deliveries: make(map[string]int), changed: make(chan struct{})}
+}
+
+// stream returns the recorder as an event stream, which is a outboxer.BatchSender when the recorded one is.
+func (r *recorder) stream() outboxer.EventStream {
+	if b, ok := r.es.(outboxer.BatchSender); ok {
+		return &batchRecorder{recorder: r, b: b}
+	}
+
+	return r
+}
+
+func (r *recorder) Send(ctx context.Context, m *outboxer.OutboxMessage) error {
+	if err := r.es.Send(ctx, m); err != nil {
+		return err
+	}
+
+	r.record(m)
+
+	return nil
+}
+
+func (r *batchRecorder) SendBatch(ctx context.Context, msgs []*outboxer.OutboxMessage) error {
+	err := r.b.SendBatch(ctx, msgs)
+
+	var batchErr *outboxer.BatchError
+	if err != nil && !errors.As(err, &batchErr) {
+		return err
+	}
+
+	for i, m := range msgs {
+		if batchErr != nil && batchErr.Errors[i] != nil {
+			continue
+		}
+
+		r.record(m)
+	}
+
+	return err
+}
+
+func (r *recorder) record(m *outboxer.OutboxMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.deliveries[string(m.Payload)]++
+	r.total++
+
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+// wait waits until every payload was delivered or ctx is done.
+func (r *recorder) wait(ctx context.Context, payloads []string) {
+	for {
+		r.mu.Lock()
+		changed := r.changed
+		delivered := len(r.missing(payloads)) == 0
+		r.mu.Unlock()
+
+		if delivered {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *recorder) missing(payloads []string) []string {
+	var missing []string
+
+	for _, p := range payloads {
+		if r.deliveries[p] == 0 {
+			missing = append(missing, p)
+		}
+	}
+
+	return missing
+}
+
+func (r *recorder) report(s *Schedule, payloads []string) *Report {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := &Report{
+		Seed:       s.Seed(),
+		Enqueued:   len(payloads),
+		Deliveries: r.total,
+		Missing:    r.missing(payloads),
+		Duplicates: make(map[string]int),
+		Injected:   s.Injected(),
+	}
+
+	for p, n := range r.deliveries {
+		if n > 1 {
+			report.Duplicates[p] = n
+		}
+	}
+
+	return report
+}
@@ -0,0 +1,211 @@
+package outboxertest
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/italolelis/outboxer"
+)
+
+// Clock is an outboxer.Clock whose time only moves with Advance, it is safe for concurrent use.
+// Its tickers and timers fire synchronously: Advance returns once every tick that became due
+// was received, so the dispatcher, cleanup or compaction loop woken by it is already running.
+//
+//	clock := outboxertest.NewClock(time.Now())
+//	o, _ := outboxer.New(..., outboxer.WithClock(clock), outboxer.WithCheckInterval(time.Minute))
+//	go o.StartDispatcher(ctx)
+//
+//	clock.WaitForTimers(ctx, 1)
+//	clock.Advance(time.Minute)
+type Clock struct {
+	mu      sync.Mutex
+	now     time.Time
+	timers  []*clockTimer
+	changed chan struct{}
+}
+
+// NewClock creates a clock that starts at the given time.
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start, changed: make(chan struct{})}
+}
+
+// Now returns the time of the clock.
+func (c *Clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+// NewTicker creates a ticker that ticks every d as the clock advances.
+func (c *Clock) NewTicker(d time.Duration) outboxer.Ticker {
+	if d <= 0 {
+		panic("outboxertest: non-positive interval for NewTicker")
+	}
+
+	return clockTicker{c.add(d, d)}
+}
+
+// NewTimer creates a timer that fires once the clock advanced by d.
+func (c *Clock) NewTimer(d time.Duration) outboxer.Timer {
+	return c.add(d, 0)
+}
+
+// Advance moves the clock forward by d, firing the tickers and timers that become due in order.
+// Each tick is delivered at the time it was due, and Advance waits for it to be received
+// unless its ticker or timer is stopped. A ticker due several times within d ticks that many times.
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	end := c.now.Add(d)
+	c.mu.Unlock()
+
+	for {
+		c.mu.Lock()
+
+		t := c.next(end)
+		if t == nil {
+			c.now = end
+			c.mu.Unlock()
+
+			return
+		}
+
+		if t.deadline.After(c.now) {
+			c.now = t.deadline
+		}
+
+		now := c.now
+
+		if t.period > 0 {
+			t.deadline = t.deadline.Add(t.period)
+		} else {
+			c.remove(t)
+		}
+
+		c.mu.Unlock()
+
+		t.fire(now)
+	}
+}
+
+// Timers returns the number of tickers and timers waiting for the clock to advance.
+func (c *Clock) Timers() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return len(c.timers)
+}
+
+// WaitForTimers waits until at least n tickers and timers are waiting for the clock to advance,
+// so a test doesn't advance the clock before the loop it drives created its ticker.
+func (c *Clock) WaitForTimers(ctx context.Context, n int) error {
+	for {
+		c.mu.Lock()
+		changed := c.changed
+		ok := len(c.timers) >= n
+		c.mu.Unlock()
+
+		if ok {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *Clock) add(d, period time.Duration) *clockTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := &clockTimer{
+		clock:    c,
+		deadline: c.now.Add(d),
+		period:   period,
+		c:        make(chan time.Time),
+		stopped:  make(chan struct{}),
+	}
+
+	c.timers = append(c.timers, t)
+	c.notify()
+
+	return t
+}
+
+// next returns the timer that is due first, no later than end. Timers due at the same time fire
+// in the order they were created.
+func (c *Clock) next(end time.Time) *clockTimer {
+	sort.SliceStable(c.timers, func(i, j int) bool {
+		return c.timers[i].deadline.Before(c.timers[j].deadline)
+	})
+
+	if len(c.timers) == 0 || c.timers[0].deadline.After(end) {
+		return nil
+	}
+
+	return c.timers[0]
+}
+
+// remove removes the timer and reports if it was waiting.
+func (c *Clock) remove(t *clockTimer) bool {
+	for i, other := range c.timers {
+		if other == t {
+			c.timers = append(c.timers[:i], c.timers[i+1:]...)
+			c.notify()
+
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Clock) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+type clockTimer struct {
+	clock    *Clock
+	deadline time.Time
+	period   time.Duration
+	c        chan time.Time
+	stopped  chan struct{}
+	once     sync.Once
+}
+
+func (t *clockTimer) C() <-chan time.Time {
+	return t.c
+}
+
+// Stop stops the timer, a pending tick is dropped.
+func (t *clockTimer) Stop() bool {
+	t.clock.mu.Lock()
+	waiting := t.clock.remove(t)
+	t.clock.mu.Unlock()
+
+	t.once.Do(func() { close(t.stopped) })
+
+	return waiting
+}
+
+// clockTicker is a clockTimer with a period, whose Stop has the signature of outboxer.Ticker.
+type clockTicker struct {
+	*clockTimer
+}
+
+func (t clockTicker) Stop() {
+	t.clockTimer.Stop()
+}
+
+func (t *clockTimer) fire(now time.Time) {
+	select {
+	case t.c <- now:
+	case <-t.stopped:
+	}
+}
@@ -0,0 +1,571 @@
+package outboxertest
+
+import (
+	"context"
+	"database/sql"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/italolelis/outboxer"
+)
+
+// DataStore is an in-memory data store that is safe for concurrent use. Besides outboxer.DataStore it
+// implements outboxer.BatchAdder, outboxer.TxOptionsAdder, outboxer.Notifier, outboxer.Replayer,
+// outboxer.Inspector and outboxer.FailureTracker. Messages added within a transaction are only stored when the callback succeeds.
+// The data store keeps copies of the messages, so changing a message after adding it has no effect.
+type DataStore struct {
+	mu         sync.Mutex
+	msgs       []*outboxer.OutboxMessage
+	statements []Statement
+	lastID     int64
+	listeners  map[chan struct{}]struct{}
+	clock      outboxer.Clock
+}
+
+// Option represents the in-memory data store options.
+type Option func(*DataStore)
+
+// WithClock sets the clock of the CreatedAt and DispatchedAt timestamps, the system clock by default.
+func WithClock(c outboxer.Clock) Option {
+	return func(s *DataStore) {
+		s.clock = c
+	}
+}
+
+// NewDataStore creates an empty in-memory data store.
+func NewDataStore(opts ...Option) *DataStore {
+	s := &DataStore{listeners: make(map[chan struct{}]struct{}), clock: outboxer.SystemClock()}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// GetEvents returns up to batchSize pending messages that are not dead, ordered by id.
+func (s *DataStore) GetEvents(ctx context.Context, batchSize int32) ([]*outboxer.OutboxMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var msgs []*outboxer.OutboxMessage
+
+	for _, m := range s.msgs {
+		if len(msgs) == int(batchSize) {
+			break
+		}
+
+		if !m.Dispatched && !m.Dead {
+			msgs = append(msgs, clone(m))
+		}
+	}
+
+	return msgs, nil
+}
+
+// Add adds the message to the data store.
+func (s *DataStore) Add(ctx context.Context, m *outboxer.OutboxMessage) error {
+	return s.AddAll(ctx, m)
+}
+
+// AddWithinTx runs fn and adds the message, unless fn fails.
+func (s *DataStore) AddWithinTx(ctx context.Context, m *outboxer.OutboxMessage, fn func(outboxer.ExecerContext) error) error {
+	if fn == nil {
+		return s.AddAll(ctx, m)
+	}
+
+	return s.AddAllWithinTx(ctx, []*outboxer.OutboxMessage{m}, nil, func(tx outboxer.Tx) error {
+		return fn(tx)
+	})
+}
+
+// AddWithinTxOptions runs fn and adds the message, unless fn fails. The options are ignored.
+func (s *DataStore) AddWithinTxOptions(
+	ctx context.Context,
+	m *outboxer.OutboxMessage,
+	opts *sql.TxOptions,
+	fn func(outboxer.Tx) error,
+) error {
+	return s.AddAllWithinTx(ctx, []*outboxer.OutboxMessage{m}, opts, fn)
+}
+
+// AddAll adds all the messages atomically.
+func (s *DataStore) AddAll(ctx context.Context, msgs ...*outboxer.OutboxMessage) error {
+	return s.AddAllWithinTx(ctx, msgs, nil, nil)
+}
+
+// AddAllWithinTx runs fn, when not nil, and adds all the messages, unless fn fails. The options are ignored.
+func (s *DataStore) AddAllWithinTx(
+	ctx context.Context,
+	msgs []*outboxer.OutboxMessage,
+	_ *sql.TxOptions,
+	fn func(outboxer.Tx) error,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	var tx Tx
+
+	if fn != nil {
+		if err := fn(&tx); err != nil {
+			return err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.clock.Now()
+
+	for _, m := range msgs {
+		s.lastID++
+
+		m.ID = s.lastID
+		if m.CreatedAt.IsZero() {
+			m.CreatedAt = now
+		}
+		m.Dispatched = false
+		m.DispatchedAt = sql.NullTime{}
+		m.Attempts = 0
+		m.LastError = ""
+		m.Dead = false
+
+		s.msgs = append(s.msgs, clone(m))
+	}
+
+	s.statements = append(s.statements, tx.statements...)
+	s.wake()
+
+	return nil
+}
+
+// SetAsDispatched sets the message as dispatched, it returns outboxer.ErrMessageNotFound
+// when there is no message with the given id.
+func (s *DataStore) SetAsDispatched(ctx context.Context, id int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.find(id)
+	if m == nil {
+		return outboxer.ErrMessageNotFound
+	}
+
+	m.Dispatched = true
+	m.DispatchedAt = sql.NullTime{Time: s.clock.Now(), Valid: true}
+
+	return nil
+}
+
+// SetAsFailed records a failed send of the message, it is set as dead once it failed maxAttempts times.
+// It returns outboxer.ErrMessageNotFound when there is no message with the given id.
+func (s *DataStore) SetAsFailed(ctx context.Context, id int64, reason string, maxAttempts int32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.find(id)
+	if m == nil {
+		return outboxer.ErrMessageNotFound
+	}
+
+	m.Attempts++
+	m.LastError = reason
+	m.Dead = maxAttempts > 0 && m.Attempts >= maxAttempts
+
+	return nil
+}
+
+// Requeue sets the dead messages with the given ids back to pending, clearing their attempts.
+func (s *DataStore) Requeue(ctx context.Context, ids ...int64) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+
+	for _, id := range ids {
+		if m := s.find(id); m != nil && m.Dead {
+			m.Dead = false
+			m.Attempts = 0
+			m.LastError = ""
+			n++
+		}
+	}
+
+	if n > 0 {
+		s.wake()
+	}
+
+	return n, nil
+}
+
+// Remove removes up to batchSize messages that were dispatched before the given time.
+func (s *DataStore) Remove(ctx context.Context, dispatchedBefore time.Time, batchSize int32) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var removed int32
+
+	kept := s.msgs[:0]
+
+	for _, m := range s.msgs {
+		if removed < batchSize && m.Dispatched && m.DispatchedAt.Time.Before(dispatchedBefore) {
+			removed++
+			continue
+		}
+
+		kept = append(kept, m)
+	}
+
+	for i := len(kept); i < len(s.msgs); i++ {
+		s.msgs[i] = nil
+	}
+
+	s.msgs = kept
+
+	return nil
+}
+
+// Notify returns a channel that receives a value when messages are added, it is closed when ctx is done.
+func (s *DataStore) Notify(ctx context.Context) (<-chan struct{}, error) {
+	ch := make(chan struct{}, 1)
+
+	s.mu.Lock()
+	if s.listeners == nil {
+		s.listeners = make(map[chan struct{}]struct{})
+	}
+
+	s.listeners[ch] = struct{}{}
+	s.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		s.mu.Lock()
+		delete(s.listeners, ch)
+		s.mu.Unlock()
+
+		close(ch)
+	}()
+
+	return ch, nil
+}
+
+// CountDispatched counts the dispatched messages that match the filter.
+func (s *DataStore) CountDispatched(ctx context.Context, f outboxer.ReplayFilter) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+
+	for _, m := range s.msgs {
+		if matches(m, f) {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+// GetDispatched returns up to batchSize dispatched messages that match the filter
+// and have an id greater than afterID, ordered by id.
+func (s *DataStore) GetDispatched(
+	ctx context.Context,
+	f outboxer.ReplayFilter,
+	afterID int64,
+	batchSize int32,
+) ([]*outboxer.OutboxMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var msgs []*outboxer.OutboxMessage
+
+	for _, m := range s.msgs {
+		if len(msgs) == int(batchSize) {
+			break
+		}
+
+		if m.ID > afterID && matches(m, f) {
+			msgs = append(msgs, clone(m))
+		}
+	}
+
+	return msgs, nil
+}
+
+// Replay sets the dispatched messages that match the filter back to pending, merging override into their options.
+func (s *DataStore) Replay(ctx context.Context, f outboxer.ReplayFilter, override outboxer.DynamicValues) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+
+	for _, m := range s.msgs {
+		if !matches(m, f) {
+			continue
+		}
+
+		if len(override) > 0 {
+			if m.Options == nil {
+				m.Options = make(outboxer.DynamicValues, len(override))
+			}
+
+			for k, v := range override {
+				m.Options[k] = v
+			}
+		}
+
+		m.Dispatched = false
+		m.DispatchedAt = sql.NullTime{}
+		n++
+	}
+
+	if n > 0 {
+		s.wake()
+	}
+
+	return n, nil
+}
+
+// Stats returns the counters of the messages in the data store.
+func (s *DataStore) Stats(ctx context.Context) (*outboxer.Stats, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var stats outboxer.Stats
+
+	for _, m := range s.msgs {
+		if m.Dead {
+			stats.Dead++
+			continue
+		}
+
+		if !m.Dispatched {
+			stats.Pending++
+
+			if m.Attempts > 0 {
+				stats.Failed++
+			}
+
+			if !stats.OldestPendingID.Valid {
+				stats.OldestPendingID = sql.NullInt64{Int64: m.ID, Valid: true}
+			}
+
+			continue
+		}
+
+		stats.Dispatched++
+
+		if m.DispatchedAt.Time.After(stats.LastDispatchedAt.Time) {
+			stats.LastDispatchedAt = m.DispatchedAt
+		}
+	}
+
+	return &stats, nil
+}
+
+// GetEvent returns the message with the given id, or outboxer.ErrMessageNotFound.
+func (s *DataStore) GetEvent(ctx context.Context, id int64) (*outboxer.OutboxMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := s.find(id)
+	if m == nil {
+		return nil, outboxer.ErrMessageNotFound
+	}
+
+	return clone(m), nil
+}
+
+// ListEvents returns the messages that match the filter, ordered by id.
+func (s *DataStore) ListEvents(ctx context.Context, f outboxer.ListFilter) ([]*outboxer.OutboxMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var msgs []*outboxer.OutboxMessage
+
+	for _, m := range s.msgs {
+		if len(msgs) == int(f.Limit) {
+			break
+		}
+
+		if m.ID <= f.AfterID || !inState(m, f.State) {
+			continue
+		}
+
+		msgs = append(msgs, clone(m))
+	}
+
+	return msgs, nil
+}
+
+// Messages returns a copy of every message in the data store, ordered by id.
+func (s *DataStore) Messages() []*outboxer.OutboxMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msgs := make([]*outboxer.OutboxMessage, len(s.msgs))
+	for i, m := range s.msgs {
+		msgs[i] = clone(m)
+	}
+
+	return msgs
+}
+
+// Statements returns the statements executed by the transaction callbacks that succeeded, in commit order.
+func (s *DataStore) Statements() []Statement {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Statement(nil), s.statements...)
+}
+
+// Enqueued runs the unit of work fn and returns a copy of the messages that were committed while it ran,
+// ordered by id. Messages that were removed in the meantime are left out.
+func (s *DataStore) Enqueued(fn func()) []*outboxer.OutboxMessage {
+	s.mu.Lock()
+	mark := s.lastID
+	s.mu.Unlock()
+
+	fn()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// ids are assigned in commit order, so the messages of the unit of work come after the mark.
+	i := sort.Search(len(s.msgs), func(i int) bool { return s.msgs[i].ID > mark })
+
+	msgs := make([]*outboxer.OutboxMessage, 0, len(s.msgs)-i)
+	for _, m := range s.msgs[i:] {
+		msgs = append(msgs, clone(m))
+	}
+
+	return msgs
+}
+
+// find returns the message with the given id, the caller must hold the lock.
+func (s *DataStore) find(id int64) *outboxer.OutboxMessage {
+	i := sort.Search(len(s.msgs), func(i int) bool { return s.msgs[i].ID >= id })
+	if i < len(s.msgs) && s.msgs[i].ID == id {
+		return s.msgs[i]
+	}
+
+	return nil
+}
+
+// wake signals the Notify channels without blocking, the caller must hold the lock.
+func (s *DataStore) wake() {
+	for l := range s.listeners {
+		select {
+		case l <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// inState reports if a message is in the given state.
+func inState(m *outboxer.OutboxMessage, state outboxer.MessageState) bool {
+	switch state {
+	case outboxer.PendingState:
+		return !m.Dispatched && !m.Dead
+	case outboxer.DispatchedState:
+		return m.Dispatched
+	case outboxer.FailedState:
+		return !m.Dispatched && !m.Dead && m.Attempts > 0
+	case outboxer.DeadState:
+		return m.Dead
+	default:
+		return true
+	}
+}
+
+// matches reports if a message is dispatched and matches the replay filter.
+func matches(m *outboxer.OutboxMessage, f outboxer.ReplayFilter) bool {
+	if !m.Dispatched || m.ID < f.FromID || (f.ToID != 0 && m.ID > f.ToID) {
+		return false
+	}
+
+	if !f.DispatchedAfter.IsZero() && m.DispatchedAt.Time.Before(f.DispatchedAfter) {
+		return false
+	}
+
+	if !f.DispatchedBefore.IsZero() && !m.DispatchedAt.Time.Before(f.DispatchedBefore) {
+		return false
+	}
+
+	for k, v := range f.Destination {
+		if o, ok := m.Options[k]; !ok || !reflect.DeepEqual(o, v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// clone copies a message, with its payload, options and headers.
+func clone(m *outboxer.OutboxMessage) *outboxer.OutboxMessage {
+	c := *m
+	c.Payload = append([]byte(nil), m.Payload...)
+	c.Options = cloneValues(m.Options)
+	c.Headers = cloneValues(m.Headers)
+
+	return &c
+}
+
+func cloneValues(v outboxer.DynamicValues) outboxer.DynamicValues {
+	if v == nil {
+		return nil
+	}
+
+	c := make(outboxer.DynamicValues, len(v))
+	for k, val := range v {
+		c[k] = val
+	}
+
+	return c
+}
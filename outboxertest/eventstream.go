@@ -0,0 +1,157 @@
+package outboxertest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/italolelis/outboxer"
+)
+
+// EventStream is an event stream that records the messages it is sent, it is safe for concurrent use.
+// It implements outboxer.BatchSender. Sends can be scripted to fail with FailNext and FailWhen,
+// failed sends are not recorded.
+type EventStream struct {
+	mu       sync.Mutex
+	sent     []*outboxer.OutboxMessage
+	attempts int
+	script   []error
+	failWhen func(*outboxer.OutboxMessage) error
+	// changed is closed and replaced whenever a message is recorded, to wake up WaitForSent.
+	changed chan struct{}
+}
+
+// NewEventStream creates an event stream that accepts every message.
+func NewEventStream() *EventStream {
+	return &EventStream{changed: make(chan struct{})}
+}
+
+// FailNext scripts the results of the next sends, in order. A nil error lets its send succeed,
+// so FailNext(nil, err) fails the second send only. Sends after the script run out are not affected.
+func (s *EventStream) FailNext(errs ...error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.script = append(s.script, errs...)
+}
+
+// FailWhen fails the sends for which fn returns an error, once the scripted results of FailNext run out.
+// A nil fn lets every send succeed again.
+func (s *EventStream) FailWhen(fn func(*outboxer.OutboxMessage) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failWhen = fn
+}
+
+// Send records a copy of the message, unless ctx is done or the send is scripted to fail.
+func (s *EventStream) Send(ctx context.Context, m *outboxer.OutboxMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attempts++
+
+	if len(s.script) > 0 {
+		err := s.script[0]
+		s.script = s.script[1:]
+
+		if err != nil {
+			return err
+		}
+	} else if s.failWhen != nil {
+		if err := s.failWhen(m); err != nil {
+			return err
+		}
+	}
+
+	s.sent = append(s.sent, clone(m))
+
+	if s.changed != nil {
+		close(s.changed)
+	}
+
+	s.changed = make(chan struct{})
+
+	return nil
+}
+
+// SendBatch sends each message as Send does, and returns a *outboxer.BatchError with the ones that failed.
+func (s *EventStream) SendBatch(ctx context.Context, msgs []*outboxer.OutboxMessage) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	failed := make(map[int]error)
+
+	for i, m := range msgs {
+		if err := s.Send(ctx, m); err != nil {
+			failed[i] = err
+		}
+	}
+
+	if len(failed) > 0 {
+		return &outboxer.BatchError{Errors: failed}
+	}
+
+	return nil
+}
+
+// Sent returns a copy of the messages that were sent successfully, in order.
+func (s *EventStream) Sent() []*outboxer.OutboxMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msgs := make([]*outboxer.OutboxMessage, len(s.sent))
+	for i, m := range s.sent {
+		msgs[i] = clone(m)
+	}
+
+	return msgs
+}
+
+// Attempts returns how many times Send was called, including the failed sends.
+func (s *EventStream) Attempts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.attempts
+}
+
+// WaitForSent blocks until at least n messages were sent successfully and returns them,
+// or returns the error of ctx when it is done first.
+func (s *EventStream) WaitForSent(ctx context.Context, n int) ([]*outboxer.OutboxMessage, error) {
+	for {
+		s.mu.Lock()
+		if len(s.sent) >= n {
+			s.mu.Unlock()
+			return s.Sent(), nil
+		}
+
+		if s.changed == nil {
+			s.changed = make(chan struct{})
+		}
+
+		changed := s.changed
+		s.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Reset forgets the sent messages, the attempts and the scripted failures.
+func (s *EventStream) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sent = nil
+	s.attempts = 0
+	s.script = nil
+	s.failWhen = nil
+}
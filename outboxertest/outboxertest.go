@@ -0,0 +1,150 @@
+// Package outboxertest provides an in-memory data store and a recording event stream for tests,
+// so applications that use outboxer don't need to write their own fakes.
+//
+//	ds := outboxertest.NewDataStore()
+//	es := outboxertest.NewEventStream()
+//	o, _ := outboxer.New(outboxer.WithDataStore(ds), outboxer.WithEventStream(es))
+//
+//	outboxertest.AssertEnqueued(t, ds, func() {
+//		if err := placeOrder(ctx, o); err != nil {
+//			t.Fatal(err)
+//		}
+//	}, &outboxer.OutboxMessage{Payload: []byte("order placed")})
+package outboxertest
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/italolelis/outboxer"
+)
+
+// ErrQueryNotSupported is returned when a transaction callback queries or prepares a statement,
+// which the in-memory transactions can't answer.
+var ErrQueryNotSupported = errors.New("queries are not supported by the in-memory transaction")
+
+// unsupportedDB answers every query of a Tx with ErrQueryNotSupported.
+var unsupportedDB = sql.OpenDB(unsupportedConnector{})
+
+// Statement is a statement executed within a transaction.
+type Statement struct {
+	Query string
+	Args  []interface{}
+}
+
+// Tx is the transaction handed to the callbacks of DataStore. It records the executed statements,
+// which the data store keeps only when the callback succeeds, see DataStore.Statements.
+// Each statement reports one affected row. Queries fail with ErrQueryNotSupported.
+type Tx struct {
+	statements []Statement
+}
+
+// ExecContext records the statement.
+func (tx *Tx) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	tx.statements = append(tx.statements, Statement{Query: query, Args: args})
+
+	return driver.RowsAffected(1), nil
+}
+
+// QueryContext returns ErrQueryNotSupported.
+func (tx *Tx) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	return unsupportedDB.QueryContext(ctx, query, args...)
+}
+
+// QueryRowContext returns a row whose Scan fails with ErrQueryNotSupported.
+func (tx *Tx) QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row {
+	return unsupportedDB.QueryRowContext(ctx, query, args...)
+}
+
+// PrepareContext returns ErrQueryNotSupported.
+func (tx *Tx) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
+	return unsupportedDB.PrepareContext(ctx, query)
+}
+
+type unsupportedConnector struct{}
+
+func (unsupportedConnector) Connect(context.Context) (driver.Conn, error) {
+	return nil, ErrQueryNotSupported
+}
+
+func (unsupportedConnector) Driver() driver.Driver { return unsupportedDriver{} }
+
+type unsupportedDriver struct{}
+
+func (unsupportedDriver) Open(string) (driver.Conn, error) { return nil, ErrQueryNotSupported }
+
+// AssertEnqueued runs the unit of work fn and fails the test unless the wanted messages, and only them,
+// were committed to the data store while it ran, in that order. Messages are compared by payload,
+// options and headers. Messages added concurrently by other goroutines are seen as part of the unit of work.
+func AssertEnqueued(t testing.TB, ds *DataStore, fn func(), want ...*outboxer.OutboxMessage) {
+	t.Helper()
+
+	got := ds.Enqueued(fn)
+
+	if len(got) != len(want) {
+		t.Errorf("expected %d enqueued messages, got %d: %s", len(want), len(got), describe(got))
+		return
+	}
+
+	for i := range want {
+		if !sameMessage(got[i], want[i]) {
+			t.Errorf("enqueued message %d is %s, expected %s", i, describe(got[i:i+1]), describe(want[i:i+1]))
+		}
+	}
+}
+
+// AssertNothingEnqueued runs the unit of work fn and fails the test if it committed any message
+// to the data store, such as a unit of work that is expected to roll back.
+func AssertNothingEnqueued(t testing.TB, ds *DataStore, fn func()) {
+	t.Helper()
+
+	AssertEnqueued(t, ds, fn)
+}
+
+// sameMessage compares the payload, options and headers of two messages. Empty and nil values are the same.
+func sameMessage(a, b *outboxer.OutboxMessage) bool {
+	return bytes.Equal(a.Payload, b.Payload) && sameValues(a.Options, b.Options) && sameValues(a.Headers, b.Headers)
+}
+
+func sameValues(a, b outboxer.DynamicValues) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for k, v := range a {
+		w, ok := b[k]
+		if !ok || !reflect.DeepEqual(v, w) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func describe(msgs []*outboxer.OutboxMessage) string {
+	var buf bytes.Buffer
+
+	buf.WriteString("[")
+
+	for i, m := range msgs {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+
+		fmt.Fprintf(&buf, "{payload: %q, options: %v, headers: %v}", m.Payload, m.Options, m.Headers)
+	}
+
+	buf.WriteString("]")
+
+	return buf.String()
+}
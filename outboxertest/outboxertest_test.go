@@ -0,0 +1,305 @@
+package outboxertest_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/outboxertest"
+	"github.com/italolelis/outboxer/storage/storetest"
+)
+
+func TestDataStore(t *testing.T) {
+	storetest.RunDataStoreTests(t, func(t *testing.T) outboxer.DataStore {
+		return outboxertest.NewDataStore()
+	})
+}
+
+func TestDataStore_Tx(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("commit", func(t *testing.T) {
+		ds := outboxertest.NewDataStore()
+
+		outboxertest.AssertEnqueued(t, ds, func() {
+			if err := ds.AddWithinTx(ctx, &outboxer.OutboxMessage{Payload: []byte("a")}, func(tx outboxer.ExecerContext) error {
+				_, err := tx.ExecContext(ctx, "UPDATE orders SET state = ? WHERE id = ?", "placed", 1)
+				return err
+			}); err != nil {
+				t.Fatalf("failed to add message: %s", err)
+			}
+		}, &outboxer.OutboxMessage{Payload: []byte("a")})
+
+		stmts := ds.Statements()
+		if len(stmts) != 1 || stmts[0].Query != "UPDATE orders SET state = ? WHERE id = ?" || len(stmts[0].Args) != 2 {
+			t.Fatalf("unexpected statements %+v", stmts)
+		}
+	})
+
+	t.Run("rollback", func(t *testing.T) {
+		ds := outboxertest.NewDataStore()
+		errFailed := errors.New("failed")
+
+		outboxertest.AssertNothingEnqueued(t, ds, func() {
+			err := ds.AddAllWithinTx(ctx, []*outboxer.OutboxMessage{
+				{Payload: []byte("a")},
+				{Payload: []byte("b")},
+			}, nil, func(tx outboxer.Tx) error {
+				if _, err := tx.ExecContext(ctx, "UPDATE orders SET state = 'placed'"); err != nil {
+					return err
+				}
+
+				return errFailed
+			})
+			if !errors.Is(err, errFailed) {
+				t.Fatalf("expected the callback error, got %v", err)
+			}
+		})
+
+		if stmts := ds.Statements(); len(stmts) != 0 {
+			t.Fatalf("expected the statements to be rolled back, got %+v", stmts)
+		}
+	})
+
+	t.Run("queries", func(t *testing.T) {
+		ds := outboxertest.NewDataStore()
+
+		err := ds.AddWithinTxOptions(ctx, &outboxer.OutboxMessage{Payload: []byte("a")}, nil, func(tx outboxer.Tx) error {
+			var n int
+			return tx.QueryRowContext(ctx, "SELECT 1").Scan(&n)
+		})
+		if !errors.Is(err, outboxertest.ErrQueryNotSupported) {
+			t.Fatalf("expected ErrQueryNotSupported, got %v", err)
+		}
+	})
+}
+
+func TestDataStore_Replay(t *testing.T) {
+	ctx := context.Background()
+	ds := outboxertest.NewDataStore()
+
+	for _, topic := range []string{"a", "b"} {
+		if err := ds.Add(ctx, &outboxer.OutboxMessage{Options: outboxer.DynamicValues{"topic": topic}}); err != nil {
+			t.Fatalf("failed to add message: %s", err)
+		}
+	}
+
+	for _, id := range []int64{1, 2} {
+		if err := ds.SetAsDispatched(ctx, id); err != nil {
+			t.Fatalf("failed to dispatch message: %s", err)
+		}
+	}
+
+	n, err := ds.Replay(ctx, outboxer.ReplayFilter{Destination: outboxer.DynamicValues{"topic": "b"}}, outboxer.DynamicValues{"topic": "c"})
+	if err != nil {
+		t.Fatalf("failed to replay messages: %s", err)
+	}
+
+	if n != 1 {
+		t.Fatalf("expected 1 replayed message, got %d", n)
+	}
+
+	msgs, err := ds.GetEvents(ctx, 10)
+	if err != nil {
+		t.Fatalf("failed to get events: %s", err)
+	}
+
+	if len(msgs) != 1 || msgs[0].ID != 2 || msgs[0].Options["topic"] != "c" {
+		t.Fatalf("unexpected pending messages %+v", msgs)
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	ctx := context.Background()
+	errFailed := errors.New("failed")
+
+	es := outboxertest.NewEventStream()
+	es.FailNext(nil, errFailed)
+	es.FailWhen(func(m *outboxer.OutboxMessage) error {
+		if string(m.Payload) == "poison" {
+			return errFailed
+		}
+
+		return nil
+	})
+
+	for i, c := range []struct {
+		payload string
+		err     error
+	}{
+		{"a", nil},
+		{"b", errFailed},
+		{"poison", errFailed},
+		{"c", nil},
+	} {
+		if err := es.Send(ctx, &outboxer.OutboxMessage{Payload: []byte(c.payload)}); !errors.Is(err, c.err) {
+			t.Fatalf("send %d: expected %v, got %v", i, c.err, err)
+		}
+	}
+
+	sent := es.Sent()
+	if len(sent) != 2 || string(sent[0].Payload) != "a" || string(sent[1].Payload) != "c" {
+		t.Fatalf("unexpected sent messages %+v", sent)
+	}
+
+	if n := es.Attempts(); n != 4 {
+		t.Fatalf("expected 4 attempts, got %d", n)
+	}
+
+	es.Reset()
+
+	if len(es.Sent()) != 0 || es.Attempts() != 0 {
+		t.Fatal("expected the event stream to be reset")
+	}
+}
+
+func TestClock(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := outboxertest.NewClock(start)
+
+	ticker := clock.NewTicker(time.Minute)
+	timer := clock.NewTimer(90 * time.Second)
+	stopped := clock.NewTimer(time.Second)
+
+	if !stopped.Stop() || stopped.Stop() {
+		t.Fatal("expected Stop to report if the timer was waiting")
+	}
+
+	ticks := make(chan time.Time, 10)
+
+	go func() {
+		for {
+			select {
+			case now := <-ticker.C():
+				ticks <- now
+			case now := <-timer.C():
+				ticks <- now
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	if err := clock.WaitForTimers(ctx, 2); err != nil {
+		t.Fatalf("expected 2 timers, got %d", clock.Timers())
+	}
+
+	clock.Advance(2*time.Minute + time.Second)
+
+	// Advance returns once each tick was received, in the order they were due.
+	for _, want := range []time.Duration{time.Minute, 90 * time.Second, 2 * time.Minute} {
+		if got := <-ticks; !got.Equal(start.Add(want)) {
+			t.Errorf("expected a tick at %s, got %s", start.Add(want), got)
+		}
+	}
+
+	if got := clock.Now(); !got.Equal(start.Add(2*time.Minute + time.Second)) {
+		t.Errorf("expected the clock to be advanced, got %s", got)
+	}
+
+	if n := clock.Timers(); n != 1 {
+		t.Errorf("expected only the ticker to be left, got %d timers", n)
+	}
+
+	ticker.Stop()
+	clock.Advance(time.Hour)
+
+	select {
+	case got := <-ticks:
+		t.Errorf("expected no tick after Stop, got %s", got)
+	default:
+	}
+}
+
+// recorder is a testing.TB that records the failures, to check the assertions.
+type recorder struct {
+	testing.TB
+	failures []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+func TestAssertEnqueued(t *testing.T) {
+	ctx := context.Background()
+	ds := outboxertest.NewDataStore()
+
+	if err := ds.Add(ctx, &outboxer.OutboxMessage{Payload: []byte("before")}); err != nil {
+		t.Fatalf("failed to add message: %s", err)
+	}
+
+	r := &recorder{TB: t}
+	outboxertest.AssertEnqueued(r, ds, func() {
+		if err := ds.Add(ctx, &outboxer.OutboxMessage{Payload: []byte("a"), Headers: outboxer.DynamicValues{"k": "v"}}); err != nil {
+			t.Fatalf("failed to add message: %s", err)
+		}
+	}, &outboxer.OutboxMessage{Payload: []byte("a")})
+
+	if len(r.failures) != 1 {
+		t.Fatalf("expected the headers to differ, got %q", r.failures)
+	}
+
+	r = &recorder{TB: t}
+	outboxertest.AssertNothingEnqueued(r, ds, func() {
+		if err := ds.Add(ctx, &outboxer.OutboxMessage{Payload: []byte("b")}); err != nil {
+			t.Fatalf("failed to add message: %s", err)
+		}
+	})
+
+	if len(r.failures) != 1 {
+		t.Fatalf("expected a message to be enqueued, got %q", r.failures)
+	}
+}
+
+func TestOutboxer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	ds := outboxertest.NewDataStore()
+	es := outboxertest.NewEventStream()
+	es.FailNext(errors.New("broker unavailable"))
+
+	o, err := outboxer.New(
+		outboxer.WithDataStore(ds),
+		outboxer.WithEventStream(es),
+		outboxer.WithCheckInterval(10*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("could not create an outboxer instance: %s", err)
+	}
+
+	go o.StartDispatcher(ctx)
+
+	go func() {
+		for {
+			select {
+			case <-o.ErrChan():
+			case <-o.OkChan():
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	if err := o.Send(ctx, &outboxer.OutboxMessage{Payload: []byte("a")}); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+
+	sent, err := es.WaitForSent(ctx, 1)
+	if err != nil {
+		t.Fatalf("the message was not sent: %s", err)
+	}
+
+	if string(sent[0].Payload) != "a" || es.Attempts() < 2 {
+		t.Fatalf("expected the message to be sent after a failure, got %+v after %d attempts", sent, es.Attempts())
+	}
+}
@@ -0,0 +1,80 @@
+package outboxer
+
+import (
+	"context"
+	"time"
+)
+
+const (
+	defaultRetryInitialBackoff = 50 * time.Millisecond
+	defaultRetryMaxBackoff     = time.Second
+)
+
+// RetryClassifier is implemented by data stores that recognise the errors of their dialect
+// that are safe to retry, such as serialization failures and deadlocks.
+type RetryClassifier interface {
+	IsRetryable(err error) bool
+}
+
+// RetryPolicy re-runs a transaction sent with SendWithinTx, SendWithinTxOptions or SendAllWithinTx when it fails
+// with a retryable error. The whole callback runs again together with the outbox insert, so it must be safe to repeat.
+// Each attempt is a call to the data store, so when the data store retries its transactions itself, such as the
+// cockroach one, the budgets multiply: keep the retries in one of them and turn the other off. The policy has
+// nothing to do with WithMaxAttempts, which counts the failed sends of a message to the event stream.
+type RetryPolicy struct {
+	// Retryable decides if an error is retryable. When nil, the data store is used if it is a RetryClassifier,
+	// otherwise nothing is retried.
+	Retryable func(error) bool
+	// MaxAttempts is the total number of attempts, including the first one.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, it doubles on each retry. Defaults to 50ms.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between retries. Defaults to 1s.
+	MaxBackoff time.Duration
+}
+
+func (o *Outboxer) withRetry(ctx context.Context, fn func() error) error {
+	p := o.retryPolicy
+	if p == nil {
+		return fn()
+	}
+
+	retryable := p.Retryable
+	if retryable == nil {
+		c, ok := o.ds.(RetryClassifier)
+		if !ok {
+			return fn()
+		}
+
+		retryable = c.IsRetryable
+	}
+
+	backoff := p.InitialBackoff
+	if backoff <= 0 {
+		backoff = defaultRetryInitialBackoff
+	}
+
+	maxBackoff := p.MaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultRetryMaxBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= p.MaxAttempts || !retryable(err) {
+			return err
+		}
+
+		t := o.clock.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C():
+		}
+
+		if backoff *= 2; backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
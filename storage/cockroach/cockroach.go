@@ -0,0 +1,126 @@
+// Package cockroach is the implementation of the cockroachdb data store.
+//
+// CockroachDB speaks the postgres protocol, but it has no advisory locks and SERIAL ids
+// concentrate writes on a single range. This data store uses unique_rowid() ids, locks with
+// a lease table and retries its transactions on serialization failures.
+package cockroach
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/italolelis/outboxer/storage/postgres"
+	"github.com/italolelis/outboxer/storage/sqlstore"
+)
+
+const (
+	// DefaultEventStoreTable is the default table name.
+	DefaultEventStoreTable = sqlstore.DefaultEventStoreTable
+
+	// DefaultArchiveTable is the default archive table name.
+	DefaultArchiveTable = sqlstore.DefaultArchiveTable
+
+	// DefaultLeaseDuration is how long the migrations lock is leased for by default.
+	DefaultLeaseDuration = 30 * time.Second
+
+	// DefaultMaxRetries is how many times a transaction is retried by default.
+	DefaultMaxRetries = 10
+)
+
+var (
+	// ErrLocked is used when we can't acquire an explicit lock.
+	ErrLocked = sqlstore.ErrLocked
+
+	// ErrNoDatabaseName is used when the database name is blank.
+	ErrNoDatabaseName = errors.New("no database name")
+
+	// ErrNoSchema is used when the schema name is blank.
+	ErrNoSchema = errors.New("no schema")
+
+	// ErrInvalidSchema is used when DDL is disabled and the outbox table doesn't have the expected columns.
+	ErrInvalidSchema = sqlstore.ErrInvalidSchema
+)
+
+// Cockroach is the implementation of the data store.
+// Its transactions run again, up to MaxRetries times, on serialization failures.
+type Cockroach struct {
+	*sqlstore.Store
+	// LeaseDuration is how long the migrations lock is leased for, it is renewed while the lock is held.
+	LeaseDuration time.Duration
+
+	db *sql.DB
+}
+
+// newCockroach creates the data store with the defaults, the dialect needs its lease duration
+// and its connection pool to renew the lease.
+func newCockroach(db *sql.DB, owner string) *Cockroach {
+	d := dialect{Dialect: postgres.Dialect(), owner: owner}
+	p := Cockroach{Store: sqlstore.New(db, &d), LeaseDuration: DefaultLeaseDuration, db: db}
+	p.MaxRetries = DefaultMaxRetries
+	d.p = &p
+
+	return &p
+}
+
+// WithInstance creates a cockroach data store with an existing db connection pool.
+func WithInstance(ctx context.Context, db *sql.DB, opts ...Option) (*Cockroach, error) {
+	owner := make([]byte, 8)
+	if _, err := rand.Read(owner); err != nil {
+		return nil, fmt.Errorf("failed to generate the lease owner: %w", err)
+	}
+
+	p := newCockroach(db, hex.EncodeToString(owner))
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	if err := db.QueryRowContext(ctx, `SELECT CURRENT_DATABASE()`).Scan(&p.DatabaseName); err != nil {
+		return nil, err
+	}
+
+	if p.DatabaseName == "" {
+		return nil, ErrNoDatabaseName
+	}
+
+	if p.SchemaName == "" {
+		if err := db.QueryRowContext(ctx, `SELECT CURRENT_SCHEMA()`).Scan(&p.SchemaName); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.SchemaName == "" {
+		return nil, ErrNoSchema
+	}
+
+	if err := p.Setup(ctx); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// DDL returns the statements that create the outbox table, for schemas that are managed outside
+// the application. It takes the same options as WithInstance.
+func DDL(opts ...Option) string {
+	p := newCockroach(nil, "")
+	p.EventStoreTable = DefaultEventStoreTable
+
+	for _, opt := range opts {
+		opt(p)
+	}
+
+	return p.Store.DDL()
+}
+
+// IsRetryable reports if the error is a serialization failure (40001), which CockroachDB
+// returns whenever a transaction must be retried.
+// It works with any driver whose errors have a SQLState method, such as lib/pq and pgx.
+func (p *Cockroach) IsRetryable(err error) bool {
+	return (&dialect{}).IsRetryable(err)
+}
@@ -0,0 +1,26 @@
+package cockroach_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+
+	"github.com/italolelis/outboxer/storage/cockroach"
+)
+
+func ExampleCockroach() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := sql.Open("postgres", os.Getenv("DS_DSN"))
+	if err != nil {
+		fmt.Printf("failed to connect to cockroachdb: %s", err)
+		return
+	}
+
+	if _, err := cockroach.WithInstance(ctx, db); err != nil {
+		fmt.Printf("failed to setup the data store: %s", err)
+		return
+	}
+}
@@ -0,0 +1,435 @@
+package cockroach
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/lock"
+	"github.com/italolelis/outboxer/outboxertest"
+	"github.com/lib/pq"
+)
+
+var eventStoreRows = []string{"id", "dispatched", "dispatched_at", "payload", "options", "headers", "created_at"}
+
+// nolint
+func TestCockroach_AddSuccessfully(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, db)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO event_store (.+) VALUES (.+) RETURNING id, created_at`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(int64(907824519346290689), time.Now()))
+	mock.ExpectCommit()
+
+	mock.ExpectQuery(`SELECT (.+) FROM event_store WHERE dispatched = false AND dead = false ORDER BY id LIMIT 10`).
+		WillReturnRows(sqlmock.NewRows(eventStoreRows).
+			AddRow(int64(907824519346290689), false, nil, []byte("test payload"), nil, nil, time.Now()))
+
+	mock.ExpectExec(`UPDATE event_store SET (.+)WHERE id = \$2`).
+		WithArgs(sqlmock.AnyArg(), int64(907824519346290689)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`DELETE FROM event_store WHERE id IN \(SELECT id FROM \(SELECT id FROM event_store WHERE (.+) ORDER BY id LIMIT 10\) AS batch\)`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	evt := outboxer.OutboxMessage{Payload: []byte("test payload")}
+	if err := ds.Add(ctx, &evt); err != nil {
+		t.Fatalf("failed to add message in the data store: %s", err)
+	}
+
+	if evt.ID != 907824519346290689 {
+		t.Fatalf("was expecting the id returned by unique_rowid() but got %d", evt.ID)
+	}
+
+	msgs, err := ds.GetEvents(ctx, 10)
+	if err != nil {
+		t.Fatalf("failed to retrieve messages from the data store: %s", err)
+	}
+
+	if len(msgs) != 1 {
+		t.Fatalf("was expecting 1 message in the data store but got %d", len(msgs))
+	}
+
+	for _, m := range msgs {
+		if err := ds.SetAsDispatched(ctx, m.ID); err != nil {
+			t.Fatalf("failed to set message as dispatched: %s", err)
+		}
+	}
+
+	if err := ds.Remove(ctx, time.Now(), 10); err != nil {
+		t.Fatalf("failed to remove messages: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCockroach_WithInstanceWithEmptyDBName(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT CURRENT_DATABASE()`).
+		WillReturnRows(sqlmock.NewRows([]string{"CURRENT_DATABASE()"}).AddRow(""))
+
+	if _, err := WithInstance(ctx, db); !errors.Is(err, ErrNoDatabaseName) {
+		t.Fatalf("was expecting %s but got %v", ErrNoDatabaseName, err)
+	}
+}
+
+func TestCockroach_DDL(t *testing.T) {
+	ddl := DDL(WithEventStoreTable("outbox"), WithQuotedIdentifiers(), WithArchiveTable("outbox_archive"))
+
+	if !strings.HasPrefix(ddl, `CREATE TABLE IF NOT EXISTS "outbox" (`) ||
+		!strings.Contains(ddl, `CREATE TABLE IF NOT EXISTS "outbox_archive" (`) {
+		t.Fatalf("unexpected DDL:\n%s", ddl)
+	}
+}
+
+func TestCockroach_AddWithinTxRetries(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, db)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		mock.ExpectBegin()
+		mock.ExpectExec(`UPDATE orders SET (.+)`).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectQuery(`INSERT INTO event_store (.+) VALUES (.+) RETURNING id, created_at`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(int64(i+1), time.Now()))
+
+		if i == 0 {
+			mock.ExpectCommit().WillReturnError(&pq.Error{Code: sqlStateSerializationFailure})
+		} else {
+			mock.ExpectCommit()
+		}
+	}
+
+	var calls int
+
+	evt := outboxer.OutboxMessage{Payload: []byte("test payload")}
+	if err := ds.AddWithinTx(ctx, &evt, func(tx outboxer.ExecerContext) error {
+		calls++
+		_, err := tx.ExecContext(ctx, "UPDATE orders SET status = 'paid'")
+
+		return err
+	}); err != nil {
+		t.Fatalf("failed to add message within the transaction: %s", err)
+	}
+
+	if calls != 2 || evt.ID != 2 {
+		t.Fatalf("was expecting the transaction to run twice but it ran %d times", calls)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCockroach_AddWithinTxRollback(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, db, WithMaxRetries(1))
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	var calls int
+
+	err = ds.AddWithinTx(ctx, &outboxer.OutboxMessage{Payload: []byte("test payload")}, func(tx outboxer.ExecerContext) error {
+		calls++
+
+		return &pq.Error{Code: sqlStateSerializationFailure}
+	})
+	if !ds.IsRetryable(err) {
+		t.Fatalf("was expecting the serialization failure but got %v", err)
+	}
+
+	if calls != 2 {
+		t.Fatalf("was expecting the transaction to run twice but it ran %d times", calls)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCockroach_AddWithinTxRollbackFailure(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, db, WithMaxRetries(0))
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	rbErr := errors.New("connection reset")
+
+	mock.ExpectBegin()
+	mock.ExpectRollback().WillReturnError(rbErr)
+
+	errFn := errors.New("callback failed")
+
+	err = ds.AddWithinTx(ctx, &outboxer.OutboxMessage{Payload: []byte("test payload")}, func(tx outboxer.ExecerContext) error {
+		return errFn
+	})
+	if !errors.Is(err, errFn) || !errors.Is(err, rbErr) {
+		t.Fatalf("was expecting both the callback and the rollback errors but got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCockroach_LockWaitsForLease(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT CURRENT_DATABASE()`).
+		WillReturnRows(sqlmock.NewRows([]string{"CURRENT_DATABASE()"}).AddRow("test"))
+	mock.ExpectQuery(`SELECT CURRENT_SCHEMA()`).
+		WillReturnRows(sqlmock.NewRows([]string{"CURRENT_SCHEMA()"}).AddRow("test_schema"))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS event_store_leases (.+);`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`INSERT INTO event_store_leases AS l (.+) ON CONFLICT (.+) RETURNING owner`).
+		WithArgs(sqlmock.AnyArg(), sqlmock.AnyArg(), "5000 milliseconds").
+		WillReturnRows(sqlmock.NewRows([]string{"owner"}))
+	initLeaseMock(t, mock)
+
+	// the lease is polled through the clock, so it is only tried again once the clock advances
+	clock := outboxertest.NewClock(time.Now())
+	errs := make(chan error, 1)
+
+	go func() {
+		_, err := WithInstance(ctx, db, WithLeaseDuration(5*time.Second), WithClock(clock))
+		errs <- err
+	}()
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+
+	if err := clock.WaitForTimers(waitCtx, 1); err != nil {
+		t.Fatalf("expected the lock to wait on the clock: %s", err)
+	}
+
+	clock.Advance(lockPollInterval)
+
+	if err := <-errs; err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCockroach_LockRenewsLease(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	name, err := lock.Generate("test", "test_schema")
+	if err != nil {
+		t.Fatalf("failed to generate the lock value: %s", err)
+	}
+
+	clock := outboxertest.NewClock(time.Now())
+
+	p := newCockroach(db, "owner")
+	p.DatabaseName = "test"
+	p.SchemaName = "test_schema"
+	p.EventStoreTable = DefaultEventStoreTable
+	p.LeaseDuration = 3 * time.Second
+	p.Clock = clock
+
+	d := &dialect{p: p, owner: "owner"}
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatalf("failed to get a connection: %s", err)
+	}
+
+	defer conn.Close()
+
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS event_store_leases (.+);`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`INSERT INTO event_store_leases AS l (.+) ON CONFLICT (.+) RETURNING owner`).
+		WithArgs(name, "owner", "3000 milliseconds").
+		WillReturnRows(sqlmock.NewRows([]string{"owner"}).AddRow("owner"))
+	mock.ExpectExec(`UPDATE event_store_leases SET expires_at = (.+) WHERE name = \$1 AND owner = \$2`).
+		WithArgs(name, "owner", "3000 milliseconds").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// another instance took the lease over, it is no longer renewed
+	mock.ExpectExec(`UPDATE event_store_leases SET expires_at = (.+) WHERE name = \$1 AND owner = \$2`).
+		WithArgs(name, "owner", "3000 milliseconds").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`DELETE FROM event_store_leases WHERE name = \$1 AND owner = \$2`).
+		WithArgs(name, "owner").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	if err := d.Lock(ctx, conn, p.Store); err != nil {
+		t.Fatalf("failed to take the lock: %s", err)
+	}
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+
+	if err := clock.WaitForTimers(waitCtx, 1); err != nil {
+		t.Fatalf("expected the lease to be renewed on the clock: %s", err)
+	}
+
+	// each tick is received before Advance returns, the second one comes after the first renewal ran
+	clock.Advance(time.Second)
+	clock.Advance(time.Second)
+
+	if err := d.Unlock(ctx, conn, p.Store); !errors.Is(err, ErrLeaseLost) {
+		t.Fatalf("was expecting the lost lease to be reported but got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestCockroach_IsRetryable(t *testing.T) {
+	ds := Cockroach{}
+
+	for code, want := range map[pq.ErrorCode]bool{
+		sqlStateSerializationFailure: true,
+		"23505":                      false,
+	} {
+		if got := ds.IsRetryable(&pq.Error{Code: code}); got != want {
+			t.Errorf("was expecting %s to be retryable %t but got %t", code, want, got)
+		}
+	}
+
+	if ds.IsRetryable(errors.New("connection refused")) {
+		t.Error("was not expecting a generic error to be retryable")
+	}
+}
+
+func initDatastoreMock(t *testing.T, mock sqlmock.Sqlmock) {
+	mock.ExpectQuery(`SELECT CURRENT_DATABASE()`).
+		WillReturnRows(sqlmock.NewRows([]string{"CURRENT_DATABASE()"}).AddRow("test"))
+	mock.ExpectQuery(`SELECT CURRENT_SCHEMA()`).
+		WillReturnRows(sqlmock.NewRows([]string{"CURRENT_SCHEMA()"}).AddRow("test_schema"))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS event_store_leases (.+);`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	initLeaseMock(t, mock)
+}
+
+func initLeaseMock(t *testing.T, mock sqlmock.Sqlmock) {
+	name, err := lock.Generate("test", "test_schema")
+	if err != nil {
+		t.Fatalf("failed to generate the lock value: %s", err)
+	}
+
+	mock.ExpectQuery(`INSERT INTO event_store_leases AS l (.+) ON CONFLICT (.+) RETURNING owner`).
+		WithArgs(name, sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"owner"}).AddRow("owner"))
+	initMigrationsMock(mock)
+	mock.ExpectExec(`DELETE FROM event_store_leases WHERE name = \$1 AND owner = \$2`).
+		WithArgs(name, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func initMigrationsMock(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS event_store_migrations (.+);`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT version FROM event_store_migrations`).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}))
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS event_store \((.+)unique_rowid\(\)(.+)\);`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO event_store_migrations (.+) VALUES (.+)`).
+		WithArgs(1, "create outbox table").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`ALTER TABLE event_store\s+ADD COLUMN IF NOT EXISTS attempts`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO event_store_migrations (.+) VALUES (.+)`).
+		WithArgs(2, "track failed sends").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
@@ -0,0 +1,278 @@
+package cockroach
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/italolelis/outboxer/lock"
+	"github.com/italolelis/outboxer/migrate"
+	"github.com/italolelis/outboxer/storage/sqlstore"
+)
+
+const (
+	// sqlStateSerializationFailure is the error code of transactions that must be retried.
+	sqlStateSerializationFailure = "40001"
+
+	// lockTimeout is how long to wait for the lease before giving up.
+	lockTimeout = 10 * time.Second
+
+	// lockPollInterval is how often the lease is tried while another instance holds it.
+	lockPollInterval = 100 * time.Millisecond
+
+	// leasesTableSuffix is appended to the outbox table name to name the lock table.
+	leasesTableSuffix = "_leases"
+
+	// renewalsPerLease is how many times the lease is renewed within its duration,
+	// so a renewal can fail and be tried again before the lease expires.
+	renewalsPerLease = 3
+)
+
+// ErrLeaseLost is used when the lease of the migrations lock expired and was taken over while it was held.
+var ErrLeaseLost = errors.New("the lease of the migrations lock was lost")
+
+// dialect is the cockroachdb flavour of SQL. It is the postgres one, except for the ids,
+// the lock, the migrations and the retryable errors.
+type dialect struct {
+	sqlstore.Dialect
+	// p holds the lease duration of the lock.
+	p *Cockroach
+	// owner identifies this instance in the lease table.
+	owner string
+
+	mu sync.Mutex
+	// stopRenewal stops renewing the lease that is held, it returns ErrLeaseLost if the lease was taken over.
+	stopRenewal func() error
+}
+
+// Lock takes the lease of the migrations lock, CockroachDB has no advisory locks. An expired lease
+// is taken over, so a crashed instance can't hold the lock for longer than LeaseDuration.
+// The lease is renewed in the background until Unlock, so migrations can run for longer than it.
+func (d *dialect) Lock(ctx context.Context, conn *sql.Conn, s *sqlstore.Store) error {
+	name, err := lock.Generate(s.DatabaseName, s.SchemaName)
+	if err != nil {
+		return err
+	}
+
+	table := s.Ident(s.EventStoreTable + leasesTableSuffix)
+
+	// nolint
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	name STRING not null primary key,
+	owner STRING not null,
+	expires_at TIMESTAMPTZ not null
+);
+`, table)); err != nil {
+		return fmt.Errorf("failed to create the lease table: %w", err)
+	}
+
+	// nolint
+	query := fmt.Sprintf(`
+INSERT INTO %s AS l (name, owner, expires_at)
+VALUES ($1, $2, now() + $3::INTERVAL)
+ON CONFLICT (name) DO UPDATE
+SET owner = excluded.owner, expires_at = excluded.expires_at
+WHERE l.expires_at < now() OR l.owner = excluded.owner
+RETURNING owner
+`, table)
+	lease := fmt.Sprintf("%d milliseconds", d.p.LeaseDuration.Milliseconds())
+
+	ctx, cancel := context.WithTimeout(ctx, lockTimeout)
+	defer cancel()
+
+	for {
+		var owner string
+
+		err := conn.QueryRowContext(ctx, query, name, d.owner, lease).Scan(&owner)
+		if err == nil {
+			d.mu.Lock()
+			d.stopRenewal = d.renew(s, name, table, lease)
+			d.mu.Unlock()
+
+			return nil
+		}
+
+		if !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("try lock failed: %w", err)
+		}
+
+		t := s.Clock.NewTimer(lockPollInterval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ErrLocked
+		case <-t.C():
+		}
+	}
+}
+
+// renew extends the lease every LeaseDuration / renewalsPerLease until the returned func is called.
+// The lease is renewed through the connection pool, the locked connection runs the migrations
+// in transactions of their own. A failed renewal is tried again on the next tick, renewing stops
+// once the lease is held by another instance.
+func (d *dialect) renew(s *sqlstore.Store, name, table, lease string) func() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+
+	var lost error
+
+	// nolint
+	query := fmt.Sprintf(`UPDATE %s SET expires_at = now() + $3::INTERVAL WHERE name = $1 AND owner = $2`, table)
+
+	go func() {
+		defer close(done)
+
+		t := s.Clock.NewTicker(d.p.LeaseDuration / renewalsPerLease)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C():
+			}
+
+			res, err := d.p.db.ExecContext(ctx, query, name, d.owner, lease)
+			if err != nil {
+				continue
+			}
+
+			if n, err := res.RowsAffected(); err == nil && n == 0 {
+				lost = ErrLeaseLost
+				return
+			}
+		}
+	}()
+
+	return func() error {
+		cancel()
+		<-done
+
+		return lost
+	}
+}
+
+// Unlock stops renewing the lease and gives it up, if it is still held by this instance.
+// It returns ErrLeaseLost if the lease was taken over while it was held.
+func (d *dialect) Unlock(ctx context.Context, conn *sql.Conn, s *sqlstore.Store) error {
+	d.mu.Lock()
+	stop := d.stopRenewal
+	d.stopRenewal = nil
+	d.mu.Unlock()
+
+	var lost error
+	if stop != nil {
+		lost = stop()
+	}
+
+	name, err := lock.Generate(s.DatabaseName, s.SchemaName)
+	if err != nil {
+		return errors.Join(lost, err)
+	}
+
+	// nolint
+	query := fmt.Sprintf(`DELETE FROM %s WHERE name = $1 AND owner = $2`, s.Ident(s.EventStoreTable+leasesTableSuffix))
+	_, err = conn.ExecContext(ctx, query, name, d.owner)
+
+	return errors.Join(lost, err)
+}
+
+func (*dialect) MigrationsDialect(s *sqlstore.Store, table string) migrate.Dialect {
+	table = s.Ident(table + sqlstore.MigrationsTableSuffix)
+
+	return migrate.Dialect{
+		CreateTable: fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	version INT8 not null primary key,
+	description STRING not null,
+	applied_at TIMESTAMP not null default now()
+);
+`, table),
+		SelectVersions: fmt.Sprintf(`SELECT version FROM %s`, table),
+		InsertVersion:  fmt.Sprintf(`INSERT INTO %s (version, description) VALUES ($1, $2)`, table),
+	}
+}
+
+// Migrations create the ids with unique_rowid(), SERIAL ids would concentrate the writes on a single range.
+// Index names belong to their table in CockroachDB.
+func (*dialect) Migrations(s *sqlstore.Store) []migrate.Migration {
+	return []migrate.Migration{
+		{
+			Version:     1,
+			Description: "create outbox table",
+			Up: fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	id INT8 not null default unique_rowid() primary key,
+	dispatched BOOL not null default false,
+	dispatched_at TIMESTAMP,
+	payload BYTES not null,
+	options JSONB,
+	headers JSONB,
+	created_at TIMESTAMP not null default now(),
+	INDEX "index_dispatchedAt" (dispatched_at),
+	INDEX "index_dispatched" (dispatched)
+);
+`, s.Ident(s.EventStoreTable)),
+		},
+		{
+			Version:     2,
+			Description: "track failed sends",
+			Up: fmt.Sprintf(`
+ALTER TABLE %s
+	ADD COLUMN IF NOT EXISTS attempts INT4 not null default 0,
+	ADD COLUMN IF NOT EXISTS last_error STRING,
+	ADD COLUMN IF NOT EXISTS dead BOOL not null default false;
+`, s.Ident(s.EventStoreTable)),
+		},
+	}
+}
+
+func (d *dialect) ArchiveMigrations(s *sqlstore.Store) []migrate.Migration {
+	return []migrate.Migration{
+		{
+			Version:     1,
+			Description: "create archive table",
+			Up: fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	id INT8 not null primary key,
+	dispatched BOOL not null default false,
+	dispatched_at TIMESTAMP not null,
+	payload BYTES not null,
+	options JSONB,
+	headers JSONB,
+	archived_at TIMESTAMP not null default now(),
+	INDEX "index_dispatched_at" (dispatched_at)
+);
+`, s.Ident(s.ArchiveTable)),
+		},
+		{
+			Version:     2,
+			Description: "add created_at column",
+			Up: fmt.Sprintf(`
+ALTER TABLE %s ADD COLUMN IF NOT EXISTS created_at TIMESTAMP;
+`, s.Ident(s.ArchiveTable)),
+		},
+		{
+			Version:     3,
+			Description: "key the archive on id and archived_at",
+			// the old primary key is kept as a unique index, which would still reject a message archived again
+			Up: fmt.Sprintf(`
+ALTER TABLE %[1]s ALTER PRIMARY KEY USING COLUMNS (id, archived_at);
+DROP INDEX IF EXISTS %[1]s@%[2]s CASCADE;
+`, s.Ident(s.ArchiveTable), d.Quote(s.ArchiveTable+"_id_key")),
+		},
+	}
+}
+
+func (*dialect) IsRetryable(err error) bool {
+	var e interface{ SQLState() string }
+	if !errors.As(err, &e) {
+		return false
+	}
+
+	return e.SQLState() == sqlStateSerializationFailure
+}
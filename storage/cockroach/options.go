@@ -0,0 +1,81 @@
+package cockroach
+
+import (
+	"time"
+
+	"github.com/italolelis/outboxer"
+)
+
+// Option represents the cockroach data store options.
+type Option func(*Cockroach)
+
+// WithEventStoreTable sets the name of the outbox table.
+func WithEventStoreTable(name string) Option {
+	return func(p *Cockroach) {
+		p.EventStoreTable = name
+	}
+}
+
+// WithSchema sets the schema of the outbox table. Table names are qualified with it,
+// otherwise they are resolved through the search path.
+func WithSchema(name string) Option {
+	return func(p *Cockroach) {
+		p.SchemaName = name
+		p.QualifyTables = true
+	}
+}
+
+// WithQuotedIdentifiers quotes the table and schema names, so they can be mixed case or reserved words.
+func WithQuotedIdentifiers() Option {
+	return func(p *Cockroach) {
+		p.QuoteIdentifiers = true
+	}
+}
+
+// WithoutDDL never creates or changes tables. The data store only validates that the outbox table
+// exists and has the expected columns, for setups where the schema is managed outside the application, see DDL.
+func WithoutDDL() Option {
+	return func(p *Cockroach) {
+		p.SkipDDL = true
+	}
+}
+
+// WithClearMetadataOnDispatch wipes the options and headers of a message once it is dispatched.
+// By default they are kept for audit and replay, see Compact to strip them later on.
+func WithClearMetadataOnDispatch() Option {
+	return func(p *Cockroach) {
+		p.ClearMetadataOnDispatch = true
+	}
+}
+
+// WithArchiveTable makes Remove move dispatched messages into the given archive table instead of
+// deleting them, like EnableArchive. With WithoutDDL the table is only validated and DDL includes it.
+func WithArchiveTable(name string) Option {
+	return func(p *Cockroach) {
+		p.ArchiveTable = name
+	}
+}
+
+// WithLeaseDuration sets how long the migrations lock is leased for. The lease is renewed while
+// the lock is held, when its holder dies other instances take the lock over once the lease expires.
+func WithLeaseDuration(d time.Duration) Option {
+	return func(p *Cockroach) {
+		p.LeaseDuration = d
+	}
+}
+
+// WithMaxRetries sets how many times a transaction is retried after a serialization failure.
+// With an outboxer.RetryPolicy the transactions of SendWithinTx are retried by both, up to
+// MaxAttempts * (n + 1) times, so pass zero to leave the retries to the policy.
+func WithMaxRetries(n int) Option {
+	return func(p *Cockroach) {
+		p.MaxRetries = n
+	}
+}
+
+// WithClock sets the clock of the created_at and dispatched_at timestamps, the system clock by default.
+func WithClock(c outboxer.Clock) Option {
+	return func(p *Cockroach) {
+		p.Clock = c
+	}
+}
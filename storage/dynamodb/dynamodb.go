@@ -0,0 +1,554 @@
+// Package dynamodb is the implementation of the dynamodb data store.
+//
+// Messages are items keyed by a numeric id. Pending messages carry a pending attribute, which is the partition
+// key of a sparse global secondary index, so the dispatcher only reads pending messages. The attribute is
+// removed when the message is dispatched, and a dispatched_shard attribute is set instead, which is the
+// partition key of a sparse index sorted by dispatch time, so Remove only reads old messages.
+//
+// The partition keys are the shard of the message, its id modulo Shards. A partition of an index takes
+// about 1000 writes per second, so with a single shard, the default, the outbox takes about as many
+// messages per second. Raise it with WithShards for more, at the cost of a query per shard on each read.
+package dynamodb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/italolelis/outboxer"
+)
+
+const (
+	// DefaultTableName is the default table name.
+	DefaultTableName = "event_store"
+
+	// DefaultPendingIndex is the default name of the index of pending messages.
+	DefaultPendingIndex = "pending-index"
+
+	// DefaultDispatchedIndex is the default name of the index of dispatched messages.
+	DefaultDispatchedIndex = "dispatched-index"
+
+	// DefaultShards is the default number of partitions of the indexes.
+	DefaultShards = 1
+
+	// maxTransactItems is the limit of items in a single TransactWriteItems call.
+	maxTransactItems = 100
+
+	// maxBatchWriteItems is the limit of items in a single BatchWriteItem call.
+	maxBatchWriteItems = 25
+
+	// maxBatchWriteAttempts caps the calls of a batch write that keeps leaving items unprocessed.
+	maxBatchWriteAttempts = 8
+
+	// batchWriteInitialBackoff is the wait before unprocessed items are resent, it doubles on each attempt
+	// up to batchWriteMaxBackoff.
+	batchWriteInitialBackoff = 50 * time.Millisecond
+	batchWriteMaxBackoff     = 2 * time.Second
+
+	// maxPrealloc caps the room made up front for the messages of a query, the batch size comes from the caller.
+	maxPrealloc = 1000
+
+	// idRandomBits are the low bits of an id, filled at random. The high bits are the creation time in milliseconds.
+	idRandomBits = 20
+)
+
+var (
+	// ErrTooManyItems is used when a transaction would have more items than DynamoDB allows.
+	ErrTooManyItems = fmt.Errorf("a transaction can't have more than %d items", maxTransactItems)
+
+	// ErrSQLNotSupported is used when a SQL statement is run within a DynamoDB transaction.
+	ErrSQLNotSupported = errors.New("dynamodb transactions don't run SQL, add items to the *dynamodb.Tx instead")
+
+	// ErrUnprocessedItems is used when a batch write still has unprocessed items after every attempt.
+	ErrUnprocessedItems = errors.New("dynamodb left items unprocessed")
+)
+
+// DynamoDB is the implementation of the data store.
+type DynamoDB struct {
+	conn            dynamodbiface.DynamoDBAPI
+	TableName       string
+	PendingIndex    string
+	DispatchedIndex string
+	// Shards is the number of partitions of the indexes, see WithShards.
+	Shards  int
+	skipDDL bool
+	clock   outboxer.Clock
+}
+
+// Tx collects the items written within AddWithinTx. They are written atomically with the outbox message
+// in a single TransactWriteItems call. The callback gets it as an outboxer.ExecerContext:
+//
+//	ds.AddWithinTx(ctx, evt, func(execer outboxer.ExecerContext) error {
+//		tx := execer.(*dynamodb.Tx)
+//		tx.Add(&awsdynamodb.TransactWriteItem{Put: &awsdynamodb.Put{...}})
+//		return nil
+//	})
+type Tx struct {
+	items []*dynamodb.TransactWriteItem
+}
+
+// Add adds items to the transaction.
+func (tx *Tx) Add(items ...*dynamodb.TransactWriteItem) {
+	tx.items = append(tx.items, items...)
+}
+
+// ExecContext always fails, DynamoDB transactions are made of items, see Add.
+func (tx *Tx) ExecContext(context.Context, string, ...interface{}) (sql.Result, error) {
+	return nil, ErrSQLNotSupported
+}
+
+// WithInstance creates a dynamodb data store with an existing client. The outbox table and its
+// indexes are created when they don't exist, unless WithoutDDL is used.
+func WithInstance(ctx context.Context, conn dynamodbiface.DynamoDBAPI, opts ...Option) (*DynamoDB, error) {
+	p := DynamoDB{conn: conn, clock: outboxer.SystemClock()}
+
+	for _, opt := range opts {
+		opt(&p)
+	}
+
+	if p.TableName == "" {
+		p.TableName = DefaultTableName
+	}
+
+	if p.PendingIndex == "" {
+		p.PendingIndex = DefaultPendingIndex
+	}
+
+	if p.DispatchedIndex == "" {
+		p.DispatchedIndex = DefaultDispatchedIndex
+	}
+
+	if p.Shards <= 0 {
+		p.Shards = DefaultShards
+	}
+
+	if err := p.ensureTable(ctx); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// GetEvents retrieves all the relevant events, in id order, from the pending index. Each shard is queried
+// for a batch and the lowest ids of them are kept. The index is eventually consistent, so a message may show
+// up shortly after being dispatched.
+func (p *DynamoDB) GetEvents(ctx context.Context, batchSize int32) ([]*outboxer.OutboxMessage, error) {
+	events := newEvents(batchSize)
+
+	for shard := 0; shard < p.Shards; shard++ {
+		out, err := p.conn.QueryWithContext(ctx, &dynamodb.QueryInput{
+			TableName:              aws.String(p.TableName),
+			IndexName:              aws.String(p.PendingIndex),
+			KeyConditionExpression: aws.String("pending = :pending"),
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":pending": shardValue(shard),
+			},
+			Limit: aws.Int64(int64(batchSize)),
+		})
+		if err != nil {
+			return events, fmt.Errorf("failed to get messages from the store: %w", err)
+		}
+
+		for _, item := range out.Items {
+			e, err := decode(item)
+			if err != nil {
+				return events, err
+			}
+
+			events = append(events, e)
+		}
+	}
+
+	if p.Shards > 1 {
+		sort.Slice(events, func(i, j int) bool { return events[i].ID < events[j].ID })
+
+		if len(events) > int(batchSize) {
+			events = events[:batchSize]
+		}
+	}
+
+	return events, nil
+}
+
+// Add adds the message to the data store.
+func (p *DynamoDB) Add(ctx context.Context, evt *outboxer.OutboxMessage) error {
+	return p.AddWithinTx(ctx, evt, nil)
+}
+
+// AddWithinTx runs fn, when not nil, with a *Tx that collects the caller's items, and then writes them
+// together with the message in a single TransactWriteItems call. Nothing is written when fn fails.
+func (p *DynamoDB) AddWithinTx(ctx context.Context, evt *outboxer.OutboxMessage, fn func(outboxer.ExecerContext) error) error {
+	var tx Tx
+
+	if fn != nil {
+		if err := fn(&tx); err != nil {
+			return err
+		}
+	}
+
+	return p.AddInTransaction(ctx, tx.items, evt)
+}
+
+// AddInTransaction writes the messages together with the given items in a single TransactWriteItems call.
+func (p *DynamoDB) AddInTransaction(
+	ctx context.Context,
+	items []*dynamodb.TransactWriteItem,
+	msgs ...*outboxer.OutboxMessage,
+) error {
+	puts, err := p.TransactItems(msgs...)
+	if err != nil {
+		return err
+	}
+
+	items = append(append(make([]*dynamodb.TransactWriteItem, 0, len(items)+len(puts)), items...), puts...)
+	if len(items) > maxTransactItems {
+		return ErrTooManyItems
+	}
+
+	if _, err := p.conn.TransactWriteItemsWithContext(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	}); err != nil {
+		return fmt.Errorf("failed to insert message into the data store: %w", err)
+	}
+
+	return nil
+}
+
+// TransactItems returns the items that add the messages, for callers that run TransactWriteItems on their own.
+// The ID of the messages is set, and their CreatedAt unless it is already set. Each put only succeeds if no message has the same id.
+func (p *DynamoDB) TransactItems(msgs ...*outboxer.OutboxMessage) ([]*dynamodb.TransactWriteItem, error) {
+	items := make([]*dynamodb.TransactWriteItem, 0, len(msgs))
+
+	for _, evt := range msgs {
+		if evt.CreatedAt.IsZero() {
+			evt.CreatedAt = p.clock.Now()
+		}
+
+		evt.CreatedAt = evt.CreatedAt.UTC()
+		evt.ID = newID(evt.CreatedAt)
+
+		item, err := encode(evt, p.shard(evt.ID))
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, &dynamodb.TransactWriteItem{
+			Put: &dynamodb.Put{
+				TableName:           aws.String(p.TableName),
+				Item:                item,
+				ConditionExpression: aws.String("attribute_not_exists(id)"),
+			},
+		})
+	}
+
+	return items, nil
+}
+
+// SetAsDispatched sets one message as dispatched, which moves it from the pending index to the dispatched one.
+// The update is conditional, so a message that was already removed is not written back.
+func (p *DynamoDB) SetAsDispatched(ctx context.Context, id int64) error {
+	_, err := p.conn.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(p.TableName),
+		Key:                 key(id),
+		UpdateExpression:    aws.String("SET dispatched = :dispatched, dispatched_at = :now, dispatched_shard = :shard REMOVE pending"),
+		ConditionExpression: aws.String("attribute_exists(id)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":dispatched": {BOOL: aws.Bool(true)},
+			":now":        timeValue(p.clock.Now()),
+			":shard":      shardValue(p.shard(id)),
+		},
+	})
+
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return outboxer.ErrMessageNotFound
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to set message as dispatched: %w", err)
+	}
+
+	return nil
+}
+
+// Remove removes old messages from the data store, at most batchSize at a time.
+// They are queried from the dispatched index, shard by shard, oldest first.
+func (p *DynamoDB) Remove(ctx context.Context, dispatchedBefore time.Time, batchSize int32) error {
+	var keys []map[string]*dynamodb.AttributeValue
+
+	for shard := 0; shard < p.Shards && len(keys) < int(batchSize); shard++ {
+		var startKey map[string]*dynamodb.AttributeValue
+
+		for len(keys) < int(batchSize) {
+			out, err := p.conn.QueryWithContext(ctx, &dynamodb.QueryInput{
+				TableName:              aws.String(p.TableName),
+				IndexName:              aws.String(p.DispatchedIndex),
+				KeyConditionExpression: aws.String("dispatched_shard = :shard AND dispatched_at < :before"),
+				ProjectionExpression:   aws.String("id"),
+				ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+					":shard":  shardValue(shard),
+					":before": timeValue(dispatchedBefore),
+				},
+				Limit:             aws.Int64(int64(int(batchSize) - len(keys))),
+				ExclusiveStartKey: startKey,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to get messages to remove: %w", err)
+			}
+
+			keys = append(keys, out.Items...)
+
+			if len(out.LastEvaluatedKey) == 0 {
+				break
+			}
+
+			startKey = out.LastEvaluatedKey
+		}
+	}
+
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxBatchWriteItems {
+			n = maxBatchWriteItems
+		}
+
+		if err := p.deleteKeys(ctx, keys[:n]); err != nil {
+			return err
+		}
+
+		keys = keys[n:]
+	}
+
+	return nil
+}
+
+// deleteKeys deletes the items with a batch write. Unprocessed items, which DynamoDB leaves when the table
+// is throttled, are resent with an exponential backoff, up to maxBatchWriteAttempts calls.
+func (p *DynamoDB) deleteKeys(ctx context.Context, keys []map[string]*dynamodb.AttributeValue) error {
+	requests := make([]*dynamodb.WriteRequest, 0, len(keys))
+	for _, k := range keys {
+		requests = append(requests, &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{Key: k}})
+	}
+
+	input := map[string][]*dynamodb.WriteRequest{p.TableName: requests}
+	backoff := batchWriteInitialBackoff
+
+	for attempt := 1; ; attempt++ {
+		out, err := p.conn.BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{RequestItems: input})
+		if err != nil {
+			return fmt.Errorf("failed to remove messages from the data store: %w", err)
+		}
+
+		input = out.UnprocessedItems
+		if len(input) == 0 {
+			return nil
+		}
+
+		if attempt >= maxBatchWriteAttempts {
+			return fmt.Errorf("failed to remove messages from the data store: %w: %d items after %d attempts",
+				ErrUnprocessedItems, len(input[p.TableName]), attempt)
+		}
+
+		t := p.clock.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C():
+		}
+
+		if backoff *= 2; backoff > batchWriteMaxBackoff {
+			backoff = batchWriteMaxBackoff
+		}
+	}
+}
+
+// ensureTable checks that the outbox table exists, creating it with its indexes when it doesn't.
+func (p *DynamoDB) ensureTable(ctx context.Context) error {
+	_, err := p.conn.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(p.TableName)})
+	if err == nil {
+		return nil
+	}
+
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) || aerr.Code() != dynamodb.ErrCodeResourceNotFoundException || p.skipDDL {
+		return fmt.Errorf("failed to describe the outbox table: %w", err)
+	}
+
+	if _, err := p.conn.CreateTableWithContext(ctx, p.tableDefinition()); err != nil {
+		return fmt.Errorf("failed to create the outbox table: %w", err)
+	}
+
+	if err := p.conn.WaitUntilTableExistsWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(p.TableName),
+	}); err != nil {
+		return fmt.Errorf("failed to wait for the outbox table: %w", err)
+	}
+
+	return nil
+}
+
+// tableDefinition is the outbox table, keyed by id, with the sparse index of pending messages sorted by id
+// and the one of dispatched messages sorted by dispatch time. Remove only needs the ids of the latter.
+func (p *DynamoDB) tableDefinition() *dynamodb.CreateTableInput {
+	return &dynamodb.CreateTableInput{
+		TableName:   aws.String(p.TableName),
+		BillingMode: aws.String(dynamodb.BillingModePayPerRequest),
+		AttributeDefinitions: []*dynamodb.AttributeDefinition{
+			{AttributeName: aws.String("id"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeN)},
+			{AttributeName: aws.String("pending"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("dispatched_shard"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeS)},
+			{AttributeName: aws.String("dispatched_at"), AttributeType: aws.String(dynamodb.ScalarAttributeTypeN)},
+		},
+		KeySchema: []*dynamodb.KeySchemaElement{
+			{AttributeName: aws.String("id"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+		},
+		GlobalSecondaryIndexes: []*dynamodb.GlobalSecondaryIndex{
+			{
+				IndexName: aws.String(p.PendingIndex),
+				KeySchema: []*dynamodb.KeySchemaElement{
+					{AttributeName: aws.String("pending"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+					{AttributeName: aws.String("id"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+				},
+				Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeAll)},
+			},
+			{
+				IndexName: aws.String(p.DispatchedIndex),
+				KeySchema: []*dynamodb.KeySchemaElement{
+					{AttributeName: aws.String("dispatched_shard"), KeyType: aws.String(dynamodb.KeyTypeHash)},
+					{AttributeName: aws.String("dispatched_at"), KeyType: aws.String(dynamodb.KeyTypeRange)},
+				},
+				Projection: &dynamodb.Projection{ProjectionType: aws.String(dynamodb.ProjectionTypeKeysOnly)},
+			},
+		},
+	}
+}
+
+// encode turns a pending message of the given shard into an item. Options and headers are stored as JSON strings.
+func encode(evt *outboxer.OutboxMessage, shard int) (map[string]*dynamodb.AttributeValue, error) {
+	item := key(evt.ID)
+	item["pending"] = shardValue(shard)
+	item["dispatched"] = &dynamodb.AttributeValue{BOOL: aws.Bool(false)}
+	item["payload"] = &dynamodb.AttributeValue{B: evt.Payload}
+	item["created_at"] = timeValue(evt.CreatedAt)
+
+	for name, v := range map[string]outboxer.DynamicValues{"options": evt.Options, "headers": evt.Headers} {
+		if len(v) == 0 {
+			continue
+		}
+
+		data, err := json.Marshal(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode message %s: %w", name, err)
+		}
+
+		item[name] = &dynamodb.AttributeValue{S: aws.String(string(data))}
+	}
+
+	return item, nil
+}
+
+func decode(item map[string]*dynamodb.AttributeValue) (*outboxer.OutboxMessage, error) {
+	var (
+		e   outboxer.OutboxMessage
+		err error
+	)
+
+	if e.ID, err = numberValue(item["id"]); err != nil {
+		return nil, fmt.Errorf("failed to decode message id: %w", err)
+	}
+
+	if v, ok := item["payload"]; ok {
+		e.Payload = v.B
+	}
+
+	if v, ok := item["dispatched"]; ok && v.BOOL != nil {
+		e.Dispatched = *v.BOOL
+	}
+
+	if v, ok := item["created_at"]; ok {
+		ns, err := numberValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode message creation time: %w", err)
+		}
+
+		e.CreatedAt = time.Unix(0, ns).UTC()
+	}
+
+	if v, ok := item["dispatched_at"]; ok {
+		ns, err := numberValue(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode message dispatch time: %w", err)
+		}
+
+		e.DispatchedAt.Time = time.Unix(0, ns).UTC()
+		e.DispatchedAt.Valid = true
+	}
+
+	for name, dst := range map[string]*outboxer.DynamicValues{"options": &e.Options, "headers": &e.Headers} {
+		if v, ok := item[name]; ok && v.S != nil {
+			if err := json.Unmarshal([]byte(*v.S), dst); err != nil {
+				return nil, fmt.Errorf("failed to decode message %s: %w", name, err)
+			}
+		}
+	}
+
+	return &e, nil
+}
+
+func key(id int64) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"id": {N: aws.String(strconv.FormatInt(id, 10))},
+	}
+}
+
+// shard returns the partition of the indexes the message with the given id belongs to.
+func (p *DynamoDB) shard(id int64) int {
+	return int(id % int64(p.Shards))
+}
+
+func shardValue(shard int) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{S: aws.String(strconv.Itoa(shard))}
+}
+
+// timeValue stores times as unix nanoseconds, so they can be compared in filters.
+func timeValue(t time.Time) *dynamodb.AttributeValue {
+	return &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(t.UnixNano(), 10))}
+}
+
+func numberValue(v *dynamodb.AttributeValue) (int64, error) {
+	if v == nil || v.N == nil {
+		return 0, errors.New("missing number")
+	}
+
+	return strconv.ParseInt(*v.N, 10, 64)
+}
+
+// newID returns an id that grows with the creation time, so the pending index is sorted in creation order.
+// The random low bits make collisions unlikely, and the conditional put rejects them.
+func newID(createdAt time.Time) int64 {
+	return createdAt.UnixMilli()<<idRandomBits | rand.Int63n(1<<idRandomBits) // nolint
+}
+
+// newEvents returns an empty slice with room for up to n messages, n is capped by maxPrealloc.
+func newEvents(n int32) []*outboxer.OutboxMessage {
+	if n < 0 {
+		n = 0
+	}
+
+	if n > maxPrealloc {
+		n = maxPrealloc
+	}
+
+	return make([]*outboxer.OutboxMessage, 0, n)
+}
@@ -0,0 +1,41 @@
+package dynamodb_test
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	awsdynamodb "github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/storage/dynamodb"
+)
+
+func ExampleDynamoDB() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sess, err := session.NewSession()
+	if err != nil {
+		fmt.Printf("failed to create the aws session: %s", err)
+		return
+	}
+
+	ds, err := dynamodb.WithInstance(ctx, awsdynamodb.New(sess))
+	if err != nil {
+		fmt.Printf("failed to setup the data store: %s", err)
+		return
+	}
+
+	// the order and the message are written atomically
+	if err := ds.AddWithinTx(ctx, &outboxer.OutboxMessage{Payload: []byte("order paid")}, func(execer outboxer.ExecerContext) error {
+		execer.(*dynamodb.Tx).Add(&awsdynamodb.TransactWriteItem{Put: &awsdynamodb.Put{
+			TableName: aws.String("orders"),
+			Item:      map[string]*awsdynamodb.AttributeValue{"id": {S: aws.String("123")}},
+		}})
+
+		return nil
+	}); err != nil {
+		fmt.Printf("failed to add the message: %s", err)
+	}
+}
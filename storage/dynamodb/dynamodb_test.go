@@ -0,0 +1,581 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/outboxertest"
+	"github.com/italolelis/outboxer/storage/storetest"
+)
+
+// fakeDynamoDB keeps the items of every table in memory. It only understands the expressions of the data store,
+// and it can't scan, so a scan fails the test.
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+
+	mu     sync.Mutex
+	tables map[string]*dynamodb.CreateTableInput
+	items  map[string]map[string]map[string]*dynamodb.AttributeValue
+}
+
+func newFake() *fakeDynamoDB {
+	return &fakeDynamoDB{
+		tables: map[string]*dynamodb.CreateTableInput{},
+		items:  map[string]map[string]map[string]*dynamodb.AttributeValue{},
+	}
+}
+
+func (f *fakeDynamoDB) DescribeTableWithContext(
+	_ aws.Context,
+	in *dynamodb.DescribeTableInput,
+	_ ...request.Option,
+) (*dynamodb.DescribeTableOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.tables[*in.TableName]; !ok {
+		return nil, awserr.New(dynamodb.ErrCodeResourceNotFoundException, "table not found", nil)
+	}
+
+	return &dynamodb.DescribeTableOutput{}, nil
+}
+
+func (f *fakeDynamoDB) CreateTableWithContext(
+	_ aws.Context,
+	in *dynamodb.CreateTableInput,
+	_ ...request.Option,
+) (*dynamodb.CreateTableOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.tables[*in.TableName] = in
+	f.items[*in.TableName] = map[string]map[string]*dynamodb.AttributeValue{}
+
+	return &dynamodb.CreateTableOutput{}, nil
+}
+
+func (f *fakeDynamoDB) WaitUntilTableExistsWithContext(aws.Context, *dynamodb.DescribeTableInput, ...request.WaiterOption) error {
+	return nil
+}
+
+func (f *fakeDynamoDB) TransactWriteItemsWithContext(
+	_ aws.Context,
+	in *dynamodb.TransactWriteItemsInput,
+	_ ...request.Option,
+) (*dynamodb.TransactWriteItemsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, item := range in.TransactItems {
+		if item.Put == nil {
+			continue
+		}
+
+		if _, ok := f.items[*item.Put.TableName][*item.Put.Item["id"].N]; ok {
+			return nil, awserr.New(dynamodb.ErrCodeTransactionCanceledException, "ConditionalCheckFailed", nil)
+		}
+	}
+
+	for _, item := range in.TransactItems {
+		if item.Put != nil {
+			f.items[*item.Put.TableName][*item.Put.Item["id"].N] = item.Put.Item
+		}
+	}
+
+	return &dynamodb.TransactWriteItemsOutput{}, nil
+}
+
+// QueryWithContext queries the pending or the dispatched index. The dispatched index returns one key per page,
+// to exercise the paging of the data store.
+func (f *fakeDynamoDB) QueryWithContext(_ aws.Context, in *dynamodb.QueryInput, _ ...request.Option) (*dynamodb.QueryOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if *in.IndexName == DefaultDispatchedIndex {
+		return f.queryDispatched(in), nil
+	}
+
+	var items []map[string]*dynamodb.AttributeValue
+
+	for _, item := range f.items[*in.TableName] {
+		if v, ok := item["pending"]; ok && *v.S == *in.ExpressionAttributeValues[":pending"].S {
+			items = append(items, item)
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool { return number(items[i]["id"]) < number(items[j]["id"]) })
+
+	if int64(len(items)) > *in.Limit {
+		items = items[:*in.Limit]
+	}
+
+	return &dynamodb.QueryOutput{Items: items}, nil
+}
+
+func (f *fakeDynamoDB) queryDispatched(in *dynamodb.QueryInput) *dynamodb.QueryOutput {
+	var items []map[string]*dynamodb.AttributeValue
+
+	before := number(in.ExpressionAttributeValues[":before"])
+
+	for _, item := range f.items[*in.TableName] {
+		if v, ok := item["dispatched_shard"]; ok && *v.S == *in.ExpressionAttributeValues[":shard"].S &&
+			number(item["dispatched_at"]) < before {
+			items = append(items, item)
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return number(items[i]["dispatched_at"]) < number(items[j]["dispatched_at"]) ||
+			number(items[i]["dispatched_at"]) == number(items[j]["dispatched_at"]) && number(items[i]["id"]) < number(items[j]["id"])
+	})
+
+	if in.ExclusiveStartKey != nil {
+		start := number(in.ExclusiveStartKey["id"])
+		for i, item := range items {
+			if number(item["id"]) == start {
+				items = items[i+1:]
+				break
+			}
+		}
+	}
+
+	if len(items) == 0 || *in.Limit == 0 {
+		return &dynamodb.QueryOutput{}
+	}
+
+	out := dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{key(number(items[0]["id"]))}}
+	if len(items) > 1 {
+		out.LastEvaluatedKey = key(number(items[0]["id"]))
+	}
+
+	return &out
+}
+
+func (f *fakeDynamoDB) UpdateItemWithContext(
+	_ aws.Context,
+	in *dynamodb.UpdateItemInput,
+	_ ...request.Option,
+) (*dynamodb.UpdateItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	item, ok := f.items[*in.TableName][*in.Key["id"].N]
+	if !ok {
+		return nil, awserr.New(dynamodb.ErrCodeConditionalCheckFailedException, "the conditional request failed", nil)
+	}
+
+	item["dispatched"] = in.ExpressionAttributeValues[":dispatched"]
+	item["dispatched_at"] = in.ExpressionAttributeValues[":now"]
+	item["dispatched_shard"] = in.ExpressionAttributeValues[":shard"]
+	delete(item, "pending")
+
+	return &dynamodb.UpdateItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) BatchWriteItemWithContext(
+	_ aws.Context,
+	in *dynamodb.BatchWriteItemInput,
+	_ ...request.Option,
+) (*dynamodb.BatchWriteItemOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for table, requests := range in.RequestItems {
+		for _, r := range requests {
+			delete(f.items[table], *r.DeleteRequest.Key["id"].N)
+		}
+	}
+
+	return &dynamodb.BatchWriteItemOutput{}, nil
+}
+
+func number(v *dynamodb.AttributeValue) int64 {
+	n, _ := strconv.ParseInt(*v.N, 10, 64)
+	return n
+}
+
+func TestDynamoDB_AddSuccessfully(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn := newFake()
+
+	ds, err := WithInstance(ctx, conn)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	if _, ok := conn.tables[DefaultTableName]; !ok {
+		t.Fatal("was expecting the outbox table to be created")
+	}
+
+	evt := outboxer.OutboxMessage{
+		Payload: []byte("test payload"),
+		Options: outboxer.DynamicValues{"exchange.name": "test"},
+		Headers: outboxer.DynamicValues{"trace_id": "abc"},
+	}
+	if err := ds.Add(ctx, &evt); err != nil {
+		t.Fatalf("failed to add message in the data store: %s", err)
+	}
+
+	if evt.ID == 0 || evt.CreatedAt.IsZero() {
+		t.Fatalf("was expecting the ID and creation time to be set but got %d and %s", evt.ID, evt.CreatedAt)
+	}
+
+	msgs, err := ds.GetEvents(ctx, 10)
+	if err != nil {
+		t.Fatalf("failed to retrieve messages from the data store: %s", err)
+	}
+
+	if len(msgs) != 1 {
+		t.Fatalf("was expecting 1 message in the data store but got %d", len(msgs))
+	}
+
+	m := msgs[0]
+	if m.ID != evt.ID || string(m.Payload) != "test payload" || m.Options["exchange.name"] != "test" || m.Headers["trace_id"] != "abc" {
+		t.Fatalf("the message was not stored as it was added: %+v", m)
+	}
+
+	if !m.CreatedAt.Equal(evt.CreatedAt) {
+		t.Fatalf("was expecting the creation time %s but got %s", evt.CreatedAt, m.CreatedAt)
+	}
+
+	if err := ds.SetAsDispatched(ctx, m.ID); err != nil {
+		t.Fatalf("failed to set message as dispatched: %s", err)
+	}
+
+	if msgs, err = ds.GetEvents(ctx, 10); err != nil || len(msgs) != 0 {
+		t.Fatalf("was expecting the message to leave the pending index but got %d messages (%v)", len(msgs), err)
+	}
+
+	if err := ds.SetAsDispatched(ctx, 42); !errors.Is(err, outboxer.ErrMessageNotFound) {
+		t.Fatalf("was expecting %s but got %v", outboxer.ErrMessageNotFound, err)
+	}
+}
+
+func TestDynamoDB_AddWithinTx(t *testing.T) {
+	ctx := context.Background()
+	conn := newFake()
+
+	ds, err := WithInstance(ctx, conn)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	conn.items["orders"] = map[string]map[string]*dynamodb.AttributeValue{}
+
+	order := &dynamodb.TransactWriteItem{Put: &dynamodb.Put{
+		TableName: aws.String("orders"),
+		Item:      map[string]*dynamodb.AttributeValue{"id": {N: aws.String("1")}},
+	}}
+
+	fnErr := errors.New("payment declined")
+	err = ds.AddWithinTx(ctx, &outboxer.OutboxMessage{Payload: []byte("rolled back")}, func(tx outboxer.ExecerContext) error {
+		tx.(*Tx).Add(order)
+
+		return fnErr
+	})
+	if !errors.Is(err, fnErr) {
+		t.Fatalf("was expecting %s but got %v", fnErr, err)
+	}
+
+	if len(conn.items["orders"]) != 0 || len(conn.items[DefaultTableName]) != 0 {
+		t.Fatal("was expecting nothing to be written when the callback fails")
+	}
+
+	if err := ds.AddWithinTx(ctx, &outboxer.OutboxMessage{Payload: []byte("committed")}, func(tx outboxer.ExecerContext) error {
+		if _, err := tx.ExecContext(ctx, "UPDATE orders SET status = 'paid'"); !errors.Is(err, ErrSQLNotSupported) {
+			t.Fatalf("was expecting %s but got %v", ErrSQLNotSupported, err)
+		}
+
+		tx.(*Tx).Add(order)
+
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to add message within the transaction: %s", err)
+	}
+
+	if len(conn.items["orders"]) != 1 || len(conn.items[DefaultTableName]) != 1 {
+		t.Fatal("was expecting the order and the message to be written together")
+	}
+
+	items := make([]*dynamodb.TransactWriteItem, maxTransactItems)
+	if err := ds.AddInTransaction(ctx, items, &outboxer.OutboxMessage{}); !errors.Is(err, ErrTooManyItems) {
+		t.Fatalf("was expecting %s but got %v", ErrTooManyItems, err)
+	}
+}
+
+func TestDynamoDB_Remove(t *testing.T) {
+	ctx := context.Background()
+	conn := newFake()
+
+	ds, err := WithInstance(ctx, conn, WithTableName("outbox"))
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		evt := outboxer.OutboxMessage{Payload: []byte("test payload")}
+		if err := ds.Add(ctx, &evt); err != nil {
+			t.Fatalf("failed to add message in the data store: %s", err)
+		}
+
+		if i < 4 {
+			if err := ds.SetAsDispatched(ctx, evt.ID); err != nil {
+				t.Fatalf("failed to set message as dispatched: %s", err)
+			}
+		}
+	}
+
+	if err := ds.Remove(ctx, time.Now().Add(-time.Hour), 10); err != nil {
+		t.Fatalf("failed to remove messages: %s", err)
+	}
+
+	if n := len(conn.items["outbox"]); n != 5 {
+		t.Fatalf("was expecting recently dispatched messages to be kept but got %d messages", n)
+	}
+
+	if err := ds.Remove(ctx, time.Now().Add(time.Second), 3); err != nil {
+		t.Fatalf("failed to remove messages: %s", err)
+	}
+
+	if n := len(conn.items["outbox"]); n != 2 {
+		t.Fatalf("was expecting a batch of 3 messages to be removed but got %d messages", n)
+	}
+
+	if msgs, err := ds.GetEvents(ctx, 10); err != nil || len(msgs) != 1 {
+		t.Fatalf("was expecting the pending message to be kept but got %d messages (%v)", len(msgs), err)
+	}
+}
+
+func TestDynamoDB_RemoveWithClock(t *testing.T) {
+	ctx := context.Background()
+	conn := newFake()
+	clock := outboxertest.NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	ds, err := WithInstance(ctx, conn, WithTableName("outbox"), WithClock(clock))
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	dispatch := func(n int) {
+		for i := 0; i < n; i++ {
+			evt := outboxer.OutboxMessage{Payload: []byte("test payload")}
+			if err := ds.Add(ctx, &evt); err != nil {
+				t.Fatalf("failed to add message in the data store: %s", err)
+			}
+
+			if !evt.CreatedAt.Equal(clock.Now()) {
+				t.Fatalf("was expecting the message to be created at %s but got %s", clock.Now(), evt.CreatedAt)
+			}
+
+			if err := ds.SetAsDispatched(ctx, evt.ID); err != nil {
+				t.Fatalf("failed to set message as dispatched: %s", err)
+			}
+		}
+	}
+
+	dispatch(2)
+	clock.Advance(48 * time.Hour)
+	dispatch(1)
+
+	if err := ds.Remove(ctx, clock.Now().Add(-24*time.Hour), 10); err != nil {
+		t.Fatalf("failed to remove messages: %s", err)
+	}
+
+	if n := len(conn.items["outbox"]); n != 1 {
+		t.Fatalf("was expecting the messages dispatched two days ago to be removed but got %d messages", n)
+	}
+}
+
+func TestDynamoDB_Shards(t *testing.T) {
+	ctx := context.Background()
+	conn := newFake()
+
+	ds, err := WithInstance(ctx, conn, WithShards(3))
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	ids := make([]int64, 0, 9)
+
+	for i := 0; i < 9; i++ {
+		evt := outboxer.OutboxMessage{Payload: []byte("test payload")}
+		if err := ds.Add(ctx, &evt); err != nil {
+			t.Fatalf("failed to add message in the data store: %s", err)
+		}
+
+		ids = append(ids, evt.ID)
+	}
+
+	for _, item := range conn.items[DefaultTableName] {
+		if want := strconv.FormatInt(number(item["id"])%3, 10); *item["pending"].S != want {
+			t.Fatalf("was expecting message %s in shard %s but got %s", *item["id"].N, want, *item["pending"].S)
+		}
+	}
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	msgs, err := ds.GetEvents(ctx, 5)
+	if err != nil {
+		t.Fatalf("failed to get messages: %s", err)
+	}
+
+	if len(msgs) != 5 {
+		t.Fatalf("was expecting 5 messages but got %d", len(msgs))
+	}
+
+	for i, m := range msgs {
+		if m.ID != ids[i] {
+			t.Fatalf("was expecting the lowest ids of every shard in order, got %d at %d", m.ID, i)
+		}
+
+		if err := ds.SetAsDispatched(ctx, m.ID); err != nil {
+			t.Fatalf("failed to set message as dispatched: %s", err)
+		}
+	}
+
+	if err := ds.Remove(ctx, time.Now().Add(time.Second), 4); err != nil {
+		t.Fatalf("failed to remove messages: %s", err)
+	}
+
+	if n := len(conn.items[DefaultTableName]); n != 5 {
+		t.Fatalf("was expecting a batch of 4 messages to be removed but got %d messages", n)
+	}
+
+	if err := ds.Remove(ctx, time.Now().Add(time.Second), 10); err != nil {
+		t.Fatalf("failed to remove messages: %s", err)
+	}
+
+	if msgs, err := ds.GetEvents(ctx, 10); err != nil || len(msgs) != 4 || len(conn.items[DefaultTableName]) != 4 {
+		t.Fatalf("was expecting the pending messages to be kept but got %d messages (%v)", len(msgs), err)
+	}
+}
+
+// countingDynamoDB lets the conformance suite count the dispatched messages.
+type countingDynamoDB struct {
+	*DynamoDB
+	conn *fakeDynamoDB
+}
+
+func (d countingDynamoDB) CountDispatched(context.Context, outboxer.ReplayFilter) (int64, error) {
+	d.conn.mu.Lock()
+	defer d.conn.mu.Unlock()
+
+	var n int64
+
+	for _, item := range d.conn.items[d.TableName] {
+		if v, ok := item["dispatched"]; ok && v.BOOL != nil && *v.BOOL {
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func TestDynamoDB_DataStore(t *testing.T) {
+	storetest.RunDataStoreTests(t, func(t *testing.T) outboxer.DataStore {
+		conn := newFake()
+
+		ds, err := WithInstance(context.Background(), conn)
+		if err != nil {
+			t.Fatalf("failed to setup the data store: %s", err)
+		}
+
+		return countingDynamoDB{DynamoDB: ds, conn: conn}
+	})
+}
+
+func TestDynamoDB_WithoutDDL(t *testing.T) {
+	_, err := WithInstance(context.Background(), newFake(), WithoutDDL())
+
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) || aerr.Code() != dynamodb.ErrCodeResourceNotFoundException {
+		t.Fatalf("was expecting the missing table error but got %v", err)
+	}
+}
+
+// throttledDynamoDB leaves every delete of a batch write unprocessed for the first throttled calls.
+type throttledDynamoDB struct {
+	*fakeDynamoDB
+	throttled int
+	calls     int
+}
+
+func (f *throttledDynamoDB) BatchWriteItemWithContext(
+	ctx aws.Context,
+	in *dynamodb.BatchWriteItemInput,
+	opts ...request.Option,
+) (*dynamodb.BatchWriteItemOutput, error) {
+	if f.calls++; f.calls <= f.throttled {
+		return &dynamodb.BatchWriteItemOutput{UnprocessedItems: in.RequestItems}, nil
+	}
+
+	return f.fakeDynamoDB.BatchWriteItemWithContext(ctx, in, opts...)
+}
+
+func TestDynamoDB_RemoveUnprocessed(t *testing.T) {
+	cases := []struct {
+		name      string
+		throttled int
+		err       error
+		calls     int
+		left      int
+	}{
+		{name: "resent", throttled: 2, calls: 3, left: 0},
+		{name: "gives up", throttled: maxBatchWriteAttempts, err: ErrUnprocessedItems, calls: maxBatchWriteAttempts, left: 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			conn := &throttledDynamoDB{fakeDynamoDB: newFake(), throttled: c.throttled}
+			clock := outboxertest.NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+			ds, err := WithInstance(ctx, conn, WithClock(clock))
+			if err != nil {
+				t.Fatalf("failed to setup the data store: %s", err)
+			}
+
+			evt := outboxer.OutboxMessage{Payload: []byte("test payload")}
+			if err := ds.Add(ctx, &evt); err != nil {
+				t.Fatalf("failed to add message in the data store: %s", err)
+			}
+
+			if err := ds.SetAsDispatched(ctx, evt.ID); err != nil {
+				t.Fatalf("failed to set message as dispatched: %s", err)
+			}
+
+			go func() {
+				for clock.WaitForTimers(ctx, 1) == nil {
+					clock.Advance(batchWriteMaxBackoff)
+				}
+			}()
+
+			if err := ds.Remove(ctx, clock.Now().Add(time.Hour), 10); !errors.Is(err, c.err) {
+				t.Fatalf("was expecting %v but got %v", c.err, err)
+			}
+
+			if n := len(conn.items[DefaultTableName]); n != c.left {
+				t.Fatalf("was expecting %d messages left but got %d", c.left, n)
+			}
+
+			if conn.calls != c.calls {
+				t.Fatalf("was expecting %d batch writes but got %d", c.calls, conn.calls)
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package dynamodb
+
+import "github.com/italolelis/outboxer"
+
+// Option represents the dynamodb data store options.
+type Option func(*DynamoDB)
+
+// WithTableName sets the name of the outbox table.
+func WithTableName(name string) Option {
+	return func(p *DynamoDB) {
+		p.TableName = name
+	}
+}
+
+// WithPendingIndex sets the name of the sparse index of pending messages.
+func WithPendingIndex(name string) Option {
+	return func(p *DynamoDB) {
+		p.PendingIndex = name
+	}
+}
+
+// WithDispatchedIndex sets the name of the sparse index of dispatched messages.
+func WithDispatchedIndex(name string) Option {
+	return func(p *DynamoDB) {
+		p.DispatchedIndex = name
+	}
+}
+
+// WithShards spreads the messages over n partitions of the indexes, one by default. A partition takes
+// about 1000 writes per second, so raise it when the outbox takes more, every read queries each of them.
+// Lowering it on a live table strands the messages of the partitions that are gone.
+func WithShards(n int) Option {
+	return func(p *DynamoDB) {
+		p.Shards = n
+	}
+}
+
+// WithoutDDL never creates the outbox table. The data store only checks that it exists,
+// for setups where the table is managed outside the application.
+func WithoutDDL() Option {
+	return func(p *DynamoDB) {
+		p.skipDDL = true
+	}
+}
+
+// WithClock sets the clock of the created_at and dispatched_at timestamps, the system clock by default.
+// The ids of the messages are derived from their creation time, so they follow the clock too,
+// as do the waits before unprocessed deletes are resent.
+func WithClock(c outboxer.Clock) Option {
+	return func(p *DynamoDB) {
+		p.clock = c
+	}
+}
@@ -0,0 +1,212 @@
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/lock"
+	"github.com/italolelis/outboxer/migrate"
+	"github.com/italolelis/outboxer/storage/sqlstore"
+)
+
+const (
+	// errDeadlock and errLockWaitTimeout are the retryable error numbers.
+	errDeadlock        = 1213
+	errLockWaitTimeout = 1205
+
+	// maxInsertRows bounds the size of a multi-row insert.
+	maxInsertRows = 1000
+)
+
+// dialect is the mysql flavour of SQL.
+type dialect struct{}
+
+func (dialect) Placeholder(int) string { return "?" }
+
+func (dialect) Quote(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+func (dialect) Bool(v bool) string {
+	if v {
+		return "true"
+	}
+
+	return "false"
+}
+
+func (dialect) Limit(n int32) (string, string) { return "", fmt.Sprintf("LIMIT %d", n) }
+
+func (dialect) LockRows() (string, string) { return "", "FOR UPDATE" }
+
+// Returning is empty, the inserted rows are read back from LAST_INSERT_ID.
+// InnoDB hands out the ids of a multi-row insert in a row, IDStep apart.
+func (dialect) Returning() (string, string) { return "", "" }
+
+// IDStep is the auto_increment_increment of the session, above one on multi-primary setups such as Galera.
+func (dialect) IDStep() string { return "@@auto_increment_increment" }
+
+func (dialect) MaxInsertRows() int { return maxInsertRows }
+
+func (dialect) Metadata(v outboxer.DynamicValues) interface{} { return v }
+
+func (dialect) EmptyMetadata() string { return "'{}'" }
+
+func (dialect) HasMetadata() string { return "(JSON_LENGTH(options) > 0 OR JSON_LENGTH(headers) > 0)" }
+
+func (dialect) OptionsContain(args *sqlstore.Args, values outboxer.DynamicValues) (string, error) {
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode the destination filter: %w", err)
+	}
+
+	return fmt.Sprintf("JSON_CONTAINS(options, %s)", args.Add(string(data))), nil
+}
+
+func (dialect) MergeOptions(args *sqlstore.Args, values outboxer.DynamicValues) (string, error) {
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode the options override: %w", err)
+	}
+
+	return fmt.Sprintf("JSON_MERGE_PATCH(COALESCE(options, JSON_OBJECT()), %s)", args.Add(string(data))), nil
+}
+
+// Lock waits up to 10 seconds for a named lock.
+func (dialect) Lock(ctx context.Context, conn *sql.Conn, s *sqlstore.Store) error {
+	aid, err := lock.Generate(s.DatabaseName, s.EventStoreTable)
+	if err != nil {
+		return err
+	}
+
+	query := "SELECT GET_LOCK(?, 10)"
+
+	var success bool
+	if err := conn.QueryRowContext(ctx, query, aid).Scan(&success); err != nil {
+		return fmt.Errorf("failed to acquire lock: %w", err)
+	}
+
+	if !success {
+		return ErrLocked
+	}
+
+	return nil
+}
+
+func (dialect) Unlock(ctx context.Context, conn *sql.Conn, s *sqlstore.Store) error {
+	aid, err := lock.Generate(s.DatabaseName, s.EventStoreTable)
+	if err != nil {
+		return err
+	}
+
+	query := `SELECT RELEASE_LOCK(?)`
+	_, err = conn.ExecContext(ctx, query, aid)
+
+	return err
+}
+
+func (dialect) MigrationsDialect(s *sqlstore.Store, table string) migrate.Dialect {
+	table = s.Ident(table + sqlstore.MigrationsTableSuffix)
+
+	return migrate.Dialect{
+		CreateTable: fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	version BIGINT not null primary key,
+	description VARCHAR(255) not null,
+	applied_at DATETIME not null default CURRENT_TIMESTAMP
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+`, table),
+		SelectVersions: fmt.Sprintf(`SELECT version FROM %s`, table),
+		InsertVersion:  fmt.Sprintf(`INSERT INTO %s (version, description) VALUES (?, ?)`, table),
+	}
+}
+
+// Migrations are single statements, MySQL commits schema changes right away.
+func (dialect) Migrations(s *sqlstore.Store) []migrate.Migration {
+	return []migrate.Migration{
+		{
+			Version:     1,
+			Description: "create outbox table",
+			Up: fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %[1]s (
+	id BIGINT AUTO_INCREMENT not null primary key, 
+	dispatched BOOL not null default false, 
+	dispatched_at DATETIME,
+	payload BLOB not null,
+	options json,
+	headers json
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+`, s.Ident(s.EventStoreTable)),
+		},
+		{
+			Version:     2,
+			Description: "add created_at column",
+			Up: fmt.Sprintf(`
+ALTER TABLE %s ADD COLUMN created_at DATETIME not null default CURRENT_TIMESTAMP;
+`, s.Ident(s.EventStoreTable)),
+		},
+		{
+			Version:     3,
+			Description: "track failed sends",
+			Up: fmt.Sprintf(`
+ALTER TABLE %s
+	ADD COLUMN attempts INT not null default 0,
+	ADD COLUMN last_error TEXT,
+	ADD COLUMN dead BOOL not null default false;
+`, s.Ident(s.EventStoreTable)),
+		},
+	}
+}
+
+func (dialect) ArchiveMigrations(s *sqlstore.Store) []migrate.Migration {
+	return []migrate.Migration{
+		{
+			Version:     1,
+			Description: "create archive table",
+			Up: fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %[1]s (
+	id BIGINT not null primary key,
+	dispatched BOOL not null default false,
+	dispatched_at DATETIME not null,
+	payload BLOB not null,
+	options json,
+	headers json,
+	archived_at DATETIME not null default CURRENT_TIMESTAMP,
+	INDEX index_dispatched_at (dispatched_at)
+) ENGINE=InnoDB DEFAULT CHARSET=utf8;
+`, s.Ident(s.ArchiveTable)),
+		},
+		{
+			Version:     2,
+			Description: "add created_at column",
+			Up: fmt.Sprintf(`
+ALTER TABLE %s ADD COLUMN created_at DATETIME;
+`, s.Ident(s.ArchiveTable)),
+		},
+		{
+			Version:     3,
+			Description: "key the archive on id and archived_at",
+			Up: fmt.Sprintf(`
+ALTER TABLE %s
+	MODIFY archived_at DATETIME(6) not null default CURRENT_TIMESTAMP(6),
+	DROP PRIMARY KEY,
+	ADD PRIMARY KEY (id, archived_at);
+`, s.Ident(s.ArchiveTable)),
+		},
+	}
+}
+
+func (dialect) IsRetryable(err error) bool {
+	var e *mysql.MySQLError
+	if !errors.As(err, &e) {
+		return false
+	}
+
+	return e.Number == errDeadlock || e.Number == errLockWaitTimeout
+}
@@ -0,0 +1,51 @@
+//go:build integration
+
+package mysql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/storage/sqlstore"
+	"github.com/italolelis/outboxer/storage/storetest"
+)
+
+func TestMySQL_DataStore(t *testing.T) {
+	dsn := os.Getenv("MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("MYSQL_DSN is not set")
+	}
+
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		t.Fatalf("failed to connect to mysql: %s", err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	storetest.RunDataStoreTests(t, func(t *testing.T) outboxer.DataStore {
+		ctx := context.Background()
+		table := fmt.Sprintf("storetest_%d", time.Now().UnixNano())
+
+		ds, err := WithInstance(ctx, db, WithEventStoreTable(table))
+		if err != nil {
+			t.Fatalf("failed to setup the data store: %s", err)
+		}
+
+		t.Cleanup(func() {
+			for _, name := range []string{table, table + sqlstore.MigrationsTableSuffix} {
+				if _, err := db.ExecContext(ctx, `DROP TABLE IF EXISTS `+ds.Ident(name)); err != nil {
+					t.Errorf("failed to drop table %s: %s", name, err)
+				}
+			}
+		})
+
+		return ds
+	})
+}
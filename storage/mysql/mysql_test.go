@@ -2,28 +2,47 @@ package mysql
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"fmt"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
 	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
 	"github.com/italolelis/outboxer"
 	"github.com/italolelis/outboxer/lock"
 )
 
-var eventStoreRows = []string{"id", "dispatched", "dispatched_at", "payload", "options", "headers"}
+var eventStoreRows = []string{"id", "dispatched", "dispatched_at", "payload", "options", "headers", "created_at"}
+
+var inspectRows = append(eventStoreRows, "attempts", "last_error", "dead")
 
 func TestMySQL_CloseSuccessfully(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	ds, mock := getDatastore(ctx, t)
-	mock.ExpectClose()
 
 	if err := ds.Close(); err != nil {
 		t.Errorf("error was not expected while closing connection: %s", err)
 	}
 
+	// the connection pool belongs to the caller, so it stays open
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO event_store (.+) VALUES (.+)`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`SELECT id, created_at FROM (.+) WHERE id >= \? (.+) ORDER BY id LIMIT 1`).
+		WithArgs(1, 1, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Now()))
+	mock.ExpectCommit()
+
+	if err := ds.Add(ctx, &outboxer.OutboxMessage{Payload: []byte("test payload")}); err != nil {
+		t.Errorf("failed to add message after closing the data store: %s", err)
+	}
+
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("there were unfulfilled expectations: %s", err)
 	}
@@ -36,7 +55,7 @@ func TestMySQL_GetEventsSuccessfully(t *testing.T) {
 	ds, mock := getDatastore(ctx, t)
 	mock.ExpectQuery(`SELECT (.+) FROM (.+) WHERE (.+) LIMIT (.+)`).
 		WillReturnRows(sqlmock.NewRows(eventStoreRows).
-			AddRow(1, false, time.Now(), []byte("test payload"), outboxer.DynamicValues{}, outboxer.DynamicValues{}))
+			AddRow(1, false, time.Now(), []byte("test payload"), outboxer.DynamicValues{}, outboxer.DynamicValues{}, time.Now()))
 
 	msgs, err := ds.GetEvents(ctx, 10)
 	if err != nil {
@@ -109,8 +128,8 @@ func TestMySQL_SetAsDispatchedSuccessfully(t *testing.T) {
 
 	ds, mock := getDatastore(ctx, t)
 
-	mock.ExpectExec(`update (.+) set (.+) where id = ?`).
-		WithArgs(1).
+	mock.ExpectExec(`UPDATE (.+) SET (.+) WHERE id = ?`).
+		WithArgs(sqlmock.AnyArg(), 1).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
 	err := ds.SetAsDispatched(ctx, 1)
@@ -129,7 +148,7 @@ func TestMySQL_SetAsDispatchedWithSQLError(t *testing.T) {
 
 	ds, mock := getDatastore(ctx, t)
 
-	mock.ExpectExec(`update (.+) set (.+) where id = ?`).
+	mock.ExpectExec(`UPDATE (.+) SET (.+) WHERE id = ?`).
 		WillReturnError(errors.New("failed to set message as dispatched"))
 
 	err := ds.SetAsDispatched(ctx, 1)
@@ -142,6 +161,60 @@ func TestMySQL_SetAsDispatchedWithSQLError(t *testing.T) {
 	}
 }
 
+func TestMySQL_SetAsDispatchedClearsMetadata(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, mock := getDatastore(ctx, t)
+
+	mock.ExpectExec(`UPDATE event_store SET dispatched = true, dispatched_at = \? WHERE id = \?;`).
+		WithArgs(sqlmock.AnyArg(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := ds.SetAsDispatched(ctx, 1); err != nil {
+		t.Fatalf("error was not expected: %s", err)
+	}
+
+	WithClearMetadataOnDispatch()(ds)
+
+	mock.ExpectExec(`UPDATE event_store SET (.+), options = '{}', headers = '{}' WHERE id = \?;`).
+		WithArgs(sqlmock.AnyArg(), 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := ds.SetAsDispatched(ctx, 2); err != nil {
+		t.Fatalf("error was not expected: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMySQL_Compact(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, mock := getDatastore(ctx, t)
+
+	mock.ExpectExec(`UPDATE event_store SET options = '{}', headers = '{}' WHERE (.+) ORDER BY id LIMIT 10`).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	if err := ds.Compact(ctx, time.Now(), 10); err != nil {
+		t.Fatalf("error was not expected: %s", err)
+	}
+
+	mock.ExpectExec(`UPDATE event_store SET (.+)`).
+		WillReturnError(errors.New("failed to compact"))
+
+	if err := ds.Compact(ctx, time.Now(), 10); err == nil {
+		t.Fatal("error was expected")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func TestMySQL_RemoveSuccessfully(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -149,7 +222,7 @@ func TestMySQL_RemoveSuccessfully(t *testing.T) {
 	ds, mock := getDatastore(ctx, t)
 
 	mock.ExpectBegin()
-	mock.ExpectExec(`DELETE FROM (.+) WHERE ctid IN (.+)`).
+	mock.ExpectExec(`DELETE FROM event_store WHERE id IN \(SELECT id FROM \(SELECT id FROM event_store WHERE (.+) ORDER BY id LIMIT 10\) AS batch\)`).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectCommit()
 
@@ -170,7 +243,7 @@ func TestMySQL_RemoveWithSQLError(t *testing.T) {
 	ds, mock := getDatastore(ctx, t)
 
 	mock.ExpectBegin()
-	mock.ExpectExec(`DELETE FROM (.+) WHERE ctid IN (.+)`).
+	mock.ExpectExec(`DELETE FROM event_store WHERE id IN \(SELECT id FROM \(SELECT id FROM event_store WHERE (.+) ORDER BY id LIMIT 10\) AS batch\)`).
 		WillReturnError(errors.New("failed to remove messages"))
 	mock.ExpectRollback()
 
@@ -197,7 +270,7 @@ func TestMySQL_RemoveTxFails(t *testing.T) {
 	}
 
 	mock.ExpectBegin()
-	mock.ExpectExec(`DELETE FROM (.+) WHERE ctid IN (.+)`).
+	mock.ExpectExec(`DELETE FROM event_store WHERE id IN \(SELECT id FROM \(SELECT id FROM event_store WHERE (.+) ORDER BY id LIMIT 10\) AS batch\)`).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectCommit().WillReturnError(errors.New("failed to commit messages"))
 
@@ -216,8 +289,13 @@ func TestMySQL_AddSuccessfully(t *testing.T) {
 
 	ds, mock := getDatastore(ctx, t)
 
+	mock.ExpectBegin()
 	mock.ExpectExec(`INSERT INTO event_store (.+) VALUES (.+)`).
-		WillReturnResult(sqlmock.NewResult(0, 1))
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`SELECT id, created_at FROM (.+) WHERE id >= \? (.+) ORDER BY id LIMIT 1`).
+		WithArgs(1, 1, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Now()))
+	mock.ExpectCommit()
 
 	if err := ds.Add(ctx, &outboxer.OutboxMessage{
 		Payload: []byte("test payload"),
@@ -235,8 +313,10 @@ func TestMySQL_AddFails(t *testing.T) {
 	defer cancel()
 
 	ds, mock := getDatastore(ctx, t)
+	mock.ExpectBegin()
 	mock.ExpectExec(`INSERT INTO event_store (.+) VALUES (.+)`).
 		WillReturnError(errors.New("failed to remove messages"))
+	mock.ExpectRollback()
 
 	if err := ds.Add(ctx, &outboxer.OutboxMessage{
 		Payload: []byte("test payload"),
@@ -249,6 +329,37 @@ func TestMySQL_AddFails(t *testing.T) {
 	}
 }
 
+func TestMySQL_AddAll(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, mock := getDatastore(ctx, t)
+
+	createdAt := time.Date(2023, time.January, 1, 10, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO event_store (payload, options, headers, created_at) VALUES (?, ?, ?, ?), (?, ?, ?, ?)`)).
+		WithArgs([]byte("first"), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), []byte("second"), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(7, 2))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, created_at FROM event_store WHERE id >= ? AND id <= ? + 1 * @@auto_increment_increment AND MOD(id - ?, @@auto_increment_increment) = 0 ORDER BY id LIMIT 2`)).
+		WithArgs(7, 7, 7).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, createdAt).AddRow(8, createdAt))
+	mock.ExpectCommit()
+
+	msgs := []*outboxer.OutboxMessage{{Payload: []byte("first")}, {Payload: []byte("second")}}
+	if err := ds.AddAll(ctx, msgs...); err != nil {
+		t.Fatalf("failed to add messages in the data store: %s", err)
+	}
+
+	if msgs[0].ID != 7 || msgs[1].ID != 8 || !msgs[1].CreatedAt.Equal(createdAt) {
+		t.Fatalf("expected the generated ids and creation time to be set, got %+v and %+v", msgs[0], msgs[1])
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func TestMySQL_WithInstanceNoDB(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -289,6 +400,125 @@ func TestMySQL_WithInstanceWithEmptyDBName(t *testing.T) {
 	}
 }
 
+func TestMySQL_WithInstanceOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT GET_LOCK(.+)`).
+		WillReturnRows(sqlmock.NewRows([]string{"GET_LOCK"}).AddRow(true))
+	mock.ExpectExec(regexp.QuoteMeta("CREATE TABLE IF NOT EXISTS `app`.`outbox_migrations`")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT version FROM `app`.`outbox_migrations`")).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(1).AddRow(2))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("ALTER TABLE `app`.`outbox`")).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `app`.`outbox_migrations`")).
+		WithArgs(3, "track failed sends").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(`SELECT RELEASE_LOCK(.+)`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta("INSERT INTO `app`.`outbox` (payload, options, headers, created_at)")).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(regexp.QuoteMeta("SELECT id, created_at FROM `app`.`outbox` WHERE id >= ?")).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Now()))
+	mock.ExpectCommit()
+
+	ds, err := WithInstance(ctx, db, WithEventStoreTable("outbox"), WithSchema("app"), WithQuotedIdentifiers())
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	if err := ds.Add(ctx, &outboxer.OutboxMessage{Payload: []byte("test payload")}); err != nil {
+		t.Fatalf("failed to add message in the data store: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMySQL_WithInstanceWithoutDDL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT DATABASE()`).
+		WillReturnRows(sqlmock.NewRows([]string{"DATABASE()"}).AddRow("test"))
+	mock.ExpectQuery(`SELECT id, dispatched, dispatched_at, payload, options, headers, created_at FROM event_store WHERE 1 = 0`).
+		WillReturnError(errors.New("table 'test.event_store' doesn't exist"))
+
+	if _, err := WithInstance(ctx, db, WithoutDDL()); !errors.Is(err, ErrInvalidSchema) {
+		t.Fatalf("expected an invalid schema error, got %v", err)
+	}
+}
+
+func TestMySQL_DDL(t *testing.T) {
+	ddl := DDL(WithEventStoreTable("outbox"), WithQuotedIdentifiers())
+
+	if !strings.HasPrefix(ddl, "CREATE TABLE IF NOT EXISTS `outbox` (") {
+		t.Fatalf("unexpected DDL:\n%s", ddl)
+	}
+}
+
+func TestMySQL_AddInTx(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, db)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`INSERT INTO event_store (.+) VALUES (.+)`).
+		WithArgs([]byte("first"), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnError(errors.New("duplicate key"))
+	mock.ExpectRollback()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %s", err)
+	}
+
+	if err := ds.AddInTx(ctx, tx, &outboxer.OutboxMessage{Payload: []byte("first")}); err == nil {
+		t.Fatal("expected the insert to fail")
+	}
+
+	// the transaction belongs to the caller, so it is still open
+	if err := tx.Rollback(); err != nil {
+		t.Fatalf("failed to rollback transaction: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func TestMySQL_AddWithinTx(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -299,7 +529,10 @@ func TestMySQL_AddWithinTx(t *testing.T) {
 	mock.ExpectExec(`SELECT (.+) from (.+) LIMIT (.+)`).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectExec(`INSERT INTO (.+) (.+) VALUES (.+)`).
-		WillReturnResult(sqlmock.NewResult(0, 1))
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`SELECT id, created_at FROM (.+) WHERE id >= \? (.+) ORDER BY id LIMIT 1`).
+		WithArgs(1, 1, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Now()))
 	mock.ExpectCommit()
 
 	fn := func(tx outboxer.ExecerContext) error {
@@ -318,13 +551,284 @@ func TestMySQL_AddWithinTx(t *testing.T) {
 	}
 }
 
+func TestMySQL_AddWithinTxOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, mock := getDatastore(ctx, t)
+
+	opts := &sql.TxOptions{Isolation: sql.LevelSerializable}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT count\(\*\) FROM orders`).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectExec(`INSERT INTO (.+) (.+) VALUES (.+)`).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery(`SELECT id, created_at FROM (.+) WHERE id >= \? (.+) ORDER BY id LIMIT 1`).
+		WithArgs(1, 1, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Now()))
+	mock.ExpectCommit()
+
+	if err := ds.AddWithinTxOptions(ctx, &outboxer.OutboxMessage{
+		Payload: []byte("test payload"),
+	}, opts, func(tx outboxer.Tx) error {
+		var count int
+		return tx.QueryRowContext(ctx, "SELECT count(*) FROM orders").Scan(&count)
+	}); err != nil {
+		t.Fatalf("failed to add message in the data store: %s", err)
+	}
+
+	fnErr := errors.New("business logic failed")
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	if err := ds.AddWithinTxOptions(ctx, &outboxer.OutboxMessage{
+		Payload: []byte("test payload"),
+	}, opts, func(outboxer.Tx) error {
+		return fnErr
+	}); !errors.Is(err, fnErr) {
+		t.Fatalf("expected the callback error, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMySQL_RemoveWithArchive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, mock := getDatastore(ctx, t)
+
+	aid, err := lock.Generate("test", "event_store")
+	if err != nil {
+		t.Fatalf("failed to generate the lock value: %s", err)
+	}
+
+	mock.ExpectQuery(`SELECT GET_LOCK(.+)`).
+		WithArgs(aid).
+		WillReturnRows(sqlmock.NewRows([]string{"GET_LOCK"}).AddRow(true))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS archive_migrations (.+)`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT version FROM archive_migrations`).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}))
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS archive (.+) ENGINE=InnoDB DEFAULT CHARSET=utf8;`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`INSERT INTO archive_migrations (.+) VALUES (.+)`).
+		WithArgs(1, "create archive table").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`ALTER TABLE archive ADD COLUMN created_at DATETIME`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO archive_migrations (.+) VALUES (.+)`).
+		WithArgs(2, "add created_at column").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`ALTER TABLE archive (.+) DROP PRIMARY KEY, ADD PRIMARY KEY \(id, archived_at\)`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO archive_migrations (.+) VALUES (.+)`).
+		WithArgs(3, "key the archive on id and archived_at").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(`SELECT RELEASE_LOCK(.+)`).
+		WithArgs(aid).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := ds.EnableArchive(ctx, "archive"); err != nil {
+		t.Fatalf("failed to enable the archive: %s", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT (.+) FROM event_store WHERE (.+) ORDER BY id LIMIT 10 FOR UPDATE`).
+		WillReturnRows(sqlmock.NewRows(eventStoreRows).
+			AddRow(1, true, time.Now(), []byte("a"), nil, nil, time.Now()).
+			AddRow(2, true, time.Now(), []byte("b"), nil, nil, time.Now()))
+	mock.ExpectExec(`INSERT INTO archive \(id, dispatched, dispatched_at, payload, options, headers, created_at\) SELECT (.+) FROM event_store WHERE id IN \(1, 2\)$`).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`DELETE FROM event_store WHERE id IN \(1, 2\)`).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	if err := ds.Remove(ctx, time.Now(), 10); err != nil {
+		t.Fatalf("error was not expected: %s", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT (.+) FROM event_store WHERE (.+) FOR UPDATE`).
+		WillReturnRows(sqlmock.NewRows(eventStoreRows).
+			AddRow(3, true, time.Now(), []byte("c"), nil, nil, time.Now()))
+	mock.ExpectExec(`INSERT INTO archive (.+)`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`DELETE FROM event_store WHERE id IN \(3\)`).
+		WillReturnError(errors.New("failed to remove messages"))
+	mock.ExpectRollback()
+
+	if err := ds.Remove(ctx, time.Now(), 10); err == nil {
+		t.Fatal("error was expected")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+type archiverFunc func(context.Context, []*outboxer.OutboxMessage) error
+
+func (f archiverFunc) Archive(ctx context.Context, msgs []*outboxer.OutboxMessage) error {
+	return f(ctx, msgs)
+}
+
+func TestMySQL_RemoveWithArchiver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, mock := getDatastore(ctx, t)
+
+	var archived []*outboxer.OutboxMessage
+
+	ds.Archiver = archiverFunc(func(_ context.Context, msgs []*outboxer.OutboxMessage) error {
+		archived = append(archived, msgs...)
+		return nil
+	})
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT (.+) FROM event_store WHERE (.+) FOR UPDATE`).
+		WillReturnRows(sqlmock.NewRows(eventStoreRows).
+			AddRow(1, true, time.Now(), []byte("a"), nil, nil, time.Now()))
+	mock.ExpectExec(`DELETE FROM event_store WHERE id IN \(1\)`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	if err := ds.Remove(ctx, time.Now(), 10); err != nil {
+		t.Fatalf("error was not expected: %s", err)
+	}
+
+	if len(archived) != 1 || string(archived[0].Payload) != "a" {
+		t.Fatalf("was expecting the message to be archived but got %v", archived)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMySQL_Replay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, mock := getDatastore(ctx, t)
+
+	before := time.Now()
+	filter := outboxer.ReplayFilter{
+		DispatchedBefore: before,
+		Destination:      outboxer.DynamicValues{"queue_name": "orders"},
+	}
+
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM event_store WHERE dispatched = true AND dispatched_at < \? AND JSON_CONTAINS\(options, \?\)`).
+		WithArgs(before, `{"queue_name":"orders"}`).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(4))
+
+	count, err := ds.CountDispatched(ctx, filter)
+	if err != nil {
+		t.Fatalf("error was not expected: %s", err)
+	}
+
+	if count != 4 {
+		t.Fatalf("was expecting 4 messages but got %d", count)
+	}
+
+	mock.ExpectQuery(`SELECT (.+) FROM event_store WHERE id > \? AND dispatched = true (.+) ORDER BY id LIMIT 10`).
+		WithArgs(0, before, `{"queue_name":"orders"}`).
+		WillReturnRows(sqlmock.NewRows(eventStoreRows).
+			AddRow(1, true, time.Now(), []byte("a"), nil, nil, time.Now()).
+			AddRow(2, true, time.Now(), []byte("b"), nil, nil, time.Now()))
+
+	msgs, err := ds.GetDispatched(ctx, filter, 0, 10)
+	if err != nil {
+		t.Fatalf("error was not expected: %s", err)
+	}
+
+	if len(msgs) != 2 {
+		t.Fatalf("was expecting 2 messages but got %d", len(msgs))
+	}
+
+	mock.ExpectExec(`UPDATE event_store SET (.+), options = JSON_MERGE_PATCH\(COALESCE\(options, JSON_OBJECT\(\)\), \?\) WHERE dispatched = true AND dispatched_at < \?`).
+		WithArgs(`{"queue_name":"orders.replay"}`, before, `{"queue_name":"orders"}`).
+		WillReturnResult(sqlmock.NewResult(0, 4))
+
+	replayed, err := ds.Replay(ctx, filter, outboxer.DynamicValues{"queue_name": "orders.replay"})
+	if err != nil {
+		t.Fatalf("error was not expected: %s", err)
+	}
+
+	if replayed != 4 {
+		t.Fatalf("was expecting 4 replayed messages but got %d", replayed)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestMySQL_Inspect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, mock := getDatastore(ctx, t)
+
+	mock.ExpectQuery(`SELECT (.+) FROM event_store`).
+		WillReturnRows(sqlmock.NewRows([]string{"pending", "dispatched", "failed", "dead", "oldest", "last"}).
+			AddRow(0, 2, 0, 0, nil, time.Now()))
+
+	stats, err := ds.Stats(ctx)
+	if err != nil {
+		t.Fatalf("error was not expected: %s", err)
+	}
+
+	if stats.Pending != 0 || stats.Dispatched != 2 || stats.OldestPendingID.Valid {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	mock.ExpectQuery(`SELECT (.+) FROM event_store WHERE id = \?`).
+		WithArgs(1).
+		WillReturnError(errors.New("connection lost"))
+
+	if _, err := ds.GetEvent(ctx, 1); err == nil || errors.Is(err, outboxer.ErrMessageNotFound) {
+		t.Fatalf("was expecting a database error but got %v", err)
+	}
+
+	mock.ExpectQuery(`SELECT (.+) FROM event_store WHERE id > \? AND dispatched = true ORDER BY id LIMIT 10`).
+		WithArgs(0).
+		WillReturnRows(sqlmock.NewRows(inspectRows).
+			AddRow(1, true, time.Now(), []byte("a"), nil, nil, time.Now(), 0, nil, false).
+			AddRow(2, true, time.Now(), []byte("b"), nil, nil, time.Now(), 1, "timeout", false))
+
+	msgs, err := ds.ListEvents(ctx, outboxer.ListFilter{State: outboxer.DispatchedState, Limit: 10})
+	if err != nil {
+		t.Fatalf("error was not expected: %s", err)
+	}
+
+	if len(msgs) != 2 {
+		t.Fatalf("was expecting 2 messages but got %d", len(msgs))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func getDatastore(ctx context.Context, t *testing.T) (*MySQL, sqlmock.Sqlmock) {
 	db, mock, err := sqlmock.New()
 	if err != nil {
 		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
 	}
 
-	defer db.Close()
+	t.Cleanup(func() { db.Close() })
 
 	initDatastoreMock(t, mock)
 
@@ -351,9 +855,51 @@ func initLockMock(t *testing.T, mock sqlmock.Sqlmock) {
 	mock.ExpectQuery(`SELECT GET_LOCK(.+)`).
 		WithArgs(aid).
 		WillReturnRows(sqlmock.NewRows([]string{"GET_LOCK"}).AddRow(true))
-	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS event_store (.+) ENGINE=InnoDB DEFAULT CHARSET=utf8;`).
-		WillReturnResult(sqlmock.NewResult(0, 1))
+	initMigrationsMock(mock)
 	mock.ExpectExec(`SELECT RELEASE_LOCK(.+)`).
 		WithArgs(aid).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 }
+
+func initMigrationsMock(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS event_store_migrations (.+) ENGINE=InnoDB DEFAULT CHARSET=utf8;`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT version FROM event_store_migrations`).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}))
+	mock.ExpectBegin()
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS event_store (.+) ENGINE=InnoDB DEFAULT CHARSET=utf8;`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO event_store_migrations (.+) VALUES (.+)`).
+		WithArgs(1, "create outbox table").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`ALTER TABLE event_store ADD COLUMN created_at`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO event_store_migrations (.+) VALUES (.+)`).
+		WithArgs(2, "add created_at column").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`ALTER TABLE event_store\s+ADD COLUMN attempts`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO event_store_migrations (.+) VALUES (.+)`).
+		WithArgs(3, "track failed sends").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func TestMySQL_IsRetryable(t *testing.T) {
+	p := &MySQL{}
+
+	for number, want := range map[uint16]bool{1213: true, 1205: true, 1062: false} {
+		err := fmt.Errorf("transaction commit failed: %w", &mysql.MySQLError{Number: number})
+		if got := p.IsRetryable(err); got != want {
+			t.Errorf("expected IsRetryable to be %t for %d, got %t", want, number, got)
+		}
+	}
+
+	if p.IsRetryable(errors.New("connection refused")) {
+		t.Error("expected a generic error not to be retryable")
+	}
+}
@@ -0,0 +1,45 @@
+package pgx
+
+import "github.com/italolelis/outboxer"
+
+// Option represents the pgx data store options.
+type Option func(*Pgx)
+
+// WithEventStoreTable sets the name of the outbox table.
+func WithEventStoreTable(name string) Option {
+	return func(p *Pgx) {
+		p.EventStoreTable = name
+	}
+}
+
+// WithSchema sets the schema of the outbox table. Table names are qualified with it,
+// otherwise they are resolved through the search path.
+func WithSchema(name string) Option {
+	return func(p *Pgx) {
+		p.SchemaName = name
+		p.qualifyTables = true
+	}
+}
+
+// WithoutDDL never creates or changes tables. The data store only validates that the outbox table
+// exists and has the expected columns, for setups where the schema is managed outside the application, see DDL.
+func WithoutDDL() Option {
+	return func(p *Pgx) {
+		p.skipDDL = true
+	}
+}
+
+// WithNotifyChannel notifies the given channel whenever messages are added, so a dispatcher
+// listening on it, see Notify, picks them up right away instead of waiting for its next check.
+func WithNotifyChannel(name string) Option {
+	return func(p *Pgx) {
+		p.NotifyChannel = name
+	}
+}
+
+// WithClock sets the clock of the created_at and dispatched_at timestamps, the system clock by default.
+func WithClock(c outboxer.Clock) Option {
+	return func(p *Pgx) {
+		p.clock = c
+	}
+}
@@ -0,0 +1,978 @@
+// Package pgx is the implementation of the postgres data store on top of a native pgx connection pool.
+// It shares the table layout and the migrations with the postgres data store.
+package pgx
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/lock"
+	"github.com/italolelis/outboxer/migrate"
+	"github.com/italolelis/outboxer/storage/postgres"
+	"github.com/italolelis/outboxer/storage/sqlstore"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// DefaultEventStoreTable is the default table name.
+	DefaultEventStoreTable = sqlstore.DefaultEventStoreTable
+
+	// maxInsertRows keeps a multi-row insert under the limit of 65535 parameters.
+	maxInsertRows = 1000
+
+	// maxPrealloc caps the room made up front for the messages of a query, the batch size comes from the caller.
+	maxPrealloc = 1000
+
+	// inspectColumns are the columns of the outbox table along with the failure tracking ones.
+	inspectColumns = "id, dispatched, dispatched_at, payload, options, headers, created_at, attempts, last_error, dead"
+)
+
+var (
+	// ErrNoDatabaseName is used when the database name is blank.
+	ErrNoDatabaseName = errors.New("no database name")
+
+	// ErrNoSchema is used when the schema name is blank.
+	ErrNoSchema = errors.New("no schema")
+
+	// ErrInvalidSchema is used when DDL is disabled and the outbox table doesn't have the expected columns.
+	ErrInvalidSchema = sqlstore.ErrInvalidSchema
+
+	// ErrInsertedMismatch is used when the database doesn't return one row for each inserted message.
+	ErrInsertedMismatch = sqlstore.ErrInsertedMismatch
+
+	// ErrNoListener is used when a notify channel is set but the pool can't hand out connections to listen on.
+	ErrNoListener = errors.New("the pool is not a listener")
+)
+
+// Pool is the part of *pgxpool.Pool used by the data store, so it can be replaced by a mock in tests.
+type Pool interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+	BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error)
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// Conn is a connection that listens on the notify channel. It is released once listening stops.
+type Conn interface {
+	Exec(ctx context.Context, sql string, args ...interface{}) (pgconn.CommandTag, error)
+	WaitForNotification(ctx context.Context) (*pgconn.Notification, error)
+	Release()
+}
+
+// Listener is implemented by pools that hand out connections to listen on. A *pgxpool.Pool is used
+// as it is, other pools have to implement it for notifications to work.
+type Listener interface {
+	AcquireConn(ctx context.Context) (Conn, error)
+}
+
+// Pgx is the implementation of the data store.
+type Pgx struct {
+	pool            Pool
+	DatabaseName    string
+	SchemaName      string
+	EventStoreTable string
+	// NotifyChannel is notified when messages are added. Notifications are disabled when it is empty.
+	NotifyChannel string
+	qualifyTables bool
+	skipDDL       bool
+	clock         outboxer.Clock
+}
+
+// WithInstance creates a pgx data store with an existing connection pool, such as a *pgxpool.Pool.
+// The pool belongs to the caller and is never closed by the data store.
+func WithInstance(ctx context.Context, pool Pool, opts ...Option) (*Pgx, error) {
+	p := Pgx{pool: pool, clock: outboxer.SystemClock()}
+
+	for _, opt := range opts {
+		opt(&p)
+	}
+
+	if err := pool.QueryRow(ctx, `SELECT CURRENT_DATABASE()`).Scan(&p.DatabaseName); err != nil {
+		return nil, err
+	}
+
+	if p.DatabaseName == "" {
+		return nil, ErrNoDatabaseName
+	}
+
+	if p.SchemaName == "" {
+		if err := pool.QueryRow(ctx, `SELECT CURRENT_SCHEMA()`).Scan(&p.SchemaName); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.SchemaName == "" {
+		return nil, ErrNoSchema
+	}
+
+	if p.EventStoreTable == "" {
+		p.EventStoreTable = DefaultEventStoreTable
+	}
+
+	var err error
+	if p.skipDDL {
+		err = p.validateTable(ctx)
+	} else {
+		err = p.ensureTable(ctx)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// DDL returns the statements that create the outbox table, for schemas that are managed outside
+// the application. It takes the same options as WithInstance, the table is the postgres data store one.
+func DDL(opts ...Option) string {
+	p := Pgx{EventStoreTable: DefaultEventStoreTable}
+
+	for _, opt := range opts {
+		opt(&p)
+	}
+
+	return p.schema().DDL()
+}
+
+// Migrate applies the pending schema migrations of the outbox table.
+func (p *Pgx) Migrate(ctx context.Context) error {
+	return p.ensureTable(ctx)
+}
+
+// IsRetryable reports if the error is a serialization failure (40001) or a deadlock (40P01).
+func (p *Pgx) IsRetryable(err error) bool {
+	return postgres.Dialect().IsRetryable(err)
+}
+
+// GetEvents retrieves the pending events, oldest first.
+func (p *Pgx) GetEvents(ctx context.Context, batchSize int32) ([]*outboxer.OutboxMessage, error) {
+	events := newEvents(batchSize)
+
+	// nolint
+	query := fmt.Sprintf(`
+SELECT id, dispatched, dispatched_at, payload, options, headers, created_at
+FROM %s
+WHERE dispatched = false AND dead = false
+ORDER BY id
+LIMIT %d
+`, p.table(), batchSize)
+
+	rows, err := p.pool.Query(ctx, query)
+	if err != nil {
+		return events, fmt.Errorf("failed to get messages from the store: %w", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanMessage(rows)
+		if err != nil {
+			return events, err
+		}
+
+		events = append(events, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return events, fmt.Errorf("failed to get messages from the store: %w", err)
+	}
+
+	return events, nil
+}
+
+// Add adds the message to the data store.
+func (p *Pgx) Add(ctx context.Context, evt *outboxer.OutboxMessage) error {
+	return p.AddWithinPgxTx(ctx, pgx.TxOptions{}, nil, evt)
+}
+
+// AddWithinTx creates a transaction and then tries to execute anything within it.
+// The transaction is rolled back when fn fails.
+func (p *Pgx) AddWithinTx(ctx context.Context, evt *outboxer.OutboxMessage, fn func(outboxer.ExecerContext) error) error {
+	return p.AddWithinPgxTx(ctx, pgx.TxOptions{}, func(tx pgx.Tx) error {
+		return fn(execer{tx: tx})
+	}, evt)
+}
+
+// AddWithinPgxTx creates a transaction with the given options, executes fn within it, when not nil,
+// and then adds the messages. The transaction is rolled back when fn fails.
+func (p *Pgx) AddWithinPgxTx(
+	ctx context.Context,
+	opts pgx.TxOptions,
+	fn func(pgx.Tx) error,
+	msgs ...*outboxer.OutboxMessage,
+) error {
+	tx, err := p.pool.BeginTx(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("transaction start failed: %w", err)
+	}
+
+	if fn != nil {
+		if err := fn(tx); err != nil {
+			if rbErr := tx.Rollback(ctx); rbErr != nil {
+				return errors.Join(err, fmt.Errorf("transaction rollback failed: %w", rbErr))
+			}
+
+			return err
+		}
+	}
+
+	if err := p.AddInTx(ctx, tx, msgs...); err != nil {
+		if rbErr := tx.Rollback(ctx); rbErr != nil {
+			return errors.Join(err, fmt.Errorf("transaction rollback failed: %w", rbErr))
+		}
+
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("transaction commit failed: %w", err)
+	}
+
+	return nil
+}
+
+// AddInTx adds the messages within the given transaction, setting their ID and CreatedAt.
+// Committing or rolling it back is left to the caller.
+func (p *Pgx) AddInTx(ctx context.Context, tx pgx.Tx, msgs ...*outboxer.OutboxMessage) error {
+	for len(msgs) > 0 {
+		n := len(msgs)
+		if n > maxInsertRows {
+			n = maxInsertRows
+		}
+
+		if err := p.insert(ctx, tx, msgs[:n]); err != nil {
+			return err
+		}
+
+		msgs = msgs[n:]
+	}
+
+	return p.notify(ctx, tx)
+}
+
+// Copy adds the messages with COPY within a single transaction, which is faster than inserts for large batches.
+// The ID of the messages is not set.
+func (p *Pgx) Copy(ctx context.Context, msgs ...*outboxer.OutboxMessage) (int64, error) {
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("transaction start failed: %w", err)
+	}
+
+	now := p.clock.Now()
+	rows := make([][]interface{}, 0, len(msgs))
+
+	for _, evt := range msgs {
+		if evt.CreatedAt.IsZero() {
+			evt.CreatedAt = now
+		}
+
+		rows = append(rows, []interface{}{evt.Payload, jsonb(evt.Options), jsonb(evt.Headers), evt.CreatedAt})
+	}
+
+	n, err := tx.CopyFrom(ctx, p.identifier(p.EventStoreTable),
+		[]string{"payload", "options", "headers", "created_at"}, pgx.CopyFromRows(rows))
+	if err == nil {
+		err = p.notify(ctx, tx)
+	}
+
+	if err != nil {
+		err = fmt.Errorf("failed to copy messages into the data store: %w", err)
+
+		if rbErr := tx.Rollback(ctx); rbErr != nil {
+			return 0, errors.Join(err, fmt.Errorf("transaction rollback failed: %w", rbErr))
+		}
+
+		return 0, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return 0, fmt.Errorf("transaction commit failed: %w", err)
+	}
+
+	return n, nil
+}
+
+func (p *Pgx) insert(ctx context.Context, tx pgx.Tx, msgs []*outboxer.OutboxMessage) error {
+	values := make([]string, 0, len(msgs))
+	args := make([]interface{}, 0, len(msgs)*4)
+	now := p.clock.Now()
+
+	for _, evt := range msgs {
+		createdAt := evt.CreatedAt
+		if createdAt.IsZero() {
+			createdAt = now
+		}
+
+		values = append(values, fmt.Sprintf("($%d, $%d, $%d, $%d)", len(args)+1, len(args)+2, len(args)+3, len(args)+4))
+		args = append(args, evt.Payload, jsonb(evt.Options), jsonb(evt.Headers), createdAt)
+	}
+
+	// nolint
+	query := fmt.Sprintf(
+		`INSERT INTO %s (payload, options, headers, created_at) VALUES %s RETURNING id, created_at`,
+		p.table(), strings.Join(values, ", "),
+	)
+
+	rows, err := tx.Query(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to insert message into the data store: %w", err)
+	}
+
+	defer rows.Close()
+
+	// RETURNING doesn't follow the order of VALUES, the ids are handed out in order though
+	inserted := make([]outboxer.OutboxMessage, 0, len(msgs))
+
+	for rows.Next() {
+		var e outboxer.OutboxMessage
+		if err := rows.Scan(&e.ID, &e.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan inserted message: %w", err)
+		}
+
+		inserted = append(inserted, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to insert message into the data store: %w", err)
+	}
+
+	if len(inserted) != len(msgs) {
+		return fmt.Errorf("%w: got %d rows for %d messages", ErrInsertedMismatch, len(inserted), len(msgs))
+	}
+
+	sort.Slice(inserted, func(i, j int) bool { return inserted[i].ID < inserted[j].ID })
+
+	for i, e := range inserted {
+		msgs[i].ID = e.ID
+		msgs[i].CreatedAt = e.CreatedAt
+	}
+
+	return nil
+}
+
+// notify signals the notify channel, the notification is only delivered when the transaction commits.
+func (p *Pgx) notify(ctx context.Context, tx pgx.Tx) error {
+	if p.NotifyChannel == "" {
+		return nil
+	}
+
+	if _, err := tx.Exec(ctx, `SELECT pg_notify($1, '')`, p.NotifyChannel); err != nil {
+		return fmt.Errorf("failed to notify channel: %w", err)
+	}
+
+	return nil
+}
+
+// Notify listens on the notify channel with a connection acquired from the pool, until the context is done.
+// It returns a nil channel when no notify channel is set.
+func (p *Pgx) Notify(ctx context.Context) (<-chan struct{}, error) {
+	if p.NotifyChannel == "" {
+		return nil, nil
+	}
+
+	conn, err := p.acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get a connection: %w", err)
+	}
+
+	if _, err := conn.Exec(ctx, "LISTEN "+pgx.Identifier{p.NotifyChannel}.Sanitize()); err != nil {
+		conn.Release()
+		return nil, fmt.Errorf("failed to listen on channel: %w", err)
+	}
+
+	c := make(chan struct{}, 1)
+
+	go func() {
+		defer close(c)
+		defer conn.Release()
+
+		for {
+			if _, err := conn.WaitForNotification(ctx); err != nil {
+				// the connection goes back to the pool, so it must stop listening
+				_, _ = conn.Exec(context.Background(), "UNLISTEN *")
+				return
+			}
+
+			select {
+			case c <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return c, nil
+}
+
+// acquire gets a connection to listen on from the pool.
+func (p *Pgx) acquire(ctx context.Context) (Conn, error) {
+	switch pool := p.pool.(type) {
+	case Listener:
+		return pool.AcquireConn(ctx)
+	case *pgxpool.Pool:
+		conn, err := pool.Acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		return poolConn{Conn: conn}, nil
+	default:
+		return nil, ErrNoListener
+	}
+}
+
+// SetAsDispatched sets one message as dispatched.
+func (p *Pgx) SetAsDispatched(ctx context.Context, id int64) error {
+	query := fmt.Sprintf(`
+update %s
+set
+    dispatched = true,
+    dispatched_at = $1
+where id = $2;
+`, p.table())
+	if _, err := p.pool.Exec(ctx, query, p.clock.Now(), id); err != nil {
+		return fmt.Errorf("failed to set message as dispatched: %w", err)
+	}
+
+	return nil
+}
+
+// Remove removes old messages from the data store.
+func (p *Pgx) Remove(ctx context.Context, dispatchedBefore time.Time, batchSize int32) error {
+	q := `
+DELETE FROM %[1]s
+WHERE ctid IN
+(
+    select ctid
+    from %[1]s
+    where
+        "dispatched" = true and
+        "dispatched_at" < $1
+    limit %d
+)
+`
+
+	query := fmt.Sprintf(q, p.table(), batchSize)
+	if _, err := p.pool.Exec(ctx, query, dispatchedBefore); err != nil {
+		return fmt.Errorf("failed to remove messages from the data store: %w", err)
+	}
+
+	return nil
+}
+
+// SetAsFailed records a failed send of the message. Once it failed maxAttempts times, it is set as dead
+// and GetEvents skips it. A maxAttempts of zero never sets it as dead.
+func (p *Pgx) SetAsFailed(ctx context.Context, id int64, reason string, maxAttempts int32) error {
+	query := fmt.Sprintf(`
+UPDATE %s
+SET
+    dead = dead OR ($3 > 0 AND attempts + 1 >= $3),
+    attempts = attempts + 1,
+    last_error = $2
+WHERE id = $1;
+`, p.table())
+	if _, err := p.pool.Exec(ctx, query, id, reason, maxAttempts); err != nil {
+		return fmt.Errorf("failed to set message as failed: %w", err)
+	}
+
+	return nil
+}
+
+// Requeue sets the dead messages with the given ids back to pending, clearing their attempts,
+// and returns how many were requeued.
+func (p *Pgx) Requeue(ctx context.Context, ids ...int64) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	query := fmt.Sprintf(`
+UPDATE %s
+SET
+    dead = false,
+    attempts = 0,
+    last_error = NULL
+WHERE dead = true AND id = ANY($1);
+`, p.table())
+
+	tag, err := p.pool.Exec(ctx, query, ids)
+	if err != nil {
+		return 0, fmt.Errorf("failed to requeue messages: %w", err)
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// Stats returns the counters of the messages in the data store.
+func (p *Pgx) Stats(ctx context.Context) (*outboxer.Stats, error) {
+	var (
+		stats          outboxer.Stats
+		oldestPending  *int64
+		lastDispatched *time.Time
+	)
+
+	// nolint
+	query := fmt.Sprintf(`
+SELECT
+    COALESCE(SUM(CASE WHEN dispatched = false AND dead = false THEN 1 ELSE 0 END), 0),
+    COALESCE(SUM(CASE WHEN dispatched = true THEN 1 ELSE 0 END), 0),
+    COALESCE(SUM(CASE WHEN dispatched = false AND dead = false AND attempts > 0 THEN 1 ELSE 0 END), 0),
+    COALESCE(SUM(CASE WHEN dead = true THEN 1 ELSE 0 END), 0),
+    MIN(CASE WHEN dispatched = false AND dead = false THEN id END),
+    MAX(dispatched_at)
+FROM %s
+`, p.table())
+	if err := p.pool.QueryRow(ctx, query).Scan(
+		&stats.Pending,
+		&stats.Dispatched,
+		&stats.Failed,
+		&stats.Dead,
+		&oldestPending,
+		&lastDispatched,
+	); err != nil {
+		return nil, fmt.Errorf("failed to get the data store stats: %w", err)
+	}
+
+	if oldestPending != nil {
+		stats.OldestPendingID = sql.NullInt64{Int64: *oldestPending, Valid: true}
+	}
+
+	if lastDispatched != nil {
+		stats.LastDispatchedAt = sql.NullTime{Time: *lastDispatched, Valid: true}
+	}
+
+	return &stats, nil
+}
+
+// GetEvent retrieves a single message.
+func (p *Pgx) GetEvent(ctx context.Context, id int64) (*outboxer.OutboxMessage, error) {
+	// nolint
+	query := fmt.Sprintf(`SELECT %s FROM %s WHERE id = $1`, inspectColumns, p.table())
+
+	e, err := scanInspected(p.pool.QueryRow(ctx, query, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, outboxer.ErrMessageNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get message from the store: %w", err)
+	}
+
+	return e, nil
+}
+
+// ListEvents retrieves the messages that match the filter.
+func (p *Pgx) ListEvents(ctx context.Context, f outboxer.ListFilter) ([]*outboxer.OutboxMessage, error) {
+	events := newEvents(f.Limit)
+
+	var state string
+
+	switch f.State {
+	case outboxer.PendingState:
+		state = " AND dispatched = false AND dead = false"
+	case outboxer.DispatchedState:
+		state = " AND dispatched = true"
+	case outboxer.FailedState:
+		state = " AND dispatched = false AND dead = false AND attempts > 0"
+	case outboxer.DeadState:
+		state = " AND dead = true"
+	}
+
+	// nolint
+	query := fmt.Sprintf(`
+SELECT %s
+FROM %s
+WHERE id > $1%s
+ORDER BY id
+LIMIT %d
+`, inspectColumns, p.table(), state, f.Limit)
+
+	rows, err := p.pool.Query(ctx, query, f.AfterID)
+	if err != nil {
+		return events, fmt.Errorf("failed to list messages from the store: %w", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanInspected(rows)
+		if err != nil {
+			return events, fmt.Errorf("failed to scan message: %w", err)
+		}
+
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// CountDispatched counts the dispatched messages that match the filter.
+func (p *Pgx) CountDispatched(ctx context.Context, f outboxer.ReplayFilter) (int64, error) {
+	args := sqlstore.NewArgs(postgres.Dialect())
+
+	where, err := dispatchedFilter(f, args)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+
+	// nolint
+	query := fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE %s`, p.table(), where)
+	if err := p.pool.QueryRow(ctx, query, args.Values()...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count dispatched messages: %w", err)
+	}
+
+	return count, nil
+}
+
+// GetDispatched retrieves the dispatched messages that match the filter and come after the given id.
+func (p *Pgx) GetDispatched(
+	ctx context.Context,
+	f outboxer.ReplayFilter,
+	afterID int64,
+	batchSize int32,
+) ([]*outboxer.OutboxMessage, error) {
+	events := newEvents(batchSize)
+
+	args := sqlstore.NewArgs(postgres.Dialect())
+	after := args.Add(afterID)
+
+	where, err := dispatchedFilter(f, args)
+	if err != nil {
+		return events, err
+	}
+
+	// nolint
+	query := fmt.Sprintf(`
+SELECT id, dispatched, dispatched_at, payload, options, headers, created_at
+FROM %s
+WHERE id > %s AND %s
+ORDER BY id
+LIMIT %d
+`, p.table(), after, where, batchSize)
+
+	rows, err := p.pool.Query(ctx, query, args.Values()...)
+	if err != nil {
+		return events, fmt.Errorf("failed to get dispatched messages from the store: %w", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		e, err := scanMessage(rows)
+		if err != nil {
+			return events, err
+		}
+
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// Replay sets the dispatched messages that match the filter back to pending.
+// When override is not empty, it is merged into the options of each message.
+func (p *Pgx) Replay(ctx context.Context, f outboxer.ReplayFilter, override outboxer.DynamicValues) (int64, error) {
+	d := postgres.Dialect()
+	args := sqlstore.NewArgs(d)
+
+	var options string
+
+	if len(override) > 0 {
+		merge, err := d.MergeOptions(args, override)
+		if err != nil {
+			return 0, err
+		}
+
+		options = `,
+    options = ` + merge
+	}
+
+	where, err := dispatchedFilter(f, args)
+	if err != nil {
+		return 0, err
+	}
+
+	// nolint
+	query := fmt.Sprintf(`
+UPDATE %s
+SET
+    dispatched = false,
+    dispatched_at = NULL%s
+WHERE %s
+`, p.table(), options, where)
+
+	tag, err := p.pool.Exec(ctx, query, args.Values()...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to replay messages: %w", err)
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// ensureTable applies the pending migrations in a single transaction that holds the advisory lock,
+// the same lock the postgres data store takes, so both can share a table.
+func (p *Pgx) ensureTable(ctx context.Context) error {
+	key, err := lock.Generate(p.DatabaseName, p.SchemaName)
+	if err != nil {
+		return err
+	}
+
+	aid, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid advisory lock %q: %w", key, err)
+	}
+
+	tx, err := p.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("transaction start failed: %w", err)
+	}
+
+	if err := p.migrate(ctx, tx, aid); err != nil {
+		if rbErr := tx.Rollback(ctx); rbErr != nil {
+			return errors.Join(err, fmt.Errorf("transaction rollback failed: %w", rbErr))
+		}
+
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("transaction commit failed: %w", err)
+	}
+
+	return nil
+}
+
+func (p *Pgx) migrate(ctx context.Context, tx pgx.Tx, aid int64) error {
+	s := p.schema()
+	d := postgres.Dialect()
+	migrations := d.Migrations(s)
+	stmts := d.MigrationsDialect(s, p.EventStoreTable)
+
+	if err := migrate.Validate(migrations); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, aid); err != nil {
+		return fmt.Errorf("try lock failed: %w", err)
+	}
+
+	if _, err := tx.Exec(ctx, stmts.CreateTable); err != nil {
+		return fmt.Errorf("failed to create the migrations table: %w", err)
+	}
+
+	rows, err := tx.Query(ctx, stmts.SelectVersions)
+	if err != nil {
+		return fmt.Errorf("failed to get the applied migrations: %w", err)
+	}
+
+	applied, err := pgx.CollectRows(rows, pgx.RowTo[int64])
+	if err != nil {
+		return fmt.Errorf("failed to get the applied migrations: %w", err)
+	}
+
+	for _, m := range migrate.Unapplied(migrations, applied) {
+		if _, err := tx.Exec(ctx, m.Up); err != nil {
+			return fmt.Errorf("failed to apply migration %d (%s): %w", m.Version, m.Description, err)
+		}
+
+		if _, err := tx.Exec(ctx, stmts.InsertVersion, m.Version, m.Description); err != nil {
+			return fmt.Errorf("failed to record migration %d: %w", m.Version, err)
+		}
+	}
+
+	return nil
+}
+
+// validateTable checks that the outbox table has the expected columns, without changing it.
+func (p *Pgx) validateTable(ctx context.Context) error {
+	// nolint
+	rows, err := p.pool.Query(ctx, fmt.Sprintf(`SELECT %s FROM %s WHERE 1 = 0`, inspectColumns, p.table()))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSchema, err)
+	}
+
+	rows.Close()
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSchema, err)
+	}
+
+	return nil
+}
+
+// schema describes the outbox table to the postgres dialect, which the migrations come from.
+// Its names are always quoted, like the ones of the queries.
+func (p *Pgx) schema() *sqlstore.Store {
+	s := sqlstore.New(nil, postgres.Dialect())
+	s.DatabaseName = p.DatabaseName
+	s.SchemaName = p.SchemaName
+	s.EventStoreTable = p.EventStoreTable
+	s.QualifyTables = p.qualifyTables
+	s.QuoteIdentifiers = true
+
+	return s
+}
+
+// table returns the quoted name of the outbox table, ready to be used in a query.
+func (p *Pgx) table() string {
+	return p.identifier(p.EventStoreTable).Sanitize()
+}
+
+// identifier qualifies a table name with the schema, when it was set with WithSchema.
+func (p *Pgx) identifier(name string) pgx.Identifier {
+	if p.qualifyTables {
+		return pgx.Identifier{p.SchemaName, name}
+	}
+
+	return pgx.Identifier{name}
+}
+
+// scanMessage scans a message row. Options and headers are decoded from the binary jsonb format.
+func scanMessage(row pgx.Row) (*outboxer.OutboxMessage, error) {
+	var (
+		m                outboxer.OutboxMessage
+		dispatchedAt     *time.Time
+		options, headers map[string]interface{}
+	)
+
+	if err := row.Scan(&m.ID, &m.Dispatched, &dispatchedAt, &m.Payload, &options, &headers, &m.CreatedAt); err != nil {
+		return nil, fmt.Errorf("failed to scan message: %w", err)
+	}
+
+	m.Options = options
+	m.Headers = headers
+
+	if dispatchedAt != nil {
+		m.DispatchedAt = sql.NullTime{Time: *dispatchedAt, Valid: true}
+	}
+
+	return &m, nil
+}
+
+// scanInspected scans a message along with its failure tracking columns.
+func scanInspected(row pgx.Row) (*outboxer.OutboxMessage, error) {
+	var (
+		m                outboxer.OutboxMessage
+		dispatchedAt     *time.Time
+		options, headers map[string]interface{}
+		lastError        *string
+	)
+
+	err := row.Scan(&m.ID, &m.Dispatched, &dispatchedAt, &m.Payload, &options, &headers, &m.CreatedAt,
+		&m.Attempts, &lastError, &m.Dead)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Options = options
+	m.Headers = headers
+
+	if dispatchedAt != nil {
+		m.DispatchedAt = sql.NullTime{Time: *dispatchedAt, Valid: true}
+	}
+
+	if lastError != nil {
+		m.LastError = *lastError
+	}
+
+	return &m, nil
+}
+
+// dispatchedFilter builds the where clause that matches the dispatched messages selected by the filter,
+// adding its arguments to args. The destination is matched the way the postgres data store does.
+func dispatchedFilter(f outboxer.ReplayFilter, args *sqlstore.Args) (string, error) {
+	conds := []string{"dispatched = true"}
+
+	if f.FromID > 0 {
+		conds = append(conds, "id >= "+args.Add(f.FromID))
+	}
+
+	if f.ToID > 0 {
+		conds = append(conds, "id <= "+args.Add(f.ToID))
+	}
+
+	if !f.DispatchedAfter.IsZero() {
+		conds = append(conds, "dispatched_at >= "+args.Add(f.DispatchedAfter))
+	}
+
+	if !f.DispatchedBefore.IsZero() {
+		conds = append(conds, "dispatched_at < "+args.Add(f.DispatchedBefore))
+	}
+
+	if len(f.Destination) > 0 {
+		cond, err := postgres.Dialect().OptionsContain(args, f.Destination)
+		if err != nil {
+			return "", err
+		}
+
+		conds = append(conds, cond)
+	}
+
+	return strings.Join(conds, " AND "), nil
+}
+
+// jsonb returns the value that pgx encodes as binary jsonb, nil for empty values.
+func jsonb(v outboxer.DynamicValues) interface{} {
+	if len(v) == 0 {
+		return nil
+	}
+
+	return map[string]interface{}(v)
+}
+
+// poolConn adapts a connection of a *pgxpool.Pool to Conn.
+type poolConn struct {
+	*pgxpool.Conn
+}
+
+func (c poolConn) WaitForNotification(ctx context.Context) (*pgconn.Notification, error) {
+	return c.Conn.Conn().WaitForNotification(ctx)
+}
+
+// execer adapts a pgx transaction to outboxer.ExecerContext.
+type execer struct {
+	tx pgx.Tx
+}
+
+func (e execer) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	tag, err := e.tx.Exec(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return result(tag), nil
+}
+
+type result pgconn.CommandTag
+
+func (r result) LastInsertId() (int64, error) {
+	return 0, errors.New("LastInsertId is not supported by postgres, use RETURNING instead")
+}
+
+func (r result) RowsAffected() (int64, error) {
+	return pgconn.CommandTag(r).RowsAffected(), nil
+}
+
+// newEvents returns an empty slice with room for up to n messages, n is capped by maxPrealloc.
+func newEvents(n int32) []*outboxer.OutboxMessage {
+	if n < 0 {
+		n = 0
+	}
+
+	if n > maxPrealloc {
+		n = maxPrealloc
+	}
+
+	return make([]*outboxer.OutboxMessage, 0, n)
+}
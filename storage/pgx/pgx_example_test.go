@@ -0,0 +1,28 @@
+package pgx_test
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/italolelis/outboxer/storage/pgx"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func ExamplePgx() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pool, err := pgxpool.New(ctx, os.Getenv("DS_DSN"))
+	if err != nil {
+		fmt.Printf("failed to connect to postgres: %s", err)
+		return
+	}
+
+	defer pool.Close()
+
+	if _, err := pgx.WithInstance(ctx, pool, pgx.WithNotifyChannel("outbox")); err != nil {
+		fmt.Printf("failed to setup the data store: %s", err)
+		return
+	}
+}
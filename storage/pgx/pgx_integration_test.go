@@ -0,0 +1,50 @@
+//go:build integration
+
+package pgx
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/storage/sqlstore"
+	"github.com/italolelis/outboxer/storage/storetest"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestPgx_DataStore(t *testing.T) {
+	dsn := os.Getenv("POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("POSTGRES_DSN is not set")
+	}
+
+	pool, err := pgxpool.New(context.Background(), dsn)
+	if err != nil {
+		t.Fatalf("failed to connect to postgres: %s", err)
+	}
+
+	t.Cleanup(pool.Close)
+
+	storetest.RunDataStoreTests(t, func(t *testing.T) outboxer.DataStore {
+		ctx := context.Background()
+		table := fmt.Sprintf("storetest_%d", time.Now().UnixNano())
+
+		ds, err := WithInstance(ctx, pool, WithEventStoreTable(table))
+		if err != nil {
+			t.Fatalf("failed to setup the data store: %s", err)
+		}
+
+		t.Cleanup(func() {
+			for _, name := range []string{table, table + sqlstore.MigrationsTableSuffix} {
+				if _, err := pool.Exec(ctx, `DROP TABLE IF EXISTS `+ds.identifier(name).Sanitize()); err != nil {
+					t.Errorf("failed to drop table %s: %s", name, err)
+				}
+			}
+		})
+
+		return ds
+	})
+}
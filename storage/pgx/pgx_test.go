@@ -0,0 +1,786 @@
+package pgx
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/lock"
+	"github.com/italolelis/outboxer/outboxertest"
+	"github.com/italolelis/outboxer/storage/postgres"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/pashagolub/pgxmock/v2"
+)
+
+var eventStoreRows = []string{"id", "dispatched", "dispatched_at", "payload", "options", "headers", "created_at"}
+
+var inspectRows = append(eventStoreRows, "attempts", "last_error", "dead")
+
+// nolint
+func TestPgx_AddSuccessfully(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub pool", err)
+	}
+
+	defer mock.Close()
+
+	initDatastoreMock(t, mock)
+
+	clock := outboxertest.NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	ds, err := WithInstance(ctx, mock, WithClock(clock))
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	dispatchedAt := time.Now()
+
+	mock.ExpectBeginTx(pgx.TxOptions{})
+	mock.ExpectQuery(`INSERT INTO "event_store" (.+) VALUES (.+) RETURNING id, created_at`).
+		WithArgs([]byte("test payload"), map[string]interface{}{"exchange.name": "test"}, nil, clock.Now()).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "created_at"}).AddRow(int64(1), time.Now()))
+	mock.ExpectCommit()
+
+	mock.ExpectQuery(`SELECT (.+) FROM "event_store" WHERE dispatched = false AND dead = false ORDER BY id LIMIT 10`).
+		WillReturnRows(pgxmock.NewRows(eventStoreRows).
+			AddRow(int64(1), false, &dispatchedAt, []byte("test payload"),
+				map[string]interface{}{"exchange.name": "test"}, map[string]interface{}(nil), time.Now()))
+
+	mock.ExpectExec(`update "event_store" set (.+)where id = \$2`).
+		WithArgs(clock.Now(), int64(1)).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	mock.ExpectExec(`DELETE FROM "event_store" WHERE ctid IN (.+)`).
+		WithArgs(pgxmock.AnyArg()).
+		WillReturnResult(pgxmock.NewResult("DELETE", 1))
+
+	evt := outboxer.OutboxMessage{
+		Payload: []byte("test payload"),
+		Options: outboxer.DynamicValues{"exchange.name": "test"},
+	}
+	if err := ds.Add(ctx, &evt); err != nil {
+		t.Fatalf("failed to add message in the data store: %s", err)
+	}
+
+	if evt.ID != 1 || evt.CreatedAt.IsZero() {
+		t.Fatalf("was expecting the ID and creation time to be set but got %d and %s", evt.ID, evt.CreatedAt)
+	}
+
+	msgs, err := ds.GetEvents(ctx, 10)
+	if err != nil {
+		t.Fatalf("failed to retrieve messages from the data store: %s", err)
+	}
+
+	if len(msgs) != 1 {
+		t.Fatalf("was expecting 1 message in the data store but got %d", len(msgs))
+	}
+
+	if msgs[0].Options["exchange.name"] != "test" || !msgs[0].DispatchedAt.Valid {
+		t.Fatalf("the message was not decoded: %+v", msgs[0])
+	}
+
+	for _, m := range msgs {
+		if err := ds.SetAsDispatched(ctx, m.ID); err != nil {
+			t.Fatalf("failed to set message as dispatched: %s", err)
+		}
+	}
+
+	if err := ds.Remove(ctx, time.Now(), 10); err != nil {
+		t.Fatalf("failed to remove messages: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPgx_WithInstanceWithEmptyDBName(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub pool", err)
+	}
+
+	defer mock.Close()
+
+	mock.ExpectQuery(`SELECT CURRENT_DATABASE()`).
+		WillReturnRows(pgxmock.NewRows([]string{"current_database"}).AddRow(""))
+
+	if _, err := WithInstance(ctx, mock); !errors.Is(err, ErrNoDatabaseName) {
+		t.Fatalf("was expecting %s but got %v", ErrNoDatabaseName, err)
+	}
+}
+
+func TestPgx_WithInstanceWithEmptySchemaName(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub pool", err)
+	}
+
+	defer mock.Close()
+
+	mock.ExpectQuery(`SELECT CURRENT_DATABASE()`).
+		WillReturnRows(pgxmock.NewRows([]string{"current_database"}).AddRow("test"))
+	mock.ExpectQuery(`SELECT CURRENT_SCHEMA()`).
+		WillReturnRows(pgxmock.NewRows([]string{"current_schema"}).AddRow(""))
+
+	if _, err := WithInstance(ctx, mock); !errors.Is(err, ErrNoSchema) {
+		t.Fatalf("was expecting %s but got %v", ErrNoSchema, err)
+	}
+}
+
+func TestPgx_WithoutDDL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Run("valid table", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub pool", err)
+		}
+
+		defer mock.Close()
+
+		mock.ExpectQuery(`SELECT CURRENT_DATABASE()`).
+			WillReturnRows(pgxmock.NewRows([]string{"current_database"}).AddRow("test"))
+		mock.ExpectQuery(`SELECT CURRENT_SCHEMA()`).
+			WillReturnRows(pgxmock.NewRows([]string{"current_schema"}).AddRow("test_schema"))
+		mock.ExpectQuery(`SELECT id, dispatched, dispatched_at, payload, options, headers, created_at, attempts, last_error, dead FROM "event_store" WHERE 1 = 0`).
+			WillReturnRows(pgxmock.NewRows([]string{"id"}))
+
+		if _, err := WithInstance(ctx, mock, WithoutDDL()); err != nil {
+			t.Fatalf("failed to setup the data store: %s", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("missing table", func(t *testing.T) {
+		mock, err := pgxmock.NewPool()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub pool", err)
+		}
+
+		defer mock.Close()
+
+		mock.ExpectQuery(`SELECT CURRENT_DATABASE()`).
+			WillReturnRows(pgxmock.NewRows([]string{"current_database"}).AddRow("test"))
+		mock.ExpectQuery(`SELECT CURRENT_SCHEMA()`).
+			WillReturnRows(pgxmock.NewRows([]string{"current_schema"}).AddRow("test_schema"))
+		mock.ExpectQuery(`SELECT (.+) FROM "event_store" WHERE 1 = 0`).
+			WillReturnError(errors.New(`relation "event_store" does not exist`))
+
+		if _, err := WithInstance(ctx, mock, WithoutDDL()); !errors.Is(err, ErrInvalidSchema) {
+			t.Fatalf("was expecting %s but got %v", ErrInvalidSchema, err)
+		}
+	})
+}
+
+func TestPgx_DDL(t *testing.T) {
+	want := postgres.DDL(postgres.WithQuotedIdentifiers())
+	if got := DDL(); got != want {
+		t.Fatalf("was expecting the postgres DDL\n%s\nbut got\n%s", want, got)
+	}
+
+	if got := DDL(WithEventStoreTable("events")); !strings.Contains(got, `CREATE TABLE IF NOT EXISTS "events" (`) {
+		t.Fatalf("was expecting the DDL to create the events table but got\n%s", got)
+	}
+}
+
+func TestPgx_AddInTx(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub pool", err)
+	}
+
+	defer mock.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, mock, WithNotifyChannel("outbox"))
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	now := time.Now()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE orders SET (.+)`).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectQuery(`INSERT INTO "event_store" \(payload, options, headers, created_at\) VALUES \(\$1, \$2, \$3, \$4\), \(\$5, \$6, \$7, \$8\) RETURNING id, created_at`).
+		WithArgs([]byte("first"), nil, nil, pgxmock.AnyArg(), []byte("second"), nil, nil, pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "created_at"}).AddRow(int64(2), now).AddRow(int64(1), now))
+	mock.ExpectExec(`SELECT pg_notify\(\$1, ''\)`).
+		WithArgs("outbox").
+		WillReturnResult(pgxmock.NewResult("SELECT", 1))
+	mock.ExpectCommit()
+
+	tx, err := mock.Begin(ctx)
+	if err != nil {
+		t.Fatalf("failed to begin the transaction: %s", err)
+	}
+
+	if _, err := tx.Exec(ctx, "UPDATE orders SET status = 'paid'"); err != nil {
+		t.Fatalf("failed to update the order: %s", err)
+	}
+
+	msgs := []*outboxer.OutboxMessage{{Payload: []byte("first")}, {Payload: []byte("second")}}
+	if err := ds.AddInTx(ctx, tx, msgs...); err != nil {
+		t.Fatalf("failed to add messages in the transaction: %s", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatalf("failed to commit the transaction: %s", err)
+	}
+
+	for i, m := range msgs {
+		if m.ID != int64(i+1) || !m.CreatedAt.Equal(now) {
+			t.Fatalf("was expecting the ID and creation time to be set but got %d and %s", m.ID, m.CreatedAt)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPgx_AddInTxMismatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub pool", err)
+	}
+
+	defer mock.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, mock)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`INSERT INTO "event_store" (.+) RETURNING id, created_at`).
+		WithArgs(pgxmock.AnyArg(), nil, nil, pgxmock.AnyArg(), pgxmock.AnyArg(), nil, nil, pgxmock.AnyArg()).
+		WillReturnRows(pgxmock.NewRows([]string{"id", "created_at"}).AddRow(int64(1), time.Now()))
+	mock.ExpectRollback()
+
+	tx, err := mock.Begin(ctx)
+	if err != nil {
+		t.Fatalf("failed to begin the transaction: %s", err)
+	}
+
+	msgs := []*outboxer.OutboxMessage{{Payload: []byte("first")}, {Payload: []byte("second")}}
+	if err := ds.AddInTx(ctx, tx, msgs...); !errors.Is(err, ErrInsertedMismatch) {
+		t.Fatalf("was expecting %s but got %v", ErrInsertedMismatch, err)
+	}
+
+	if err := tx.Rollback(ctx); err != nil {
+		t.Fatalf("failed to roll back the transaction: %s", err)
+	}
+
+	if msgs[0].ID != 0 || msgs[1].ID != 0 {
+		t.Fatal("was expecting the ids to be left unset")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPgx_AddWithinTx(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub pool", err)
+	}
+
+	defer mock.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, mock)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	mock.ExpectBeginTx(pgx.TxOptions{})
+	mock.ExpectExec(`UPDATE orders SET (.+)`).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+	mock.ExpectRollback()
+
+	fnErr := errors.New("order not found")
+	err = ds.AddWithinTx(ctx, &outboxer.OutboxMessage{Payload: []byte("test payload")}, func(tx outboxer.ExecerContext) error {
+		res, err := tx.ExecContext(ctx, "UPDATE orders SET status = 'paid'")
+		if err != nil {
+			return err
+		}
+
+		if n, err := res.RowsAffected(); err != nil || n != 1 {
+			t.Fatalf("was expecting 1 affected row but got %d", n)
+		}
+
+		return fnErr
+	})
+	if !errors.Is(err, fnErr) {
+		t.Fatalf("was expecting %s but got %v", fnErr, err)
+	}
+
+	rbErr := errors.New("connection reset")
+
+	mock.ExpectBeginTx(pgx.TxOptions{})
+	mock.ExpectRollback().WillReturnError(rbErr)
+
+	err = ds.AddWithinTx(ctx, &outboxer.OutboxMessage{Payload: []byte("test payload")}, func(outboxer.ExecerContext) error {
+		return fnErr
+	})
+	if !errors.Is(err, fnErr) || !errors.Is(err, rbErr) {
+		t.Fatalf("was expecting both %s and %s but got %v", fnErr, rbErr, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPgx_Copy(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub pool", err)
+	}
+
+	defer mock.Close()
+
+	mock.ExpectQuery(`SELECT CURRENT_DATABASE()`).
+		WillReturnRows(pgxmock.NewRows([]string{"current_database"}).AddRow("test"))
+	initMigrationsMock(t, mock, "outbox")
+
+	ds, err := WithInstance(ctx, mock, WithSchema("outbox"))
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectCopyFrom(pgx.Identifier{"outbox", "event_store"}, []string{"payload", "options", "headers", "created_at"}).
+		WillReturnResult(2)
+	mock.ExpectCommit()
+
+	n, err := ds.Copy(ctx, &outboxer.OutboxMessage{Payload: []byte("first")}, &outboxer.OutboxMessage{Payload: []byte("second")})
+	if err != nil {
+		t.Fatalf("failed to copy messages: %s", err)
+	}
+
+	if n != 2 {
+		t.Fatalf("was expecting 2 copied messages but got %d", n)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPgx_Notify(t *testing.T) {
+	ds := Pgx{}
+
+	c, err := ds.Notify(context.Background())
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	if c != nil {
+		t.Fatal("was expecting notifications to be disabled without a channel")
+	}
+}
+
+func TestPgx_SetAsFailed(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub pool", err)
+	}
+
+	defer mock.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, mock)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	mock.ExpectExec(`UPDATE "event_store" SET dead = dead OR \(\$3 > 0 AND attempts \+ 1 >= \$3\), attempts = attempts \+ 1, last_error = \$2 WHERE id = \$1`).
+		WithArgs(int64(7), "broker unavailable", int32(3)).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	if err := ds.SetAsFailed(ctx, 7, "broker unavailable", 3); err != nil {
+		t.Fatalf("failed to set message as failed: %s", err)
+	}
+
+	mock.ExpectExec(`UPDATE "event_store" SET dead = false, attempts = 0, last_error = NULL WHERE dead = true AND id = ANY\(\$1\)`).
+		WithArgs([]int64{7, 8}).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	n, err := ds.Requeue(ctx, 7, 8)
+	if err != nil {
+		t.Fatalf("failed to requeue messages: %s", err)
+	}
+
+	if n != 1 {
+		t.Fatalf("was expecting 1 requeued message but got %d", n)
+	}
+
+	if n, err := ds.Requeue(ctx); err != nil || n != 0 {
+		t.Fatalf("was expecting nothing to be requeued but got %d, %v", n, err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPgx_Replay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub pool", err)
+	}
+
+	defer mock.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, mock)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	since := time.Now().Add(-time.Hour)
+	filter := outboxer.ReplayFilter{
+		FromID:          10,
+		ToID:            20,
+		DispatchedAfter: since,
+		Destination:     outboxer.DynamicValues{"topic_name": "orders"},
+	}
+
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM "event_store" WHERE dispatched = true AND id >= \$1 AND id <= \$2 AND dispatched_at >= \$3 AND options @> \$4::jsonb`).
+		WithArgs(int64(10), int64(20), since, `{"topic_name":"orders"}`).
+		WillReturnRows(pgxmock.NewRows([]string{"count"}).AddRow(int64(2)))
+
+	count, err := ds.CountDispatched(ctx, filter)
+	if err != nil {
+		t.Fatalf("failed to count messages: %s", err)
+	}
+
+	if count != 2 {
+		t.Fatalf("was expecting 2 messages but got %d", count)
+	}
+
+	dispatchedAt := time.Now()
+
+	mock.ExpectQuery(`SELECT (.+) FROM "event_store" WHERE id > \$1 AND dispatched = true AND id >= \$2 (.+) ORDER BY id LIMIT 5`).
+		WithArgs(int64(12), int64(10), int64(20), since, `{"topic_name":"orders"}`).
+		WillReturnRows(pgxmock.NewRows(eventStoreRows).
+			AddRow(int64(13), true, &dispatchedAt, []byte("a"),
+				map[string]interface{}{"topic_name": "orders"}, map[string]interface{}(nil), time.Now()))
+
+	msgs, err := ds.GetDispatched(ctx, filter, 12, 5)
+	if err != nil {
+		t.Fatalf("failed to get messages: %s", err)
+	}
+
+	if len(msgs) != 1 || msgs[0].ID != 13 || !msgs[0].DispatchedAt.Valid {
+		t.Fatalf("was expecting message 13 but got %v", msgs)
+	}
+
+	mock.ExpectExec(`UPDATE "event_store" SET dispatched = false, dispatched_at = NULL WHERE dispatched = true AND id >= \$1`).
+		WithArgs(int64(10)).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 3))
+
+	replayed, err := ds.Replay(ctx, outboxer.ReplayFilter{FromID: 10}, nil)
+	if err != nil {
+		t.Fatalf("failed to replay messages: %s", err)
+	}
+
+	if replayed != 3 {
+		t.Fatalf("was expecting 3 replayed messages but got %d", replayed)
+	}
+
+	mock.ExpectExec(`UPDATE "event_store" SET (.+), options = COALESCE\(options, '{}'::jsonb\) \|\| \$1::jsonb WHERE dispatched = true AND id <= \$2`).
+		WithArgs(`{"topic_name":"orders.replay"}`, int64(20)).
+		WillReturnResult(pgxmock.NewResult("UPDATE", 1))
+
+	if _, err := ds.Replay(ctx, outboxer.ReplayFilter{ToID: 20}, outboxer.DynamicValues{"topic_name": "orders.replay"}); err != nil {
+		t.Fatalf("failed to replay messages: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPgx_Inspect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub pool", err)
+	}
+
+	defer mock.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, mock)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	lastDispatchedAt := time.Now()
+	oldestPendingID := int64(8)
+
+	mock.ExpectQuery(`SELECT (.+) FROM "event_store"`).
+		WillReturnRows(pgxmock.NewRows([]string{"pending", "dispatched", "failed", "dead", "oldest", "last"}).
+			AddRow(int64(3), int64(7), int64(1), int64(2), &oldestPendingID, &lastDispatchedAt))
+
+	stats, err := ds.Stats(ctx)
+	if err != nil {
+		t.Fatalf("failed to get stats: %s", err)
+	}
+
+	if stats.Pending != 3 || stats.Dispatched != 7 || stats.Failed != 1 || stats.Dead != 2 || stats.OldestPendingID.Int64 != 8 || !stats.LastDispatchedAt.Valid {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	lastError := "broker unavailable"
+
+	mock.ExpectQuery(`SELECT (.+) FROM "event_store" WHERE id = \$1`).
+		WithArgs(int64(8)).
+		WillReturnRows(pgxmock.NewRows(inspectRows).
+			AddRow(int64(8), false, (*time.Time)(nil), []byte("payload"), map[string]interface{}(nil),
+				map[string]interface{}(nil), time.Now(), int32(2), &lastError, false))
+	mock.ExpectQuery(`SELECT (.+) FROM "event_store" WHERE id = \$1`).
+		WithArgs(int64(9)).
+		WillReturnRows(pgxmock.NewRows(inspectRows))
+
+	msg, err := ds.GetEvent(ctx, 8)
+	if err != nil {
+		t.Fatalf("failed to get message: %s", err)
+	}
+
+	if msg.ID != 8 || string(msg.Payload) != "payload" || msg.Attempts != 2 || msg.LastError != lastError {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+
+	if _, err := ds.GetEvent(ctx, 9); !errors.Is(err, outboxer.ErrMessageNotFound) {
+		t.Fatalf("was expecting ErrMessageNotFound but got %v", err)
+	}
+
+	mock.ExpectQuery(`SELECT (.+) FROM "event_store" WHERE id > \$1 AND dispatched = false AND dead = false ORDER BY id LIMIT 20`).
+		WithArgs(int64(5)).
+		WillReturnRows(pgxmock.NewRows(inspectRows).
+			AddRow(int64(8), false, (*time.Time)(nil), []byte("payload"), map[string]interface{}(nil),
+				map[string]interface{}(nil), time.Now(), int32(0), (*string)(nil), false))
+
+	msgs, err := ds.ListEvents(ctx, outboxer.ListFilter{State: outboxer.PendingState, AfterID: 5, Limit: 20})
+	if err != nil {
+		t.Fatalf("failed to list messages: %s", err)
+	}
+
+	if len(msgs) != 1 || msgs[0].LastError != "" {
+		t.Fatalf("was expecting 1 message but got %v", msgs)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPgx_NotifyListens(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn := &fakeConn{notifications: make(chan struct{}), released: make(chan struct{})}
+	ds := Pgx{pool: fakeListener{conn: conn}, NotifyChannel: "outbox"}
+
+	c, err := ds.Notify(ctx)
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	conn.notifications <- struct{}{}
+
+	select {
+	case <-c:
+	case <-time.After(5 * time.Second):
+		t.Fatal("was expecting a notification")
+	}
+
+	cancel()
+
+	select {
+	case <-conn.released:
+	case <-time.After(5 * time.Second):
+		t.Fatal("was expecting the connection to be released")
+	}
+
+	if _, ok := <-c; ok {
+		t.Fatal("was expecting the channel to be closed")
+	}
+
+	want := []string{`LISTEN "outbox"`, "UNLISTEN *"}
+	if strings.Join(conn.execs, "; ") != strings.Join(want, "; ") {
+		t.Fatalf("was expecting %v but got %v", want, conn.execs)
+	}
+}
+
+func TestPgx_NotifyWithoutListener(t *testing.T) {
+	mock, err := pgxmock.NewPool()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub pool", err)
+	}
+
+	defer mock.Close()
+
+	ds := Pgx{pool: mock, NotifyChannel: "outbox"}
+
+	if _, err := ds.Notify(context.Background()); !errors.Is(err, ErrNoListener) {
+		t.Fatalf("was expecting %s but got %v", ErrNoListener, err)
+	}
+}
+
+func TestPgx_IsRetryable(t *testing.T) {
+	ds := Pgx{}
+
+	for code, want := range map[string]bool{
+		"40001": true,
+		"40P01": true,
+		"23505": false,
+	} {
+		if got := ds.IsRetryable(&pgconn.PgError{Code: code}); got != want {
+			t.Errorf("was expecting %s to be retryable %t but got %t", code, want, got)
+		}
+	}
+
+	if ds.IsRetryable(errors.New("connection refused")) {
+		t.Error("was not expecting a generic error to be retryable")
+	}
+}
+
+func initDatastoreMock(t *testing.T, mock pgxmock.PgxPoolIface) {
+	mock.ExpectQuery(`SELECT CURRENT_DATABASE()`).
+		WillReturnRows(pgxmock.NewRows([]string{"current_database"}).AddRow("test"))
+	mock.ExpectQuery(`SELECT CURRENT_SCHEMA()`).
+		WillReturnRows(pgxmock.NewRows([]string{"current_schema"}).AddRow("test_schema"))
+
+	initMigrationsMock(t, mock, "test_schema")
+}
+
+func initMigrationsMock(t *testing.T, mock pgxmock.PgxPoolIface, schema string) {
+	key, err := lock.Generate("test", schema)
+	if err != nil {
+		t.Fatalf("failed to generate the lock value: %s", err)
+	}
+
+	aid, err := strconv.ParseInt(key, 10, 64)
+	if err != nil {
+		t.Fatalf("failed to parse the lock value: %s", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`SELECT pg_advisory_xact_lock(.+)`).
+		WithArgs(aid).
+		WillReturnResult(pgxmock.NewResult("SELECT", 1))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS (.+)event_store_migrations(.+);`).
+		WillReturnResult(pgxmock.NewResult("CREATE TABLE", 0))
+	mock.ExpectQuery(`SELECT version FROM (.+)event_store_migrations`).
+		WillReturnRows(pgxmock.NewRows([]string{"version"}))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS (.+)event_store(.+);`).
+		WillReturnResult(pgxmock.NewResult("CREATE TABLE", 0))
+	mock.ExpectExec(`INSERT INTO (.+)event_store_migrations(.+) VALUES (.+)`).
+		WithArgs(int64(1), "create outbox table").
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectExec(`ALTER TABLE (.+)event_store(.+) ADD COLUMN IF NOT EXISTS created_at`).
+		WillReturnResult(pgxmock.NewResult("ALTER TABLE", 0))
+	mock.ExpectExec(`INSERT INTO (.+)event_store_migrations(.+) VALUES (.+)`).
+		WithArgs(int64(2), "add created_at column").
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectExec(`(?s)DO .+ CREATE INDEX IF NOT EXISTS "event_store_index_dispatchedAt" ON (.+)event_store`).
+		WillReturnResult(pgxmock.NewResult("CREATE INDEX", 0))
+	mock.ExpectExec(`INSERT INTO (.+)event_store_migrations(.+) VALUES (.+)`).
+		WithArgs(int64(3), "name indexes after the table").
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectExec(`ALTER TABLE (.+)event_store(.+) ADD COLUMN IF NOT EXISTS attempts`).
+		WillReturnResult(pgxmock.NewResult("ALTER TABLE", 0))
+	mock.ExpectExec(`INSERT INTO (.+)event_store_migrations(.+) VALUES (.+)`).
+		WithArgs(int64(4), "track failed sends").
+		WillReturnResult(pgxmock.NewResult("INSERT", 1))
+	mock.ExpectCommit()
+}
+
+// fakeListener hands out the same fake connection.
+type fakeListener struct {
+	Pool
+	conn *fakeConn
+}
+
+func (l fakeListener) AcquireConn(context.Context) (Conn, error) {
+	return l.conn, nil
+}
+
+// fakeConn records the statements it runs and delivers a notification for each value sent on notifications.
+type fakeConn struct {
+	execs         []string
+	notifications chan struct{}
+	released      chan struct{}
+}
+
+func (c *fakeConn) Exec(_ context.Context, sql string, _ ...interface{}) (pgconn.CommandTag, error) {
+	c.execs = append(c.execs, sql)
+
+	return pgconn.CommandTag{}, nil
+}
+
+func (c *fakeConn) WaitForNotification(ctx context.Context) (*pgconn.Notification, error) {
+	select {
+	case <-c.notifications:
+		return &pgconn.Notification{Channel: "outbox"}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *fakeConn) Release() {
+	close(c.released)
+}
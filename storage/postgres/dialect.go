@@ -0,0 +1,281 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/lock"
+	"github.com/italolelis/outboxer/migrate"
+	"github.com/italolelis/outboxer/storage/sqlstore"
+)
+
+const (
+	// sqlStateSerializationFailure and sqlStateDeadlockDetected are the retryable error codes.
+	sqlStateSerializationFailure = "40001"
+	sqlStateDeadlockDetected     = "40P01"
+
+	// maxInsertRows keeps a multi-row insert under the limit of 65535 parameters.
+	maxInsertRows = 1000
+)
+
+// dialect is the postgres flavour of SQL.
+type dialect struct{}
+
+func (dialect) Placeholder(n int) string { return "$" + strconv.Itoa(n) }
+
+func (dialect) Quote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (dialect) Bool(v bool) string { return strconv.FormatBool(v) }
+
+func (dialect) Limit(n int32) (string, string) { return "", fmt.Sprintf("LIMIT %d", n) }
+
+func (dialect) LockRows() (string, string) { return "", "FOR UPDATE" }
+
+func (dialect) Returning() (string, string) { return "", "RETURNING id, created_at" }
+
+func (dialect) MaxInsertRows() int { return maxInsertRows }
+
+func (dialect) Metadata(v outboxer.DynamicValues) interface{} { return v }
+
+func (dialect) EmptyMetadata() string { return "'{}'" }
+
+func (dialect) HasMetadata() string { return "(options <> '{}' OR headers <> '{}')" }
+
+func (dialect) OptionsContain(args *sqlstore.Args, values outboxer.DynamicValues) (string, error) {
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode the destination filter: %w", err)
+	}
+
+	return fmt.Sprintf("options @> %s::jsonb", args.Add(string(data))), nil
+}
+
+func (dialect) MergeOptions(args *sqlstore.Args, values outboxer.DynamicValues) (string, error) {
+	data, err := json.Marshal(values)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode the options override: %w", err)
+	}
+
+	return fmt.Sprintf("COALESCE(options, '{}'::jsonb) || %s::jsonb", args.Add(string(data))), nil
+}
+
+// Lock implements explicit locking.
+// https://www.postgresql.org/docs/9.6/static/explicit-locking.html#ADVISORY-LOCKS
+func (dialect) Lock(ctx context.Context, conn *sql.Conn, s *sqlstore.Store) error {
+	aid, err := lock.Generate(s.DatabaseName, s.SchemaName)
+	if err != nil {
+		return err
+	}
+
+	// This blocks until the lock is obtained.
+	query := `SELECT pg_advisory_lock($1)`
+	if _, err := conn.ExecContext(ctx, query, aid); err != nil {
+		return fmt.Errorf("try lock failed: %w", err)
+	}
+
+	return nil
+}
+
+func (dialect) Unlock(ctx context.Context, conn *sql.Conn, s *sqlstore.Store) error {
+	aid, err := lock.Generate(s.DatabaseName, s.SchemaName)
+	if err != nil {
+		return err
+	}
+
+	query := `SELECT pg_advisory_unlock($1)`
+	_, err = conn.ExecContext(ctx, query, aid)
+
+	return err
+}
+
+func (dialect) MigrationsDialect(s *sqlstore.Store, table string) migrate.Dialect {
+	table = s.Ident(table + sqlstore.MigrationsTableSuffix)
+
+	return migrate.Dialect{
+		CreateTable: fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	version bigint not null primary key,
+	description text not null,
+	applied_at timestamp not null default now()
+);
+`, table),
+		SelectVersions: fmt.Sprintf(`SELECT version FROM %s`, table),
+		InsertVersion:  fmt.Sprintf(`INSERT INTO %s (version, description) VALUES ($1, $2)`, table),
+	}
+}
+
+func (dialect) Migrations(s *sqlstore.Store) []migrate.Migration {
+	return []migrate.Migration{
+		{
+			Version:     1,
+			Description: "create outbox table",
+			Up: fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %[1]s (
+	id SERIAL not null primary key, 
+	dispatched boolean not null default false, 
+	dispatched_at timestamp,
+	payload bytea not null,
+	options jsonb,
+	headers jsonb
+);
+
+CREATE INDEX IF NOT EXISTS "index_dispatchedAt" ON %[1]s using btree (dispatched_at asc nulls last);
+CREATE INDEX IF NOT EXISTS "index_dispatched" ON %[1]s using btree (dispatched asc nulls last);
+`, s.Ident(s.EventStoreTable)),
+		},
+		{
+			Version:     2,
+			Description: "add created_at column",
+			Up: fmt.Sprintf(`
+ALTER TABLE %s ADD COLUMN IF NOT EXISTS created_at timestamp not null default now();
+`, s.Ident(s.EventStoreTable)),
+		},
+		{
+			Version:     3,
+			Description: "name indexes after the table",
+			Up:          indexesMigration(s),
+		},
+		{
+			Version:     4,
+			Description: "track failed sends",
+			Up: fmt.Sprintf(`
+ALTER TABLE %s
+	ADD COLUMN IF NOT EXISTS attempts integer not null default 0,
+	ADD COLUMN IF NOT EXISTS last_error text,
+	ADD COLUMN IF NOT EXISTS dead boolean not null default false;
+`, s.Ident(s.EventStoreTable)),
+		},
+	}
+}
+
+// indexesMigration names the indexes of the outbox table after it. Index names are unique within a schema,
+// so the fixed names of the first migration only ever indexed the first outbox table of a schema.
+// Those indexes are renamed when they belong to this table, otherwise the indexes are created.
+func indexesMigration(s *sqlstore.Store) string {
+	table := s.Ident(s.EventStoreTable)
+	renames := make([]string, 0, 2)
+
+	for _, idx := range []struct{ old, new string }{
+		{old: "index_dispatchedAt", new: s.EventStoreTable + "_index_dispatchedAt"},
+		{old: "index_dispatched", new: s.EventStoreTable + "_index_dispatched"},
+	} {
+		old := qualifiedIndex(s, idx.old)
+
+		renames = append(renames, fmt.Sprintf(`	IF EXISTS (SELECT 1 FROM pg_index WHERE indexrelid = to_regclass(%s) AND indrelid = to_regclass(%s)) THEN
+		ALTER INDEX %s RENAME TO %s;
+	END IF;`, literal(old), literal(table), old, dialect{}.Quote(idx.new)))
+	}
+
+	return fmt.Sprintf(`
+DO $$
+BEGIN
+%[2]s
+END $$;
+
+CREATE INDEX IF NOT EXISTS %[3]s ON %[1]s using btree (dispatched_at asc nulls last);
+CREATE INDEX IF NOT EXISTS %[4]s ON %[1]s using btree (dispatched asc nulls last);
+`, table, strings.Join(renames, "\n"),
+		dialect{}.Quote(s.EventStoreTable+"_index_dispatchedAt"), dialect{}.Quote(s.EventStoreTable+"_index_dispatched"))
+}
+
+// qualifiedIndex returns the quoted name of an index, qualified with the schema like the tables are.
+// Indexes always live in the schema of their table.
+func qualifiedIndex(s *sqlstore.Store, name string) string {
+	if s.QualifyTables {
+		return dialect{}.Quote(s.SchemaName) + "." + dialect{}.Quote(name)
+	}
+
+	return dialect{}.Quote(name)
+}
+
+// literal quotes a string literal.
+func literal(v string) string {
+	return "'" + strings.ReplaceAll(v, "'", "''") + "'"
+}
+
+// ArchiveMigrations partition the archive by month, see PrepareArchive.
+// Its index is named after it, like the ones of the outbox table.
+func (dialect) ArchiveMigrations(s *sqlstore.Store) []migrate.Migration {
+	return []migrate.Migration{
+		{
+			Version:     1,
+			Description: "create archive table",
+			Up: fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %[1]s (
+	id integer not null,
+	dispatched boolean not null default false,
+	dispatched_at timestamp not null,
+	payload bytea not null,
+	options jsonb,
+	headers jsonb,
+	archived_at timestamp not null default now()
+) PARTITION BY RANGE (dispatched_at);
+
+CREATE INDEX IF NOT EXISTS %[2]s ON %[1]s using btree (id);
+`, s.Ident(s.ArchiveTable), dialect{}.Quote(s.ArchiveTable+"_index_id")),
+		},
+		{
+			Version:     2,
+			Description: "add created_at column",
+			Up: fmt.Sprintf(`
+ALTER TABLE %s ADD COLUMN IF NOT EXISTS created_at timestamp;
+`, s.Ident(s.ArchiveTable)),
+		},
+	}
+}
+
+// PrepareArchive creates the monthly archive partitions that are needed to hold the messages.
+func (dialect) PrepareArchive(ctx context.Context, tx *sql.Tx, s *sqlstore.Store, msgs []*outboxer.OutboxMessage) error {
+	months := make(map[time.Time]struct{})
+	for _, m := range msgs {
+		t := m.DispatchedAt.Time
+		months[time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)] = struct{}{}
+	}
+
+	starts := make([]time.Time, 0, len(months))
+	for m := range months {
+		starts = append(starts, m)
+	}
+
+	sort.Slice(starts, func(i, j int) bool { return starts[i].Before(starts[j]) })
+
+	for _, start := range starts {
+		// nolint
+		query := fmt.Sprintf(
+			`CREATE TABLE IF NOT EXISTS %s PARTITION OF %s FOR VALUES FROM ('%s') TO ('%s')`,
+			s.Ident(s.ArchiveTable+"_p"+start.Format("200601")),
+			s.Ident(s.ArchiveTable),
+			start.Format("2006-01-02"),
+			start.AddDate(0, 1, 0).Format("2006-01-02"),
+		)
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to create archive partition: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func (dialect) IsRetryable(err error) bool {
+	var e interface{ SQLState() string }
+	if !errors.As(err, &e) {
+		return false
+	}
+
+	switch e.SQLState() {
+	case sqlStateSerializationFailure, sqlStateDeadlockDetected:
+		return true
+	default:
+		return false
+	}
+}
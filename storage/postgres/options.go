@@ -0,0 +1,60 @@
+package postgres
+
+import "github.com/italolelis/outboxer"
+
+// Option represents the postgres data store options.
+type Option func(*Postgres)
+
+// WithEventStoreTable sets the name of the outbox table.
+func WithEventStoreTable(name string) Option {
+	return func(p *Postgres) {
+		p.EventStoreTable = name
+	}
+}
+
+// WithSchema sets the schema of the outbox table. Table names are qualified with it,
+// otherwise they are resolved through the search path.
+func WithSchema(name string) Option {
+	return func(p *Postgres) {
+		p.SchemaName = name
+		p.QualifyTables = true
+	}
+}
+
+// WithQuotedIdentifiers quotes the table and schema names, so they can be mixed case or reserved words.
+func WithQuotedIdentifiers() Option {
+	return func(p *Postgres) {
+		p.QuoteIdentifiers = true
+	}
+}
+
+// WithoutDDL never creates or changes tables. The data store only validates that the outbox table
+// exists and has the expected columns, for setups where the schema is managed outside the application, see DDL.
+func WithoutDDL() Option {
+	return func(p *Postgres) {
+		p.SkipDDL = true
+	}
+}
+
+// WithClearMetadataOnDispatch wipes the options and headers of a message once it is dispatched.
+// By default they are kept for audit and replay, see Compact to strip them later on.
+func WithClearMetadataOnDispatch() Option {
+	return func(p *Postgres) {
+		p.ClearMetadataOnDispatch = true
+	}
+}
+
+// WithArchiveTable makes Remove move dispatched messages into the given archive table instead of
+// deleting them, like EnableArchive. With WithoutDDL the table is only validated and DDL includes it.
+func WithArchiveTable(name string) Option {
+	return func(p *Postgres) {
+		p.ArchiveTable = name
+	}
+}
+
+// WithClock sets the clock of the created_at and dispatched_at timestamps, the system clock by default.
+func WithClock(c outboxer.Clock) Option {
+	return func(p *Postgres) {
+		p.Clock = c
+	}
+}
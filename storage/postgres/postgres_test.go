@@ -2,15 +2,24 @@ package postgres
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"fmt"
+	"regexp"
+	"strings"
 	"testing"
 	"time"
 
 	sqlmock "github.com/DATA-DOG/go-sqlmock"
 	"github.com/italolelis/outboxer"
 	"github.com/italolelis/outboxer/lock"
+	"github.com/lib/pq"
 )
 
+var eventStoreRows = []string{"id", "dispatched", "dispatched_at", "payload", "options", "headers", "created_at"}
+
+var inspectRows = append(eventStoreRows, "attempts", "last_error", "dead")
+
 // nolint
 func TestPostgres_AddSuccessfully(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
@@ -33,20 +42,20 @@ func TestPostgres_AddSuccessfully(t *testing.T) {
 	defer ds.Close()
 
 	mock.ExpectBegin()
-	mock.ExpectExec(`INSERT INTO event_store (.+) VALUES (.+)`).
-		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`INSERT INTO event_store (.+) VALUES (.+) RETURNING id, created_at`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Now()))
 	mock.ExpectCommit()
 
-	mock.ExpectQuery(`SELECT (.+) FROM event_store WHERE dispatched = false LIMIT 10`).
-		WillReturnRows(sqlmock.NewRows([]string{"id", "dispatched", "dispatched_at", "payload", "options", "headers"}).
-			AddRow(1, false, time.Now(), []byte("test payload"), outboxer.DynamicValues{}, outboxer.DynamicValues{}))
+	mock.ExpectQuery(`SELECT (.+) FROM event_store WHERE dispatched = false AND dead = false ORDER BY id LIMIT 10`).
+		WillReturnRows(sqlmock.NewRows(eventStoreRows).
+			AddRow(1, false, time.Now(), []byte("test payload"), outboxer.DynamicValues{}, outboxer.DynamicValues{}, time.Now()))
 
-	mock.ExpectExec(`update event_store set (.+)where id = ?`).
-		WithArgs(1).
+	mock.ExpectExec(`UPDATE event_store SET (.+)WHERE id = ?`).
+		WithArgs(sqlmock.AnyArg(), 1).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
 	mock.ExpectBegin()
-	mock.ExpectExec(`DELETE FROM (.+) WHERE ctid IN (.+)`).
+	mock.ExpectExec(`DELETE FROM event_store WHERE id IN \(SELECT id FROM \(SELECT id FROM event_store WHERE (.+) ORDER BY id LIMIT 10\) AS batch\)`).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectCommit()
 
@@ -180,8 +189,8 @@ func TestPostgres_AddWithinTx(t *testing.T) {
 	mock.ExpectBegin()
 	mock.ExpectExec(`SELECT (.+) from event_store LIMIT 1`).
 		WillReturnResult(sqlmock.NewResult(0, 1))
-	mock.ExpectExec(`INSERT INTO event_store (.+) VALUES (.+)`).
-		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(`INSERT INTO event_store (.+) VALUES (.+) RETURNING id, created_at`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Now()))
 	mock.ExpectCommit()
 
 	fn := func(tx outboxer.ExecerContext) error {
@@ -196,6 +205,244 @@ func TestPostgres_AddWithinTx(t *testing.T) {
 	}
 }
 
+func TestPostgres_AddWithinTxOptions(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, db)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	defer ds.Close()
+
+	opts := &sql.TxOptions{Isolation: sql.LevelSerializable}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT count\(\*\) FROM orders`).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(`INSERT INTO event_store (.+) VALUES (.+) RETURNING id, created_at`).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Now()))
+	mock.ExpectCommit()
+
+	if err := ds.AddWithinTxOptions(ctx, &outboxer.OutboxMessage{
+		Payload: []byte("test payload"),
+	}, opts, func(tx outboxer.Tx) error {
+		var count int
+		return tx.QueryRowContext(ctx, "SELECT count(*) FROM orders").Scan(&count)
+	}); err != nil {
+		t.Fatalf("failed to add message in the data store: %s", err)
+	}
+
+	fnErr := errors.New("business logic failed")
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	if err := ds.AddWithinTxOptions(ctx, &outboxer.OutboxMessage{
+		Payload: []byte("test payload"),
+	}, opts, func(outboxer.Tx) error {
+		return fnErr
+	}); !errors.Is(err, fnErr) {
+		t.Fatalf("expected the callback error, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPostgres_AddInTx(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, db)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	createdAt := time.Date(2023, time.January, 1, 10, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectExec(`UPDATE orders SET status = 'paid'`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(
+		`INSERT INTO event_store (payload, options, headers, created_at) VALUES ($1, $2, $3, $4), ($5, $6, $7, $8) RETURNING id, created_at`,
+	)).
+		WithArgs([]byte("first"), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), []byte("second"), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, createdAt).AddRow(2, createdAt))
+	mock.ExpectCommit()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %s", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE orders SET status = 'paid'`); err != nil {
+		t.Fatalf("failed to update order: %s", err)
+	}
+
+	msgs := []*outboxer.OutboxMessage{{Payload: []byte("first")}, {Payload: []byte("second")}}
+	if err := ds.AddInTx(ctx, tx, msgs...); err != nil {
+		t.Fatalf("failed to add messages in the transaction: %s", err)
+	}
+
+	if msgs[0].ID != 1 || msgs[1].ID != 2 || !msgs[1].CreatedAt.Equal(createdAt) {
+		t.Fatalf("expected the generated ids and creation time to be set, got %+v and %+v", msgs[0], msgs[1])
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("failed to commit transaction: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPostgres_Options(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("custom table and schema", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+
+		defer db.Close()
+
+		mock.ExpectQuery(`SELECT CURRENT_DATABASE()`).
+			WillReturnRows(sqlmock.NewRows([]string{"CURRENT_DATABASE()"}).AddRow("test"))
+		mock.ExpectExec(`SELECT pg_advisory_lock(.+)`).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec(regexp.QuoteMeta(`CREATE TABLE IF NOT EXISTS "Outbox"."Events_migrations"`)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(regexp.QuoteMeta(`SELECT version FROM "Outbox"."Events_migrations"`)).
+			WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(1).AddRow(2))
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(`ALTER INDEX "Outbox"."index_dispatchedAt" RENAME TO "Events_index_dispatchedAt"`)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "Outbox"."Events_migrations"`)).
+			WithArgs(3, "name indexes after the table").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		mock.ExpectBegin()
+		mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE "Outbox"."Events" ADD COLUMN IF NOT EXISTS attempts`)).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO "Outbox"."Events_migrations"`)).
+			WithArgs(4, "track failed sends").
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		mock.ExpectExec(`SELECT pg_advisory_unlock(.+)`).WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectBegin()
+		mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO "Outbox"."Events" (payload, options, headers, created_at)`)).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Now()))
+		mock.ExpectCommit()
+
+		ds, err := WithInstance(ctx, db,
+			WithEventStoreTable("Events"),
+			WithSchema("Outbox"),
+			WithQuotedIdentifiers(),
+		)
+		if err != nil {
+			t.Fatalf("failed to setup the data store: %s", err)
+		}
+
+		if err := ds.Add(ctx, &outboxer.OutboxMessage{Payload: []byte("test payload")}); err != nil {
+			t.Fatalf("failed to add message in the data store: %s", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("without DDL", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+
+		defer db.Close()
+
+		mock.ExpectQuery(`SELECT CURRENT_DATABASE()`).
+			WillReturnRows(sqlmock.NewRows([]string{"CURRENT_DATABASE()"}).AddRow("test"))
+		mock.ExpectQuery(`SELECT CURRENT_SCHEMA()`).
+			WillReturnRows(sqlmock.NewRows([]string{"CURRENT_SCHEMA()"}).AddRow("test_schema"))
+		mock.ExpectQuery(`SELECT id, dispatched, dispatched_at, payload, options, headers, created_at, attempts, last_error, dead FROM event_store WHERE 1 = 0`).
+			WillReturnError(errors.New(`relation "event_store" does not exist`))
+
+		if _, err := WithInstance(ctx, db, WithoutDDL()); !errors.Is(err, ErrInvalidSchema) {
+			t.Fatalf("expected an invalid schema error, got %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+
+	t.Run("DDL", func(t *testing.T) {
+		ddl := DDL(WithEventStoreTable("outbox"), WithSchema("app"))
+
+		if !strings.HasPrefix(ddl, "CREATE TABLE IF NOT EXISTS app.outbox (") {
+			t.Fatalf("unexpected DDL:\n%s", ddl)
+		}
+
+		if !strings.Contains(ddl, `CREATE INDEX IF NOT EXISTS "outbox_index_dispatched" ON app.outbox`) {
+			t.Fatalf("expected the indexes to be named after the table:\n%s", ddl)
+		}
+
+		ddl = DDL(WithEventStoreTable("outbox"), WithArchiveTable("outbox_archive"))
+		if !strings.Contains(ddl, "CREATE TABLE IF NOT EXISTS outbox_archive (") ||
+			!strings.Contains(ddl, "ALTER TABLE outbox_archive ADD COLUMN IF NOT EXISTS created_at") {
+			t.Fatalf("expected the archive table in the DDL:\n%s", ddl)
+		}
+	})
+
+	t.Run("archive without DDL", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+
+		defer db.Close()
+
+		mock.ExpectQuery(`SELECT CURRENT_DATABASE()`).
+			WillReturnRows(sqlmock.NewRows([]string{"CURRENT_DATABASE()"}).AddRow("test"))
+		mock.ExpectQuery(`SELECT CURRENT_SCHEMA()`).
+			WillReturnRows(sqlmock.NewRows([]string{"CURRENT_SCHEMA()"}).AddRow("test_schema"))
+		mock.ExpectQuery(`SELECT (.+) FROM event_store WHERE 1 = 0`).
+			WillReturnRows(sqlmock.NewRows([]string{"id"}))
+		mock.ExpectQuery(`SELECT id, dispatched, dispatched_at, payload, options, headers, created_at FROM event_store_archive WHERE 1 = 0`).
+			WillReturnError(errors.New(`relation "event_store_archive" does not exist`))
+
+		if _, err := WithInstance(ctx, db, WithoutDDL(), WithArchiveTable("event_store_archive")); !errors.Is(err, ErrInvalidSchema) {
+			t.Fatalf("expected an invalid schema error, got %v", err)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+}
+
 func initDatastoreMock(t *testing.T, mock sqlmock.Sqlmock) {
 	mock.ExpectQuery(`SELECT CURRENT_DATABASE()`).
 		WillReturnRows(sqlmock.NewRows([]string{"CURRENT_DATABASE()"}).AddRow("test"))
@@ -214,9 +461,437 @@ func initLockMock(t *testing.T, mock sqlmock.Sqlmock) {
 	mock.ExpectExec(`SELECT pg_advisory_lock(.+)`).
 		WithArgs(aid).
 		WillReturnResult(sqlmock.NewResult(0, 1))
+	initMigrationsMock(mock)
+	mock.ExpectExec(`SELECT pg_advisory_unlock(.+)`).
+		WithArgs(aid).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+}
+
+func initMigrationsMock(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS event_store_migrations (.+);`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT version FROM event_store_migrations`).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}))
+	mock.ExpectBegin()
 	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS event_store (.+);`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO event_store_migrations (.+) VALUES (.+)`).
+		WithArgs(1, "create outbox table").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`ALTER TABLE event_store ADD COLUMN IF NOT EXISTS created_at`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO event_store_migrations (.+) VALUES (.+)`).
+		WithArgs(2, "add created_at column").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`(?s)DO .+ CREATE INDEX IF NOT EXISTS "event_store_index_dispatchedAt" ON event_store`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO event_store_migrations (.+) VALUES (.+)`).
+		WithArgs(3, "name indexes after the table").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(`ALTER TABLE event_store\s+ADD COLUMN IF NOT EXISTS attempts`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO event_store_migrations (.+) VALUES (.+)`).
+		WithArgs(4, "track failed sends").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func TestPostgres_RemoveWithArchive(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, db)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	defer ds.Close()
+
+	aid, err := lock.Generate("test", "test_schema")
+	if err != nil {
+		t.Fatalf("failed to generate the lock value: %s", err)
+	}
+
+	mock.ExpectExec(`SELECT pg_advisory_lock(.+)`).
+		WithArgs(aid).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS event_store_archive_migrations (.+);`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(`SELECT version FROM event_store_archive_migrations`).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(1))
+	mock.ExpectBegin()
+	mock.ExpectExec(`ALTER TABLE event_store_archive ADD COLUMN IF NOT EXISTS created_at timestamp`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO event_store_archive_migrations (.+) VALUES (.+)`).
+		WithArgs(2, "add created_at column").
 		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
 	mock.ExpectExec(`SELECT pg_advisory_unlock(.+)`).
 		WithArgs(aid).
 		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := ds.EnableArchive(ctx, ""); err != nil {
+		t.Fatalf("failed to enable the archive: %s", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT (.+) FROM event_store WHERE (.+) ORDER BY id LIMIT 10 FOR UPDATE`).
+		WillReturnRows(sqlmock.NewRows(eventStoreRows).
+			AddRow(1, true, time.Date(2023, time.January, 31, 10, 0, 0, 0, time.UTC), []byte("a"), nil, nil, time.Now()).
+			AddRow(2, true, time.Date(2023, time.February, 1, 10, 0, 0, 0, time.UTC), []byte("b"), nil, nil, time.Now()))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS event_store_archive_p202301 PARTITION OF event_store_archive FOR VALUES FROM \('2023-01-01'\) TO \('2023-02-01'\)`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS event_store_archive_p202302 PARTITION OF event_store_archive FOR VALUES FROM \('2023-02-01'\) TO \('2023-03-01'\)`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO event_store_archive (.+) SELECT (.+) FROM event_store WHERE id IN \(1, 2\)$`).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(`DELETE FROM event_store WHERE id IN \(1, 2\)`).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	if err := ds.Remove(ctx, time.Now(), 10); err != nil {
+		t.Fatalf("failed to remove messages: %s", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT (.+) FROM event_store WHERE (.+) FOR UPDATE`).
+		WillReturnRows(sqlmock.NewRows(eventStoreRows))
+	mock.ExpectCommit()
+
+	if err := ds.Remove(ctx, time.Now(), 10); err != nil {
+		t.Fatalf("failed to remove messages: %s", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT (.+) FROM event_store WHERE (.+) FOR UPDATE`).
+		WillReturnRows(sqlmock.NewRows(eventStoreRows).
+			AddRow(3, true, time.Date(2023, time.March, 1, 10, 0, 0, 0, time.UTC), []byte("c"), nil, nil, time.Now()))
+	mock.ExpectExec(`CREATE TABLE IF NOT EXISTS event_store_archive_p202303 (.+)`).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(`INSERT INTO event_store_archive (.+)`).
+		WillReturnError(errors.New("failed to archive"))
+	mock.ExpectRollback()
+
+	if err := ds.Remove(ctx, time.Now(), 10); err == nil {
+		t.Fatal("an error was expected when archiving fails")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+type archiverFunc func(context.Context, []*outboxer.OutboxMessage) error
+
+func (f archiverFunc) Archive(ctx context.Context, msgs []*outboxer.OutboxMessage) error {
+	return f(ctx, msgs)
+}
+
+func TestPostgres_RemoveWithArchiver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, db)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	defer ds.Close()
+
+	var archived []*outboxer.OutboxMessage
+
+	ds.Archiver = archiverFunc(func(_ context.Context, msgs []*outboxer.OutboxMessage) error {
+		archived = append(archived, msgs...)
+		return nil
+	})
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT (.+) FROM event_store WHERE (.+) FOR UPDATE`).
+		WillReturnRows(sqlmock.NewRows(eventStoreRows).
+			AddRow(1, true, time.Now(), []byte("a"), []byte(`{"topic": "a"}`), nil, time.Now()).
+			AddRow(2, true, time.Now(), []byte("b"), nil, nil, time.Now()))
+	mock.ExpectExec(`DELETE FROM event_store WHERE id IN \(1, 2\)`).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	if err := ds.Remove(ctx, time.Now(), 10); err != nil {
+		t.Fatalf("failed to remove messages: %s", err)
+	}
+
+	if len(archived) != 2 {
+		t.Fatalf("was expecting 2 archived messages but got %d", len(archived))
+	}
+
+	if archived[0].Options["topic"] != "a" {
+		t.Errorf("was expecting the options to be archived but got %v", archived[0].Options)
+	}
+
+	ds.Archiver = archiverFunc(func(context.Context, []*outboxer.OutboxMessage) error {
+		return errors.New("sink is full")
+	})
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(`SELECT (.+) FROM event_store WHERE (.+) FOR UPDATE`).
+		WillReturnRows(sqlmock.NewRows(eventStoreRows).
+			AddRow(3, true, time.Now(), []byte("c"), nil, nil, time.Now()))
+	mock.ExpectRollback()
+
+	if err := ds.Remove(ctx, time.Now(), 10); err == nil {
+		t.Fatal("an error was expected when the archiver fails")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPostgres_SetAsDispatchedMetadata(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, db)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	defer ds.Close()
+
+	mock.ExpectExec(`UPDATE event_store SET dispatched = true, dispatched_at = \$1 WHERE id = \$2;`).
+		WithArgs(sqlmock.AnyArg(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := ds.SetAsDispatched(ctx, 1); err != nil {
+		t.Fatalf("failed to set message as dispatched: %s", err)
+	}
+
+	WithClearMetadataOnDispatch()(ds)
+
+	mock.ExpectExec(`UPDATE event_store SET (.+), options = '{}', headers = '{}' WHERE id = \$2;`).
+		WithArgs(sqlmock.AnyArg(), 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := ds.SetAsDispatched(ctx, 2); err != nil {
+		t.Fatalf("failed to set message as dispatched: %s", err)
+	}
+
+	mock.ExpectExec(`UPDATE event_store SET options = '{}', headers = '{}' WHERE id IN (.+) LIMIT 10`).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+	mock.ExpectExec(`UPDATE event_store SET (.+)`).
+		WillReturnError(errors.New("failed to compact"))
+
+	if err := ds.Compact(ctx, time.Now(), 10); err != nil {
+		t.Fatalf("failed to compact messages: %s", err)
+	}
+
+	if err := ds.Compact(ctx, time.Now(), 10); err == nil {
+		t.Fatal("an error was expected when compacting fails")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPostgres_Replay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, db)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	defer ds.Close()
+
+	since := time.Now().Add(-time.Hour)
+	filter := outboxer.ReplayFilter{
+		FromID:          10,
+		ToID:            20,
+		DispatchedAfter: since,
+		Destination:     outboxer.DynamicValues{"topic_name": "orders"},
+	}
+
+	mock.ExpectQuery(`SELECT COUNT\(\*\) FROM event_store WHERE dispatched = true AND id >= \$1 AND id <= \$2 AND dispatched_at >= \$3 AND options @> \$4::jsonb`).
+		WithArgs(10, 20, since, `{"topic_name":"orders"}`).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(2))
+
+	count, err := ds.CountDispatched(ctx, filter)
+	if err != nil {
+		t.Fatalf("failed to count messages: %s", err)
+	}
+
+	if count != 2 {
+		t.Fatalf("was expecting 2 messages but got %d", count)
+	}
+
+	mock.ExpectQuery(`SELECT (.+) FROM event_store WHERE id > \$1 AND dispatched = true AND id >= \$2 (.+) ORDER BY id LIMIT 5`).
+		WithArgs(12, 10, 20, since, `{"topic_name":"orders"}`).
+		WillReturnRows(sqlmock.NewRows(eventStoreRows).
+			AddRow(13, true, time.Now(), []byte("a"), []byte(`{"topic_name": "orders"}`), nil, time.Now()))
+
+	msgs, err := ds.GetDispatched(ctx, filter, 12, 5)
+	if err != nil {
+		t.Fatalf("failed to get messages: %s", err)
+	}
+
+	if len(msgs) != 1 || msgs[0].ID != 13 {
+		t.Fatalf("was expecting message 13 but got %v", msgs)
+	}
+
+	mock.ExpectExec(`UPDATE event_store SET dispatched = false, dispatched_at = NULL WHERE dispatched = true AND id >= \$1`).
+		WithArgs(10).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	replayed, err := ds.Replay(ctx, outboxer.ReplayFilter{FromID: 10}, nil)
+	if err != nil {
+		t.Fatalf("failed to replay messages: %s", err)
+	}
+
+	if replayed != 3 {
+		t.Fatalf("was expecting 3 replayed messages but got %d", replayed)
+	}
+
+	mock.ExpectExec(`UPDATE event_store SET (.+), options = COALESCE\(options, '{}'::jsonb\) \|\| \$1::jsonb WHERE dispatched = true AND id <= \$2`).
+		WithArgs(`{"topic_name":"orders.replay"}`, 20).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if _, err := ds.Replay(ctx, outboxer.ReplayFilter{ToID: 20}, outboxer.DynamicValues{"topic_name": "orders.replay"}); err != nil {
+		t.Fatalf("failed to replay messages: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPostgres_Inspect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, db)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	defer ds.Close()
+
+	lastDispatchedAt := time.Now()
+
+	mock.ExpectQuery(`SELECT (.+) FROM event_store`).
+		WillReturnRows(sqlmock.NewRows([]string{"pending", "dispatched", "failed", "dead", "oldest", "last"}).
+			AddRow(3, 7, 1, 2, 8, lastDispatchedAt))
+
+	stats, err := ds.Stats(ctx)
+	if err != nil {
+		t.Fatalf("failed to get stats: %s", err)
+	}
+
+	if stats.Pending != 3 || stats.Dispatched != 7 || stats.Failed != 1 || stats.Dead != 2 || stats.OldestPendingID.Int64 != 8 || !stats.LastDispatchedAt.Valid {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	mock.ExpectQuery(`SELECT (.+) FROM event_store WHERE id = \$1`).
+		WithArgs(8).
+		WillReturnRows(sqlmock.NewRows(inspectRows).
+			AddRow(8, false, nil, []byte("payload"), nil, nil, time.Now(), 0, nil, false))
+	mock.ExpectQuery(`SELECT (.+) FROM event_store WHERE id = \$1`).
+		WithArgs(9).
+		WillReturnRows(sqlmock.NewRows(inspectRows))
+
+	msg, err := ds.GetEvent(ctx, 8)
+	if err != nil {
+		t.Fatalf("failed to get message: %s", err)
+	}
+
+	if msg.ID != 8 || string(msg.Payload) != "payload" {
+		t.Fatalf("unexpected message %+v", msg)
+	}
+
+	if _, err := ds.GetEvent(ctx, 9); !errors.Is(err, outboxer.ErrMessageNotFound) {
+		t.Fatalf("was expecting ErrMessageNotFound but got %v", err)
+	}
+
+	mock.ExpectQuery(`SELECT (.+) FROM event_store WHERE id > \$1 AND dispatched = false AND dead = false ORDER BY id LIMIT 20`).
+		WithArgs(5).
+		WillReturnRows(sqlmock.NewRows(inspectRows).
+			AddRow(8, false, nil, []byte("payload"), nil, nil, time.Now(), 0, nil, false))
+
+	msgs, err := ds.ListEvents(ctx, outboxer.ListFilter{State: outboxer.PendingState, AfterID: 5, Limit: 20})
+	if err != nil {
+		t.Fatalf("failed to list messages: %s", err)
+	}
+
+	if len(msgs) != 1 {
+		t.Fatalf("was expecting 1 message but got %d", len(msgs))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestPostgres_IsRetryable(t *testing.T) {
+	p := &Postgres{}
+
+	for code, want := range map[pq.ErrorCode]bool{"40001": true, "40P01": true, "23505": false} {
+		err := fmt.Errorf("transaction commit failed: %w", &pq.Error{Code: code})
+		if got := p.IsRetryable(err); got != want {
+			t.Errorf("expected IsRetryable to be %t for %s, got %t", want, code, got)
+		}
+	}
+
+	if p.IsRetryable(errors.New("connection refused")) {
+		t.Error("expected a generic error not to be retryable")
+	}
 }
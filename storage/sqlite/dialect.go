@@ -0,0 +1,294 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/migrate"
+	"github.com/italolelis/outboxer/storage/sqlstore"
+)
+
+const (
+	// errBusy and errLocked are the retryable primary result codes.
+	errBusy   = 5
+	errLocked = 6
+
+	// maxInsertRows keeps a multi-row insert under the default limit of 32766 parameters.
+	maxInsertRows = 1000
+
+	// timeLayout is how timestamps are stored. All of them are UTC and share the layout,
+	// so they can be compared as text.
+	timeLayout = "2006-01-02 15:04:05.000"
+
+	// leaseDuration is how long the migrations lock is leased for, a crashed process can't hold it for longer.
+	leaseDuration = time.Minute
+
+	// lockTimeout is how long to wait for the lease before giving up.
+	lockTimeout = 10 * time.Second
+
+	// lockPollInterval is how often the lease is tried while another data store holds it.
+	lockPollInterval = 100 * time.Millisecond
+
+	// leasesTableSuffix is appended to the outbox table name to name the lock table.
+	leasesTableSuffix = "_leases"
+
+	// leaseName is the name of the migrations lease, there is a lease table per outbox table.
+	leaseName = "migrations"
+)
+
+// dialect is the sqlite flavour of SQL.
+type dialect struct {
+	// owner tells the lease of this data store apart from the ones of other data stores.
+	owner string
+}
+
+func (dialect) Placeholder(int) string { return "?" }
+
+func (dialect) Quote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func (dialect) Bool(v bool) string {
+	if v {
+		return "true"
+	}
+
+	return "false"
+}
+
+func (dialect) Limit(n int32) (string, string) { return "", fmt.Sprintf("LIMIT %d", n) }
+
+// LockRows is empty, a write transaction locks the whole database.
+func (dialect) LockRows() (string, string) { return "", "" }
+
+func (dialect) Returning() (string, string) { return "", "RETURNING id, created_at" }
+
+func (dialect) MaxInsertRows() int { return maxInsertRows }
+
+func (dialect) Metadata(v outboxer.DynamicValues) interface{} { return v }
+
+func (dialect) EmptyMetadata() string { return "NULL" }
+
+func (dialect) HasMetadata() string { return "(options IS NOT NULL OR headers IS NOT NULL)" }
+
+// OptionsContain compares the values one by one, the options are stored as a JSON blob.
+func (dialect) OptionsContain(args *sqlstore.Args, values outboxer.DynamicValues) (string, error) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	conds := make([]string, 0, len(keys))
+	for _, k := range keys {
+		data, err := json.Marshal(values[k])
+		if err != nil {
+			return "", fmt.Errorf("failed to encode the destination filter: %w", err)
+		}
+
+		path := args.Add(fmt.Sprintf("$.%q", k))
+		conds = append(conds, fmt.Sprintf("json_extract(CAST(options AS TEXT), %s) = json_extract(%s, '$')", path, args.Add(string(data))))
+	}
+
+	return strings.Join(conds, " AND "), nil
+}
+
+// MergeOptions is empty, the options are stored as a blob so they are merged row by row.
+func (dialect) MergeOptions(*sqlstore.Args, outboxer.DynamicValues) (string, error) {
+	return "", nil
+}
+
+// Lock takes the lease of the migrations lock, SQLite has no advisory locks. Each migration only runs
+// within a transaction of its own, so without the lease two processes could both apply it. An expired
+// lease is taken over, so a crashed process can't hold the lock for longer than leaseDuration.
+func (d dialect) Lock(ctx context.Context, conn *sql.Conn, s *sqlstore.Store) error {
+	table := s.Ident(s.EventStoreTable + leasesTableSuffix)
+
+	// nolint
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	name TEXT not null primary key,
+	owner TEXT not null,
+	expires_at INTEGER not null
+);
+`, table)); err != nil {
+		return fmt.Errorf("failed to create the lease table: %w", err)
+	}
+
+	// nolint
+	query := fmt.Sprintf(`
+INSERT INTO %s (name, owner, expires_at)
+VALUES (?, ?, CAST(strftime('%%s', 'now') AS INTEGER) + ?)
+ON CONFLICT (name) DO UPDATE
+SET owner = excluded.owner, expires_at = excluded.expires_at
+WHERE expires_at < CAST(strftime('%%s', 'now') AS INTEGER) OR owner = excluded.owner
+RETURNING owner
+`, table)
+
+	ctx, cancel := context.WithTimeout(ctx, lockTimeout)
+	defer cancel()
+
+	for {
+		var owner string
+
+		err := conn.QueryRowContext(ctx, query, leaseName, d.owner, int64(leaseDuration/time.Second)).Scan(&owner)
+		if err == nil {
+			return nil
+		}
+
+		if !errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("try lock failed: %w", err)
+		}
+
+		t := s.Clock.NewTimer(lockPollInterval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return sqlstore.ErrLocked
+		case <-t.C():
+		}
+	}
+}
+
+// Unlock gives the lease up, if it is still held by this data store.
+func (d dialect) Unlock(ctx context.Context, conn *sql.Conn, s *sqlstore.Store) error {
+	// nolint
+	query := fmt.Sprintf(`DELETE FROM %s WHERE name = ? AND owner = ?`, s.Ident(s.EventStoreTable+leasesTableSuffix))
+	_, err := conn.ExecContext(ctx, query, leaseName, d.owner)
+
+	return err
+}
+
+func (dialect) MigrationsDialect(s *sqlstore.Store, table string) migrate.Dialect {
+	table = s.Ident(table + sqlstore.MigrationsTableSuffix)
+
+	return migrate.Dialect{
+		CreateTable: fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %s (
+	version INTEGER not null primary key,
+	description TEXT not null,
+	applied_at DATETIME not null default CURRENT_TIMESTAMP
+);
+`, table),
+		SelectVersions: fmt.Sprintf(`SELECT version FROM %s`, table),
+		InsertVersion:  fmt.Sprintf(`INSERT INTO %s (version, description) VALUES (?, ?)`, table),
+	}
+}
+
+// Migrations prefix the index names with the table name, they are global in SQLite.
+func (d dialect) Migrations(s *sqlstore.Store) []migrate.Migration {
+	return []migrate.Migration{
+		{
+			Version:     1,
+			Description: "create outbox table",
+			Up: fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %[1]s (
+	id INTEGER not null primary key,
+	dispatched BOOLEAN not null default false,
+	dispatched_at DATETIME,
+	payload BLOB not null,
+	options JSON,
+	headers JSON,
+	created_at DATETIME not null default (strftime('%%Y-%%m-%%d %%H:%%M:%%f', 'now'))
+);
+
+CREATE INDEX IF NOT EXISTS %[2]s ON %[1]s (dispatched_at);
+CREATE INDEX IF NOT EXISTS %[3]s ON %[1]s (dispatched);
+`, s.Ident(s.EventStoreTable), d.Quote(s.EventStoreTable+"_index_dispatchedAt"), d.Quote(s.EventStoreTable+"_index_dispatched")),
+		},
+		{
+			Version:     2,
+			Description: "track failed sends",
+			Up: fmt.Sprintf(`
+ALTER TABLE %[1]s ADD COLUMN attempts INTEGER not null default 0;
+ALTER TABLE %[1]s ADD COLUMN last_error TEXT;
+ALTER TABLE %[1]s ADD COLUMN dead BOOLEAN not null default false;
+`, s.Ident(s.EventStoreTable)),
+		},
+	}
+}
+
+func (d dialect) ArchiveMigrations(s *sqlstore.Store) []migrate.Migration {
+	return []migrate.Migration{
+		{
+			Version:     1,
+			Description: "create archive table",
+			Up: fmt.Sprintf(`
+CREATE TABLE IF NOT EXISTS %[1]s (
+	id INTEGER not null primary key,
+	dispatched BOOLEAN not null default false,
+	dispatched_at DATETIME not null,
+	payload BLOB not null,
+	options JSON,
+	headers JSON,
+	archived_at DATETIME not null default (strftime('%%Y-%%m-%%d %%H:%%M:%%f', 'now'))
+);
+
+CREATE INDEX IF NOT EXISTS %[2]s ON %[1]s (dispatched_at);
+`, s.Ident(s.ArchiveTable), d.Quote(s.ArchiveTable+"_index_dispatched_at")),
+		},
+		{
+			Version:     2,
+			Description: "add created_at column",
+			Up: fmt.Sprintf(`
+ALTER TABLE %s ADD COLUMN created_at DATETIME;
+`, s.Ident(s.ArchiveTable)),
+		},
+		{
+			Version:     3,
+			Description: "key the archive on id and archived_at",
+			// SQLite can't change the primary key of a table, it is copied into a new one
+			Up: fmt.Sprintf(`
+CREATE TABLE %[2]s (
+	id INTEGER not null,
+	dispatched BOOLEAN not null default false,
+	dispatched_at DATETIME not null,
+	payload BLOB not null,
+	options JSON,
+	headers JSON,
+	archived_at DATETIME not null default (strftime('%%Y-%%m-%%d %%H:%%M:%%f', 'now')),
+	created_at DATETIME,
+	PRIMARY KEY (id, archived_at)
+);
+
+INSERT INTO %[2]s (id, dispatched, dispatched_at, payload, options, headers, archived_at, created_at)
+SELECT id, dispatched, dispatched_at, payload, options, headers, archived_at, created_at FROM %[1]s;
+
+DROP TABLE %[1]s;
+ALTER TABLE %[2]s RENAME TO %[3]s;
+
+CREATE INDEX IF NOT EXISTS %[4]s ON %[1]s (dispatched_at);
+`, s.Ident(s.ArchiveTable), s.Ident(s.ArchiveTable+"_new"), d.Quote(s.ArchiveTable),
+				d.Quote(s.ArchiveTable+"_index_dispatched_at")),
+		},
+	}
+}
+
+// BindTime stores the timestamps as UTC text, see timeLayout.
+func (dialect) BindTime(t time.Time) interface{} {
+	return t.UTC().Format(timeLayout)
+}
+
+func (dialect) ParseTime(v string) (time.Time, error) {
+	return time.Parse(timeLayout, v)
+}
+
+func (dialect) IsRetryable(err error) bool {
+	var e interface{ Code() int }
+	if !errors.As(err, &e) {
+		return false
+	}
+
+	// extended result codes keep the primary result code in the lower byte
+	code := e.Code() & 0xff
+
+	return code == errBusy || code == errLocked
+}
@@ -0,0 +1,44 @@
+package sqlite
+
+import "github.com/italolelis/outboxer"
+
+// Option represents the sqlite data store options.
+type Option func(*SQLite)
+
+// WithEventStoreTable sets the name of the outbox table.
+func WithEventStoreTable(name string) Option {
+	return func(p *SQLite) {
+		p.EventStoreTable = name
+	}
+}
+
+// WithoutDDL never creates or changes tables. The data store only validates that the outbox table
+// exists and has the expected columns, for setups where the schema is managed outside the application, see DDL.
+func WithoutDDL() Option {
+	return func(p *SQLite) {
+		p.SkipDDL = true
+	}
+}
+
+// WithClearMetadataOnDispatch wipes the options and headers of a message once it is dispatched.
+// By default they are kept for audit and replay, see Compact to strip them later on.
+func WithClearMetadataOnDispatch() Option {
+	return func(p *SQLite) {
+		p.ClearMetadataOnDispatch = true
+	}
+}
+
+// WithArchiveTable makes Remove move dispatched messages into the given archive table instead of
+// deleting them, like EnableArchive. With WithoutDDL the table is only validated and DDL includes it.
+func WithArchiveTable(name string) Option {
+	return func(p *SQLite) {
+		p.ArchiveTable = name
+	}
+}
+
+// WithClock sets the clock of the created_at and dispatched_at timestamps, the system clock by default.
+func WithClock(c outboxer.Clock) Option {
+	return func(p *SQLite) {
+		p.Clock = c
+	}
+}
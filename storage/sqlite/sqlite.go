@@ -0,0 +1,90 @@
+// Package sqlite is the implementation of the sqlite data store.
+//
+// SQLite allows a single writer at a time, so the data store serializes its own write transactions.
+// It has no advisory locks either, migrations are guarded by a lease in a <table>_leases table.
+//
+// The supported driver is modernc.org/sqlite, IsRetryable relies on the Code method of its errors.
+// The connection should set a busy timeout, so writers from other processes wait for the lock
+// instead of failing right away.
+package sqlite
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/italolelis/outboxer/storage/sqlstore"
+)
+
+const (
+	// DefaultEventStoreTable is the default table name.
+	DefaultEventStoreTable = sqlstore.DefaultEventStoreTable
+
+	// DefaultArchiveTable is the default archive table name.
+	DefaultArchiveTable = sqlstore.DefaultArchiveTable
+)
+
+var (
+	// ErrInvalidSchema is used when DDL is disabled and the outbox table doesn't have the expected columns.
+	ErrInvalidSchema = sqlstore.ErrInvalidSchema
+)
+
+// SQLite is the implementation of the data store.
+// SQLite has no schemas, table names are never qualified and are always quoted.
+type SQLite struct {
+	*sqlstore.Store
+}
+
+func newSQLite(db *sql.DB, owner string) SQLite {
+	p := SQLite{Store: sqlstore.New(db, dialect{owner: owner})}
+	p.QuoteIdentifiers = true
+	p.SerializeWrites = true
+
+	return p
+}
+
+// WithInstance creates a sqlite data store with an existing db connection pool.
+func WithInstance(ctx context.Context, db *sql.DB, opts ...Option) (*SQLite, error) {
+	owner := make([]byte, 8)
+	if _, err := rand.Read(owner); err != nil {
+		return nil, fmt.Errorf("failed to generate the lease owner: %w", err)
+	}
+
+	p := newSQLite(db, hex.EncodeToString(owner))
+
+	for _, opt := range opts {
+		opt(&p)
+	}
+
+	if err := db.PingContext(ctx); err != nil {
+		return nil, fmt.Errorf("could not ping to SQLite database: %w", err)
+	}
+
+	if err := p.Setup(ctx); err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// DDL returns the statements that create the outbox table, for schemas that are managed outside
+// the application. It takes the same options as WithInstance.
+func DDL(opts ...Option) string {
+	p := newSQLite(nil, "")
+	p.EventStoreTable = DefaultEventStoreTable
+
+	for _, opt := range opts {
+		opt(&p)
+	}
+
+	return p.Store.DDL()
+}
+
+// IsRetryable reports if the error is SQLITE_BUSY (5) or SQLITE_LOCKED (6), which happen when another
+// connection holds the write lock for longer than the busy timeout. It matches the errors of
+// modernc.org/sqlite, which have a Code method.
+func (p *SQLite) IsRetryable(err error) bool {
+	return dialect{}.IsRetryable(err)
+}
@@ -0,0 +1,28 @@
+package sqlite_test
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/italolelis/outboxer/storage/sqlite"
+	_ "modernc.org/sqlite"
+)
+
+func ExampleSQLite() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, err := sql.Open("sqlite", "file:outbox.db?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate")
+	if err != nil {
+		fmt.Printf("failed to open the sqlite database: %s", err)
+		return
+	}
+
+	defer db.Close()
+
+	if _, err := sqlite.WithInstance(ctx, db); err != nil {
+		fmt.Printf("failed to setup the data store: %s", err)
+		return
+	}
+}
@@ -0,0 +1,681 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/outboxertest"
+	"github.com/italolelis/outboxer/storage/storetest"
+	_ "modernc.org/sqlite"
+)
+
+func openDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	return openPath(t, filepath.Join(t.TempDir(), "outbox.db"))
+}
+
+// openPath opens the database at path, a connection pool per call stands for a process.
+func openPath(t *testing.T, path string) *sql.DB {
+	t.Helper()
+
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatalf("failed to open the database: %s", err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	return db
+}
+
+func TestSQLite_AddSuccessfully(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, err := WithInstance(ctx, openDB(t))
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	evt := outboxer.OutboxMessage{
+		Payload: []byte("test payload"),
+		Options: outboxer.DynamicValues{"exchange.name": "test"},
+		Headers: outboxer.DynamicValues{"trace_id": "abc"},
+	}
+	if err := ds.Add(ctx, &evt); err != nil {
+		t.Fatalf("failed to add message in the data store: %s", err)
+	}
+
+	if evt.ID != 1 || evt.CreatedAt.IsZero() {
+		t.Fatalf("was expecting the ID and creation time to be set but got %d and %s", evt.ID, evt.CreatedAt)
+	}
+
+	msgs, err := ds.GetEvents(ctx, 10)
+	if err != nil {
+		t.Fatalf("failed to retrieve messages from the data store: %s", err)
+	}
+
+	if len(msgs) != 1 {
+		t.Fatalf("was expecting 1 message in the data store but got %d", len(msgs))
+	}
+
+	m := msgs[0]
+	if string(m.Payload) != "test payload" || m.Options["exchange.name"] != "test" || m.Headers["trace_id"] != "abc" {
+		t.Fatalf("the message was not stored as it was added: %+v", m)
+	}
+
+	if err := ds.SetAsDispatched(ctx, m.ID); err != nil {
+		t.Fatalf("failed to set message as dispatched: %s", err)
+	}
+
+	if msgs, err = ds.GetEvents(ctx, 10); err != nil || len(msgs) != 0 {
+		t.Fatalf("was expecting no pending messages but got %d (%v)", len(msgs), err)
+	}
+
+	if err := ds.Remove(ctx, time.Now().Add(time.Second), 10); err != nil {
+		t.Fatalf("failed to remove messages: %s", err)
+	}
+
+	if n := count(t, ds); n != 0 {
+		t.Fatalf("was expecting the message to be removed but got %d messages", n)
+	}
+}
+
+func TestSQLite_Remove(t *testing.T) {
+	ctx := context.Background()
+
+	ds, err := WithInstance(ctx, openDB(t))
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	msgs := make([]*outboxer.OutboxMessage, 5)
+	for i := range msgs {
+		msgs[i] = &outboxer.OutboxMessage{Payload: []byte("test payload")}
+	}
+
+	if err := ds.AddAll(ctx, msgs...); err != nil {
+		t.Fatalf("failed to add messages: %s", err)
+	}
+
+	for i, m := range msgs {
+		if m.ID != int64(i+1) {
+			t.Fatalf("was expecting message %d to have the id %d but got %d", i, i+1, m.ID)
+		}
+
+		if i < 4 {
+			if err := ds.SetAsDispatched(ctx, m.ID); err != nil {
+				t.Fatalf("failed to set message as dispatched: %s", err)
+			}
+		}
+	}
+
+	if err := ds.Remove(ctx, time.Now().Add(-time.Hour), 10); err != nil {
+		t.Fatalf("failed to remove messages: %s", err)
+	}
+
+	if n := count(t, ds); n != 5 {
+		t.Fatalf("was expecting recently dispatched messages to be kept but got %d messages", n)
+	}
+
+	if err := ds.Remove(ctx, time.Now().Add(time.Second), 3); err != nil {
+		t.Fatalf("failed to remove messages: %s", err)
+	}
+
+	if n := count(t, ds); n != 2 {
+		t.Fatalf("was expecting a batch of 3 messages to be removed but got %d messages", n)
+	}
+}
+
+func TestSQLite_RemoveWithClock(t *testing.T) {
+	ctx := context.Background()
+	clock := outboxertest.NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	ds, err := WithInstance(ctx, openDB(t), WithClock(clock))
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	dispatch := func(n int) {
+		for i := 0; i < n; i++ {
+			m := &outboxer.OutboxMessage{Payload: []byte("test payload")}
+			if err := ds.Add(ctx, m); err != nil {
+				t.Fatalf("failed to add message: %s", err)
+			}
+
+			if !m.CreatedAt.Equal(clock.Now()) {
+				t.Fatalf("was expecting the message to be created at %s but got %s", clock.Now(), m.CreatedAt)
+			}
+
+			if err := ds.SetAsDispatched(ctx, m.ID); err != nil {
+				t.Fatalf("failed to set message as dispatched: %s", err)
+			}
+		}
+	}
+
+	dispatch(2)
+	clock.Advance(48 * time.Hour)
+	dispatch(1)
+
+	if err := ds.Remove(ctx, clock.Now().Add(-24*time.Hour), 10); err != nil {
+		t.Fatalf("failed to remove messages: %s", err)
+	}
+
+	if n := count(t, ds); n != 1 {
+		t.Fatalf("was expecting the messages dispatched two days ago to be removed but got %d messages", n)
+	}
+}
+
+func TestSQLite_AddWithinTx(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+
+	ds, err := WithInstance(ctx, db)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	if _, err := db.ExecContext(ctx, `CREATE TABLE orders (id INTEGER primary key, status TEXT)`); err != nil {
+		t.Fatalf("failed to create the orders table: %s", err)
+	}
+
+	fnErr := errors.New("payment declined")
+	err = ds.AddWithinTx(ctx, &outboxer.OutboxMessage{Payload: []byte("rolled back")}, func(tx outboxer.ExecerContext) error {
+		if _, err := tx.ExecContext(ctx, `INSERT INTO orders (status) VALUES ('paid')`); err != nil {
+			return err
+		}
+
+		return fnErr
+	})
+	if !errors.Is(err, fnErr) {
+		t.Fatalf("was expecting %s but got %v", fnErr, err)
+	}
+
+	if err := ds.AddWithinTx(ctx, &outboxer.OutboxMessage{Payload: []byte("committed")}, func(tx outboxer.ExecerContext) error {
+		_, err := tx.ExecContext(ctx, `INSERT INTO orders (status) VALUES ('paid')`)
+		return err
+	}); err != nil {
+		t.Fatalf("failed to add message within the transaction: %s", err)
+	}
+
+	var orders int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM orders`).Scan(&orders); err != nil {
+		t.Fatalf("failed to count orders: %s", err)
+	}
+
+	if orders != 1 || count(t, ds) != 1 {
+		t.Fatalf("was expecting only the committed order and message, got %d orders", orders)
+	}
+}
+
+func TestSQLite_AddInTx(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+
+	ds, err := WithInstance(ctx, db, WithEventStoreTable("outbox"))
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin the transaction: %s", err)
+	}
+
+	msgs := []*outboxer.OutboxMessage{{Payload: []byte("first")}, {Payload: []byte("second")}}
+	if err := ds.AddInTx(ctx, tx, msgs...); err != nil {
+		t.Fatalf("failed to add messages in the transaction: %s", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("failed to commit the transaction: %s", err)
+	}
+
+	for i, m := range msgs {
+		if m.ID != int64(i+1) || m.CreatedAt.IsZero() {
+			t.Fatalf("was expecting the ID and creation time to be set but got %d and %s", m.ID, m.CreatedAt)
+		}
+	}
+
+	if n := count(t, ds); n != 2 {
+		t.Fatalf("was expecting 2 messages but got %d", n)
+	}
+}
+
+func TestSQLite_Migrate(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+
+	if _, err := WithInstance(ctx, db); err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	ds, err := WithInstance(ctx, db)
+	if err != nil {
+		t.Fatalf("failed to setup the data store a second time: %s", err)
+	}
+
+	var versions int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_store_migrations`).Scan(&versions); err != nil {
+		t.Fatalf("failed to count migrations: %s", err)
+	}
+
+	if want := len(dialect{}.Migrations(ds.Store)); versions != want {
+		t.Fatalf("was expecting %d applied migrations but got %d", want, versions)
+	}
+}
+
+func TestSQLite_ConcurrentMigrate(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "outbox.db")
+
+	const n = 4
+
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		db := openPath(t, path)
+
+		go func() {
+			_, err := WithInstance(ctx, db, WithArchiveTable(DefaultArchiveTable))
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("failed to setup the data store concurrently: %s", err)
+		}
+	}
+
+	db := openPath(t, path)
+
+	var versions int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_store_migrations`).Scan(&versions); err != nil {
+		t.Fatalf("failed to count migrations: %s", err)
+	}
+
+	if want := len(dialect{}.Migrations(newSQLite(nil, "").Store)); versions != want {
+		t.Fatalf("was expecting %d applied migrations but got %d", want, versions)
+	}
+
+	var leases int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_store_leases`).Scan(&leases); err != nil {
+		t.Fatalf("failed to count leases: %s", err)
+	}
+
+	if leases != 0 {
+		t.Fatalf("expected the lease to be given up, got %d leases", leases)
+	}
+}
+
+func TestSQLite_LockWaitsForLease(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	db := openDB(t)
+
+	if _, err := db.ExecContext(ctx, `
+CREATE TABLE event_store_leases (name TEXT not null primary key, owner TEXT not null, expires_at INTEGER not null);
+INSERT INTO event_store_leases VALUES ('migrations', 'other', CAST(strftime('%s', 'now') AS INTEGER) + 60);
+`); err != nil {
+		t.Fatalf("failed to take the lease: %s", err)
+	}
+
+	clock := outboxertest.NewClock(time.Now())
+	errs := make(chan error, 1)
+
+	go func() {
+		_, err := WithInstance(ctx, db, WithClock(clock))
+		errs <- err
+	}()
+
+	if err := clock.WaitForTimers(ctx, 1); err != nil {
+		t.Fatalf("expected the lock to wait for the lease: %s", err)
+	}
+
+	if _, err := db.ExecContext(ctx, `DELETE FROM event_store_leases`); err != nil {
+		t.Fatalf("failed to give the lease up: %s", err)
+	}
+
+	clock.Advance(lockPollInterval)
+
+	if err := <-errs; err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+}
+
+func TestSQLite_ReplayAndArchive(t *testing.T) {
+	ctx := context.Background()
+	db := openDB(t)
+
+	ds, err := WithInstance(ctx, db, WithArchiveTable("event_store_archive"))
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	msgs := []*outboxer.OutboxMessage{
+		{Payload: []byte("first"), Options: outboxer.DynamicValues{"exchange.name": "orders", "priority": 1}},
+		{Payload: []byte("second"), Options: outboxer.DynamicValues{"exchange.name": "payments"}},
+		{Payload: []byte("third"), Options: outboxer.DynamicValues{"exchange.name": "orders", "priority": 2}},
+	}
+	if err := ds.AddAll(ctx, msgs...); err != nil {
+		t.Fatalf("failed to add messages: %s", err)
+	}
+
+	for _, m := range msgs {
+		if err := ds.SetAsDispatched(ctx, m.ID); err != nil {
+			t.Fatalf("failed to set message as dispatched: %s", err)
+		}
+	}
+
+	f := outboxer.ReplayFilter{Destination: outboxer.DynamicValues{"exchange.name": "orders", "priority": 1}}
+	if n, err := ds.CountDispatched(ctx, f); err != nil || n != 1 {
+		t.Fatalf("was expecting 1 message to match the destination but got %d (%v)", n, err)
+	}
+
+	n, err := ds.Replay(ctx, f, outboxer.DynamicValues{"exchange.name": "orders.replay"})
+	if err != nil || n != 1 {
+		t.Fatalf("was expecting 1 message to be replayed but got %d (%v)", n, err)
+	}
+
+	m, err := ds.GetEvent(ctx, msgs[0].ID)
+	if err != nil {
+		t.Fatalf("failed to get the replayed message: %s", err)
+	}
+
+	if m.Dispatched || m.Options["exchange.name"] != "orders.replay" || m.Options["priority"] != float64(1) {
+		t.Fatalf("was expecting the message to be pending with the override merged but got %+v", m)
+	}
+
+	stats, err := ds.Stats(ctx)
+	if err != nil {
+		t.Fatalf("failed to get the data store stats: %s", err)
+	}
+
+	if stats.Pending != 1 || stats.Dispatched != 2 || stats.OldestPendingID.Int64 != msgs[0].ID || !stats.LastDispatchedAt.Valid {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	if err := ds.Compact(ctx, time.Now().Add(time.Second), 10); err != nil {
+		t.Fatalf("failed to compact messages: %s", err)
+	}
+
+	if err := ds.Remove(ctx, time.Now().Add(time.Second), 10); err != nil {
+		t.Fatalf("failed to remove messages: %s", err)
+	}
+
+	var archived int
+	if err := db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_store_archive WHERE options IS NULL AND created_at IS NOT NULL`).Scan(&archived); err != nil {
+		t.Fatalf("failed to count archived messages: %s", err)
+	}
+
+	if archived != 2 || count(t, ds) != 1 {
+		t.Fatalf("was expecting the 2 compacted messages to be archived with their creation time but got %d", archived)
+	}
+}
+
+func TestSQLite_FailureTracking(t *testing.T) {
+	ctx := context.Background()
+
+	ds, err := WithInstance(ctx, openDB(t))
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	msgs := []*outboxer.OutboxMessage{{Payload: []byte("first")}, {Payload: []byte("second")}}
+	if err := ds.AddAll(ctx, msgs...); err != nil {
+		t.Fatalf("failed to add messages: %s", err)
+	}
+
+	for _, reason := range []string{"broker unavailable", "connection reset"} {
+		if err := ds.SetAsFailed(ctx, msgs[0].ID, reason, 2); err != nil {
+			t.Fatalf("failed to set message as failed: %s", err)
+		}
+	}
+
+	if err := ds.SetAsFailed(ctx, msgs[1].ID, "broker unavailable", 2); err != nil {
+		t.Fatalf("failed to set message as failed: %s", err)
+	}
+
+	dead, err := ds.ListEvents(ctx, outboxer.ListFilter{State: outboxer.DeadState, Limit: 10})
+	if err != nil {
+		t.Fatalf("failed to list dead messages: %s", err)
+	}
+
+	if len(dead) != 1 || dead[0].ID != msgs[0].ID || dead[0].Attempts != 2 || dead[0].LastError != "connection reset" {
+		t.Fatalf("was expecting the first message to be dead but got %+v", dead)
+	}
+
+	pending, err := ds.GetEvents(ctx, 10)
+	if err != nil {
+		t.Fatalf("failed to get messages: %s", err)
+	}
+
+	if len(pending) != 1 || pending[0].ID != msgs[1].ID {
+		t.Fatalf("was expecting only the second message to be dispatched but got %+v", pending)
+	}
+
+	stats, err := ds.Stats(ctx)
+	if err != nil {
+		t.Fatalf("failed to get the data store stats: %s", err)
+	}
+
+	if stats.Pending != 1 || stats.Failed != 1 || stats.Dead != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	n, err := ds.Requeue(ctx, msgs[0].ID, msgs[1].ID)
+	if err != nil || n != 1 {
+		t.Fatalf("was expecting 1 message to be requeued but got %d (%v)", n, err)
+	}
+
+	m, err := ds.GetEvent(ctx, msgs[0].ID)
+	if err != nil {
+		t.Fatalf("failed to get the requeued message: %s", err)
+	}
+
+	if m.Dead || m.Attempts != 0 || m.LastError != "" {
+		t.Fatalf("was expecting the message to be pending again but got %+v", m)
+	}
+}
+
+func TestSQLite_ClearMetadataOnDispatch(t *testing.T) {
+	cases := []struct {
+		name string
+		opts []Option
+		kept bool
+	}{
+		{name: "default", kept: true},
+		{name: "cleared", opts: []Option{WithClearMetadataOnDispatch()}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			ds, err := WithInstance(ctx, openDB(t), c.opts...)
+			if err != nil {
+				t.Fatalf("failed to setup the data store: %s", err)
+			}
+
+			evt := outboxer.OutboxMessage{
+				Payload: []byte("payload"),
+				Options: outboxer.DynamicValues{"topic": "orders"},
+				Headers: outboxer.DynamicValues{"trace_id": "abc"},
+			}
+			if err := ds.Add(ctx, &evt); err != nil {
+				t.Fatalf("failed to add message: %s", err)
+			}
+
+			if err := ds.SetAsDispatched(ctx, evt.ID); err != nil {
+				t.Fatalf("failed to set message as dispatched: %s", err)
+			}
+
+			m, err := ds.GetEvent(ctx, evt.ID)
+			if err != nil {
+				t.Fatalf("failed to get the message: %s", err)
+			}
+
+			if kept := m.Options["topic"] == "orders" && m.Headers["trace_id"] == "abc"; kept != c.kept {
+				t.Fatalf("was expecting the metadata kept to be %t but got %+v", c.kept, m)
+			}
+		})
+	}
+}
+
+func TestSQLite_DDL(t *testing.T) {
+	ddl := DDL(WithEventStoreTable("outbox"))
+
+	if !strings.HasPrefix(ddl, `CREATE TABLE IF NOT EXISTS "outbox" (`) {
+		t.Fatalf("unexpected DDL:\n%s", ddl)
+	}
+}
+
+func TestSQLite_DataStore(t *testing.T) {
+	storetest.RunDataStoreTests(t, func(t *testing.T) outboxer.DataStore {
+		ds, err := WithInstance(context.Background(), openDB(t))
+		if err != nil {
+			t.Fatalf("failed to setup the data store: %s", err)
+		}
+
+		return ds
+	})
+}
+
+// archivingSQLite gives the conformance suite access to the archive table.
+type archivingSQLite struct {
+	*SQLite
+	db *sql.DB
+}
+
+func (s archivingSQLite) Restore(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, `
+INSERT INTO event_store (id, dispatched, dispatched_at, payload, options, headers, created_at)
+SELECT id, dispatched, dispatched_at, payload, options, headers, COALESCE(created_at, archived_at)
+FROM event_store_archive WHERE id = ? ORDER BY archived_at DESC LIMIT 1
+`, id)
+
+	return err
+}
+
+func (s archivingSQLite) CountArchived(ctx context.Context, id int64) (int64, error) {
+	var n int64
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM event_store_archive WHERE id = ?`, id).Scan(&n)
+
+	return n, err
+}
+
+func TestSQLite_ArchiveDataStore(t *testing.T) {
+	storetest.RunDataStoreTests(t, func(t *testing.T) outboxer.DataStore {
+		db := openDB(t)
+
+		ds, err := WithInstance(context.Background(), db, WithArchiveTable(DefaultArchiveTable))
+		if err != nil {
+			t.Fatalf("failed to setup the data store: %s", err)
+		}
+
+		return archivingSQLite{SQLite: ds, db: db}
+	})
+}
+
+type chanES chan *outboxer.OutboxMessage
+
+func (es chanES) Send(ctx context.Context, m *outboxer.OutboxMessage) error {
+	es <- m
+
+	return nil
+}
+
+func TestSQLite_Outboxer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	ds, err := WithInstance(ctx, openDB(t))
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	es := make(chanES, 1)
+
+	o, err := outboxer.New(
+		outboxer.WithDataStore(ds),
+		outboxer.WithEventStream(es),
+		outboxer.WithCheckInterval(10*time.Millisecond),
+		outboxer.WithCleanupInterval(10*time.Millisecond),
+		outboxer.WithCleanUpBefore(time.Now().Add(time.Hour)),
+	)
+	if err != nil {
+		t.Fatalf("could not create an outboxer instance: %s", err)
+	}
+
+	o.Start(ctx)
+
+	if err := o.Send(ctx, &outboxer.OutboxMessage{Payload: []byte("test payload")}); err != nil {
+		t.Fatalf("could not send message: %s", err)
+	}
+
+	select {
+	case m := <-es:
+		if string(m.Payload) != "test payload" {
+			t.Fatalf("was expecting the sent payload but got %q", m.Payload)
+		}
+	case err := <-o.ErrChan():
+		t.Fatalf("could not dispatch message: %s", err)
+	case <-time.After(time.Second):
+		t.Fatal("the message was not dispatched")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for count(t, ds) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the dispatched message was not cleaned up")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+type codeError int
+
+func (e codeError) Error() string { return "sqlite error" }
+func (e codeError) Code() int     { return int(e) }
+
+func TestSQLite_IsRetryable(t *testing.T) {
+	ds := SQLite{}
+
+	for code, want := range map[int]bool{
+		errBusy:              true,
+		errLocked:            true,
+		errBusy | (2 << 8):   true, // SQLITE_BUSY_SNAPSHOT
+		19:                   false,
+		errLocked | (1 << 8): true, // SQLITE_LOCKED_SHAREDCACHE
+	} {
+		if got := ds.IsRetryable(codeError(code)); got != want {
+			t.Errorf("was expecting %d to be retryable %t but got %t", code, want, got)
+		}
+	}
+
+	if ds.IsRetryable(errors.New("disk I/O error")) {
+		t.Error("was not expecting a generic error to be retryable")
+	}
+}
+
+func count(t *testing.T, ds *SQLite) int {
+	t.Helper()
+
+	stats, err := ds.Stats(context.Background())
+	if err != nil {
+		t.Fatalf("failed to count messages: %s", err)
+	}
+
+	return int(stats.Pending + stats.Dispatched)
+}
@@ -0,0 +1,222 @@
+package sqlserver
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/lock"
+	"github.com/italolelis/outboxer/migrate"
+	"github.com/italolelis/outboxer/storage/sqlstore"
+)
+
+const (
+	// errDeadlock is the retryable error number.
+	errDeadlock = 1205
+
+	// maxInsertRows keeps a multi-row insert under the limit of 2100 parameters.
+	maxInsertRows = 500
+)
+
+// dialect is the SQL Server flavour of SQL.
+type dialect struct{}
+
+func (dialect) Placeholder(n int) string { return fmt.Sprintf("@p%d", n) }
+
+func (dialect) Quote(name string) string {
+	return "[" + strings.ReplaceAll(name, "]", "]]") + "]"
+}
+
+func (dialect) Bool(v bool) string {
+	if v {
+		return "1"
+	}
+
+	return "0"
+}
+
+func (dialect) Limit(n int32) (string, string) { return fmt.Sprintf("TOP %d", n), "" }
+
+func (dialect) LockRows() (string, string) { return "WITH (UPDLOCK, ROWLOCK)", "" }
+
+func (dialect) Returning() (string, string) { return "OUTPUT INSERTED.id, INSERTED.created_at", "" }
+
+func (dialect) MaxInsertRows() int { return maxInsertRows }
+
+// Metadata is a fix for issue with mssql driver converting nil value in varbinary to nvarchar.
+// https://github.com/denisenkom/go-mssqldb/issues/530
+func (dialect) Metadata(v outboxer.DynamicValues) interface{} {
+	if v == nil {
+		return outboxer.DynamicValues{}
+	}
+
+	return v
+}
+
+func (dialect) EmptyMetadata() string { return "null" }
+
+func (dialect) HasMetadata() string { return "(options IS NOT NULL OR headers IS NOT NULL)" }
+
+// OptionsContain compares the values one by one, the options are stored as binary JSON.
+func (dialect) OptionsContain(args *sqlstore.Args, values outboxer.DynamicValues) (string, error) {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	conds := make([]string, 0, len(keys))
+	for _, k := range keys {
+		path := args.Add(fmt.Sprintf("$.%q", k))
+		conds = append(conds, fmt.Sprintf("JSON_VALUE(CAST(options AS VARCHAR(MAX)), %s) = %s", path, args.Add(fmt.Sprint(values[k]))))
+	}
+
+	return strings.Join(conds, " AND "), nil
+}
+
+// MergeOptions is empty, the options are stored as binary so they are merged row by row.
+func (dialect) MergeOptions(*sqlstore.Args, outboxer.DynamicValues) (string, error) {
+	return "", nil
+}
+
+// Lock takes an exclusive application lock owned by the session.
+func (dialect) Lock(ctx context.Context, conn *sql.Conn, s *sqlstore.Store) error {
+	aid, err := lock.Generate(s.DatabaseName, s.SchemaName)
+	if err != nil {
+		return err
+	}
+
+	query := `EXEC sp_getapplock 
+	@Resource = @p1,
+	@LockOwner='Session',
+	@LockMode = 'Exclusive';`
+
+	if _, err := conn.ExecContext(ctx, query, aid); err != nil {
+		return fmt.Errorf("try lock failed: %w", err)
+	}
+
+	return nil
+}
+
+func (dialect) Unlock(ctx context.Context, conn *sql.Conn, s *sqlstore.Store) error {
+	aid, err := lock.Generate(s.DatabaseName, s.SchemaName)
+	if err != nil {
+		return err
+	}
+
+	query := `EXEC sp_releaseapplock  
+	@Resource = @p1, 
+	@LockOwner='Session';`
+
+	_, err = conn.ExecContext(ctx, query, aid)
+
+	return err
+}
+
+func (dialect) MigrationsDialect(s *sqlstore.Store, table string) migrate.Dialect {
+	table += sqlstore.MigrationsTableSuffix
+
+	return migrate.Dialect{
+		// nolint
+		CreateTable: fmt.Sprintf(
+			`IF OBJECT_ID(N'%s', N'U') IS NULL CREATE TABLE %s (
+	version BIGINT NOT NULL PRIMARY KEY,
+	description NVARCHAR(255) NOT NULL,
+	applied_at DATETIME NOT NULL DEFAULT GETDATE()
+);
+`, literal(s.Ident(table)), s.Ident(table)),
+		SelectVersions: fmt.Sprintf(`SELECT version FROM %s`, s.Ident(table)),
+		InsertVersion:  fmt.Sprintf(`INSERT INTO %s (version, description) VALUES (@p1, @p2)`, s.Ident(table)),
+	}
+}
+
+func (dialect) Migrations(s *sqlstore.Store) []migrate.Migration {
+	return []migrate.Migration{
+		{
+			Version:     1,
+			Description: "create outbox table",
+			// nolint
+			Up: fmt.Sprintf(
+				`IF OBJECT_ID(N'%s', N'U') IS NULL CREATE TABLE %s (
+	id int IDENTITY(1,1) NOT NULL PRIMARY KEY,
+	dispatched BIT NOT NULL DEFAULT 0,
+	dispatched_at DATETIME,
+	payload VARBINARY(MAX)  NOT NULL,
+	options VARBINARY(MAX),
+	headers VARBINARY(MAX)
+);
+`, literal(s.Ident(s.EventStoreTable)), s.Ident(s.EventStoreTable)),
+		},
+		{
+			Version:     2,
+			Description: "add created_at column",
+			// nolint
+			Up: fmt.Sprintf(`ALTER TABLE %s ADD created_at DATETIME NOT NULL DEFAULT GETDATE();
+`, s.Ident(s.EventStoreTable)),
+		},
+		{
+			Version:     3,
+			Description: "track failed sends",
+			// nolint
+			Up: fmt.Sprintf(`ALTER TABLE %s ADD attempts INT NOT NULL DEFAULT 0, last_error NVARCHAR(MAX), dead BIT NOT NULL DEFAULT 0;
+`, s.Ident(s.EventStoreTable)),
+		},
+	}
+}
+
+func (dialect) ArchiveMigrations(s *sqlstore.Store) []migrate.Migration {
+	return []migrate.Migration{
+		{
+			Version:     1,
+			Description: "create archive table",
+			// nolint
+			Up: fmt.Sprintf(
+				`IF OBJECT_ID(N'%s', N'U') IS NULL CREATE TABLE %s (
+	id int NOT NULL PRIMARY KEY,
+	dispatched BIT NOT NULL DEFAULT 0,
+	dispatched_at DATETIME NOT NULL,
+	payload VARBINARY(MAX) NOT NULL,
+	options VARBINARY(MAX),
+	headers VARBINARY(MAX),
+	archived_at DATETIME NOT NULL DEFAULT GETDATE()
+);
+`, literal(s.Ident(s.ArchiveTable)), s.Ident(s.ArchiveTable)),
+		},
+		{
+			Version:     2,
+			Description: "add created_at column",
+			// nolint
+			Up: fmt.Sprintf(`ALTER TABLE %s ADD created_at DATETIME;
+`, s.Ident(s.ArchiveTable)),
+		},
+		{
+			Version:     3,
+			Description: "key the archive on id and archived_at",
+			// the primary key of the first migration has a generated name
+			// nolint
+			Up: fmt.Sprintf(`DECLARE @pk sysname = (SELECT name FROM sys.key_constraints WHERE type = 'PK' AND parent_object_id = OBJECT_ID(N'%[2]s'));
+EXEC('ALTER TABLE %[2]s DROP CONSTRAINT ' + QUOTENAME(@pk));
+ALTER TABLE %[1]s ADD PRIMARY KEY (id, archived_at);
+`, s.Ident(s.ArchiveTable), literal(s.Ident(s.ArchiveTable))),
+		},
+	}
+}
+
+func (dialect) IsRetryable(err error) bool {
+	var e interface{ SQLErrorNumber() int32 }
+	if !errors.As(err, &e) {
+		return false
+	}
+
+	return e.SQLErrorNumber() == errDeadlock
+}
+
+// literal escapes a string to be used within single quotes.
+func literal(v string) string {
+	return strings.ReplaceAll(v, "'", "''")
+}
@@ -0,0 +1,59 @@
+package sqlserver
+
+import "github.com/italolelis/outboxer"
+
+// Option represents the SQLServer data store options.
+type Option func(*SQLServer)
+
+// WithEventStoreTable sets the name of the outbox table.
+func WithEventStoreTable(name string) Option {
+	return func(s *SQLServer) {
+		s.EventStoreTable = name
+	}
+}
+
+// WithSchema sets the schema of the outbox table, instead of the default schema of the connection.
+func WithSchema(name string) Option {
+	return func(s *SQLServer) {
+		s.SchemaName = name
+	}
+}
+
+// WithQuotedIdentifiers quotes the table and schema names in DDL statements as well,
+// queries always quote them.
+func WithQuotedIdentifiers() Option {
+	return func(s *SQLServer) {
+		s.QuoteIdentifiers = true
+	}
+}
+
+// WithoutDDL never creates or changes tables. The data store only validates that the outbox table
+// exists and has the expected columns, for setups where the schema is managed outside the application, see DDL.
+func WithoutDDL() Option {
+	return func(s *SQLServer) {
+		s.SkipDDL = true
+	}
+}
+
+// WithClearMetadataOnDispatch wipes the options and headers of a message once it is dispatched.
+// By default they are kept for audit and replay, see Compact to strip them later on.
+func WithClearMetadataOnDispatch() Option {
+	return func(s *SQLServer) {
+		s.ClearMetadataOnDispatch = true
+	}
+}
+
+// WithArchiveTable makes Remove move dispatched messages into the given archive table instead of
+// deleting them, like EnableArchive. With WithoutDDL the table is only validated and DDL includes it.
+func WithArchiveTable(name string) Option {
+	return func(s *SQLServer) {
+		s.ArchiveTable = name
+	}
+}
+
+// WithClock sets the clock of the created_at and dispatched_at timestamps, the system clock by default.
+func WithClock(c outboxer.Clock) Option {
+	return func(s *SQLServer) {
+		s.Clock = c
+	}
+}
@@ -0,0 +1,51 @@
+//go:build integration
+
+package sqlserver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/storage/sqlstore"
+	"github.com/italolelis/outboxer/storage/storetest"
+	_ "github.com/microsoft/go-mssqldb"
+)
+
+func TestSQLServer_DataStore(t *testing.T) {
+	dsn := os.Getenv("SQLSERVER_DSN")
+	if dsn == "" {
+		t.Skip("SQLSERVER_DSN is not set")
+	}
+
+	db, err := sql.Open("sqlserver", dsn)
+	if err != nil {
+		t.Fatalf("failed to connect to sqlserver: %s", err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+
+	storetest.RunDataStoreTests(t, func(t *testing.T) outboxer.DataStore {
+		ctx := context.Background()
+		table := fmt.Sprintf("storetest_%d", time.Now().UnixNano())
+
+		ds, err := WithInstance(ctx, db, WithEventStoreTable(table))
+		if err != nil {
+			t.Fatalf("failed to setup the data store: %s", err)
+		}
+
+		t.Cleanup(func() {
+			for _, name := range []string{table, table + sqlstore.MigrationsTableSuffix} {
+				if _, err := db.ExecContext(ctx, `DROP TABLE IF EXISTS `+ds.Ident(name)); err != nil {
+					t.Errorf("failed to drop table %s: %s", name, err)
+				}
+			}
+		})
+
+		return ds
+	})
+}
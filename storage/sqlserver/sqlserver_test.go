@@ -2,16 +2,24 @@ package sqlserver
 
 import (
 	"context"
+	"database/sql"
 	"errors"
+	"fmt"
 	"regexp"
+	"strings"
 	"testing"
 	"time"
 
 	sqlmock "github.com/DATA-DOG/go-sqlmock"
 	"github.com/italolelis/outboxer"
 	"github.com/italolelis/outboxer/lock"
+	mssql "github.com/microsoft/go-mssqldb"
 )
 
+var eventStoreRows = []string{"id", "dispatched", "dispatched_at", "payload", "options", "headers", "created_at"}
+
+var inspectRows = append(eventStoreRows, "attempts", "last_error", "dead")
+
 func TestSQLServer_WithInstance_must_return_SQLServerDataStore(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -85,6 +93,79 @@ func TestSQLServer_WithInstance_should_return_error_when_no_schema_selected(t *t
 	}
 }
 
+func TestSQLServer_WithInstance_should_use_options(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT DB_NAME() `).
+		WillReturnRows(sqlmock.NewRows([]string{"DB_NAME()"}).AddRow("test"))
+	mock.ExpectExec(`EXEC sp_getapplock`).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`IF OBJECT_ID(N'[app].[outbox_migrations]', N'U') IS NULL
+		CREATE TABLE [app].[outbox_migrations]`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT version FROM [app].[outbox_migrations]`)).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(1).AddRow(2))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE [app].[outbox] ADD attempts`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO [app].[outbox_migrations]`)).
+		WithArgs(3, "track failed sends").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(`EXEC sp_releaseapplock`).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	ds, err := WithInstance(ctx, db, WithEventStoreTable("outbox"), WithSchema("app"), WithQuotedIdentifiers())
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	if ds.SchemaName != "app" || ds.EventStoreTable != "outbox" {
+		t.Errorf("unexpected schema %s and table %s", ds.SchemaName, ds.EventStoreTable)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSQLServer_WithInstance_should_only_validate_without_DDL(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	mock.ExpectQuery(`SELECT DB_NAME() `).
+		WillReturnRows(sqlmock.NewRows([]string{"DB_NAME()"}).AddRow("test"))
+	mock.ExpectQuery(`SELECT SCHEMA_NAME()`).
+		WillReturnRows(sqlmock.NewRows([]string{"SCHEMA_NAME()"}).AddRow("test_schema"))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, dispatched, dispatched_at, payload, options, headers, created_at FROM [test_schema].[event_store] WHERE 1 = 0`)).
+		WillReturnError(errors.New("invalid object name"))
+
+	if _, err := WithInstance(ctx, db, WithoutDDL()); !errors.Is(err, ErrInvalidSchema) {
+		t.Fatalf("expected an invalid schema error, got %v", err)
+	}
+}
+
+func TestSQLServer_DDL_should_return_the_create_table_statement(t *testing.T) {
+	ddl := DDL(WithEventStoreTable("outbox"))
+
+	if !strings.Contains(ddl, "CREATE TABLE dbo.outbox (") {
+		t.Fatalf("unexpected DDL:\n%s", ddl)
+	}
+}
+
 func TestSQLServer_should_add_message(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -105,8 +186,10 @@ func TestSQLServer_should_add_message(t *testing.T) {
 
 	defer ds.Close()
 
-	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO [test_schema].[event_store]`)).
-		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO [test_schema].[event_store] (payload, options, headers, created_at) OUTPUT INSERTED.id, INSERTED.created_at`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Now()))
+	mock.ExpectCommit()
 
 	if err := ds.Add(ctx, &outboxer.OutboxMessage{
 		Payload: []byte("test payload"),
@@ -138,8 +221,8 @@ func TestSQLServer_should_add_message_with_tx(t *testing.T) {
 	mock.ExpectBegin()
 	mock.ExpectExec(`SELECT (.+) from event_store`).
 		WillReturnResult(sqlmock.NewResult(0, 1))
-	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO [test_schema].[event_store]`)).
-		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO [test_schema].[event_store] (payload, options, headers, created_at) OUTPUT INSERTED.id, INSERTED.created_at`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Now()))
 	mock.ExpectCommit()
 
 	fn := func(tx outboxer.ExecerContext) error {
@@ -154,6 +237,112 @@ func TestSQLServer_should_add_message_with_tx(t *testing.T) {
 	}
 }
 
+func TestSQLServer_should_add_message_within_tx_options(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, db)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	defer ds.Close()
+
+	opts := &sql.TxOptions{Isolation: sql.LevelSerializable}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT count(*) FROM orders`)).
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO [test_schema].[event_store] (payload, options, headers, created_at) OUTPUT INSERTED.id, INSERTED.created_at`)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, time.Now()))
+	mock.ExpectCommit()
+
+	if err := ds.AddWithinTxOptions(ctx, &outboxer.OutboxMessage{
+		Payload: []byte("test payload"),
+	}, opts, func(tx outboxer.Tx) error {
+		var count int
+		return tx.QueryRowContext(ctx, "SELECT count(*) FROM orders").Scan(&count)
+	}); err != nil {
+		t.Fatalf("failed to add message in the data store: %s", err)
+	}
+
+	fnErr := errors.New("business logic failed")
+
+	mock.ExpectBegin()
+	mock.ExpectRollback()
+
+	if err := ds.AddWithinTxOptions(ctx, &outboxer.OutboxMessage{
+		Payload: []byte("test payload"),
+	}, opts, func(outboxer.Tx) error {
+		return fnErr
+	}); !errors.Is(err, fnErr) {
+		t.Fatalf("expected the callback error, got %v", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSQLServer_should_add_messages_in_caller_tx(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, db)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	createdAt := time.Date(2023, time.January, 1, 10, 0, 0, 0, time.UTC)
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO [test_schema].[event_store] (payload, options, headers, created_at) `+
+		`OUTPUT INSERTED.id, INSERTED.created_at VALUES (@p1, @p2, @p3, @p4), (@p5, @p6, @p7, @p8)`)).
+		WithArgs([]byte("first"), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg(), []byte("second"), sqlmock.AnyArg(), sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(1, createdAt).AddRow(2, createdAt))
+	mock.ExpectCommit()
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin transaction: %s", err)
+	}
+
+	msgs := []*outboxer.OutboxMessage{{Payload: []byte("first")}, {Payload: []byte("second")}}
+	if err := ds.AddInTx(ctx, tx, msgs...); err != nil {
+		t.Fatalf("failed to add messages in the transaction: %s", err)
+	}
+
+	if msgs[0].ID != 1 || msgs[1].ID != 2 || !msgs[1].CreatedAt.Equal(createdAt) {
+		t.Fatalf("expected the generated ids and creation time to be set, got %+v and %+v", msgs[0], msgs[1])
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("failed to commit transaction: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func TestSQLServer_add_message_with_tx_should_rollback_on_error(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -177,7 +366,7 @@ func TestSQLServer_add_message_with_tx_should_rollback_on_error(t *testing.T) {
 	mock.ExpectBegin()
 	mock.ExpectExec(`SELECT (.+) from event_store`).
 		WillReturnResult(sqlmock.NewResult(0, 1))
-	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO [test_schema].[event_store]`)).
+	mock.ExpectQuery(regexp.QuoteMeta(`INSERT INTO [test_schema].[event_store]`)).
 		WillReturnError(errors.New("Failed to insert"))
 	mock.ExpectRollback()
 
@@ -213,9 +402,9 @@ func TestSQLServer_should_get_events(t *testing.T) {
 
 	defer ds.Close()
 
-	mock.ExpectQuery(regexp.QuoteMeta(`SELECT TOP 10 * FROM [test_schema].[event_store] WHERE dispatched = 0`)).
-		WillReturnRows(sqlmock.NewRows([]string{"id", "dispatched", "dispatched_at", "payload", "options", "headers"}).
-			AddRow(1, false, time.Now(), []byte("test payload"), outboxer.DynamicValues{}, outboxer.DynamicValues{}))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT TOP 10 id, dispatched, dispatched_at, payload, options, headers, created_at FROM [test_schema].[event_store] WHERE dispatched = 0 AND dead = 0 ORDER BY id`)).
+		WillReturnRows(sqlmock.NewRows(eventStoreRows).
+			AddRow(1, false, time.Now(), []byte("test payload"), outboxer.DynamicValues{}, outboxer.DynamicValues{}, time.Now()))
 
 	msgs, err := ds.GetEvents(ctx, 10)
 	if err != nil {
@@ -248,7 +437,7 @@ func TestSQLServer_should_set_as_dispatched(t *testing.T) {
 	defer ds.Close()
 
 	mock.ExpectExec(regexp.QuoteMeta(`UPDATE [test_schema].[event_store] SET`)).
-		WithArgs(1).
+		WithArgs(sqlmock.AnyArg(), 1).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
 	err = ds.SetAsDispatched(ctx, 1)
@@ -257,6 +446,83 @@ func TestSQLServer_should_set_as_dispatched(t *testing.T) {
 	}
 }
 
+func TestSQLServer_should_keep_metadata_when_dispatched(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, db)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	defer ds.Close()
+
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE [test_schema].[event_store] SET dispatched = 1, dispatched_at = @p1 WHERE id = @p2;`)).
+		WithArgs(sqlmock.AnyArg(), 1).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := ds.SetAsDispatched(ctx, 1); err != nil {
+		t.Fatalf("failed to set message as dispatched: %s", err)
+	}
+
+	WithClearMetadataOnDispatch()(ds)
+
+	mock.ExpectExec(regexp.QuoteMeta(`dispatched_at = @p1, options = null, headers = null WHERE id = @p2;`)).
+		WithArgs(sqlmock.AnyArg(), 2).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := ds.SetAsDispatched(ctx, 2); err != nil {
+		t.Fatalf("failed to set message as dispatched: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSQLServer_should_compact_messages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, db)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	defer ds.Close()
+
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE [test_schema].[event_store] SET options = null, headers = null WHERE id IN ` +
+		`(SELECT id FROM (SELECT TOP 10 id FROM [test_schema].[event_store] WHERE dispatched = 1 AND dispatched_at < @p1 AND ` +
+		`(options IS NOT NULL OR headers IS NOT NULL) ORDER BY id) AS batch)`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := ds.Compact(ctx, time.Now(), 10); err != nil {
+		t.Fatalf("failed to compact messages: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func TestSQLServer_should_remove_messages(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -278,7 +544,8 @@ func TestSQLServer_should_remove_messages(t *testing.T) {
 	defer ds.Close()
 
 	mock.ExpectBegin()
-	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM [test_schema].[event_store] WHERE id IN`)).
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM [test_schema].[event_store] WHERE id IN (SELECT id FROM (SELECT TOP 10 id FROM [test_schema].[event_store] ` +
+		`WHERE dispatched = 1 AND dispatched_at < @p1 ORDER BY id) AS batch)`)).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectCommit()
 
@@ -348,6 +615,240 @@ func TestRemoveMessages_Failed_Rollback(t *testing.T) {
 	}
 }
 
+func TestSQLServer_should_archive_messages_on_remove(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, db)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	defer ds.Close()
+
+	aid, err := lock.Generate("test", "test_schema")
+	if err != nil {
+		t.Fatalf("failed to generate the lock value: %s", err)
+	}
+
+	mock.ExpectExec(`EXEC sp_getapplock`).
+		WithArgs(aid).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`IF OBJECT_ID(N'test_schema.event_store_archive_migrations', N'U') IS NULL
+		CREATE TABLE test_schema.event_store_archive_migrations`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT version FROM test_schema.event_store_archive_migrations`)).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}))
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`IF OBJECT_ID(N'test_schema.event_store_archive', N'U') IS NULL
+		CREATE TABLE test_schema.event_store_archive`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO test_schema.event_store_archive_migrations (version, description) VALUES (@p1, @p2)`)).
+		WithArgs(1, "create archive table").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE test_schema.event_store_archive ADD created_at DATETIME`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO test_schema.event_store_archive_migrations (version, description) VALUES (@p1, @p2)`)).
+		WithArgs(2, "add created_at column").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`OBJECT_ID(N'test_schema.event_store_archive')`) + `(.+)` +
+		regexp.QuoteMeta(`ALTER TABLE test_schema.event_store_archive ADD PRIMARY KEY (id, archived_at)`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO test_schema.event_store_archive_migrations (version, description) VALUES (@p1, @p2)`)).
+		WithArgs(3, "key the archive on id and archived_at").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectExec(`EXEC sp_releaseapplock`).
+		WithArgs(aid).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := ds.EnableArchive(ctx, ""); err != nil {
+		t.Fatalf("failed to enable the archive: %s", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT TOP 10 id, dispatched, dispatched_at, payload, options, headers, created_at FROM [test_schema].[event_store] WITH (UPDLOCK, ROWLOCK)`)).
+		WillReturnRows(sqlmock.NewRows(eventStoreRows).
+			AddRow(1, true, time.Now(), []byte("a"), nil, nil, time.Now()).
+			AddRow(2, true, time.Now(), []byte("b"), nil, nil, time.Now()))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO [test_schema].[event_store_archive] (id, dispatched, dispatched_at, payload, options, headers, created_at) SELECT`) + `(.+)` +
+		regexp.QuoteMeta(`FROM [test_schema].[event_store] WHERE id IN (1, 2)`)).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec(regexp.QuoteMeta(`DELETE FROM [test_schema].[event_store] WHERE id IN (1, 2)`)).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	if err := ds.Remove(ctx, time.Now(), 10); err != nil {
+		t.Fatalf("failed to remove messages: %s", err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT TOP 10 id, dispatched, dispatched_at, payload, options, headers, created_at FROM [test_schema].[event_store]`)).
+		WillReturnError(errors.New("failed to select"))
+	mock.ExpectRollback()
+
+	if err := ds.Remove(ctx, time.Now(), 10); err == nil {
+		t.Fatal("expected an error but got none")
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSQLServer_should_replay_messages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, db)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	defer ds.Close()
+
+	filter := outboxer.ReplayFilter{FromID: 5, Destination: outboxer.DynamicValues{"topic_name": "orders"}}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT COUNT(*) FROM [test_schema].[event_store] WHERE dispatched = 1 AND id >= @p1 AND JSON_VALUE(CAST(options AS VARCHAR(MAX)), @p2) = @p3`)).
+		WithArgs(5, `$."topic_name"`, "orders").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+
+	if count, err := ds.CountDispatched(ctx, filter); err != nil || count != 1 {
+		t.Fatalf("was expecting 1 message but got %d: %v", count, err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT TOP 10 id, dispatched, dispatched_at, payload, options, headers, created_at FROM [test_schema].[event_store] WHERE id > @p1 AND dispatched = 1 AND id >= @p2`)).
+		WithArgs(0, 5, `$."topic_name"`, "orders").
+		WillReturnRows(sqlmock.NewRows(eventStoreRows).
+			AddRow(5, true, time.Now(), []byte("a"), []byte(`{"topic_name": "orders"}`), nil, time.Now()))
+
+	msgs, err := ds.GetDispatched(ctx, filter, 0, 10)
+	if err != nil {
+		t.Fatalf("failed to get messages: %s", err)
+	}
+
+	if len(msgs) != 1 {
+		t.Fatalf("was expecting 1 message but got %d", len(msgs))
+	}
+
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE [test_schema].[event_store] SET dispatched = 0, dispatched_at = NULL WHERE dispatched = 1 AND id >= @p1`)).
+		WithArgs(5).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	if replayed, err := ds.Replay(ctx, outboxer.ReplayFilter{FromID: 5}, nil); err != nil || replayed != 2 {
+		t.Fatalf("was expecting 2 replayed messages but got %d: %v", replayed, err)
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, options FROM [test_schema].[event_store] WITH (UPDLOCK, ROWLOCK) WHERE dispatched = 1 AND id >= @p1`)).
+		WithArgs(5, `$."topic_name"`, "orders").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "options"}).
+			AddRow(5, []byte(`{"topic_name": "orders", "ordering_key": "a"}`)).
+			AddRow(6, nil))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE [test_schema].[event_store] SET dispatched = 0, dispatched_at = NULL, options = @p1 WHERE id = @p2`)).
+		WithArgs([]byte(`{"ordering_key":"a","topic_name":"orders.replay"}`), 5).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE [test_schema].[event_store] SET dispatched = 0, dispatched_at = NULL, options = @p1 WHERE id = @p2`)).
+		WithArgs([]byte(`{"topic_name":"orders.replay"}`), 6).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	replayed, err := ds.Replay(ctx, filter, outboxer.DynamicValues{"topic_name": "orders.replay"})
+	if err != nil {
+		t.Fatalf("failed to replay messages: %s", err)
+	}
+
+	if replayed != 2 {
+		t.Fatalf("was expecting 2 replayed messages but got %d", replayed)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestSQLServer_should_inspect_messages(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	initDatastoreMock(t, mock)
+
+	ds, err := WithInstance(ctx, db)
+	if err != nil {
+		t.Fatalf("failed to setup the data store: %s", err)
+	}
+
+	defer ds.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM [test_schema].[event_store]`)).
+		WillReturnRows(sqlmock.NewRows([]string{"pending", "dispatched", "failed", "dead", "oldest", "last"}).
+			AddRow(1, 0, 1, 0, 4, nil))
+
+	stats, err := ds.Stats(ctx)
+	if err != nil {
+		t.Fatalf("failed to get stats: %s", err)
+	}
+
+	if stats.Pending != 1 || stats.Failed != 1 || stats.OldestPendingID.Int64 != 4 || stats.LastDispatchedAt.Valid {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`FROM [test_schema].[event_store] WHERE id = @p1`)).
+		WithArgs(4).
+		WillReturnRows(sqlmock.NewRows(inspectRows))
+
+	if _, err := ds.GetEvent(ctx, 4); !errors.Is(err, outboxer.ErrMessageNotFound) {
+		t.Fatalf("was expecting ErrMessageNotFound but got %v", err)
+	}
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT TOP 50 id, dispatched, dispatched_at, payload, options, headers, created_at, attempts, last_error, dead FROM [test_schema].[event_store] WHERE id > @p1 ORDER BY id`)).
+		WithArgs(0).
+		WillReturnRows(sqlmock.NewRows(inspectRows).
+			AddRow(4, false, nil, []byte("a"), nil, nil, time.Now(), 1, "timeout", false))
+
+	msgs, err := ds.ListEvents(ctx, outboxer.ListFilter{Limit: 50})
+	if err != nil {
+		t.Fatalf("failed to list messages: %s", err)
+	}
+
+	if len(msgs) != 1 {
+		t.Fatalf("was expecting 1 message but got %d", len(msgs))
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
 func initDatastoreMock(t *testing.T, mock sqlmock.Sqlmock) {
 	mock.ExpectQuery(`SELECT DB_NAME() `).
 		WillReturnRows(sqlmock.NewRows([]string{"DB_NAME()"}).AddRow("test"))
@@ -370,10 +871,7 @@ func initLockMock(t *testing.T, mock sqlmock.Sqlmock) {
 		WithArgs(aid).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 
-	mock.ExpectExec(
-		regexp.QuoteMeta(`IF NOT EXISTS (SELECT * FROM sysobjects WHERE name='event_store' and xtype='U')
-		CREATE TABLE test_schema.event_store`)).
-		WillReturnResult(sqlmock.NewResult(0, 1))
+	initMigrationsMock(mock)
 
 	mock.ExpectExec(`EXEC sp_releaseapplock
 	@Resource = @p1,
@@ -381,3 +879,50 @@ func initLockMock(t *testing.T, mock sqlmock.Sqlmock) {
 		WithArgs(aid).
 		WillReturnResult(sqlmock.NewResult(0, 1))
 }
+
+func initMigrationsMock(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(
+		regexp.QuoteMeta(`IF OBJECT_ID(N'test_schema.event_store_migrations', N'U') IS NULL
+		CREATE TABLE test_schema.event_store_migrations`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT version FROM test_schema.event_store_migrations`)).
+		WillReturnRows(sqlmock.NewRows([]string{"version"}))
+	mock.ExpectBegin()
+	mock.ExpectExec(
+		regexp.QuoteMeta(`IF OBJECT_ID(N'test_schema.event_store', N'U') IS NULL
+		CREATE TABLE test_schema.event_store`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO test_schema.event_store_migrations (version, description) VALUES (@p1, @p2)`)).
+		WithArgs(1, "create outbox table").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE test_schema.event_store ADD created_at`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO test_schema.event_store_migrations (version, description) VALUES (@p1, @p2)`)).
+		WithArgs(2, "add created_at column").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`ALTER TABLE test_schema.event_store ADD attempts`)).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO test_schema.event_store_migrations (version, description) VALUES (@p1, @p2)`)).
+		WithArgs(3, "track failed sends").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+}
+
+func TestSQLServer_IsRetryable(t *testing.T) {
+	s := &SQLServer{}
+
+	for number, want := range map[int32]bool{1205: true, 2627: false} {
+		err := fmt.Errorf("transaction commit failed: %w", mssql.Error{Number: number})
+		if got := s.IsRetryable(err); got != want {
+			t.Errorf("expected IsRetryable to be %t for %d, got %t", want, number, got)
+		}
+	}
+
+	if s.IsRetryable(errors.New("connection refused")) {
+		t.Error("expected a generic error not to be retryable")
+	}
+}
@@ -0,0 +1,158 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/migrate"
+)
+
+// Dialect is what tells a SQL database apart from the others, the Store builds every query out of it.
+// Methods that take the Store use it to name tables, see Store.Ident.
+type Dialect interface {
+	// Placeholder returns the bind parameter of the n-th argument of a query, counting from 1.
+	Placeholder(n int) string
+
+	// Quote quotes an identifier.
+	Quote(name string) string
+
+	// Bool returns the literal of a boolean.
+	Bool(v bool) string
+
+	// Limit returns the clauses that limit a select to n rows. The first one goes right after
+	// SELECT, such as TOP, and the second one at the end of the query, such as LIMIT.
+	Limit(n int32) (top, limit string)
+
+	// LockRows returns the clauses that lock the selected rows until the end of the transaction.
+	// The first one is a table hint and the second one goes at the end of the query.
+	LockRows() (hint, suffix string)
+
+	// Returning returns the clauses that make an insert return the id and created_at of the new rows.
+	// The first one goes before VALUES, such as OUTPUT, and the second one at the end, such as RETURNING.
+	// When both are empty, the new rows are read back starting from the last insert id.
+	Returning() (output, returning string)
+
+	// MaxInsertRows bounds the number of rows of a multi-row insert.
+	MaxInsertRows() int
+
+	// Metadata converts the options or headers of a message before they are bound to a query.
+	Metadata(v outboxer.DynamicValues) interface{}
+
+	// EmptyMetadata returns the value the options and headers are set to when they are stripped.
+	EmptyMetadata() string
+
+	// HasMetadata returns the condition that matches the messages that have options or headers.
+	HasMetadata() string
+
+	// OptionsContain returns the condition that matches the messages whose options contain the given values.
+	OptionsContain(args *Args, values outboxer.DynamicValues) (string, error)
+
+	// MergeOptions returns the expression that merges the given values into the options of a message.
+	// When it is empty, the values are merged row by row within a transaction.
+	MergeOptions(args *Args, values outboxer.DynamicValues) (string, error)
+
+	// Lock takes the lock that serializes schema changes, on the given connection.
+	Lock(ctx context.Context, conn *sql.Conn, s *Store) error
+
+	// Unlock releases the lock taken by Lock.
+	Unlock(ctx context.Context, conn *sql.Conn, s *Store) error
+
+	// MigrationsDialect returns the statements of the bookkeeping table that records the migrations
+	// of the given table, it is named after it with MigrationsTableSuffix.
+	MigrationsDialect(s *Store, table string) migrate.Dialect
+
+	// Migrations returns the schema changes of the outbox table. Add new ones at the end,
+	// never edit a released one.
+	Migrations(s *Store) []migrate.Migration
+
+	// ArchiveMigrations returns the schema changes of the archive table, like Migrations.
+	ArchiveMigrations(s *Store) []migrate.Migration
+
+	// IsRetryable reports if the error is a transient failure, such as a deadlock.
+	IsRetryable(err error) bool
+}
+
+// ArchivePreparer is implemented by dialects that need to prepare the archive table
+// before the given messages are copied into it, such as creating their partitions.
+// It is not called when SkipDDL is set.
+type ArchivePreparer interface {
+	PrepareArchive(ctx context.Context, tx *sql.Tx, s *Store, msgs []*outboxer.OutboxMessage) error
+}
+
+// TimeBinder is implemented by dialects that store timestamps in a format of their own, such as text.
+// Args converts the timestamps with BindTime before they are bound to a query, and ParseTime reads back
+// the ones the driver can't convert, such as aggregates.
+type TimeBinder interface {
+	BindTime(t time.Time) interface{}
+	ParseTime(v string) (time.Time, error)
+}
+
+// IDStepper is implemented by dialects whose auto increment ids may grow by more than one between the rows
+// of an insert, such as MySQL with auto_increment_increment. IDStep returns the expression of the step.
+type IDStepper interface {
+	IDStep() string
+}
+
+// Args collects the arguments of a query, handing out their placeholders.
+type Args struct {
+	dialect Dialect
+	values  []interface{}
+}
+
+// NewArgs creates the arguments of a query that is written in the given dialect.
+func NewArgs(d Dialect, values ...interface{}) *Args {
+	return &Args{dialect: d, values: values}
+}
+
+// Add appends an argument and returns its placeholder.
+func (a *Args) Add(v interface{}) string {
+	if t, ok := v.(time.Time); ok {
+		if b, ok := a.dialect.(TimeBinder); ok {
+			v = b.BindTime(t)
+		}
+	}
+
+	a.values = append(a.values, v)
+
+	return a.dialect.Placeholder(len(a.values))
+}
+
+// Values returns the arguments in the order they were added.
+func (a *Args) Values() []interface{} {
+	return a.values
+}
+
+// nullTime scans a timestamp that may come back in the format of the dialect.
+type nullTime struct {
+	dialect Dialect
+	t       *sql.NullTime
+}
+
+func (n nullTime) Scan(src interface{}) error {
+	var v string
+
+	switch src := src.(type) {
+	case string:
+		v = src
+	case []byte:
+		v = string(src)
+	default:
+		return n.t.Scan(src)
+	}
+
+	b, ok := n.dialect.(TimeBinder)
+	if !ok {
+		return n.t.Scan(src)
+	}
+
+	t, err := b.ParseTime(v)
+	if err != nil {
+		return err
+	}
+
+	*n.t = sql.NullTime{Time: t, Valid: true}
+
+	return nil
+}
@@ -0,0 +1,1157 @@
+// Package sqlstore is the data store engine shared by the database/sql data stores.
+// The engine implements every feature once, the SQL that differs from a database to another comes
+// from its Dialect, so supporting a new database mostly means writing a dialect for it.
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/migrate"
+)
+
+const (
+	// DefaultEventStoreTable is the default table name.
+	DefaultEventStoreTable = "event_store"
+
+	// DefaultArchiveTable is the default archive table name.
+	DefaultArchiveTable = "event_store_archive"
+
+	// MigrationsTableSuffix is appended to the outbox table name to name the migrations bookkeeping table.
+	MigrationsTableSuffix = "_migrations"
+
+	// columns are the columns of the outbox table, in the order they are scanned.
+	columns = "id, dispatched, dispatched_at, payload, options, headers, created_at"
+
+	// inspectColumns are the columns of the outbox table along with the failure tracking ones.
+	inspectColumns = columns + ", attempts, last_error, dead"
+
+	// maxPrealloc caps the room made up front for the rows of a query, the batch size comes from the caller.
+	maxPrealloc = 1000
+
+	// retryInitialBackoff is the wait before the first retry of a transaction, it doubles on each retry
+	// up to retryMaxBackoff. A random half of it is taken off, so that conflicting transactions spread out.
+	retryInitialBackoff = 10 * time.Millisecond
+	retryMaxBackoff     = time.Second
+)
+
+var (
+	// ErrLocked is used when we can't acquire an explicit lock.
+	ErrLocked = errors.New("can't acquire lock")
+
+	// ErrInvalidSchema is used when DDL is disabled and the outbox table doesn't have the expected columns.
+	ErrInvalidSchema = errors.New("invalid outbox table schema")
+
+	// ErrInsertedMismatch is used when the database doesn't return one row for each inserted message.
+	ErrInsertedMismatch = errors.New("inserted rows don't match the messages")
+
+	// archiveColumns are the columns that are copied into the archive table.
+	archiveColumns = []string{"id", "dispatched", "dispatched_at", "payload", "options", "headers", "created_at"}
+)
+
+// querier is implemented by transactions that can run queries, such as *sql.Tx.
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Store is the implementation of the data store on top of a database/sql connection pool.
+type Store struct {
+	db              *sql.DB
+	dialect         Dialect
+	DatabaseName    string
+	SchemaName      string
+	EventStoreTable string
+	// ArchiveTable is where dispatched messages are moved to when they are removed.
+	// When it is empty, removed messages are deleted for good.
+	ArchiveTable string
+	// Archiver receives the messages right before they are removed.
+	Archiver outboxer.Archiver
+	// Clock sets the created_at and dispatched_at timestamps, they are bound to the queries
+	// instead of being set by the database.
+	Clock outboxer.Clock
+	// ClearMetadataOnDispatch wipes the options and headers of a message once it is dispatched.
+	// By default they are kept for audit and replay, see Compact to strip them later on.
+	ClearMetadataOnDispatch bool
+	// QualifyTables qualifies the table names with SchemaName, otherwise they are resolved by the database.
+	QualifyTables bool
+	// QuoteIdentifiers quotes the table and schema names, so they can be mixed case or reserved words.
+	QuoteIdentifiers bool
+	// QuoteQueries quotes the table and schema names in queries even when QuoteIdentifiers is off,
+	// which then only applies to DDL statements.
+	QuoteQueries bool
+	// SkipDDL never creates or changes tables, the outbox table is only validated.
+	SkipDDL bool
+	// MaxRetries is how many times the transactions of the data store are run again when they fail with
+	// an error the dialect reports as retryable. None by default.
+	MaxRetries int
+	// SerializeWrites runs the writes of the data store one at a time, for databases that only allow
+	// a single writer.
+	SerializeWrites bool
+	writeMu         sync.Mutex
+}
+
+// New creates a data store that talks to the db connection pool in the given dialect.
+// Setup must be called once the names are set, before the data store is used.
+func New(db *sql.DB, d Dialect) *Store {
+	return &Store{db: db, dialect: d, Clock: outboxer.SystemClock()}
+}
+
+// Setup validates the outbox table when DDL is skipped, otherwise it applies the schema migrations
+// that were not applied yet, and then does the same with the archive table when ArchiveTable is set.
+// The table name defaults to DefaultEventStoreTable.
+func (s *Store) Setup(ctx context.Context) error {
+	if s.EventStoreTable == "" {
+		s.EventStoreTable = DefaultEventStoreTable
+	}
+
+	var err error
+	if s.SkipDDL {
+		err = s.validateTable(ctx)
+	} else {
+		err = s.ensureTable(ctx)
+	}
+
+	if err != nil || s.ArchiveTable == "" {
+		return err
+	}
+
+	return s.EnableArchive(ctx, s.ArchiveTable)
+}
+
+// DDL returns the statements that create the outbox table, for schemas that are managed outside the application.
+// The archive table is included when ArchiveTable is set.
+func (s *Store) DDL() string {
+	migrations := s.dialect.Migrations(s)
+	if s.ArchiveTable != "" {
+		migrations = append(migrations, s.dialect.ArchiveMigrations(s)...)
+	}
+
+	stmts := make([]string, 0, len(migrations))
+	for _, m := range migrations {
+		stmts = append(stmts, strings.TrimSpace(m.Up))
+	}
+
+	return strings.Join(stmts, "\n\n") + "\n"
+}
+
+// Close does nothing, the connection that holds the lock is released as soon as the lock is.
+// The db connection pool belongs to the caller and is not closed.
+func (s *Store) Close() error {
+	return nil
+}
+
+// IsRetryable reports if the error is a transient failure of the database, such as a deadlock.
+func (s *Store) IsRetryable(err error) bool {
+	return s.dialect.IsRetryable(err)
+}
+
+// GetEvents retrieves the pending events, oldest first.
+func (s *Store) GetEvents(ctx context.Context, batchSize int32) ([]*outboxer.OutboxMessage, error) {
+	events := newEvents(batchSize)
+	top, limit := s.dialect.Limit(batchSize)
+
+	// nolint
+	query := fmt.Sprintf(`
+SELECT %s%s
+FROM %s
+WHERE dispatched = %s AND dead = %[4]s
+ORDER BY id%s
+`, prefix(top), columns, s.table(), s.dialect.Bool(false), clause(limit))
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return events, fmt.Errorf("failed to get messages from the store: %w", err)
+	}
+
+	return scanMessages(rows, events)
+}
+
+// Add adds the message to the data store.
+func (s *Store) Add(ctx context.Context, evt *outboxer.OutboxMessage) error {
+	return s.AddAll(ctx, evt)
+}
+
+// AddAll adds the messages to the data store within a single transaction.
+func (s *Store) AddAll(ctx context.Context, msgs ...*outboxer.OutboxMessage) error {
+	return s.AddAllWithinTx(ctx, msgs, &sql.TxOptions{}, nil)
+}
+
+// AddWithinTx creates a transaction and then tries to execute anything within it.
+func (s *Store) AddWithinTx(ctx context.Context, evt *outboxer.OutboxMessage, fn func(outboxer.ExecerContext) error) error {
+	return s.AddWithinTxOptions(ctx, evt, &sql.TxOptions{}, func(tx outboxer.Tx) error {
+		return fn(tx)
+	})
+}
+
+// AddWithinTxOptions creates a transaction with the given options and then tries to execute anything within it.
+// The transaction is rolled back when fn fails.
+func (s *Store) AddWithinTxOptions(
+	ctx context.Context,
+	evt *outboxer.OutboxMessage,
+	opts *sql.TxOptions,
+	fn func(outboxer.Tx) error,
+) error {
+	return s.AddAllWithinTx(ctx, []*outboxer.OutboxMessage{evt}, opts, fn)
+}
+
+// AddAllWithinTx creates a transaction with the given options, executes fn within it, when not nil,
+// and then adds the messages. The transaction is rolled back when fn fails.
+// When MaxRetries is set, the whole transaction runs again on a retryable error, so fn must only change
+// the database through tx.
+func (s *Store) AddAllWithinTx(
+	ctx context.Context,
+	msgs []*outboxer.OutboxMessage,
+	opts *sql.TxOptions,
+	fn func(outboxer.Tx) error,
+) error {
+	defer s.write()()
+
+	return s.runTx(ctx, opts, func(tx *sql.Tx) error {
+		if fn != nil {
+			if err := fn(tx); err != nil {
+				return err
+			}
+		}
+
+		return s.insert(ctx, tx, msgs)
+	})
+}
+
+// AddInTx adds the messages within the given transaction. Committing or rolling it back is left to the caller.
+// The ID of the messages is only set when the transaction can run queries, such as a *sql.Tx.
+func (s *Store) AddInTx(ctx context.Context, tx outboxer.ExecerContext, msgs ...*outboxer.OutboxMessage) error {
+	return s.insert(ctx, tx, msgs)
+}
+
+// insert adds the messages with multi-row inserts, setting their ID and CreatedAt. A CreatedAt that is already
+// set is kept, such as the one of an imported message. The CreatedAt is read back when the database returns
+// the inserted rows, as it may store timestamps with less precision.
+func (s *Store) insert(ctx context.Context, tx outboxer.ExecerContext, msgs []*outboxer.OutboxMessage) error {
+	output, returning := s.dialect.Returning()
+	readBack := output == "" && returning == ""
+
+	for len(msgs) > 0 {
+		n := len(msgs)
+		if n > s.dialect.MaxInsertRows() {
+			n = s.dialect.MaxInsertRows()
+		}
+
+		args := NewArgs(s.dialect)
+		values := make([]string, 0, n)
+		now := s.Clock.Now()
+
+		for _, evt := range msgs[:n] {
+			if evt.CreatedAt.IsZero() {
+				evt.CreatedAt = now
+			}
+
+			values = append(values, fmt.Sprintf("(%s, %s, %s, %s)",
+				args.Add(evt.Payload),
+				args.Add(s.dialect.Metadata(evt.Options)),
+				args.Add(s.dialect.Metadata(evt.Headers)),
+				args.Add(evt.CreatedAt),
+			))
+		}
+
+		q, ok := tx.(querier)
+		if ok && !readBack {
+			// nolint
+			query := fmt.Sprintf(`INSERT INTO %s (payload, options, headers, created_at)%s VALUES %s%s`,
+				s.table(), clause(output), strings.Join(values, ", "), clause(returning))
+			if err := scanInserted(ctx, q, query, args.Values(), msgs[:n]); err != nil {
+				return err
+			}
+		} else {
+			// nolint
+			query := fmt.Sprintf(`INSERT INTO %s (payload, options, headers, created_at) VALUES %s`,
+				s.table(), strings.Join(values, ", "))
+
+			res, err := tx.ExecContext(ctx, query, args.Values()...)
+			if err != nil {
+				return fmt.Errorf("failed to insert message into the data store: %w", err)
+			}
+
+			if readBack {
+				if err := s.readInserted(ctx, tx, res, msgs[:n]); err != nil {
+					return err
+				}
+			}
+		}
+
+		msgs = msgs[n:]
+	}
+
+	return nil
+}
+
+// scanInserted runs the insert and sets the ID and CreatedAt of the messages from the returned rows.
+// Databases don't guarantee the order of the returned rows, but the ids of a single insert are handed
+// out in the order of its values.
+func scanInserted(ctx context.Context, q querier, query string, args []interface{}, msgs []*outboxer.OutboxMessage) error {
+	rows, err := q.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to insert message into the data store: %w", err)
+	}
+
+	return assignInserted(rows, msgs)
+}
+
+// assignInserted sets the ID and CreatedAt of the messages from rows of ids and creation times,
+// matched by id order.
+func assignInserted(rows *sql.Rows, msgs []*outboxer.OutboxMessage) error {
+	defer rows.Close()
+
+	inserted := make([]outboxer.OutboxMessage, 0, len(msgs))
+
+	for rows.Next() {
+		var e outboxer.OutboxMessage
+		if err := rows.Scan(&e.ID, &e.CreatedAt); err != nil {
+			return fmt.Errorf("failed to scan inserted message: %w", err)
+		}
+
+		inserted = append(inserted, e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to insert message into the data store: %w", err)
+	}
+
+	if len(inserted) != len(msgs) {
+		return fmt.Errorf("%w: got %d rows for %d messages", ErrInsertedMismatch, len(inserted), len(msgs))
+	}
+
+	sort.Slice(inserted, func(i, j int) bool { return inserted[i].ID < inserted[j].ID })
+
+	for i, e := range inserted {
+		msgs[i].ID = e.ID
+		msgs[i].CreatedAt = e.CreatedAt
+	}
+
+	return nil
+}
+
+// readInserted sets the ID and CreatedAt of the messages for databases that can't return the inserted rows.
+// The last insert id is the first id of a multi-row insert, the rows are read back from it, one step of the
+// ids apart, so that rows of other sessions in between are skipped. When the transaction can't run queries,
+// the messages are left without them: the step between the ids depends on the server settings.
+func (s *Store) readInserted(ctx context.Context, tx outboxer.ExecerContext, res sql.Result, msgs []*outboxer.OutboxMessage) error {
+	q, ok := tx.(querier)
+	if !ok {
+		return nil
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get the inserted message id: %w", err)
+	}
+
+	args := NewArgs(s.dialect)
+	top, limit := s.dialect.Limit(int32(len(msgs)))
+	where := "id >= " + args.Add(id)
+
+	if st, ok := s.dialect.(IDStepper); ok {
+		where += fmt.Sprintf(" AND id <= %s + %d * %s AND MOD(id - %s, %[3]s) = 0",
+			args.Add(id), len(msgs)-1, st.IDStep(), args.Add(id))
+	}
+
+	// nolint
+	query := fmt.Sprintf(`SELECT %sid, created_at FROM %s WHERE %s ORDER BY id%s`,
+		prefix(top), s.table(), where, clause(limit))
+
+	rows, err := q.QueryContext(ctx, query, args.Values()...)
+	if err != nil {
+		return fmt.Errorf("failed to get the inserted messages: %w", err)
+	}
+
+	return assignInserted(rows, msgs)
+}
+
+// SetAsDispatched sets one message as dispatched.
+func (s *Store) SetAsDispatched(ctx context.Context, id int64) error {
+	defer s.write()()
+
+	var metadata string
+	if s.ClearMetadataOnDispatch {
+		metadata = fmt.Sprintf(`,
+    options = %[1]s,
+    headers = %[1]s`, s.dialect.EmptyMetadata())
+	}
+
+	args := NewArgs(s.dialect)
+
+	// nolint
+	query := fmt.Sprintf(`
+UPDATE %s
+SET
+    dispatched = %s,
+    dispatched_at = %s%s
+WHERE id = %s;
+`, s.table(), s.dialect.Bool(true), args.Add(s.Clock.Now()), metadata, args.Add(id))
+	if _, err := s.db.ExecContext(ctx, query, args.Values()...); err != nil {
+		return fmt.Errorf("failed to set message as dispatched: %w", err)
+	}
+
+	return nil
+}
+
+// SetAsFailed records a failed send of the message. Once it failed maxAttempts times, it is set as dead
+// and GetEvents skips it. A maxAttempts of zero never sets it as dead.
+func (s *Store) SetAsFailed(ctx context.Context, id int64, reason string, maxAttempts int32) error {
+	defer s.write()()
+
+	args := NewArgs(s.dialect)
+
+	// dead is set before attempts, MySQL evaluates the assignments from left to right
+	var dead string
+	if maxAttempts > 0 {
+		dead = fmt.Sprintf(`
+    dead = CASE WHEN attempts + 1 >= %s THEN %s ELSE %s END,`, args.Add(maxAttempts), s.dialect.Bool(true), s.dialect.Bool(false))
+	}
+
+	// nolint
+	query := fmt.Sprintf(`
+UPDATE %s
+SET%s
+    attempts = attempts + 1,
+    last_error = %s
+WHERE id = %s;
+`, s.table(), dead, args.Add(reason), args.Add(id))
+	if _, err := s.db.ExecContext(ctx, query, args.Values()...); err != nil {
+		return fmt.Errorf("failed to set message as failed: %w", err)
+	}
+
+	return nil
+}
+
+// Requeue sets the dead messages with the given ids back to pending, clearing their attempts,
+// and returns how many were requeued.
+func (s *Store) Requeue(ctx context.Context, ids ...int64) (int64, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	defer s.write()()
+
+	// nolint
+	query := fmt.Sprintf(`
+UPDATE %s
+SET
+    dead = %s,
+    attempts = 0,
+    last_error = NULL
+WHERE dead = %s AND id IN (%s);
+`, s.table(), s.dialect.Bool(false), s.dialect.Bool(true), idList(ids))
+
+	res, err := s.db.ExecContext(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("failed to requeue messages: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed to requeue messages: %w", err)
+	}
+
+	return n, nil
+}
+
+// Compact strips the options and headers of messages that were dispatched before the given time.
+func (s *Store) Compact(ctx context.Context, dispatchedBefore time.Time, batchSize int32) error {
+	defer s.write()()
+
+	args := NewArgs(s.dialect)
+	where := fmt.Sprintf("dispatched = %s AND dispatched_at < %s AND %s",
+		s.dialect.Bool(true), args.Add(dispatchedBefore), s.dialect.HasMetadata())
+
+	// nolint
+	query := fmt.Sprintf(`
+UPDATE %s
+SET
+    options = %[2]s,
+    headers = %[2]s
+WHERE id IN (%[3]s)
+`, s.table(), s.dialect.EmptyMetadata(), s.batch(where, batchSize))
+	if _, err := s.db.ExecContext(ctx, query, args.Values()...); err != nil {
+		return fmt.Errorf("failed to compact messages: %w", err)
+	}
+
+	return nil
+}
+
+// Remove removes old messages from the data store.
+// When an archive table or an archiver is set, the messages are handed to them within the same transaction.
+func (s *Store) Remove(ctx context.Context, dispatchedBefore time.Time, batchSize int32) error {
+	defer s.write()()
+
+	remove := s.remove
+	if s.ArchiveTable != "" || s.Archiver != nil {
+		remove = s.archive
+	}
+
+	return s.runTx(ctx, &sql.TxOptions{}, func(tx *sql.Tx) error {
+		return remove(ctx, tx, dispatchedBefore, batchSize)
+	})
+}
+
+func (s *Store) remove(ctx context.Context, tx *sql.Tx, dispatchedBefore time.Time, batchSize int32) error {
+	args := NewArgs(s.dialect)
+	where := fmt.Sprintf("dispatched = %s AND dispatched_at < %s", s.dialect.Bool(true), args.Add(dispatchedBefore))
+
+	// nolint
+	query := fmt.Sprintf(`DELETE FROM %s WHERE id IN (%s)`, s.table(), s.batch(where, batchSize))
+	if _, err := tx.ExecContext(ctx, query, args.Values()...); err != nil {
+		return fmt.Errorf("failed to remove messages from the data store: %w", err)
+	}
+
+	return nil
+}
+
+func (s *Store) archive(ctx context.Context, tx *sql.Tx, dispatchedBefore time.Time, batchSize int32) error {
+	args := NewArgs(s.dialect)
+	top, limit := s.dialect.Limit(batchSize)
+	hint, suffix := s.dialect.LockRows()
+
+	// nolint
+	query := fmt.Sprintf(`
+SELECT %s%s
+FROM %s%s
+WHERE dispatched = %s AND dispatched_at < %s
+ORDER BY id%s%s
+`, prefix(top), columns, s.table(), clause(hint), s.dialect.Bool(true), args.Add(dispatchedBefore), clause(limit), clause(suffix))
+
+	rows, err := tx.QueryContext(ctx, query, args.Values()...)
+	if err != nil {
+		return fmt.Errorf("failed to get messages to archive: %w", err)
+	}
+
+	msgs, err := scanMessages(rows, nil)
+	if err != nil {
+		return fmt.Errorf("failed to get messages to archive: %w", err)
+	}
+
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	ids := make([]int64, 0, len(msgs))
+	for _, m := range msgs {
+		ids = append(ids, m.ID)
+	}
+
+	if s.Archiver != nil {
+		if err := s.Archiver.Archive(ctx, msgs); err != nil {
+			return fmt.Errorf("failed to export messages: %w", err)
+		}
+	}
+
+	if s.ArchiveTable == "" {
+		return s.removeByID(ctx, tx, ids)
+	}
+
+	if p, ok := s.dialect.(ArchivePreparer); ok && !s.SkipDDL {
+		if err := p.PrepareArchive(ctx, tx, s, msgs); err != nil {
+			return err
+		}
+	}
+
+	// a message that was replayed and removed again is archived once more, the archive keeps its history
+	// nolint
+	query = fmt.Sprintf("INSERT INTO %s (%s)\nSELECT %[2]s FROM %s WHERE id IN (%s)",
+		s.queryIdent(s.ArchiveTable), strings.Join(archiveColumns, ", "), s.table(), idList(ids))
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to archive messages: %w", err)
+	}
+
+	return s.removeByID(ctx, tx, ids)
+}
+
+func (s *Store) removeByID(ctx context.Context, tx *sql.Tx, ids []int64) error {
+	// nolint
+	query := fmt.Sprintf(`DELETE FROM %s WHERE id IN (%s)`, s.table(), idList(ids))
+	if _, err := tx.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to remove messages from the data store: %w", err)
+	}
+
+	return nil
+}
+
+// EnableArchive makes Remove move dispatched messages into the given archive table instead of
+// deleting them. The schema migrations of the archive table that were not applied yet are applied,
+// unless SkipDDL is set, in which case it is only validated and DDL includes its statements.
+func (s *Store) EnableArchive(ctx context.Context, table string) error {
+	if table == "" {
+		table = DefaultArchiveTable
+	}
+
+	s.ArchiveTable = table
+
+	if s.SkipDDL {
+		return s.validateArchive(ctx)
+	}
+
+	return s.withLock(ctx, func(conn *sql.Conn) error {
+		return migrate.Run(ctx, conn, s.dialect.MigrationsDialect(s, s.ArchiveTable), s.dialect.ArchiveMigrations(s))
+	})
+}
+
+// Stats returns the counters of the messages in the data store.
+func (s *Store) Stats(ctx context.Context) (*outboxer.Stats, error) {
+	var stats outboxer.Stats
+
+	pending := fmt.Sprintf("dispatched = %s AND dead = %[1]s", s.dialect.Bool(false))
+
+	// nolint
+	query := fmt.Sprintf(`
+SELECT
+    COALESCE(SUM(CASE WHEN %[2]s THEN 1 ELSE 0 END), 0),
+    COALESCE(SUM(CASE WHEN dispatched = %[3]s THEN 1 ELSE 0 END), 0),
+    COALESCE(SUM(CASE WHEN %[2]s AND attempts > 0 THEN 1 ELSE 0 END), 0),
+    COALESCE(SUM(CASE WHEN dead = %[3]s THEN 1 ELSE 0 END), 0),
+    MIN(CASE WHEN %[2]s THEN id END),
+    MAX(dispatched_at)
+FROM %[1]s
+`, s.table(), pending, s.dialect.Bool(true))
+	if err := s.db.QueryRowContext(ctx, query).Scan(
+		&stats.Pending,
+		&stats.Dispatched,
+		&stats.Failed,
+		&stats.Dead,
+		&stats.OldestPendingID,
+		nullTime{dialect: s.dialect, t: &stats.LastDispatchedAt},
+	); err != nil {
+		return nil, fmt.Errorf("failed to get the data store stats: %w", err)
+	}
+
+	return &stats, nil
+}
+
+// GetEvent retrieves a single message.
+func (s *Store) GetEvent(ctx context.Context, id int64) (*outboxer.OutboxMessage, error) {
+	var e outboxer.OutboxMessage
+
+	args := NewArgs(s.dialect)
+
+	// nolint
+	query := fmt.Sprintf(`SELECT %s FROM %s WHERE id = %s`, inspectColumns, s.table(), args.Add(id))
+
+	err := scanInspected(s.db.QueryRowContext(ctx, query, args.Values()...), &e)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, outboxer.ErrMessageNotFound
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to get message from the store: %w", err)
+	}
+
+	return &e, nil
+}
+
+// ListEvents retrieves the messages that match the filter.
+func (s *Store) ListEvents(ctx context.Context, f outboxer.ListFilter) ([]*outboxer.OutboxMessage, error) {
+	events := newEvents(f.Limit)
+
+	var state string
+
+	switch f.State {
+	case outboxer.PendingState:
+		state = fmt.Sprintf(" AND dispatched = %s AND dead = %[1]s", s.dialect.Bool(false))
+	case outboxer.DispatchedState:
+		state = " AND dispatched = " + s.dialect.Bool(true)
+	case outboxer.FailedState:
+		state = fmt.Sprintf(" AND dispatched = %s AND dead = %[1]s AND attempts > 0", s.dialect.Bool(false))
+	case outboxer.DeadState:
+		state = " AND dead = " + s.dialect.Bool(true)
+	}
+
+	args := NewArgs(s.dialect)
+	top, limit := s.dialect.Limit(f.Limit)
+
+	// nolint
+	query := fmt.Sprintf(`
+SELECT %s%s
+FROM %s
+WHERE id > %s%s
+ORDER BY id%s
+`, prefix(top), inspectColumns, s.table(), args.Add(f.AfterID), state, clause(limit))
+
+	rows, err := s.db.QueryContext(ctx, query, args.Values()...)
+	if err != nil {
+		return events, fmt.Errorf("failed to list messages from the store: %w", err)
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var e outboxer.OutboxMessage
+		if err := scanInspected(rows, &e); err != nil {
+			return events, fmt.Errorf("failed to scan message: %w", err)
+		}
+
+		events = append(events, &e)
+	}
+
+	return events, rows.Err()
+}
+
+// CountDispatched counts the dispatched messages that match the filter.
+func (s *Store) CountDispatched(ctx context.Context, f outboxer.ReplayFilter) (int64, error) {
+	args := NewArgs(s.dialect)
+
+	where, err := s.dispatchedFilter(f, args)
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+
+	// nolint
+	query := fmt.Sprintf(`SELECT COUNT(*) FROM %s WHERE %s`, s.table(), where)
+	if err := s.db.QueryRowContext(ctx, query, args.Values()...).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed to count dispatched messages: %w", err)
+	}
+
+	return count, nil
+}
+
+// GetDispatched retrieves the dispatched messages that match the filter and come after the given id.
+func (s *Store) GetDispatched(
+	ctx context.Context,
+	f outboxer.ReplayFilter,
+	afterID int64,
+	batchSize int32,
+) ([]*outboxer.OutboxMessage, error) {
+	events := newEvents(batchSize)
+
+	args := NewArgs(s.dialect)
+	after := args.Add(afterID)
+
+	where, err := s.dispatchedFilter(f, args)
+	if err != nil {
+		return events, err
+	}
+
+	top, limit := s.dialect.Limit(batchSize)
+
+	// nolint
+	query := fmt.Sprintf(`
+SELECT %s%s
+FROM %s
+WHERE id > %s AND %s
+ORDER BY id%s
+`, prefix(top), columns, s.table(), after, where, clause(limit))
+
+	rows, err := s.db.QueryContext(ctx, query, args.Values()...)
+	if err != nil {
+		return events, fmt.Errorf("failed to get dispatched messages from the store: %w", err)
+	}
+
+	return scanMessages(rows, events)
+}
+
+// Replay sets the dispatched messages that match the filter back to pending.
+// When override is not empty, it is merged into the options of each message.
+func (s *Store) Replay(ctx context.Context, f outboxer.ReplayFilter, override outboxer.DynamicValues) (int64, error) {
+	defer s.write()()
+
+	args := NewArgs(s.dialect)
+
+	var options string
+
+	if len(override) > 0 {
+		merge, err := s.dialect.MergeOptions(args, override)
+		if err != nil {
+			return 0, err
+		}
+
+		if merge == "" {
+			return s.replayRows(ctx, f, override)
+		}
+
+		options = `,
+    options = ` + merge
+	}
+
+	where, err := s.dispatchedFilter(f, args)
+	if err != nil {
+		return 0, err
+	}
+
+	// nolint
+	query := fmt.Sprintf(`
+UPDATE %s
+SET
+    dispatched = %s,
+    dispatched_at = NULL%s
+WHERE %s
+`, s.table(), s.dialect.Bool(false), options, where)
+
+	res, err := s.db.ExecContext(ctx, query, args.Values()...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to replay messages: %w", err)
+	}
+
+	return res.RowsAffected()
+}
+
+// replayRows replays the messages one by one within a transaction, merging the override into their
+// options, for databases that can't merge them in a query.
+func (s *Store) replayRows(ctx context.Context, f outboxer.ReplayFilter, override outboxer.DynamicValues) (int64, error) {
+	var count int64
+
+	err := s.runTx(ctx, &sql.TxOptions{}, func(tx *sql.Tx) error {
+		var err error
+		count, err = s.replayWithOverride(ctx, tx, f, override)
+
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func (s *Store) replayWithOverride(
+	ctx context.Context,
+	tx *sql.Tx,
+	f outboxer.ReplayFilter,
+	override outboxer.DynamicValues,
+) (int64, error) {
+	args := NewArgs(s.dialect)
+
+	where, err := s.dispatchedFilter(f, args)
+	if err != nil {
+		return 0, err
+	}
+
+	hint, suffix := s.dialect.LockRows()
+
+	// nolint
+	query := fmt.Sprintf(`SELECT id, options FROM %s%s WHERE %s ORDER BY id%s`, s.table(), clause(hint), where, clause(suffix))
+
+	rows, err := tx.QueryContext(ctx, query, args.Values()...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get messages to replay: %w", err)
+	}
+
+	defer rows.Close()
+
+	var msgs []*outboxer.OutboxMessage
+
+	for rows.Next() {
+		var e outboxer.OutboxMessage
+		if err := rows.Scan(&e.ID, &e.Options); err != nil {
+			return 0, fmt.Errorf("failed to scan message: %w", err)
+		}
+
+		msgs = append(msgs, &e)
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, fmt.Errorf("failed to get messages to replay: %w", err)
+	}
+
+	// nolint
+	query = fmt.Sprintf(`
+UPDATE %s
+SET
+    dispatched = %s,
+    dispatched_at = NULL,
+    options = %s
+WHERE id = %s
+`, s.table(), s.dialect.Bool(false), s.dialect.Placeholder(1), s.dialect.Placeholder(2))
+
+	for _, m := range msgs {
+		options := make(outboxer.DynamicValues, len(m.Options)+len(override))
+		for k, v := range m.Options {
+			options[k] = v
+		}
+
+		for k, v := range override {
+			options[k] = v
+		}
+
+		if _, err := tx.ExecContext(ctx, query, s.dialect.Metadata(options), m.ID); err != nil {
+			return 0, fmt.Errorf("failed to replay messages: %w", err)
+		}
+	}
+
+	return int64(len(msgs)), nil
+}
+
+// dispatchedFilter builds the where clause that matches the dispatched messages selected by the filter,
+// adding its arguments to args.
+func (s *Store) dispatchedFilter(f outboxer.ReplayFilter, args *Args) (string, error) {
+	conds := []string{"dispatched = " + s.dialect.Bool(true)}
+
+	if f.FromID > 0 {
+		conds = append(conds, "id >= "+args.Add(f.FromID))
+	}
+
+	if f.ToID > 0 {
+		conds = append(conds, "id <= "+args.Add(f.ToID))
+	}
+
+	if !f.DispatchedAfter.IsZero() {
+		conds = append(conds, "dispatched_at >= "+args.Add(f.DispatchedAfter))
+	}
+
+	if !f.DispatchedBefore.IsZero() {
+		conds = append(conds, "dispatched_at < "+args.Add(f.DispatchedBefore))
+	}
+
+	if len(f.Destination) > 0 {
+		cond, err := s.dialect.OptionsContain(args, f.Destination)
+		if err != nil {
+			return "", err
+		}
+
+		conds = append(conds, cond)
+	}
+
+	return strings.Join(conds, " AND "), nil
+}
+
+// batch returns the subquery that selects the ids of the first batchSize messages that match the condition.
+// The ids are selected from a derived table, so the outbox table can be changed by the outer statement.
+func (s *Store) batch(where string, batchSize int32) string {
+	top, limit := s.dialect.Limit(batchSize)
+
+	return fmt.Sprintf(`SELECT id FROM (SELECT %sid FROM %s WHERE %s ORDER BY id%s) AS batch`,
+		prefix(top), s.table(), where, clause(limit))
+}
+
+// runTx runs fn within a transaction and runs it again, up to MaxRetries times, when it fails with
+// a retryable error. Retries wait for a jittered exponential backoff.
+func (s *Store) runTx(ctx context.Context, opts *sql.TxOptions, fn func(*sql.Tx) error) error {
+	backoff := retryInitialBackoff
+
+	for attempt := 0; ; attempt++ {
+		err := s.tryTx(ctx, opts, fn)
+		if err == nil || attempt >= s.MaxRetries || !s.dialect.IsRetryable(err) {
+			return err
+		}
+
+		t := s.Clock.NewTimer(backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))) // nolint
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return err
+		case <-t.C():
+		}
+
+		if backoff *= 2; backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+}
+
+func (s *Store) tryTx(ctx context.Context, opts *sql.TxOptions, fn func(*sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("transaction start failed: %w", err)
+	}
+
+	if err := fn(tx); err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil {
+			return errors.Join(err, fmt.Errorf("transaction rollback failed: %w", rbErr))
+		}
+
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("transaction commit failed: %w", err)
+	}
+
+	return nil
+}
+
+// write waits for the other writes of the data store when SerializeWrites is set,
+// the returned function ends the write.
+func (s *Store) write() func() {
+	if !s.SerializeWrites {
+		return func() {}
+	}
+
+	s.writeMu.Lock()
+
+	return s.writeMu.Unlock
+}
+
+// withLock runs fn on a connection that holds the lock, locks belong to a database session.
+// The connection is only used by this call, so concurrent calls wait for each other on the lock.
+func (s *Store) withLock(ctx context.Context, fn func(*sql.Conn) error) (err error) {
+	defer s.write()()
+
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get a connection: %w", err)
+	}
+
+	defer conn.Close()
+
+	if err := s.dialect.Lock(ctx, conn, s); err != nil {
+		return err
+	}
+
+	defer func() {
+		if e := s.dialect.Unlock(ctx, conn, s); e != nil {
+			err = errors.Join(err, fmt.Errorf("failed to unlock table: %w", e))
+		}
+	}()
+
+	return fn(conn)
+}
+
+func (s *Store) ensureTable(ctx context.Context) error {
+	return s.withLock(ctx, func(conn *sql.Conn) error {
+		return migrate.Run(ctx, conn, s.dialect.MigrationsDialect(s, s.EventStoreTable), s.dialect.Migrations(s))
+	})
+}
+
+// Migrate applies the schema migrations of the outbox table that were not applied yet.
+// It runs when the data store is created, so it only needs to be called after changing EventStoreTable.
+func (s *Store) Migrate(ctx context.Context) error {
+	return s.ensureTable(ctx)
+}
+
+// validateTable checks that the outbox table has the expected columns, without changing it.
+func (s *Store) validateTable(ctx context.Context) error {
+	// nolint
+	query := fmt.Sprintf(`SELECT %s FROM %s WHERE 1 = 0`, inspectColumns, s.table())
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSchema, err)
+	}
+
+	return rows.Close()
+}
+
+// validateArchive checks that the archive table has the expected columns, without changing it.
+func (s *Store) validateArchive(ctx context.Context) error {
+	// nolint
+	query := fmt.Sprintf(`SELECT %s FROM %s WHERE 1 = 0`, strings.Join(archiveColumns, ", "), s.queryIdent(s.ArchiveTable))
+
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidSchema, err)
+	}
+
+	return rows.Close()
+}
+
+// Ident returns a table name ready to be used in a DDL statement. It is qualified with the schema
+// when QualifyTables is set and quoted when QuoteIdentifiers is set.
+func (s *Store) Ident(name string) string {
+	return s.ident(name, s.QuoteIdentifiers)
+}
+
+// table returns the name of the outbox table, ready to be used in a query.
+func (s *Store) table() string {
+	return s.queryIdent(s.EventStoreTable)
+}
+
+// queryIdent returns a table name ready to be used in a query.
+func (s *Store) queryIdent(name string) string {
+	return s.ident(name, s.QuoteIdentifiers || s.QuoteQueries)
+}
+
+func (s *Store) ident(name string, quote bool) string {
+	schema := s.SchemaName
+
+	if quote {
+		name = s.dialect.Quote(name)
+		schema = s.dialect.Quote(schema)
+	}
+
+	if s.QualifyTables {
+		return schema + "." + name
+	}
+
+	return name
+}
+
+// scanMessages scans the messages of the rows, appending them to events, and closes the rows.
+func scanMessages(rows *sql.Rows, events []*outboxer.OutboxMessage) ([]*outboxer.OutboxMessage, error) {
+	defer rows.Close()
+
+	for rows.Next() {
+		var e outboxer.OutboxMessage
+
+		err := rows.Scan(&e.ID, &e.Dispatched, &e.DispatchedAt, &e.Payload, &e.Options, &e.Headers, &e.CreatedAt)
+		if err != nil {
+			return events, fmt.Errorf("failed to scan message: %w", err)
+		}
+
+		events = append(events, &e)
+	}
+
+	return events, rows.Err()
+}
+
+// scanner is implemented by *sql.Row and *sql.Rows.
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanInspected scans a message along with its failure tracking columns.
+func scanInspected(row scanner, e *outboxer.OutboxMessage) error {
+	var lastError sql.NullString
+
+	err := row.Scan(&e.ID, &e.Dispatched, &e.DispatchedAt, &e.Payload, &e.Options, &e.Headers, &e.CreatedAt,
+		&e.Attempts, &lastError, &e.Dead)
+	e.LastError = lastError.String
+
+	return err
+}
+
+// newEvents returns an empty slice with room for up to n messages, n is capped by maxPrealloc.
+func newEvents(n int32) []*outboxer.OutboxMessage {
+	if n < 0 {
+		n = 0
+	}
+
+	if n > maxPrealloc {
+		n = maxPrealloc
+	}
+
+	return make([]*outboxer.OutboxMessage, 0, n)
+}
+
+// prefix returns the clause followed by a space, so it can be put in front of the next one.
+func prefix(c string) string {
+	if c == "" {
+		return ""
+	}
+
+	return c + " "
+}
+
+// clause returns the clause preceded by a space, so it can be appended to the previous one.
+func clause(c string) string {
+	if c == "" {
+		return ""
+	}
+
+	return " " + c
+}
+
+func idList(ids []int64) string {
+	list := make([]string, 0, len(ids))
+	for _, id := range ids {
+		list = append(list, strconv.FormatInt(id, 10))
+	}
+
+	return strings.Join(list, ", ")
+}
@@ -0,0 +1,377 @@
+package sqlstore
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/italolelis/outboxer"
+	"github.com/italolelis/outboxer/migrate"
+	"github.com/italolelis/outboxer/outboxertest"
+)
+
+// limitDialect and topDialect implement the parts of a dialect that the tests need.
+type limitDialect struct{ Dialect }
+
+func (limitDialect) Placeholder(n int) string { return fmt.Sprintf("$%d", n) }
+
+func (limitDialect) Bool(v bool) string { return fmt.Sprint(v) }
+
+func (limitDialect) Limit(n int32) (string, string) { return "", fmt.Sprintf("LIMIT %d", n) }
+
+func (limitDialect) LockRows() (string, string) { return "", "FOR UPDATE" }
+
+func (limitDialect) Metadata(v outboxer.DynamicValues) interface{} { return v }
+
+func (limitDialect) MergeOptions(*Args, outboxer.DynamicValues) (string, error) { return "", nil }
+
+type topDialect struct{ Dialect }
+
+func (topDialect) Placeholder(n int) string { return fmt.Sprintf("@p%d", n) }
+
+func (topDialect) Quote(name string) string { return "[" + name + "]" }
+
+func (topDialect) Bool(v bool) string {
+	if v {
+		return "1"
+	}
+
+	return "0"
+}
+
+func (topDialect) Limit(n int32) (string, string) { return fmt.Sprintf("TOP %d", n), "" }
+
+func TestStore_Remove(t *testing.T) {
+	cases := []struct {
+		name    string
+		dialect Dialect
+		setup   func(s *Store)
+		query   string
+	}{
+		{
+			name:    "limit",
+			dialect: limitDialect{},
+			query: `DELETE FROM event_store WHERE id IN (SELECT id FROM (SELECT id FROM event_store ` +
+				`WHERE dispatched = true AND dispatched_at < $1 ORDER BY id LIMIT 10) AS batch)`,
+		},
+		{
+			name:    "top",
+			dialect: topDialect{},
+			setup: func(s *Store) {
+				s.SchemaName = "app"
+				s.QualifyTables = true
+				s.QuoteQueries = true
+			},
+			query: `DELETE FROM [app].[event_store] WHERE id IN (SELECT id FROM (SELECT TOP 10 id FROM [app].[event_store] ` +
+				`WHERE dispatched = 1 AND dispatched_at < @p1 ORDER BY id) AS batch)`,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+
+			defer db.Close()
+
+			s := New(db, c.dialect)
+			s.EventStoreTable = DefaultEventStoreTable
+
+			if c.setup != nil {
+				c.setup(s)
+			}
+
+			mock.ExpectBegin()
+			mock.ExpectExec(regexp.QuoteMeta(c.query)).WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+
+			if err := s.Remove(context.Background(), time.Now(), 10); err != nil {
+				t.Fatalf("failed to remove messages: %s", err)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+func TestStore_ReplayRowByRow(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	s := New(db, limitDialect{})
+	s.EventStoreTable = DefaultEventStoreTable
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT id, options FROM event_store WHERE dispatched = true AND id >= $1 ORDER BY id FOR UPDATE`)).
+		WithArgs(int64(5)).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "options"}).AddRow(5, []byte(`{"topic":"a","key":"k"}`)))
+	mock.ExpectExec(regexp.QuoteMeta(`UPDATE event_store SET dispatched = false, dispatched_at = NULL, options = $1 WHERE id = $2`)).
+		WithArgs(outboxer.DynamicValues{"topic": "b", "key": "k"}, int64(5)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	n, err := s.Replay(context.Background(), outboxer.ReplayFilter{FromID: 5}, outboxer.DynamicValues{"topic": "b"})
+	if err != nil {
+		t.Fatalf("failed to replay messages: %s", err)
+	}
+
+	if n != 1 {
+		t.Fatalf("expected 1 replayed message, got %d", n)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestStore_ListEventsLimit(t *testing.T) {
+	for _, limit := range []int32{-1, math.MaxInt32} {
+		t.Run(fmt.Sprint(limit), func(t *testing.T) {
+			db, mock, err := sqlmock.New()
+			if err != nil {
+				t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+			}
+
+			defer db.Close()
+
+			s := New(db, limitDialect{})
+			s.EventStoreTable = DefaultEventStoreTable
+
+			// The limit is left to the database, the store must not size anything after it.
+			mock.ExpectQuery(regexp.QuoteMeta(fmt.Sprintf("LIMIT %d", limit))).
+				WillReturnRows(sqlmock.NewRows([]string{"id", "dispatched", "dispatched_at", "payload", "options", "headers", "created_at"}))
+
+			if _, err := s.ListEvents(context.Background(), outboxer.ListFilter{Limit: limit}); err != nil {
+				t.Fatalf("failed to list messages: %s", err)
+			}
+
+			if err := mock.ExpectationsWereMet(); err != nil {
+				t.Errorf("there were unfulfilled expectations: %s", err)
+			}
+		})
+	}
+}
+
+// outputDialect returns the inserted rows like SQL Server, readBackDialect can't return them like MySQL.
+type outputDialect struct{ topDialect }
+
+func (outputDialect) Returning() (string, string) {
+	return "OUTPUT INSERTED.id, INSERTED.created_at", ""
+}
+
+func (outputDialect) MaxInsertRows() int { return 1000 }
+
+func (outputDialect) Metadata(v outboxer.DynamicValues) interface{} { return v }
+
+type readBackDialect struct{ limitDialect }
+
+func (readBackDialect) Returning() (string, string) { return "", "" }
+
+func (readBackDialect) MaxInsertRows() int { return 1000 }
+
+// execer hides the query methods of a transaction.
+type execer struct{ tx *sql.Tx }
+
+func (e execer) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	return e.tx.ExecContext(ctx, query, args...)
+}
+
+func TestStore_AddInTx(t *testing.T) {
+	newMsgs := func() []*outboxer.OutboxMessage {
+		return []*outboxer.OutboxMessage{{Payload: []byte("a")}, {Payload: []byte("b")}}
+	}
+
+	t.Run("rows out of order", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+
+		defer db.Close()
+
+		s := New(db, outputDialect{})
+		s.EventStoreTable = DefaultEventStoreTable
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(`INSERT INTO event_store \(payload, options, headers, created_at\) OUTPUT INSERTED.id, INSERTED.created_at VALUES`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(8, time.Now()).AddRow(7, time.Now()))
+
+		tx, _ := db.Begin()
+		msgs := newMsgs()
+
+		if err := s.AddInTx(context.Background(), tx, msgs...); err != nil {
+			t.Fatalf("failed to add messages: %s", err)
+		}
+
+		if msgs[0].ID != 7 || msgs[1].ID != 8 {
+			t.Fatalf("expected the ids in insert order, got %d and %d", msgs[0].ID, msgs[1].ID)
+		}
+	})
+
+	t.Run("missing rows", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+
+		defer db.Close()
+
+		s := New(db, outputDialect{})
+		s.EventStoreTable = DefaultEventStoreTable
+
+		mock.ExpectBegin()
+		mock.ExpectQuery(`INSERT INTO event_store`).
+			WillReturnRows(sqlmock.NewRows([]string{"id", "created_at"}).AddRow(7, time.Now()))
+
+		tx, _ := db.Begin()
+
+		if err := s.AddInTx(context.Background(), tx, newMsgs()...); !errors.Is(err, ErrInsertedMismatch) {
+			t.Fatalf("expected a mismatch error, got %v", err)
+		}
+	})
+
+	t.Run("without queries", func(t *testing.T) {
+		db, mock, err := sqlmock.New()
+		if err != nil {
+			t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+		}
+
+		defer db.Close()
+
+		s := New(db, readBackDialect{})
+		s.EventStoreTable = DefaultEventStoreTable
+
+		mock.ExpectBegin()
+		mock.ExpectExec(`INSERT INTO event_store`).WillReturnResult(sqlmock.NewResult(7, 2))
+
+		tx, _ := db.Begin()
+		msgs := newMsgs()
+
+		if err := s.AddInTx(context.Background(), execer{tx}, msgs...); err != nil {
+			t.Fatalf("failed to add messages: %s", err)
+		}
+
+		if msgs[0].ID != 0 || msgs[1].ID != 0 {
+			t.Fatalf("expected the ids to be left unset, got %d and %d", msgs[0].ID, msgs[1].ID)
+		}
+
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("there were unfulfilled expectations: %s", err)
+		}
+	})
+}
+
+func TestStore_SetAsDispatchedClock(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	clock := outboxertest.NewClock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	s := New(db, limitDialect{})
+	s.EventStoreTable = DefaultEventStoreTable
+	s.Clock = clock
+
+	mock.ExpectExec(regexp.QuoteMeta(`dispatched_at = $1`)).
+		WithArgs(clock.Now(), int64(1)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if err := s.SetAsDispatched(context.Background(), 1); err != nil {
+		t.Fatalf("failed to set message as dispatched: %s", err)
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
+
+func TestArgs(t *testing.T) {
+	args := NewArgs(topDialect{}, "a")
+
+	if p := args.Add("b"); p != "@p2" {
+		t.Fatalf("expected @p2, got %s", p)
+	}
+
+	if got := args.Values(); len(got) != 2 || got[1] != "b" {
+		t.Fatalf("unexpected values %v", got)
+	}
+}
+
+// lockDialect migrates a table without any migrations, its lock does nothing.
+type lockDialect struct{ limitDialect }
+
+func (lockDialect) Lock(context.Context, *sql.Conn, *Store) error { return nil }
+
+func (lockDialect) Unlock(context.Context, *sql.Conn, *Store) error { return nil }
+
+func (lockDialect) MigrationsDialect(*Store, string) migrate.Dialect {
+	return migrate.Dialect{CreateTable: "CREATE TABLE migrations", SelectVersions: "SELECT version FROM migrations"}
+}
+
+func (lockDialect) Migrations(*Store) []migrate.Migration { return nil }
+
+func TestStore_ConcurrentMigrate(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	if err != nil {
+		t.Fatalf("an error '%s' was not expected when opening a stub database connection", err)
+	}
+
+	defer db.Close()
+
+	s := New(db, lockDialect{})
+	s.EventStoreTable = DefaultEventStoreTable
+
+	const n = 4
+
+	mock.MatchExpectationsInOrder(false)
+
+	for i := 0; i < n; i++ {
+		mock.ExpectExec(`CREATE TABLE migrations`).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery(`SELECT version FROM migrations`).WillReturnRows(sqlmock.NewRows([]string{"version"}))
+	}
+
+	var wg sync.WaitGroup
+
+	errs := make(chan error, n)
+
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			errs <- s.Migrate(context.Background())
+		}()
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("failed to migrate: %s", err)
+		}
+	}
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("there were unfulfilled expectations: %s", err)
+	}
+}
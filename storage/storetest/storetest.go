@@ -0,0 +1,388 @@
+// Package storetest is a conformance suite for data stores. It checks that a data store honours
+// the outboxer.DataStore contract, so the built-in data stores and custom ones behave the same way.
+//
+//	func TestMyStore(t *testing.T) {
+//		storetest.RunDataStoreTests(t, func(t *testing.T) outboxer.DataStore {
+//			return newMyStore(t)
+//		})
+//	}
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/italolelis/outboxer"
+)
+
+const (
+	// concurrentAdders and addsPerAdder shape the concurrency test.
+	concurrentAdders = 8
+	addsPerAdder     = 10
+
+	// cutoffMargin keeps the Remove cutoffs clear of clock and time zone differences
+	// between the test and the database.
+	cutoffMargin = 24 * time.Hour
+)
+
+// DispatchedCounter counts the dispatched messages of a data store, as outboxer.Replayer does.
+// Checking Remove needs it, data stores that don't implement it can be wrapped in the test that runs the suite.
+type DispatchedCounter interface {
+	CountDispatched(ctx context.Context, f outboxer.ReplayFilter) (int64, error)
+}
+
+// ArchiveRestorer gives access to the archive table of a data store that archives the messages it removes.
+// Checking that the archive keeps every copy of a message needs it along with outboxer.Replayer,
+// data stores that don't implement it can be wrapped in the test that runs the suite.
+type ArchiveRestorer interface {
+	// Restore copies an archived message back to the data store, keeping its id.
+	Restore(ctx context.Context, id int64) error
+	// CountArchived counts the archived copies of a message.
+	CountArchived(ctx context.Context, id int64) (int64, error)
+}
+
+// Factory creates a new, empty data store. It is called once per test,
+// the resources it creates should be released with t.Cleanup.
+type Factory func(t *testing.T) outboxer.DataStore
+
+// RunDataStoreTests runs the conformance suite against the data stores created by factory.
+// Checking Remove needs the data store to implement DispatchedCounter, and checking the archive
+// needs ArchiveRestorer and outboxer.Replayer, those tests are skipped otherwise.
+func RunDataStoreTests(t *testing.T, factory Factory) {
+	t.Run("AddAndFetch", func(t *testing.T) { testAddAndFetch(t, factory(t)) })
+	t.Run("KeepsCreatedAt", func(t *testing.T) { testKeepsCreatedAt(t, factory(t)) })
+	t.Run("AddWithinTxCommits", func(t *testing.T) { testAddWithinTxCommits(t, factory(t)) })
+	t.Run("AddWithinTxRollsBack", func(t *testing.T) { testAddWithinTxRollsBack(t, factory(t)) })
+	t.Run("BatchSize", func(t *testing.T) { testBatchSize(t, factory(t)) })
+	t.Run("DispatchedNotReturned", func(t *testing.T) { testDispatchedNotReturned(t, factory(t)) })
+	t.Run("Remove", func(t *testing.T) { testRemove(t, factory(t)) })
+	t.Run("ArchiveAgain", func(t *testing.T) { testArchiveAgain(t, factory(t)) })
+	t.Run("ConcurrentAdders", func(t *testing.T) { testConcurrentAdders(t, factory(t)) })
+}
+
+func testAddAndFetch(t *testing.T, ds outboxer.DataStore) {
+	ctx := context.Background()
+
+	if err := ds.Add(ctx, &outboxer.OutboxMessage{
+		Payload: []byte("payload"),
+		Options: outboxer.DynamicValues{"exchange": "orders"},
+		Headers: outboxer.DynamicValues{"trace_id": "abc"},
+	}); err != nil {
+		t.Fatalf("failed to add message: %s", err)
+	}
+
+	events := getEvents(ctx, t, ds, 10)
+	if len(events) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(events))
+	}
+
+	e := events[0]
+
+	if e.ID == 0 {
+		t.Error("expected the message to have an id")
+	}
+
+	if string(e.Payload) != "payload" {
+		t.Errorf("expected payload %q, got %q", "payload", e.Payload)
+	}
+
+	if e.Dispatched {
+		t.Error("expected the message not to be dispatched")
+	}
+
+	if e.Options["exchange"] != "orders" {
+		t.Errorf("expected the options to be kept, got %v", e.Options)
+	}
+
+	if e.Headers["trace_id"] != "abc" {
+		t.Errorf("expected the headers to be kept, got %v", e.Headers)
+	}
+}
+
+func testKeepsCreatedAt(t *testing.T, ds outboxer.DataStore) {
+	ctx := context.Background()
+	createdAt := time.Now().Add(-30 * cutoffMargin).Truncate(time.Second)
+
+	if err := ds.Add(ctx, &outboxer.OutboxMessage{Payload: []byte("imported"), CreatedAt: createdAt}); err != nil {
+		t.Fatalf("failed to add message: %s", err)
+	}
+
+	events := getEvents(ctx, t, ds, 10)
+	if len(events) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(events))
+	}
+
+	if d := events[0].CreatedAt.Sub(createdAt); d < -cutoffMargin || d > cutoffMargin {
+		t.Errorf("expected the creation time %s to be kept, got %s", createdAt, events[0].CreatedAt)
+	}
+}
+
+func testAddWithinTxCommits(t *testing.T, ds outboxer.DataStore) {
+	ctx := context.Background()
+
+	if err := ds.AddWithinTx(ctx, &outboxer.OutboxMessage{Payload: []byte("committed")}, func(outboxer.ExecerContext) error {
+		return nil
+	}); err != nil {
+		t.Fatalf("failed to add message within a transaction: %s", err)
+	}
+
+	if events := getEvents(ctx, t, ds, 10); len(events) != 1 {
+		t.Fatalf("expected the committed message, got %d messages", len(events))
+	}
+}
+
+func testAddWithinTxRollsBack(t *testing.T, ds outboxer.DataStore) {
+	ctx := context.Background()
+	errFn := errors.New("unit of work failed")
+
+	err := ds.AddWithinTx(ctx, &outboxer.OutboxMessage{Payload: []byte("rolled back")}, func(outboxer.ExecerContext) error {
+		return errFn
+	})
+	if err == nil {
+		t.Fatal("expected an error when the transaction function fails")
+	}
+
+	if events := getEvents(ctx, t, ds, 10); len(events) != 0 {
+		t.Fatalf("expected no message after a rollback, got %d", len(events))
+	}
+}
+
+func testBatchSize(t *testing.T, ds outboxer.DataStore) {
+	ctx := context.Background()
+
+	add(ctx, t, ds, 5)
+
+	if events := getEvents(ctx, t, ds, 2); len(events) != 2 {
+		t.Fatalf("expected the batch size of 2 to be honoured, got %d messages", len(events))
+	}
+
+	if events := getEvents(ctx, t, ds, 10); len(events) != 5 {
+		t.Fatalf("expected 5 messages, got %d", len(events))
+	}
+}
+
+func testDispatchedNotReturned(t *testing.T, ds outboxer.DataStore) {
+	ctx := context.Background()
+
+	add(ctx, t, ds, 3)
+
+	events := getEvents(ctx, t, ds, 10)
+	if len(events) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(events))
+	}
+
+	dispatched := events[0].ID
+	if err := ds.SetAsDispatched(ctx, dispatched); err != nil {
+		t.Fatalf("failed to set message as dispatched: %s", err)
+	}
+
+	events = getEvents(ctx, t, ds, 10)
+	if len(events) != 2 {
+		t.Fatalf("expected 2 pending messages, got %d", len(events))
+	}
+
+	for _, e := range events {
+		if e.ID == dispatched {
+			t.Fatalf("message %d was returned again after being dispatched", dispatched)
+		}
+	}
+
+	for _, e := range events {
+		if err := ds.SetAsDispatched(ctx, e.ID); err != nil {
+			t.Fatalf("failed to set message as dispatched: %s", err)
+		}
+	}
+
+	if events := getEvents(ctx, t, ds, 10); len(events) != 0 {
+		t.Fatalf("expected no pending message, got %d", len(events))
+	}
+}
+
+func testRemove(t *testing.T, ds outboxer.DataStore) {
+	counter, ok := ds.(DispatchedCounter)
+	if !ok {
+		t.Skip("the data store doesn't implement storetest.DispatchedCounter, removed messages can't be counted")
+	}
+
+	ctx := context.Background()
+
+	add(ctx, t, ds, 4)
+
+	events := getEvents(ctx, t, ds, 10)
+	if len(events) != 4 {
+		t.Fatalf("expected 4 messages, got %d", len(events))
+	}
+
+	// The first message is kept pending, Remove must never touch it.
+	for _, e := range events[1:] {
+		if err := ds.SetAsDispatched(ctx, e.ID); err != nil {
+			t.Fatalf("failed to set message as dispatched: %s", err)
+		}
+	}
+
+	remove := func(before time.Time, batchSize int32, want int64) {
+		t.Helper()
+
+		if err := ds.Remove(ctx, before, batchSize); err != nil {
+			t.Fatalf("failed to remove messages: %s", err)
+		}
+
+		got, err := counter.CountDispatched(ctx, outboxer.ReplayFilter{})
+		if err != nil {
+			t.Fatalf("failed to count dispatched messages: %s", err)
+		}
+
+		if got != want {
+			t.Fatalf("expected %d dispatched messages left, got %d", want, got)
+		}
+	}
+
+	remove(time.Now().Add(-cutoffMargin), 10, 3)
+	remove(time.Now().Add(cutoffMargin), 2, 1)
+	remove(time.Now().Add(cutoffMargin), 10, 0)
+
+	if events := getEvents(ctx, t, ds, 10); len(events) != 1 {
+		t.Fatalf("expected the pending message to be kept, got %d messages", len(events))
+	}
+}
+
+func testArchiveAgain(t *testing.T, ds outboxer.DataStore) {
+	archive, ok := ds.(ArchiveRestorer)
+	if !ok {
+		t.Skip("the data store doesn't implement storetest.ArchiveRestorer, its archive can't be checked")
+	}
+
+	replayer, ok := ds.(outboxer.Replayer)
+	if !ok {
+		t.Skip("the data store doesn't implement outboxer.Replayer")
+	}
+
+	ctx := context.Background()
+
+	add(ctx, t, ds, 1)
+
+	events := getEvents(ctx, t, ds, 10)
+	if len(events) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(events))
+	}
+
+	id := events[0].ID
+
+	archived := func(want int64) {
+		t.Helper()
+
+		if err := ds.SetAsDispatched(ctx, id); err != nil {
+			t.Fatalf("failed to set message as dispatched: %s", err)
+		}
+
+		if err := ds.Remove(ctx, time.Now().Add(cutoffMargin), 10); err != nil {
+			t.Fatalf("failed to remove messages: %s", err)
+		}
+
+		got, err := archive.CountArchived(ctx, id)
+		if err != nil {
+			t.Fatalf("failed to count archived messages: %s", err)
+		}
+
+		if got != want {
+			t.Fatalf("expected %d archived copies of message %d, got %d", want, id, got)
+		}
+	}
+
+	archived(1)
+
+	if err := archive.Restore(ctx, id); err != nil {
+		t.Fatalf("failed to restore message %d: %s", id, err)
+	}
+
+	n, err := replayer.Replay(ctx, outboxer.ReplayFilter{FromID: id, ToID: id}, nil)
+	if err != nil {
+		t.Fatalf("failed to replay message %d: %s", id, err)
+	}
+
+	if n != 1 {
+		t.Fatalf("expected 1 replayed message, got %d", n)
+	}
+
+	if events := getEvents(ctx, t, ds, 10); len(events) != 1 || events[0].ID != id {
+		t.Fatalf("expected message %d to be pending again, got %d messages", id, len(events))
+	}
+
+	// the second copy must be added next to the first one, not overwrite it
+	archived(2)
+}
+
+func testConcurrentAdders(t *testing.T, ds outboxer.DataStore) {
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+
+	errs := make(chan error, concurrentAdders*addsPerAdder)
+
+	for i := 0; i < concurrentAdders; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			for j := 0; j < addsPerAdder; j++ {
+				if err := ds.Add(ctx, &outboxer.OutboxMessage{Payload: []byte(fmt.Sprintf("%d-%d", i, j))}); err != nil {
+					errs <- err
+				}
+			}
+		}(i)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("failed to add message concurrently: %s", err)
+	}
+
+	events := getEvents(ctx, t, ds, concurrentAdders*addsPerAdder+10)
+	if len(events) != concurrentAdders*addsPerAdder {
+		t.Fatalf("expected %d messages, got %d", concurrentAdders*addsPerAdder, len(events))
+	}
+
+	ids := make(map[int64]struct{}, len(events))
+	payloads := make(map[string]struct{}, len(events))
+
+	for _, e := range events {
+		ids[e.ID] = struct{}{}
+		payloads[string(e.Payload)] = struct{}{}
+	}
+
+	if len(ids) != len(events) {
+		t.Fatalf("expected %d distinct ids, got %d", len(events), len(ids))
+	}
+
+	if len(payloads) != len(events) {
+		t.Fatalf("expected %d distinct payloads, got %d", len(events), len(payloads))
+	}
+}
+
+func add(ctx context.Context, t *testing.T, ds outboxer.DataStore, n int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		if err := ds.Add(ctx, &outboxer.OutboxMessage{Payload: []byte(fmt.Sprintf("message %d", i))}); err != nil {
+			t.Fatalf("failed to add message: %s", err)
+		}
+	}
+}
+
+func getEvents(ctx context.Context, t *testing.T, ds outboxer.DataStore, batchSize int32) []*outboxer.OutboxMessage {
+	t.Helper()
+
+	events, err := ds.GetEvents(ctx, batchSize)
+	if err != nil {
+		t.Fatalf("failed to get messages: %s", err)
+	}
+
+	return events
+}